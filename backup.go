@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/logging"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+var addDBReplicas = mydb.AddReplicas
+
+// ErrAlreadyBackedUp is returned when backing up a file which is already in the catalog
+var ErrAlreadyBackedUp = fmt.Errorf("Already backed up")
+
+// BackupFile copies the file at the given path onto the given number of devices with sufficient space,
+// each on a different drive, recording every copy in the database
+// If the redundancy asks for data shards, the file is instead erasure-coded into shards, one per drive
+// Every copy or shard is read back and checked against its checksum, and the file is only recorded once all of them match
+// Files already in the catalog are refused, and copies are written under temporary names until complete,
+// so a failed backup never replaces or removes copies which are already recorded
+// Space is reserved for the meter's job, renewed while the file is being written, and released if any copy cannot be made or recorded
+// Bytes copied are counted by the meter, which may be nil
+func BackupFile(db *sql.DB, devMan *DevMan, path string, redundancy queue.Redundancy, meter *progress.Meter) ([]mydb.File, error) {
+	sourcePath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", sourcePath)
+	}
+
+	if _, err = getDBFile(db, sourcePath); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyBackedUp, sourcePath)
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	count, pieceSize := storedPieces(redundancy, info.Size())
+	mounts, reservations, err := devMan.ReserveCopies(pieceSize, count, meter.JobID(), reservationExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	meter.SetPath(sourcePath)
+	stopRenewing := keepReserved(devMan, reservations, reservationExpiry)
+	var replicas []mydb.File
+	partials, err := makePartials(mounts, sourcePath)
+	if err == nil && redundancy.DataShards > 0 {
+		replicas, err = writeShards(sourcePath, info.Size(), redundancy, mounts, partials, reservations, meter)
+	} else if err == nil {
+		replicas, err = writeReplicas(sourcePath, info.Size(), mounts, partials, reservations, meter)
+	}
+	if err == nil {
+		err = placePartials(partials, mounts, sourcePath)
+	}
+	if err == nil {
+		replicas, err = addDBReplicas(db, replicas)
+		if err != nil {
+			err = fmt.Errorf("Failed to record %s: %v", sourcePath, err)
+		}
+	}
+	stopRenewing()
+
+	if err != nil {
+		discardPartials(db, partials, mounts, reservations, sourcePath)
+		return nil, releaseFailed(devMan, reservations, err)
+	}
+
+	for _, reservation := range reservations {
+		if err = devMan.CommitSpace(reservation.ReservationID); err != nil {
+			logging.Default().Warnf("Backed up %s, but its reservation could not be committed: %v", sourcePath, err)
+		}
+	}
+
+	return replicas, nil
+}
+
+// copyCount returns the number of copies to make, with at least one always made
+func copyCount(copies int) int {
+	if copies < 1 {
+		return 1
+	}
+
+	return copies
+}
+
+// storedPieces returns how many pieces, either copies or shards, a file of the given size is stored as, and the size of each
+func storedPieces(redundancy queue.Redundancy, size int64) (int, int64) {
+	if redundancy.DataShards > 0 {
+		return redundancy.DataShards + redundancy.ParityShards, shardSize(size, redundancy.DataShards)
+	}
+
+	return copyCount(redundancy.Copies), size
+}
+
+// storedSize returns the total space a file of the given size takes up once backed up
+func storedSize(redundancy queue.Redundancy, size int64) int64 {
+	count, pieceSize := storedPieces(redundancy, size)
+	return int64(count) * pieceSize
+}
+
+// writeReplicas copies a file to the partial path on each mount, checking each copy reads back with the checksum of the first,
+// and returns the copies to record on the devices the reservations were made on
+var writeReplicas = func(
+	sourcePath string,
+	size int64,
+	mounts []string,
+	partials []string,
+	reservations []mydb.Reservation,
+	meter *progress.Meter,
+) ([]mydb.File, error) {
+	replicas := make([]mydb.File, 0, len(mounts))
+	for index, mount := range mounts {
+		destination := partials[index]
+		checksum, err := copyFile(sourcePath, destination, meter)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to copy %s: %v", sourcePath, err)
+		} else if index > 0 && checksum != replicas[0].Checksum {
+			return nil, fmt.Errorf("%s changed while its copies were being made", sourcePath)
+		}
+
+		if written, err := fileChecksum(destination); err != nil {
+			return nil, fmt.Errorf("Failed to read back copy of %s on %s: %v", sourcePath, mount, err)
+		} else if written != checksum {
+			return nil, fmt.Errorf("Copy of %s on %s does not match checksum: expected %s, got %s", sourcePath, mount, checksum, written)
+		}
+
+		replicas = append(replicas, mydb.File{
+			SourcePath: sourcePath,
+			DeviceID:   reservations[index].DeviceID,
+			Size:       size,
+			Checksum:   checksum,
+		})
+	}
+
+	return replicas, nil
+}
+
+// makePartials creates an empty file with a unique temporary name beside where the file will be stored on each mount,
+// for its copy to be written to until it is complete
+func makePartials(mounts []string, sourcePath string) ([]string, error) {
+	partials := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		partial, err := makePartial(backupPath(mount, sourcePath))
+		if err != nil {
+			return partials, err
+		}
+		partials = append(partials, partial)
+	}
+
+	return partials, nil
+}
+
+// makePartial creates an empty file with a unique temporary name beside the destination, and any needed directories
+func makePartial(destination string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return "", err
+	}
+
+	partial, err := os.CreateTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".*.partial")
+	if err != nil {
+		return "", err
+	}
+
+	err = partial.Chmod(0644)
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partial.Name())
+		return "", err
+	}
+
+	return partial.Name(), nil
+}
+
+// placePartials renames each complete partial copy to where the file is stored on its mount
+func placePartials(partials []string, mounts []string, sourcePath string) error {
+	for index, partial := range partials {
+		if err := os.Rename(partial, backupPath(mounts[index], sourcePath)); err != nil {
+			return fmt.Errorf("Failed to move copy of %s into place on %s: %v", sourcePath, mounts[index], err)
+		}
+	}
+
+	return nil
+}
+
+// discardPartials removes the partial copies of a failed backup,
+// along with any moved into place which are not recorded on their device
+func discardPartials(db *sql.DB, partials []string, mounts []string, reservations []mydb.Reservation, sourcePath string) {
+	for index, partial := range partials {
+		os.Remove(partial)
+
+		held, err := heldOn(db, sourcePath, reservations[index].DeviceID)
+		if err == nil && !held {
+			os.Remove(backupPath(mounts[index], sourcePath))
+		}
+	}
+}
+
+// keepReserved renews the reservations every half of their expiry until the returned function is called,
+// so they are not reclaimed while a large file is still being written
+// Reservations which never expire are left alone
+func keepReserved(devMan *DevMan, reservations []mydb.Reservation, expiry time.Duration) func() {
+	if expiry <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(expiry / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				renewReservations(devMan, reservations, expiry)
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// renewReservations extends each reservation to expire after the given duration from now
+func renewReservations(devMan *DevMan, reservations []mydb.Reservation, expiry time.Duration) {
+	for _, reservation := range reservations {
+		if err := devMan.RenewSpace(reservation.ReservationID, expiry); err != nil {
+			logging.Default().Warnf("Failed to renew reservation %d: %v", reservation.ReservationID, err)
+		}
+	}
+}
+
+// releaseFailed frees the reservations for a backup which could not be completed, returning the original error
+func releaseFailed(devMan *DevMan, reservations []mydb.Reservation, cause error) error {
+	for _, reservation := range reservations {
+		if err := devMan.FreeSpace(reservation.ReservationID); err != nil {
+			cause = fmt.Errorf("%v (and failed to free reserved space: %v)", cause, err)
+		}
+	}
+
+	return cause
+}
+
+// backupPath returns where on the given mount a source file is stored
+func backupPath(mount string, sourcePath string) string {
+	return filepath.Join(mount, sourcePath)
+}
+
+// copyFile copies a file to the destination, creating any needed directories, and returns its checksum
+// Partially written files are removed on failure
+// If given, the meter is also written to, to count the bytes copied
+var copyFile = func(source string, destination string, meter io.Writer) (string, error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	if err = os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return "", err
+	}
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	writers := []io.Writer{out, hash}
+	if meter != nil {
+		writers = append(writers, meter)
+	}
+
+	_, err = io.Copy(io.MultiWriter(writers...), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(destination)
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fileChecksum returns the checksum of the file at the given path, matching those produced by copyFile
+var fileChecksum = func(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, in); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestDB opens an empty database in a temporary directory
+func makeTestDB(t *testing.T) *sql.DB {
+	return mydb.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+}
+
+// makeTestDevMan runs a manager over the given devices, with an empty reservation ledger, returning a handle to it
+func makeTestDevMan(t *testing.T, devices []*device.Device) *DevMan {
+	commands := make(chan DeviceCommand, 1)
+	results := make(chan DeviceResult, 1)
+
+	go process(&devices, makeTestDB(t), commands, results)
+
+	return &DevMan{commands: commands, results: results}
+}
+
+// makeTestFile writes a file with the given contents into a temporary directory
+func makeTestFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "source.txt")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		panic(err)
+	}
+
+	return path
+}
+
+// Check a file is copied, checksummed and recorded
+func TestBackupFile(t *testing.T) {
+	realAdd := addDBReplicas
+
+	mount := t.TempDir()
+	dev := &device.Device{DeviceID: 4, MountPoint: mount, AvailableSpace: 100}
+	devMan := makeTestDevMan(t, []*device.Device{dev})
+	defer close(devMan.commands)
+
+	addDBReplicas = func(_ *sql.DB, replicas []mydb.File) ([]mydb.File, error) {
+		replicas[0].FileID = 9
+		return replicas, nil
+	}
+	defer func() { addDBReplicas = realAdd }()
+
+	source := makeTestFile(t, "hello")
+	files, err := BackupFile(makeTestDB(t), devMan, source, queue.Redundancy{Copies: 0}, nil)
+	assert.Nil(t, err, "No error backing up file")
+	assert.Len(t, files, 1, "One copy made by default")
+	assert.Equal(t, 9, files[0].FileID, "Recorded file returned")
+	assert.Equal(t, 4, files[0].DeviceID, "Device ID recorded")
+	assert.Equal(t, int64(5), files[0].Size, "Size recorded")
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", files[0].Checksum, "SHA256 recorded")
+
+	contents, err := ioutil.ReadFile(filepath.Join(mount, source))
+	assert.Nil(t, err, "Backup copy exists")
+	assert.Equal(t, "hello", string(contents), "Backup copy matches")
+	assert.Equal(t, uint64(5), dev.AllocatedSpace, "Space remains reserved for the copy")
+}
+
+// Check each copy is stored on a different drive, and recorded together
+func TestBackupFileCopies(t *testing.T) {
+	realAdd := addDBReplicas
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: t.TempDir(), DeviceSerial: "ABC", AvailableSpace: 1000},
+		{DeviceID: 2, MountPoint: t.TempDir(), DeviceSerial: "ABC", AvailableSpace: 900},
+		{DeviceID: 3, MountPoint: t.TempDir(), DeviceSerial: "DEF", AvailableSpace: 100},
+	}
+	devMan := makeTestDevMan(t, devices)
+	defer close(devMan.commands)
+
+	var recorded []mydb.File
+	addDBReplicas = func(_ *sql.DB, replicas []mydb.File) ([]mydb.File, error) {
+		recorded = replicas
+		return replicas, nil
+	}
+	defer func() { addDBReplicas = realAdd }()
+
+	source := makeTestFile(t, "hello")
+	files, err := BackupFile(makeTestDB(t), devMan, source, queue.Redundancy{Copies: 2}, nil)
+	assert.Nil(t, err, "No error backing up copies")
+	assert.Equal(t, recorded, files, "Every copy recorded")
+	assert.Equal(t, []int{1, 3}, []int{files[0].DeviceID, files[1].DeviceID}, "Copies on drives with different serials")
+	assert.Equal(t, files[0].Checksum, files[1].Checksum, "Copies share a checksum")
+
+	for _, dev := range []*device.Device{devices[0], devices[2]} {
+		contents, err := ioutil.ReadFile(filepath.Join(dev.MountPoint, source))
+		assert.Nil(t, err, "Copy exists on "+dev.MountPoint)
+		assert.Equal(t, "hello", string(contents), "Copy matches")
+	}
+
+	_, err = BackupFile(makeTestDB(t), devMan, makeTestFile(t, "hello"), queue.Redundancy{Copies: 3}, nil)
+	assert.ErrorIs(t, err, ErrNoSpace, "Copies need separate drives")
+	assert.Equal(t, uint64(5), devices[0].AllocatedSpace, "Space held for earlier copies released")
+}
+
+// Check an erasure-coded file is stored as one shard per drive, each taking a share of the file's size
+func TestBackupFileShards(t *testing.T) {
+	realAdd := addDBReplicas
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: t.TempDir(), DeviceSerial: "ABC", AvailableSpace: 1000},
+		{DeviceID: 2, MountPoint: t.TempDir(), DeviceSerial: "DEF", AvailableSpace: 900},
+		{DeviceID: 3, MountPoint: t.TempDir(), DeviceSerial: "GHI", AvailableSpace: 100},
+	}
+	devMan := makeTestDevMan(t, devices)
+	defer close(devMan.commands)
+
+	addDBReplicas = func(_ *sql.DB, replicas []mydb.File) ([]mydb.File, error) {
+		return replicas, nil
+	}
+	defer func() { addDBReplicas = realAdd }()
+
+	source := makeTestFile(t, "hello")
+	files, err := BackupFile(makeTestDB(t), devMan, source, queue.Redundancy{Copies: 1, DataShards: 2, ParityShards: 1}, nil)
+	assert.Nil(t, err, "No error backing up shards")
+	assert.Len(t, files, 3, "Every shard recorded")
+	for index, file := range files {
+		assert.Equal(t, index, file.Shard, "Shards in order")
+		assert.Equal(t, int64(3), file.Size, "Shard holds half the file, rounded up")
+		assert.Equal(t, int64(5), file.SourceSize, "File size recorded")
+		assert.Equal(t, uint64(3), devices[index].AllocatedSpace, "Space reserved for the shard")
+	}
+	assert.Equal(
+		t,
+		[]int{1, 2, 3},
+		[]int{files[0].DeviceID, files[1].DeviceID, files[2].DeviceID},
+		"Shards on separate drives",
+	)
+
+	contents, err := ioutil.ReadFile(filepath.Join(devices[0].MountPoint, source))
+	assert.Nil(t, err, "First shard exists")
+	assert.Equal(t, "hel", string(contents), "First data shard holds the start of the file")
+
+	_, err = BackupFile(makeTestDB(t), devMan, makeTestFile(t, "hello"), queue.Redundancy{DataShards: 3, ParityShards: 1}, nil)
+	assert.ErrorIs(t, err, ErrNoSpace, "Shards need separate drives")
+}
+
+// Check copied bytes are counted by the meter
+func TestBackupFileProgress(t *testing.T) {
+	realAdd := addDBReplicas
+
+	devMan := makeTestDevMan(t, []*device.Device{{DeviceID: 4, MountPoint: t.TempDir(), AvailableSpace: 100}})
+	defer close(devMan.commands)
+
+	addDBReplicas = func(_ *sql.DB, replicas []mydb.File) ([]mydb.File, error) {
+		return replicas, nil
+	}
+	defer func() { addDBReplicas = realAdd }()
+
+	reports := make(chan progress.Report, 10)
+	meter := progress.NewMeter(1, 2, reports)
+	meter.AddTotal(5)
+
+	source := makeTestFile(t, "hello")
+	_, err := BackupFile(makeTestDB(t), devMan, source, queue.Redundancy{Copies: 1}, meter)
+	assert.Nil(t, err, "No error backing up file")
+	meter.Finish()
+	close(reports)
+
+	var last progress.Report
+	for report := range reports {
+		last = report
+	}
+	assert.Equal(t, source, last.Path, "Copied file reported")
+	assert.Equal(t, int64(5), last.BytesDone, "Copied bytes counted")
+}
+
+// Check reservations are released when copying fails
+func TestBackupFileCopyFails(t *testing.T) {
+	realCopy := copyFile
+
+	first := &device.Device{DeviceID: 4, MountPoint: t.TempDir(), AvailableSpace: 100, AllocatedSpace: 10}
+	second := &device.Device{DeviceID: 5, MountPoint: t.TempDir(), AvailableSpace: 100}
+	devMan := makeTestDevMan(t, []*device.Device{first, second})
+	defer close(devMan.commands)
+
+	copyFile = func(source string, destination string, meter io.Writer) (string, error) {
+		if strings.HasPrefix(destination, second.MountPoint) {
+			return "", fmt.Errorf("disk full")
+		}
+
+		return realCopy(source, destination, meter)
+	}
+	defer func() { copyFile = realCopy }()
+
+	source := makeTestFile(t, "hello")
+	_, err := BackupFile(makeTestDB(t), devMan, source, queue.Redundancy{Copies: 2}, nil)
+	assert.EqualErrorf(t, err, fmt.Sprintf("Failed to copy %s: disk full", source), "Copy error returned")
+	assert.Equal(t, uint64(10), first.AllocatedSpace, "Reservation released")
+	assert.Equal(t, uint64(0), second.AllocatedSpace, "Reservation for failed copy released")
+
+	_, err = os.Stat(filepath.Join(first.MountPoint, source))
+	assert.True(t, os.IsNotExist(err), "Earlier copy removed")
+}
+
+// Check a copy which reads back differently fails the backup
+func TestBackupFileVerifyFails(t *testing.T) {
+	realChecksum := fileChecksum
+
+	mount := t.TempDir()
+	dev := &device.Device{DeviceID: 4, MountPoint: mount, AvailableSpace: 100}
+	devMan := makeTestDevMan(t, []*device.Device{dev})
+	defer close(devMan.commands)
+
+	fileChecksum = func(_ string) (string, error) {
+		return "corrupt", nil
+	}
+	defer func() { fileChecksum = realChecksum }()
+
+	source := makeTestFile(t, "hello")
+	_, err := BackupFile(makeTestDB(t), devMan, source, queue.Redundancy{Copies: 1}, nil)
+	assert.EqualErrorf(
+		t,
+		err,
+		fmt.Sprintf(
+			"Copy of %s on %s does not match checksum: expected 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824, got corrupt",
+			source,
+			mount,
+		),
+		"Mismatch reported",
+	)
+	assert.Equal(t, uint64(0), dev.AllocatedSpace, "Reservation released")
+
+	_, err = os.Stat(filepath.Join(mount, source))
+	assert.True(t, os.IsNotExist(err), "Copy removed")
+}
+
+// Check the copy and reservation are discarded if the file cannot be recorded
+func TestBackupFileRecordFails(t *testing.T) {
+	realAdd := addDBReplicas
+
+	mount := t.TempDir()
+	dev := &device.Device{DeviceID: 4, MountPoint: mount, AvailableSpace: 100}
+	devMan := makeTestDevMan(t, []*device.Device{dev})
+	defer close(devMan.commands)
+
+	addDBReplicas = func(_ *sql.DB, _ []mydb.File) ([]mydb.File, error) {
+		return nil, fmt.Errorf("UNIQUE constraint failed")
+	}
+	defer func() { addDBReplicas = realAdd }()
+
+	source := makeTestFile(t, "hello")
+	_, err := BackupFile(makeTestDB(t), devMan, source, queue.Redundancy{Copies: 1}, nil)
+	assert.EqualErrorf(t, err, fmt.Sprintf("Failed to record %s: UNIQUE constraint failed", source), "Record error returned")
+	assert.Equal(t, uint64(0), dev.AllocatedSpace, "Reservation released")
+
+	_, err = os.Stat(filepath.Join(mount, source))
+	assert.True(t, os.IsNotExist(err), "Copy removed")
+
+	entries, err := os.ReadDir(filepath.Dir(filepath.Join(mount, source)))
+	assert.Nil(t, err, "Backup directory readable")
+	assert.Empty(t, entries, "No partial copies left behind")
+}
+
+// Check a file already in the catalog is refused, leaving its recorded copy in place
+func TestBackupFileAlreadyBackedUp(t *testing.T) {
+	db := makeTestDB(t)
+	mount := t.TempDir()
+	if _, err := db.Exec("INSERT INTO devices (mountPoint, serialNumber) VALUES ($1, $2)", mount, "ABC"); err != nil {
+		panic(err)
+	}
+
+	dev := &device.Device{DeviceID: 1, MountPoint: mount, AvailableSpace: 100}
+	devMan := makeTestDevMan(t, []*device.Device{dev})
+	defer close(devMan.commands)
+
+	source := makeTestFile(t, "hello")
+	_, err := BackupFile(db, devMan, source, queue.Redundancy{Copies: 1}, nil)
+	assert.Nil(t, err, "No error backing up file")
+
+	if err = ioutil.WriteFile(source, []byte("changed"), 0644); err != nil {
+		panic(err)
+	}
+	_, err = BackupFile(db, devMan, source, queue.Redundancy{Copies: 1}, nil)
+	assert.ErrorIs(t, err, ErrAlreadyBackedUp, "Catalogued file refused")
+	assert.Equal(t, uint64(5), dev.AllocatedSpace, "Nothing reserved for refused backup")
+
+	contents, err := ioutil.ReadFile(filepath.Join(mount, source))
+	assert.Nil(t, err, "Recorded copy kept")
+	assert.Equal(t, "hello", string(contents), "Recorded copy unchanged")
+}
+
+// Check directories and missing devices are rejected before reserving
+func TestBackupFileInvalid(t *testing.T) {
+	devMan := makeTestDevMan(t, []*device.Device{})
+	defer close(devMan.commands)
+
+	dir := t.TempDir()
+	_, err := BackupFile(makeTestDB(t), devMan, dir, queue.Redundancy{Copies: 1}, nil)
+	assert.EqualErrorf(t, err, fmt.Sprintf("%s is not a regular file", dir), "Directories rejected")
+
+	_, err = BackupFile(makeTestDB(t), devMan, makeTestFile(t, "hello"), queue.Redundancy{Copies: 1}, nil)
+	assert.EqualErrorf(t, err, "No devices available -- add one first", "Reservation error returned")
+}
+
+// Check reservations are renewed while a backup is writing, and no longer once it stops
+func TestKeepReserved(t *testing.T) {
+	realRenew := renewSpace
+
+	devMan := makeTestDevMan(t, []*device.Device{})
+	defer close(devMan.commands)
+
+	var lock sync.Mutex
+	renewed := make(map[int]int)
+	renewSpace = func(command DeviceCommand, _ *sql.DB) error {
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Equal(t, 10*time.Millisecond, command.expiry, "Renewed for the full expiry")
+		renewed[command.reservationID]++
+		return nil
+	}
+	defer func() { renewSpace = realRenew }()
+
+	reservations := []mydb.Reservation{{ReservationID: 1}, {ReservationID: 2}}
+	stop := keepReserved(devMan, reservations, 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	stop()
+
+	lock.Lock()
+	count := renewed[1]
+	assert.Greater(t, count, 0, "Reservation renewed while writing")
+	assert.Greater(t, renewed[2], 0, "Every reservation renewed")
+	lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, count, renewed[1], "No renewals once stopped")
+	lock.Unlock()
+
+	keepReserved(devMan, reservations, 0)()
+}
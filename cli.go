@@ -0,0 +1,451 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+// cliUsage lists the subcommands, shown when one is missing or not recognized
+const cliUsage = `Commands:
+  daemon                                   run the backup daemon (the default)
+  device add [-serial SERIAL] MOUNT        add the device mounted at MOUNT
+  device list                              list devices and their space
+  device remove MOUNT                      remove a device, moving its files to the others
+  device rebalance [-band PCT] [-dry-run]  move files until devices are within PCT% of the same fill
+  device move PATH MOUNT                   move backed up files at or beneath PATH onto the device at MOUNT
+  backup [-copies N] [-wait] PATH          back up a file or folder, keeping N copies on different drives
+  backup -data-shards K [-parity-shards M] [-wait] PATH
+                                           back up, splitting each file into K data and M parity shards on different drives
+  restore [-to DIR] PATH                   restore backed up files, optionally beneath DIR
+  verify [-device ID] [-older-than DURATION] [PATH]
+                                           check backed up files against their checksums, skipping those verified within DURATION
+  queue status                             show pending, in progress and completed jobs
+`
+
+// exitFailed is the exit status when a command could not complete
+const exitFailed = 1
+
+// exitUsage is the exit status when a command was not used correctly
+const exitUsage = 2
+
+// subcommand runs against a client with its arguments, returning an exit status
+type subcommand func(backend client, args []string, out io.Writer) int
+
+// subcommands are the commands available, keyed by name including any group such as "device"
+var subcommands = map[string]subcommand{
+	"device add":       cliAddDevice,
+	"device list":      cliListDevices,
+	"device remove":    cliRemoveDevice,
+	"device rebalance": cliRebalance,
+	"device move":      cliMoveFiles,
+	"backup":           cliBackup,
+	"restore":          cliRestore,
+	"verify":           cliVerify,
+	"queue status":     cliQueueStatus,
+}
+
+// runCommand runs the subcommand named by the arguments, writing its output, and returns the exit status
+func runCommand(args []string, options clientOptions, out io.Writer, errOut io.Writer) int {
+	name, command, rest := findSubcommand(args)
+	if command == nil {
+		fmt.Fprintf(errOut, "Unknown command %q\n%s", strings.Join(args, " "), cliUsage)
+		return exitUsage
+	}
+
+	backend, err := connectClient(options)
+	if err != nil {
+		fmt.Fprintf(errOut, "Failed to connect: %v\n", err)
+		return exitFailed
+	}
+	defer backend.Close()
+
+	status := command(backend, rest, out)
+	if status == exitUsage {
+		fmt.Fprintf(errOut, "Invalid arguments for %s\n%s", name, cliUsage)
+	}
+
+	return status
+}
+
+// findSubcommand returns the subcommand named by the first one or two arguments, and the arguments following it
+func findSubcommand(args []string) (string, subcommand, []string) {
+	for words := 2; words > 0; words-- {
+		if len(args) < words {
+			continue
+		}
+
+		name := strings.Join(args[:words], " ")
+		if command, ok := subcommands[name]; ok {
+			return name, command, args[words:]
+		}
+	}
+
+	return "", nil, nil
+}
+
+// parseArgs parses flags wherever they appear among the arguments, returning the positional ones
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.SetOutput(io.Discard)
+
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// fail writes an error for a command which could not complete, returning its exit status
+func fail(out io.Writer, err error) int {
+	fmt.Fprintf(out, "Error: %v\n", err)
+	return exitFailed
+}
+
+func cliAddDevice(backend client, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("device add", flag.ContinueOnError)
+	serial := flags.String("serial", "", "Serial of the device, detected if not given")
+	positional, err := parseArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return exitUsage
+	}
+
+	added, err := backend.AddDevice(positional[0], *serial)
+	if err != nil {
+		return fail(out, err)
+	}
+
+	fmt.Fprintf(out, "Added device %d at %s with serial %s\n", added.DeviceID, added.MountPoint, added.DeviceSerial)
+	return 0
+}
+
+func cliListDevices(backend client, args []string, out io.Writer) int {
+	if len(args) > 0 {
+		return exitUsage
+	}
+
+	devices, err := backend.ListDevices()
+	if err != nil {
+		return fail(out, err)
+	}
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tMOUNT\tSERIAL\tREMAINING\tALLOCATED\tTOTAL\tFILL\tSTATUS")
+	for _, dev := range devices {
+		status := "online"
+		if dev.Offline {
+			status = "offline: " + dev.OfflineReason
+		} else if dev.ReadOnly {
+			status = "read-only: " + dev.ReadOnlyReason
+		}
+
+		fmt.Fprintf(
+			table,
+			"%d\t%s\t%s\t%s\t%s\t%s\t%.1f%%\t%s\n",
+			dev.DeviceID,
+			dev.MountPoint,
+			dev.DeviceSerial,
+			formatBytes(dev.RemainingSpace),
+			formatBytes(dev.AllocatedSpace),
+			formatBytes(dev.TotalSpace),
+			dev.FillPercent,
+			status,
+		)
+	}
+	table.Flush()
+
+	return 0
+}
+
+func cliRemoveDevice(backend client, args []string, out io.Writer) int {
+	if len(args) != 1 {
+		return exitUsage
+	}
+
+	if err := backend.RemoveDevice(args[0]); err != nil {
+		return fail(out, err)
+	}
+
+	fmt.Fprintf(out, "Removed device at %s\n", args[0])
+	return 0
+}
+
+func cliRebalance(backend client, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("device rebalance", flag.ContinueOnError)
+	band := flags.Float64("band", 5, "Percentage either side of the average fill each device should end up within")
+	dryRun := flags.Bool("dry-run", false, "Only show the moves which would be made")
+	positional, err := parseArgs(flags, args)
+	if err != nil || len(positional) > 0 {
+		return exitUsage
+	}
+
+	result, err := backend.Rebalance(*band, *dryRun)
+	if err != nil {
+		return fail(out, err)
+	}
+
+	verb := "Moved"
+	if result.DryRun {
+		verb = "Would move"
+	}
+
+	writeMoves(out, verb, result)
+	fmt.Fprintln(out, "Fill after rebalancing:")
+	writeFill(out, result.Fill)
+
+	return 0
+}
+
+func cliMoveFiles(backend client, args []string, out io.Writer) int {
+	if len(args) != 2 {
+		return exitUsage
+	}
+
+	result, err := backend.MoveFiles(args[0], args[1])
+	if err != nil {
+		return fail(out, err)
+	}
+
+	writeMoves(out, "Moved", result)
+	fmt.Fprintln(out, "Fill after moving:")
+	writeFill(out, result.Fill)
+
+	return 0
+}
+
+func cliBackup(backend client, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	copies := flags.Int("copies", 1, "Number of copies of each file to keep, each on a different drive")
+	dataShards := flags.Int("data-shards", 0, "Erasure-code each file into this many data shards instead of copying it")
+	parityShards := flags.Int("parity-shards", 0, "Parity shards to add to the data shards, each a drive which can be lost")
+	wait := flags.Bool("wait", false, "Wait for a daemon to finish the backup, showing its progress")
+	positional, err := parseArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return exitUsage
+	}
+
+	redundancy := queue.Redundancy{Copies: *copies, DataShards: *dataShards, ParityShards: *parityShards}
+	job, err := backend.Backup(positional[0], redundancy, *wait, func(running jobView) {
+		writeJobs(out, "", []jobView{running})
+	})
+	if err != nil {
+		return fail(out, err)
+	}
+
+	if job.State != queue.StateCompleted {
+		fmt.Fprintf(out, "Queued job %d to back up %s\n", job.ID, job.Path)
+		return 0
+	} else if len(job.Error) > 0 {
+		return fail(out, fmt.Errorf("Failed to back up %s: %s", job.Path, job.Error))
+	}
+
+	fmt.Fprintf(out, "Backed up %s\n", job.Path)
+	return 0
+}
+
+func cliRestore(backend client, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	target := flags.String("to", "", "Directory to restore beneath, instead of the original location")
+	positional, err := parseArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return exitUsage
+	}
+
+	result, err := backend.Restore(positional[0], *target)
+	if err != nil {
+		return fail(out, err)
+	}
+
+	fmt.Fprintf(out, "Restored %d files\n", len(result.Restored))
+	writeFailures(out, "Failed", result.Failed)
+	writeUnavailable(out, result.Unavailable)
+
+	if len(result.Failed) > 0 || len(result.Unavailable) > 0 {
+		return exitFailed
+	}
+
+	return 0
+}
+
+func cliVerify(backend client, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	deviceID := flags.Int("device", 0, "Only verify files on this device")
+	olderThan := flags.Duration("older-than", 0, "Only verify files not verified within this long, such as 720h")
+	positional, err := parseArgs(flags, args)
+	if err != nil || len(positional) > 1 || *olderThan < 0 {
+		return exitUsage
+	}
+
+	path := ""
+	if len(positional) == 1 {
+		path = positional[0]
+	}
+
+	result, err := backend.Verify(path, *deviceID, *olderThan)
+	if err != nil {
+		return fail(out, err)
+	}
+
+	fmt.Fprintf(out, "Verified %d files\n", len(result.Verified))
+	writePaths(out, "Mismatched", result.Mismatched)
+	writePaths(out, "Missing", result.Missing)
+	writeFailures(out, "Failed", result.Failed)
+	writeUnavailable(out, result.Unavailable)
+	writePaths(out, "Rebuildable from other shards", result.Rebuildable)
+	writeFailures(out, "Unrecoverable", result.Unrecoverable)
+
+	if len(result.Mismatched) > 0 || len(result.Missing) > 0 || len(result.Failed) > 0 ||
+		len(result.Unavailable) > 0 || len(result.Unrecoverable) > 0 {
+		return exitFailed
+	}
+
+	return 0
+}
+
+func cliQueueStatus(backend client, args []string, out io.Writer) int {
+	if len(args) > 0 {
+		return exitUsage
+	}
+
+	view, err := backend.QueueStatus()
+	if err != nil {
+		return fail(out, err)
+	}
+
+	writeJobs(out, "Pending", view.Pending)
+	writeJobs(out, "In progress", view.InProgress)
+	writeJobs(out, "Completed", view.Completed)
+	return 0
+}
+
+// writeJobs writes a section of the queue, under a heading if given
+func writeJobs(out io.Writer, heading string, jobs []jobView) {
+	if len(heading) > 0 {
+		fmt.Fprintf(out, "%s (%d):\n", heading, len(jobs))
+	}
+	for _, job := range jobs {
+		line := fmt.Sprintf("  #%d %s", job.ID, job.Path)
+		if len(job.Message) > 0 {
+			line += " - " + job.Message
+		}
+		if len(job.Error) > 0 {
+			line += ": " + job.Error
+		}
+		if job.WorkerID > 0 {
+			line += fmt.Sprintf(" (worker %d)", job.WorkerID)
+		}
+		if job.Progress != nil {
+			line += fmt.Sprintf(
+				" %.1f%% of %s, %s remaining",
+				job.Progress.Percent,
+				formatBytes(uint64(job.Progress.BytesTotal)),
+				formatSeconds(job.Progress.ETASeconds),
+			)
+		}
+
+		fmt.Fprintln(out, line)
+	}
+}
+
+// writePaths writes a list of paths under a heading, if there are any
+func writePaths(out io.Writer, heading string, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+
+	fmt.Fprintf(out, "%s (%d):\n", heading, len(paths))
+	for _, path := range paths {
+		fmt.Fprintf(out, "  %s\n", path)
+	}
+}
+
+// writeFailures writes each failed path with its error under the heading, in path order
+func writeFailures(out io.Writer, heading string, failed map[string]string) {
+	if len(failed) == 0 {
+		return
+	}
+
+	paths := make([]string, 0, len(failed))
+	for path := range failed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	fmt.Fprintf(out, "%s (%d):\n", heading, len(failed))
+	for _, path := range paths {
+		fmt.Fprintf(out, "  %s: %s\n", path, failed[path])
+	}
+}
+
+// writeMoves writes the files moved between devices, or which would be, and how much they total
+func writeMoves(out io.Writer, verb string, result movePlanView) {
+	fmt.Fprintf(out, "%s %d files (%s)\n", verb, len(result.Moves), formatBytes(uint64(result.Bytes)))
+	for _, move := range result.Moves {
+		fmt.Fprintf(out, "  %s (%s) %s -> %s\n", move.Path, formatBytes(uint64(move.Size)), move.From, move.To)
+	}
+}
+
+// writeFill writes how full each device is after moving files, in mount point order
+func writeFill(out io.Writer, fill map[string]float64) {
+	mounts := make([]string, 0, len(fill))
+	for mount := range fill {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+
+	for _, mount := range mounts {
+		fmt.Fprintf(out, "  %s %.1f%%\n", mount, fill[mount])
+	}
+}
+
+// writeUnavailable writes the devices which need plugging in, and how many files are on each
+func writeUnavailable(out io.Writer, unavailable []unavailableView) {
+	for _, dev := range unavailable {
+		fmt.Fprintf(
+			out,
+			"Device %d (serial %s) is offline, plug it in at %s for the %d skipped files\n",
+			dev.DeviceID,
+			dev.DeviceSerial,
+			dev.MountPoint,
+			len(dev.Files),
+		)
+	}
+}
+
+// formatBytes returns a size in the largest binary unit it has at least one of
+func formatBytes(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// formatSeconds returns a duration in seconds as hours, minutes and seconds
+func formatSeconds(seconds float64) string {
+	if seconds <= 0 {
+		return "unknown"
+	}
+
+	total := int(seconds)
+	return fmt.Sprintf("%dh%02dm%02ds", total/3600, total%3600/60, total%60)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClient records the operations requested of it, returning canned results
+type fakeClient struct {
+	calls    []string
+	devices  []deviceView
+	job      jobView
+	progress []jobView
+	moves    movePlanView
+	restore  restoreView
+	verify   verifyView
+	queue    queueView
+	err      error
+	closed   bool
+}
+
+func (fake *fakeClient) AddDevice(mountPoint string, serial string) (deviceView, error) {
+	fake.calls = append(fake.calls, fmt.Sprintf("add %s %s", mountPoint, serial))
+	return deviceView{DeviceID: 3, MountPoint: mountPoint, DeviceSerial: serial}, fake.err
+}
+
+func (fake *fakeClient) ListDevices() ([]deviceView, error) {
+	fake.calls = append(fake.calls, "list")
+	return fake.devices, fake.err
+}
+
+func (fake *fakeClient) RemoveDevice(mountPoint string) error {
+	fake.calls = append(fake.calls, "remove "+mountPoint)
+	return fake.err
+}
+
+func (fake *fakeClient) Rebalance(band float64, dryRun bool) (movePlanView, error) {
+	fake.calls = append(fake.calls, fmt.Sprintf("rebalance %.1f %t", band, dryRun))
+	return fake.moves, fake.err
+}
+
+func (fake *fakeClient) MoveFiles(path string, mountPoint string) (movePlanView, error) {
+	fake.calls = append(fake.calls, fmt.Sprintf("move %s %s", path, mountPoint))
+	return fake.moves, fake.err
+}
+
+func (fake *fakeClient) Backup(
+	path string,
+	redundancy queue.Redundancy,
+	wait bool,
+	onProgress func(jobView),
+) (jobView, error) {
+	fake.calls = append(fake.calls, fmt.Sprintf(
+		"backup %s %d %d+%d %t",
+		path, redundancy.Copies, redundancy.DataShards, redundancy.ParityShards, wait,
+	))
+	for _, running := range fake.progress {
+		onProgress(running)
+	}
+
+	return fake.job, fake.err
+}
+
+func (fake *fakeClient) Restore(path string, target string) (restoreView, error) {
+	fake.calls = append(fake.calls, fmt.Sprintf("restore %s %s", path, target))
+	return fake.restore, fake.err
+}
+
+func (fake *fakeClient) Verify(path string, deviceID int, olderThan time.Duration) (verifyView, error) {
+	fake.calls = append(fake.calls, fmt.Sprintf("verify %s %d %s", path, deviceID, olderThan))
+	return fake.verify, fake.err
+}
+
+func (fake *fakeClient) QueueStatus() (queueView, error) {
+	fake.calls = append(fake.calls, "queue")
+	return fake.queue, fake.err
+}
+
+func (fake *fakeClient) Close() {
+	fake.closed = true
+}
+
+// runTestCommand runs a command line against the fake client, returning its exit status and output
+func runTestCommand(fake *fakeClient, args ...string) (int, string, string) {
+	realConnect := connectClient
+	connectClient = func(_ clientOptions) (client, error) {
+		return fake, nil
+	}
+	defer func() { connectClient = realConnect }()
+
+	var out, errOut bytes.Buffer
+	status := runCommand(args, clientOptions{}, &out, &errOut)
+	return status, out.String(), errOut.String()
+}
+
+// Check arguments and flags are passed to the client, in any order
+func TestRunCommandArguments(t *testing.T) {
+	commands := []struct {
+		args []string
+		call string
+	}{
+		{[]string{"device", "add", "/mnt/1"}, "add /mnt/1 "},
+		{[]string{"device", "add", "/mnt/1", "-serial", "ABC"}, "add /mnt/1 ABC"},
+		{[]string{"device", "add", "--serial=ABC", "/mnt/1"}, "add /mnt/1 ABC"},
+		{[]string{"device", "list"}, "list"},
+		{[]string{"device", "remove", "/mnt/1"}, "remove /mnt/1"},
+		{[]string{"device", "rebalance"}, "rebalance 5.0 false"},
+		{[]string{"device", "rebalance", "-dry-run", "-band", "12.5"}, "rebalance 12.5 true"},
+		{[]string{"device", "move", "/home", "/mnt/2"}, "move /home /mnt/2"},
+		{[]string{"backup", "/home"}, "backup /home 1 0+0 false"},
+		{[]string{"backup", "-wait", "/home"}, "backup /home 1 0+0 true"},
+		{[]string{"backup", "-copies", "3", "/home"}, "backup /home 3 0+0 false"},
+		{[]string{"backup", "-data-shards", "4", "-parity-shards", "2", "/home"}, "backup /home 1 4+2 false"},
+		{[]string{"restore", "/home", "-to", "/tmp"}, "restore /home /tmp"},
+		{[]string{"verify"}, "verify  0 0s"},
+		{[]string{"verify", "-device", "2", "/home"}, "verify /home 2 0s"},
+		{[]string{"verify", "-older-than", "720h", "/home"}, "verify /home 0 720h0m0s"},
+		{[]string{"queue", "status"}, "queue"},
+	}
+
+	for _, command := range commands {
+		fake := &fakeClient{}
+		status, _, errOut := runTestCommand(fake, command.args...)
+		assert.Equal(t, 0, status, "%v succeeds", command.args)
+		assert.Empty(t, errOut, "%v has no errors", command.args)
+		assert.Equal(t, []string{command.call}, fake.calls, "%v calls client", command.args)
+		assert.True(t, fake.closed, "%v closes client", command.args)
+	}
+}
+
+// Check misuse is reported without calling the client
+func TestRunCommandUsage(t *testing.T) {
+	invalid := [][]string{
+		{},
+		{"device"},
+		{"device", "eject"},
+		{"device", "add"},
+		{"device", "add", "/mnt/1", "/mnt/2"},
+		{"device", "add", "-size", "5", "/mnt/1"},
+		{"device", "rebalance", "/mnt/1"},
+		{"device", "move", "/home"},
+		{"backup"},
+		{"verify", "/home", "/tmp"},
+		{"verify", "-older-than", "-1h", "/home"},
+		{"verify", "-older-than", "month", "/home"},
+		{"queue", "status", "now"},
+	}
+
+	for _, args := range invalid {
+		fake := &fakeClient{}
+		status, _, errOut := runTestCommand(fake, args...)
+		assert.Equal(t, exitUsage, status, "%v is a usage error", args)
+		assert.Contains(t, errOut, cliUsage, "%v shows usage", args)
+		assert.Empty(t, fake.calls, "%v does not call client", args)
+	}
+}
+
+// Check client errors and incomplete results fail the command
+func TestRunCommandFailures(t *testing.T) {
+	status, out, _ := runTestCommand(&fakeClient{err: fmt.Errorf("No such mountpoint")}, "device", "remove", "/mnt/1")
+	assert.Equal(t, exitFailed, status, "Client error fails")
+	assert.Equal(t, "Error: No such mountpoint\n", out, "Client error shown")
+
+	status, out, _ = runTestCommand(
+		&fakeClient{restore: restoreView{
+			Restored:    []string{"/home/a.txt"},
+			Failed:      map[string]string{"/home/b.txt": "Checksum mismatch"},
+			Unavailable: []unavailableView{{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "DEF", Files: []string{"/home/c.txt"}}},
+		}},
+		"restore",
+		"/home",
+	)
+	assert.Equal(t, exitFailed, status, "Partial restore fails")
+	assert.Equal(
+		t,
+		"Restored 1 files\nFailed (1):\n  /home/b.txt: Checksum mismatch\nDevice 2 (serial DEF) is offline, plug it in at /mnt/2 for the 1 skipped files\n",
+		out,
+		"Restore outcome shown",
+	)
+
+	status, out, _ = runTestCommand(
+		&fakeClient{verify: verifyView{Verified: []string{"/home/a.txt"}, Missing: []string{"/home/b.txt"}}},
+		"verify",
+	)
+	assert.Equal(t, exitFailed, status, "Missing file fails verification")
+	assert.Equal(t, "Verified 1 files\nMissing (1):\n  /home/b.txt\n", out, "Verify outcome shown")
+
+	status, out, _ = runTestCommand(
+		&fakeClient{verify: verifyView{
+			Mismatched:    []string{"/home/a.txt", "/home/b.txt"},
+			Rebuildable:   []string{"/home/a.txt"},
+			Unrecoverable: map[string]string{"/home/b.txt": "Only 1 of the 2 shards needed are intact"},
+		}},
+		"verify",
+	)
+	assert.Equal(t, exitFailed, status, "Damaged shards fail verification")
+	assert.Equal(
+		t,
+		"Verified 0 files\nMismatched (2):\n  /home/a.txt\n  /home/b.txt\n"+
+			"Rebuildable from other shards (1):\n  /home/a.txt\n"+
+			"Unrecoverable (1):\n  /home/b.txt: Only 1 of the 2 shards needed are intact\n",
+		out,
+		"Rebuild checks shown",
+	)
+}
+
+// Check devices and the queue are written out
+func TestRunCommandOutput(t *testing.T) {
+	_, out, _ := runTestCommand(
+		&fakeClient{devices: []deviceView{
+			{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC", RemainingSpace: 2048, TotalSpace: 4096, FillPercent: 50},
+			{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "DEF", Offline: true, OfflineReason: "No device mounted on /mnt/2"},
+			{DeviceID: 3, MountPoint: "/mnt/3", DeviceSerial: "GHI", ReadOnly: true, ReadOnlyReason: "Mounted read-only"},
+		}},
+		"device",
+		"list",
+	)
+	assert.Equal(
+		t,
+		"ID  MOUNT   SERIAL  REMAINING  ALLOCATED  TOTAL    FILL   STATUS\n"+
+			"1   /mnt/1  ABC     2.0 KiB    0 B        4.0 KiB  50.0%  online\n"+
+			"2   /mnt/2  DEF     0 B        0 B        0 B      0.0%   offline: No device mounted on /mnt/2\n"+
+			"3   /mnt/3  GHI     0 B        0 B        0 B      0.0%   read-only: Mounted read-only\n",
+		out,
+		"Device table written",
+	)
+
+	_, out, _ = runTestCommand(
+		&fakeClient{queue: queueView{
+			Pending: []jobView{{ID: 3, Path: "/home/c"}},
+			InProgress: []jobView{{
+				ID:       2,
+				Path:     "/home/b",
+				Message:  "Started",
+				WorkerID: 1,
+				Progress: &progressView{BytesTotal: 1024, Percent: 25, ETASeconds: 3725},
+			}},
+			Completed: []jobView{{ID: 1, Path: "/home/a", Message: "Failed", Error: "No space"}},
+		}},
+		"queue",
+		"status",
+	)
+	assert.Equal(
+		t,
+		"Pending (1):\n  #3 /home/c\n"+
+			"In progress (1):\n  #2 /home/b - Started (worker 1) 25.0% of 1.0 KiB, 1h02m05s remaining\n"+
+			"Completed (1):\n  #1 /home/a - Failed: No space\n",
+		out,
+		"Queue sections written",
+	)
+}
+
+// Check backups report being queued, their progress while waiting, and their outcome
+func TestRunCommandBackup(t *testing.T) {
+	status, out, _ := runTestCommand(
+		&fakeClient{job: jobView{ID: 4, Path: "/home/a", State: queue.StatePending}},
+		"backup",
+		"/home/a",
+	)
+	assert.Equal(t, 0, status, "Queued backup succeeds")
+	assert.Equal(t, "Queued job 4 to back up /home/a\n", out, "Queued job reported")
+
+	status, out, _ = runTestCommand(
+		&fakeClient{
+			progress: []jobView{{ID: 4, Path: "/home/a", Message: "Started", Progress: &progressView{BytesTotal: 2048, Percent: 50, ETASeconds: 2}}},
+			job:      jobView{ID: 4, Path: "/home/a", State: queue.StateCompleted, Message: "Finished"},
+		},
+		"backup",
+		"-wait",
+		"/home/a",
+	)
+	assert.Equal(t, 0, status, "Finished backup succeeds")
+	assert.Equal(t, "  #4 /home/a - Started 50.0% of 2.0 KiB, 0h00m02s remaining\nBacked up /home/a\n", out, "Progress and outcome reported")
+
+	status, out, _ = runTestCommand(
+		&fakeClient{job: jobView{ID: 4, Path: "/home/a", State: queue.StateCompleted, Message: "Failed", Error: "No space"}},
+		"backup",
+		"-wait",
+		"/home/a",
+	)
+	assert.Equal(t, exitFailed, status, "Failed backup fails")
+	assert.Equal(t, "Error: Failed to back up /home/a: No space\n", out, "Failure reported")
+}
+
+// Check planned moves are listed with the fill each device would end up at
+func TestRunCommandRebalance(t *testing.T) {
+	status, out, _ := runTestCommand(
+		&fakeClient{moves: movePlanView{
+			DryRun: true,
+			Moves:  []moveView{{Path: "/home/a.txt", Size: 2048, From: "/mnt/1", To: "/mnt/2"}},
+			Bytes:  2048,
+			Fill:   map[string]float64{"/mnt/2": 40, "/mnt/1": 42.5},
+		}},
+		"device",
+		"rebalance",
+		"-dry-run",
+	)
+	assert.Equal(t, 0, status, "Dry run succeeds")
+	assert.Equal(
+		t,
+		"Would move 1 files (2.0 KiB)\n  /home/a.txt (2.0 KiB) /mnt/1 -> /mnt/2\nFill after rebalancing:\n  /mnt/1 42.5%\n  /mnt/2 40.0%\n",
+		out,
+		"Plan written",
+	)
+
+	_, out, _ = runTestCommand(&fakeClient{moves: movePlanView{Fill: map[string]float64{"/mnt/1": 40}}}, "device", "rebalance")
+	assert.Equal(t, "Moved 0 files (0 B)\nFill after rebalancing:\n  /mnt/1 40.0%\n", out, "Nothing to move written")
+}
+
+// Check files moved onto a device are listed with the resulting fill
+func TestRunCommandMoveFiles(t *testing.T) {
+	status, out, _ := runTestCommand(
+		&fakeClient{moves: movePlanView{
+			Moves: []moveView{{Path: "/home/a.txt", Size: 10, From: "/mnt/1", To: "/mnt/2"}},
+			Bytes: 10,
+			Fill:  map[string]float64{"/mnt/1": 20, "/mnt/2": 80},
+		}},
+		"device",
+		"move",
+		"/home",
+		"/mnt/2",
+	)
+	assert.Equal(t, 0, status, "Move succeeds")
+	assert.Equal(
+		t,
+		"Moved 1 files (10 B)\n  /home/a.txt (10 B) /mnt/1 -> /mnt/2\nFill after moving:\n  /mnt/1 20.0%\n  /mnt/2 80.0%\n",
+		out,
+		"Moves written",
+	)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/control"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+var openDB = mydb.OpenDB
+var runManager = RunManager
+
+// client performs operations for the command line, either directly against the database or through a running daemon
+type client interface {
+	AddDevice(mountPoint string, serial string) (deviceView, error)
+	ListDevices() ([]deviceView, error)
+	RemoveDevice(mountPoint string) error
+	// Rebalance moves files until every device is within band percent of the average fill, or only plans it if a dry run
+	Rebalance(band float64, dryRun bool) (movePlanView, error)
+	// MoveFiles moves the backed up files at or beneath a path onto the device at a mount point
+	MoveFiles(path string, mountPoint string) (movePlanView, error)
+	// Backup backs up, or queues a backup of, a file or folder with the given copies or shards of each file
+	// If waiting, progress is reported until it completes, otherwise the job may be returned still pending
+	Backup(path string, redundancy queue.Redundancy, wait bool, onProgress func(jobView)) (jobView, error)
+	Restore(path string, target string) (restoreView, error)
+	Verify(path string, deviceID int, olderThan time.Duration) (verifyView, error)
+	QueueStatus() (queueView, error)
+	Close()
+}
+
+// clientOptions determines how the command line reaches the backup
+type clientOptions struct {
+	dbPath string
+	// Path to the daemon's control socket
+	socket string
+}
+
+// connectClient returns a client for a running daemon if there is one, otherwise one for the database
+var connectClient = func(options clientOptions) (client, error) {
+	if len(options.socket) > 0 && control.Available(options.socket) {
+		return &socketClient{path: options.socket}, nil
+	}
+
+	return newLocalClient(options.dbPath), nil
+}
+
+// localClient performs operations in this process, for when no daemon is running
+type localClient struct {
+	db       *sql.DB
+	devMan   *DevMan
+	commands chan DeviceCommand
+	results  chan DeviceResult
+}
+
+// newLocalClient opens the database and starts a device manager over it
+func newLocalClient(dbPath string) *localClient {
+	local := &localClient{
+		db:       openDB(dbPath),
+		commands: make(chan DeviceCommand, 1),
+		results:  make(chan DeviceResult, 1),
+	}
+
+	runManager(local.db, local.commands, local.results)
+	local.devMan = &DevMan{commands: local.commands, results: local.results}
+	return local
+}
+
+// AddDevice adds the device mounted at the given path
+func (local *localClient) AddDevice(mountPoint string, serial string) (deviceView, error) {
+	added, err := local.devMan.AddDevice(mountPoint, serial)
+	if err != nil {
+		return deviceView{}, err
+	}
+
+	return makeDeviceView(added), nil
+}
+
+// ListDevices returns every device, ordered by mount point
+func (local *localClient) ListDevices() ([]deviceView, error) {
+	devices, err := local.devMan.ListDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	return deviceViews(devices), nil
+}
+
+// RemoveDevice removes the device at the given mount point
+func (local *localClient) RemoveDevice(mountPoint string) error {
+	return local.devMan.RemoveDevice(mountPoint)
+}
+
+// Rebalance moves files between devices to even out their fill
+func (local *localClient) Rebalance(band float64, dryRun bool) (movePlanView, error) {
+	plan, err := local.devMan.Rebalance(band, dryRun)
+	if err != nil {
+		return movePlanView{}, err
+	}
+
+	return makeMovePlanView(plan, dryRun), nil
+}
+
+// MoveFiles moves backed up files onto a device
+func (local *localClient) MoveFiles(path string, mountPoint string) (movePlanView, error) {
+	plan, err := local.devMan.MoveFiles(path, mountPoint)
+	if err != nil {
+		return movePlanView{}, err
+	}
+
+	return makeMovePlanView(plan, false), nil
+}
+
+// Backup backs up a file or folder, always returning once it is done since there is no daemon to queue it with
+func (local *localClient) Backup(path string, redundancy queue.Redundancy, _ bool, _ func(jobView)) (jobView, error) {
+	action, absPath, err := backupAction(path)
+	if err != nil {
+		return jobView{}, err
+	}
+
+	redundancy, err = checkRedundancy(redundancy)
+	if err != nil {
+		return jobView{}, err
+	}
+
+	job := queue.Job{Action: action, Path: absPath, Redundancy: redundancy, State: queue.StateCompleted, Message: "Finished"}
+	if err = runJob(local.db, local.devMan, job, nil); err != nil {
+		return jobView{}, err
+	}
+
+	return makeJobView(job), nil
+}
+
+// Restore restores files, returning once every file has been attempted
+func (local *localClient) Restore(path string, target string) (restoreView, error) {
+	result, err := Restore(local.db, path, target)
+	if err != nil {
+		return restoreView{}, err
+	}
+
+	return makeRestoreView(result), nil
+}
+
+// Verify verifies files, returning once every file has been checked
+func (local *localClient) Verify(path string, deviceID int, olderThan time.Duration) (verifyView, error) {
+	request := verifyRequest{Path: path, DeviceID: deviceID, OlderThan: int64(olderThan / time.Second)}
+	result, err := Verify(local.db, request.filter(time.Now()))
+	if err != nil {
+		return verifyView{}, err
+	}
+
+	return makeVerifyView(result), nil
+}
+
+// QueueStatus returns the jobs as last persisted, without progress since nothing is running
+func (local *localClient) QueueStatus() (queueView, error) {
+	jobs, err := getDBJobs(local.db)
+	if err != nil {
+		return queueView{}, err
+	}
+
+	view := queueView{Pending: []jobView{}, InProgress: []jobView{}, Completed: []jobView{}}
+	for _, job := range jobs {
+		switch job.State {
+		case queue.StatePending:
+			view.Pending = append(view.Pending, makeJobView(job))
+		case queue.StateInProgress:
+			view.InProgress = append(view.InProgress, makeJobView(job))
+		case queue.StateCompleted:
+			view.Completed = append(view.Completed, makeJobView(job))
+		}
+	}
+
+	return view, nil
+}
+
+// Close stops the device manager and closes the database
+func (local *localClient) Close() {
+	close(local.commands)
+	close(local.results)
+	local.db.Close()
+}
+
+// socketClient sends operations to a running daemon over its control socket
+type socketClient struct {
+	path string
+}
+
+// AddDevice asks the daemon to add the device mounted at the given path
+func (socket *socketClient) AddDevice(mountPoint string, serial string) (deviceView, error) {
+	var added deviceView
+	err := control.Call(socket.path, "device add", addDeviceRequest{MountPoint: mountPoint, DeviceSerial: serial}, nil, &added)
+	return added, err
+}
+
+// ListDevices returns every device the daemon manages
+func (socket *socketClient) ListDevices() ([]deviceView, error) {
+	var devices []deviceView
+	err := control.Call(socket.path, "device list", nil, nil, &devices)
+	return devices, err
+}
+
+// RemoveDevice asks the daemon to remove the device at the given mount point
+func (socket *socketClient) RemoveDevice(mountPoint string) error {
+	return control.Call(socket.path, "device remove", removeDeviceRequest{MountPoint: mountPoint}, nil, nil)
+}
+
+// Rebalance asks the daemon to move files between devices, returning once every move is made
+func (socket *socketClient) Rebalance(band float64, dryRun bool) (movePlanView, error) {
+	var result movePlanView
+	err := control.Call(socket.path, "device rebalance", rebalanceRequest{Band: band, DryRun: dryRun}, nil, &result)
+	return result, err
+}
+
+// MoveFiles asks the daemon to move backed up files onto a device, returning once every move is made
+func (socket *socketClient) MoveFiles(path string, mountPoint string) (movePlanView, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return movePlanView{}, err
+	}
+
+	var result movePlanView
+	err = control.Call(socket.path, "device move", moveRequest{Path: absPath, MountPoint: mountPoint}, nil, &result)
+	return result, err
+}
+
+// Backup queues a backup with the daemon, optionally waiting for it to complete while reporting its progress
+func (socket *socketClient) Backup(
+	path string,
+	redundancy queue.Redundancy,
+	wait bool,
+	onProgress func(jobView),
+) (jobView, error) {
+	_, absPath, err := backupAction(path)
+	if err != nil {
+		return jobView{}, err
+	}
+
+	onEvent := func(event json.RawMessage) error {
+		var running jobView
+		if err := json.Unmarshal(event, &running); err != nil {
+			return err
+		}
+		if onProgress != nil {
+			onProgress(running)
+		}
+
+		return nil
+	}
+
+	var job jobView
+	request := backupRequest{
+		Path:         absPath,
+		Copies:       redundancy.Copies,
+		DataShards:   redundancy.DataShards,
+		ParityShards: redundancy.ParityShards,
+		Wait:         wait,
+	}
+	err = control.Call(socket.path, "backup", request, onEvent, &job)
+	return job, err
+}
+
+// Restore asks the daemon to restore files, returning once every file has been attempted
+func (socket *socketClient) Restore(path string, target string) (restoreView, error) {
+	request, err := absPaths(restoreRequest{Path: path, Target: target})
+	if err != nil {
+		return restoreView{}, err
+	}
+
+	var result restoreView
+	err = control.Call(socket.path, "restore", request, nil, &result)
+	return result, err
+}
+
+// Verify asks the daemon to verify files, returning once every file has been checked
+func (socket *socketClient) Verify(path string, deviceID int, olderThan time.Duration) (verifyView, error) {
+	if len(path) > 0 {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return verifyView{}, err
+		}
+		path = absPath
+	}
+
+	var result verifyView
+	request := verifyRequest{Path: path, DeviceID: deviceID, OlderThan: int64(olderThan / time.Second)}
+	err := control.Call(socket.path, "verify", request, nil, &result)
+	return result, err
+}
+
+// QueueStatus returns the daemon's queue, including progress of jobs in flight
+func (socket *socketClient) QueueStatus() (queueView, error) {
+	var view queueView
+	err := control.Call(socket.path, "queue status", nil, nil, &view)
+	return view, err
+}
+
+// Close has nothing to release, since each request uses its own connection
+func (socket *socketClient) Close() {
+}
+
+// absPaths resolves the paths in a restore request, since the daemon may be running elsewhere in the file system
+func absPaths(request restoreRequest) (restoreRequest, error) {
+	path, err := filepath.Abs(request.Path)
+	if err != nil {
+		return request, err
+	}
+	request.Path = path
+
+	if len(request.Target) > 0 {
+		if request.Target, err = filepath.Abs(request.Target); err != nil {
+			return request, err
+		}
+	}
+
+	return request, nil
+}
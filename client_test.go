@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/control"
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestSocket returns a client for a daemon handling commands over the given devices
+func makeTestSocket(t *testing.T, devices []*device.Device) (*socketClient, *controlHandler) {
+	handler := newControlHandler(&sql.DB{}, makeTestDevMan(t, devices), queue.New(), progress.NewTracker())
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	server, err := control.Listen(path, handler.handle)
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() {
+		handler.stop()
+		server.Close()
+	})
+
+	return &socketClient{path: path}, handler
+}
+
+// Check a daemon is used when one is listening, and the database otherwise
+func TestConnectClient(t *testing.T) {
+	realOpen := openDB
+	realRun := runManager
+
+	opened := ""
+	openDB = func(path string) *sql.DB {
+		opened = path
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+
+		return db
+	}
+	runManager = func(_ *sql.DB, _ <-chan DeviceCommand, _ chan<- DeviceResult) {}
+	defer func() {
+		openDB = realOpen
+		runManager = realRun
+	}()
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := control.Listen(path, func(_ control.Request, _ control.Stream) (interface{}, error) { return nil, nil })
+	if err != nil {
+		panic(err)
+	}
+
+	backend, err := connectClient(clientOptions{dbPath: "test.db", socket: path})
+	assert.Nil(t, err, "No error connecting to daemon")
+	assert.Equal(t, &socketClient{path: path}, backend, "Running daemon used")
+	assert.Empty(t, opened, "Database not opened while daemon runs")
+
+	server.Close()
+	backend, err = connectClient(clientOptions{dbPath: "test.db", socket: path})
+	assert.Nil(t, err, "No error opening database")
+	assert.IsType(t, &localClient{}, backend, "Database used without daemon")
+	assert.Equal(t, "test.db", opened, "Database opened")
+	backend.Close()
+}
+
+// Check device operations are sent to the daemon's manager, with its errors returned
+func TestSocketClientDevices(t *testing.T) {
+	socket, _ := makeTestSocket(t, []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC", AvailableSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "DEF", AvailableSpace: 100},
+	})
+
+	devices, err := socket.ListDevices()
+	assert.Nil(t, err, "No error listing devices")
+	assert.Len(t, devices, 2, "Devices listed")
+	assert.Equal(t, uint64(100), devices[0].RemainingSpace, "Device space returned")
+
+	_, err = socket.AddDevice("/mnt/1", "")
+	assert.EqualError(t, err, "Device already added as 1", "Daemon error returned")
+
+	realFilter := filterDBFiles
+	realRemove := removeDBDevice
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) { return nil, nil }
+	removeDBDevice = func(_ *sql.DB, _ int) error { return nil }
+	defer func() {
+		filterDBFiles = realFilter
+		removeDBDevice = realRemove
+	}()
+
+	assert.Nil(t, socket.RemoveDevice("/mnt/2"), "Device removed")
+	assert.EqualError(t, socket.RemoveDevice("/mnt/2"), "No such mountpoint", "Removed device gone")
+
+	devices, _ = socket.ListDevices()
+	assert.Len(t, devices, 1, "Removal reflected by daemon")
+}
+
+// Check backups are queued with the daemon by absolute path
+func TestSocketClientBackup(t *testing.T) {
+	socket, handler := makeTestSocket(t, nil)
+	root := makeTestTree(t, "a.txt")
+
+	job, err := socket.Backup(root, queue.Redundancy{Copies: 2}, false, nil)
+	assert.Nil(t, err, "No error queueing backup")
+	assert.Equal(t, root, job.Path, "Absolute path queued")
+	assert.Equal(t, queue.StatePending, job.State, "Job returned without waiting")
+
+	view, err := socket.QueueStatus()
+	assert.Nil(t, err, "No error getting queue")
+	assert.Len(t, view.Pending, 1, "Job pending")
+	assert.Equal(t, JobBackupFolder, view.Pending[0].Action, "Folder backed up as one job")
+	assert.Equal(t, 2, handler.jobQueue.Pending()[0].Copies, "Copies queued")
+	assert.Len(t, handler.jobQueue.Pending(), 1, "Job queued with daemon")
+
+	_, err = socket.Backup(filepath.Join(root, "missing"), queue.Redundancy{Copies: 1}, false, nil)
+	assert.NotNil(t, err, "Missing path rejected")
+
+	_, err = socket.Backup(root, queue.Redundancy{Copies: -1}, false, nil)
+	assert.EqualError(t, err, "Copies must be at least 1", "Copies checked")
+}
+
+// Check verification is sent to the daemon, skipping files verified within the given age
+func TestSocketClientVerify(t *testing.T) {
+	socket, _ := makeTestSocket(t, nil)
+
+	realFilter := filterDBFiles
+	realGetDevices := getDeviceRecords
+	var filters []mydb.FileFilter
+	filterDBFiles = func(_ *sql.DB, filter mydb.FileFilter) ([]mydb.File, error) {
+		filters = append(filters, filter)
+		return nil, nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return map[int]device.Device{}, nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		getDeviceRecords = realGetDevices
+	}()
+
+	_, err := socket.Verify("/home", 2, 0)
+	assert.Nil(t, err, "No error verifying every file")
+	_, err = socket.Verify("/home", 0, 30*24*time.Hour)
+	assert.Nil(t, err, "No error verifying files not checked recently")
+
+	assert.Len(t, filters, 2, "Both verifications run by daemon")
+	assert.Equal(t, mydb.FileFilter{Path: "/home", DeviceID: 2}, filters[0], "Every file verified without an age")
+	assert.WithinDuration(
+		t,
+		time.Now().Add(-30*24*time.Hour),
+		filters[1].VerifiedBefore,
+		time.Second,
+		"Files verified within the age skipped",
+	)
+}
+
+// Check the persisted queue is split into its sections when no daemon is running
+func TestLocalClientQueueStatus(t *testing.T) {
+	realGetJobs := getDBJobs
+
+	getDBJobs = func(_ *sql.DB) ([]queue.Job, error) {
+		return []queue.Job{
+			{ID: 1, Path: "/home/a", State: queue.StateCompleted},
+			{ID: 2, Path: "/home/b", State: queue.StateInProgress, WorkerID: 1},
+			{ID: 3, Path: "/home/c", State: queue.StatePending},
+		}, nil
+	}
+	defer func() { getDBJobs = realGetJobs }()
+
+	view, err := (&localClient{}).QueueStatus()
+	assert.Nil(t, err, "No error getting queue")
+	assert.Equal(t, []jobView{{ID: 3, Path: "/home/c", State: queue.StatePending}}, view.Pending, "Pending jobs")
+	assert.Equal(
+		t,
+		[]jobView{{ID: 2, Path: "/home/b", State: queue.StateInProgress, WorkerID: 1}},
+		view.InProgress,
+		"Jobs in progress",
+	)
+	assert.Equal(t, []jobView{{ID: 1, Path: "/home/a", State: queue.StateCompleted}}, view.Completed, "Completed jobs")
+}
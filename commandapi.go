@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+// enqueueRequest is the body of a request to back up a file or folder
+type enqueueRequest struct {
+	Path string `json:"path"`
+	// Copies of each file to keep on different drives, defaulting to one
+	Copies int `json:"copies"`
+	// Shards to erasure-code each file into instead of copying it, each on a different drive
+	DataShards   int `json:"dataShards"`
+	ParityShards int `json:"parityShards"`
+}
+
+// restoreRequest is the body of a request to restore files, optionally beneath a different root
+type restoreRequest struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+}
+
+// verifyRequest is the body of a request to verify files, with zero values matching everything
+type verifyRequest struct {
+	Path     string `json:"path"`
+	DeviceID int    `json:"deviceId"`
+	// Only verify files not verified within this many seconds
+	OlderThan int64 `json:"olderThan"`
+}
+
+// filter returns the files to verify for the request, as of the given time
+func (request verifyRequest) filter(now time.Time) mydb.FileFilter {
+	filter := mydb.FileFilter{Path: request.Path, DeviceID: request.DeviceID}
+	if request.OlderThan > 0 {
+		filter.VerifiedBefore = now.Add(-time.Duration(request.OlderThan) * time.Second)
+	}
+
+	return filter
+}
+
+// unavailableView is a device which must be mounted to act on the listed files
+type unavailableView struct {
+	DeviceID     int      `json:"deviceId"`
+	MountPoint   string   `json:"mountPoint"`
+	DeviceSerial string   `json:"deviceSerial"`
+	Files        []string `json:"files"`
+}
+
+// restoreView is the outcome of a restore
+type restoreView struct {
+	Restored    []string          `json:"restored"`
+	Failed      map[string]string `json:"failed"`
+	Unavailable []unavailableView `json:"unavailable"`
+}
+
+// verifyView is the outcome of a verification
+type verifyView struct {
+	Verified    []string          `json:"verified"`
+	Mismatched  []string          `json:"mismatched"`
+	Missing     []string          `json:"missing"`
+	Failed      map[string]string `json:"failed"`
+	Unavailable []unavailableView `json:"unavailable"`
+	// Erasure-coded files with damaged shards, by whether they can still be rebuilt
+	Rebuildable   []string          `json:"rebuildable"`
+	Unrecoverable map[string]string `json:"unrecoverable"`
+}
+
+// handleEnqueue adds a job to back up a file or folder, depending on what the path is
+func (server *WebServer) handleEnqueue(w http.ResponseWriter, r *http.Request) {
+	var request enqueueRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	action, path, err := backupAction(request.Path)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	redundancy, err := checkRedundancy(queue.Redundancy{
+		Copies:       request.Copies,
+		DataShards:   request.DataShards,
+		ParityShards: request.ParityShards,
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job, err := server.jobQueue.Add(action, path, redundancy)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, jobViews([]queue.Job{job}, server.tracker)[0])
+}
+
+// handleRestore restores files, returning once every file has been attempted
+func (server *WebServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "POST required")
+		return
+	}
+
+	var request restoreRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := Restore(server.db, request.Path, request.Target)
+	if errors.Is(err, ErrNoFiles) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, makeRestoreView(result))
+}
+
+// handleVerify verifies files, returning once every file has been checked
+func (server *WebServer) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "POST required")
+		return
+	}
+
+	var request verifyRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := Verify(server.db, request.filter(time.Now()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, makeVerifyView(result))
+}
+
+// makeRestoreView converts the outcome of a restore for display
+func makeRestoreView(result RestoreResult) restoreView {
+	return restoreView{
+		Restored:    result.Restored,
+		Failed:      errorMessages(result.Failed),
+		Unavailable: unavailableViews(result.Unavailable),
+	}
+}
+
+// makeVerifyView converts the outcome of a verification for display
+func makeVerifyView(result VerifyResult) verifyView {
+	return verifyView{
+		Verified:      result.Verified,
+		Mismatched:    result.Mismatched,
+		Missing:       result.Missing,
+		Failed:        errorMessages(result.Failed),
+		Unavailable:   unavailableViews(result.Unavailable),
+		Rebuildable:   result.Rebuildable,
+		Unrecoverable: errorMessages(result.Unrecoverable),
+	}
+}
+
+// errorMessages converts errors by path to their messages
+func errorMessages(errs map[string]error) map[string]string {
+	messages := make(map[string]string, len(errs))
+	for path, err := range errs {
+		messages[path] = err.Error()
+	}
+
+	return messages
+}
+
+// unavailableViews converts unavailable devices for display, ordered by device ID
+func unavailableViews(unavailable map[int]*UnavailableDevice) []unavailableView {
+	views := make([]unavailableView, 0, len(unavailable))
+	for _, dev := range unavailable {
+		views = append(views, unavailableView{
+			DeviceID:     dev.Device.DeviceID,
+			MountPoint:   dev.Device.MountPoint,
+			DeviceSerial: dev.Device.DeviceSerial,
+			Files:        dev.Files,
+		})
+	}
+
+	sort.Slice(views, func(i, j int) bool { return views[i].DeviceID < views[j].DeviceID })
+	return views
+}
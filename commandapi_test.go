@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Check backups are queued as file or folder jobs, depending on the path
+func TestEnqueueAPI(t *testing.T) {
+	server := makeTestWebServer(t, nil)
+	root := makeTestTree(t, "a.txt")
+
+	var job jobView
+	assert.Equal(
+		t,
+		http.StatusCreated,
+		sendTest(t, server, http.MethodPost, "/api/queue", fmt.Sprintf(`{"path": %q}`, root+"/a.txt"), &job),
+		"File queued",
+	)
+	assert.Equal(t, JobBackupFile, job.Action, "File job queued")
+	assert.Equal(t, 1, job.Copies, "One copy by default")
+
+	assert.Equal(
+		t,
+		http.StatusCreated,
+		sendTest(t, server, http.MethodPost, "/api/queue", fmt.Sprintf(`{"path": %q, "copies": 2}`, root), &job),
+		"Folder queued",
+	)
+	assert.Equal(t, 2, job.Copies, "Copies queued")
+
+	var failed map[string]string
+	assert.Equal(
+		t,
+		http.StatusBadRequest,
+		sendTest(t, server, http.MethodPost, "/api/queue", fmt.Sprintf(`{"path": %q, "copies": -1}`, root), &failed),
+		"Invalid copies rejected",
+	)
+	assert.Equal(
+		t,
+		http.StatusCreated,
+		sendTest(t, server, http.MethodPost, "/api/queue", fmt.Sprintf(`{"path": %q, "dataShards": 4, "parityShards": 2}`, root), &job),
+		"Erasure-coded folder queued",
+	)
+	assert.Equal(t, []int{4, 2}, []int{job.DataShards, job.ParityShards}, "Shards queued")
+	assert.Equal(
+		t,
+		http.StatusBadRequest,
+		sendTest(t, server, http.MethodPost, "/api/queue", fmt.Sprintf(`{"path": %q, "parityShards": 2}`, root), &failed),
+		"Parity without data shards rejected",
+	)
+	assert.Equal(
+		t,
+		http.StatusNotFound,
+		sendTest(t, server, http.MethodPost, "/api/queue", fmt.Sprintf(`{"path": %q}`, root+"/b.txt"), &failed),
+		"Missing path not found",
+	)
+	assert.Len(t, server.jobQueue.Pending(), 3, "Only valid requests queued")
+}
+
+// Check restores report their outcome, and when there is nothing to restore
+func TestRestoreAPI(t *testing.T) {
+	realGetFiles := getDBFiles
+	realGetDevices := getDeviceRecords
+	realLocate := locateDevice
+
+	getDBFiles = func(_ *sql.DB, path string) ([]mydb.File, error) {
+		if path == "/home/nothing" {
+			return nil, nil
+		}
+
+		return []mydb.File{{SourcePath: "/home/a.txt", DeviceID: 1}}, nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return map[int]device.Device{1: {DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC"}}, nil
+	}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		return device.Device{}, fmt.Errorf("No device with serial %q or UUID %q is mounted", known.DeviceSerial, known.UUID)
+	}
+	defer func() {
+		getDBFiles = realGetFiles
+		getDeviceRecords = realGetDevices
+		locateDevice = realLocate
+	}()
+
+	server := makeTestWebServer(t, nil)
+
+	var result restoreView
+	assert.Equal(t, http.StatusOK, sendTest(t, server, http.MethodPost, "/api/restore", `{"path": "/home"}`, &result), "Restore attempted")
+	assert.Equal(
+		t,
+		[]unavailableView{{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC", Files: []string{"/home/a.txt"}}},
+		result.Unavailable,
+		"Unavailable device reported",
+	)
+
+	var failed map[string]string
+	assert.Equal(
+		t,
+		http.StatusNotFound,
+		sendTest(t, server, http.MethodPost, "/api/restore", `{"path": "/home/nothing"}`, &failed),
+		"Nothing to restore",
+	)
+	assert.Equal(t, "No backed up files found for /home/nothing", failed["error"], "Reason returned")
+}
+
+// Check verification passes the filter through and reports failures by message
+func TestVerifyAPI(t *testing.T) {
+	realFilter := filterDBFiles
+	realGetDevices := getDeviceRecords
+
+	var filters []mydb.FileFilter
+	filterDBFiles = func(_ *sql.DB, filter mydb.FileFilter) ([]mydb.File, error) {
+		filters = append(filters, filter)
+		return nil, nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return map[int]device.Device{}, nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		getDeviceRecords = realGetDevices
+	}()
+
+	var result verifyView
+	assert.Equal(
+		t,
+		http.StatusOK,
+		sendTest(t, makeTestWebServer(t, nil), http.MethodPost, "/api/verify", `{"path": "/home", "deviceId": 2}`, &result),
+		"Verification run",
+	)
+	assert.Empty(t, result.Verified, "Nothing to verify")
+	assert.Equal(
+		t,
+		http.StatusOK,
+		sendTest(t, makeTestWebServer(t, nil), http.MethodPost, "/api/verify", `{"path": "/home", "olderThan": 3600}`, &result),
+		"Verification of files not checked recently run",
+	)
+	assert.Equal(t, mydb.FileFilter{Path: "/home", DeviceID: 2}, filters[0], "Filter passed through")
+	assert.Equal(t, "/home", filters[1].Path, "Path passed through with age")
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), filters[1].VerifiedBefore, time.Second, "Only files not verified within the age checked")
+
+	view := makeVerifyView(VerifyResult{Failed: map[string]error{"/home/a.txt": fmt.Errorf("Permission denied")}})
+	assert.Equal(t, map[string]string{"/home/a.txt": "Permission denied"}, view.Failed, "Errors converted to messages")
+}
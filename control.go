@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/control"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+// waitInterval is how often progress is streamed while waiting for a backup to finish
+var waitInterval = 500 * time.Millisecond
+
+// removeDeviceRequest is the arguments of a request to remove a device
+type removeDeviceRequest struct {
+	MountPoint string `json:"mountPoint"`
+}
+
+// backupRequest is the arguments of a request to back up a file or folder
+// If waiting, the job's progress is streamed until it completes
+type backupRequest struct {
+	Path         string `json:"path"`
+	Copies       int    `json:"copies"`
+	DataShards   int    `json:"dataShards"`
+	ParityShards int    `json:"parityShards"`
+	Wait         bool   `json:"wait"`
+}
+
+// controlHandler runs commands sent to the daemon over its control socket,
+// so the command line never writes to the database while the daemon is running
+type controlHandler struct {
+	db       *sql.DB
+	devMan   *DevMan
+	jobQueue *queue.Queue
+	tracker  *progress.Tracker
+	// Closed when the daemon is shutting down, to stop waiting on jobs
+	stopping chan struct{}
+}
+
+// newControlHandler returns a handler for commands against the daemon's state
+func newControlHandler(db *sql.DB, devMan *DevMan, jobQueue *queue.Queue, tracker *progress.Tracker) *controlHandler {
+	return &controlHandler{db: db, devMan: devMan, jobQueue: jobQueue, tracker: tracker, stopping: make(chan struct{})}
+}
+
+// stop ends any waits for jobs to finish, so connections can be closed
+func (handler *controlHandler) stop() {
+	close(handler.stopping)
+}
+
+// handle runs a command, with the same names as on the command line
+func (handler *controlHandler) handle(request control.Request, stream control.Stream) (interface{}, error) {
+	switch request.Command {
+	case "device add":
+		var args addDeviceRequest
+		if err := request.DecodeArgs(&args); err != nil {
+			return nil, err
+		}
+
+		added, err := handler.devMan.AddDevice(args.MountPoint, args.DeviceSerial)
+		return makeDeviceView(added), err
+	case "device list":
+		devices, err := handler.devMan.ListDevices()
+		return deviceViews(devices), err
+	case "device remove":
+		var args removeDeviceRequest
+		if err := request.DecodeArgs(&args); err != nil {
+			return nil, err
+		}
+
+		return nil, handler.devMan.RemoveDevice(args.MountPoint)
+	case "device rebalance":
+		var args rebalanceRequest
+		if err := request.DecodeArgs(&args); err != nil {
+			return nil, err
+		}
+
+		plan, err := handler.devMan.Rebalance(args.Band, args.DryRun)
+		return makeMovePlanView(plan, args.DryRun), err
+	case "device move":
+		var args moveRequest
+		if err := request.DecodeArgs(&args); err != nil {
+			return nil, err
+		}
+
+		plan, err := handler.devMan.MoveFiles(args.Path, args.MountPoint)
+		return makeMovePlanView(plan, false), err
+	case "backup":
+		var args backupRequest
+		if err := request.DecodeArgs(&args); err != nil {
+			return nil, err
+		}
+
+		return handler.backup(args, stream)
+	case "restore":
+		var args restoreRequest
+		if err := request.DecodeArgs(&args); err != nil {
+			return nil, err
+		}
+
+		result, err := Restore(handler.db, args.Path, args.Target)
+		return makeRestoreView(result), err
+	case "verify":
+		var args verifyRequest
+		if err := request.DecodeArgs(&args); err != nil {
+			return nil, err
+		}
+
+		result, err := Verify(handler.db, args.filter(time.Now()))
+		return makeVerifyView(result), err
+	case "queue status":
+		return makeQueueView(handler.jobQueue, handler.tracker), nil
+	default:
+		return nil, fmt.Errorf("%s is not a recognized command", request.Command)
+	}
+}
+
+// backup queues a job for the path, optionally streaming its progress until it completes
+func (handler *controlHandler) backup(args backupRequest, stream control.Stream) (jobView, error) {
+	action, path, err := backupAction(args.Path)
+	if err != nil {
+		return jobView{}, err
+	}
+
+	redundancy, err := checkRedundancy(queue.Redundancy{
+		Copies:       args.Copies,
+		DataShards:   args.DataShards,
+		ParityShards: args.ParityShards,
+	})
+	if err != nil {
+		return jobView{}, err
+	}
+
+	job, err := handler.jobQueue.Add(action, path, redundancy)
+	if err != nil {
+		return jobView{}, err
+	}
+	if !args.Wait {
+		return makeJobView(job), nil
+	}
+
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+
+	for {
+		current, found := findJob(handler.jobQueue, job.ID)
+		switch {
+		case !found:
+			// Completed jobs can be cleared, in which case the outcome is no longer known
+			return jobView{}, fmt.Errorf("Job %d was cleared from the queue before its outcome was read", job.ID)
+		case current.State == queue.StateCompleted:
+			return makeJobView(current), nil
+		case current.State == queue.StateInProgress:
+			if err = stream(jobViews([]queue.Job{current}, handler.tracker)[0]); err != nil {
+				return jobView{}, err
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-handler.stopping:
+			return jobView{}, fmt.Errorf("Daemon is shutting down, job %d will resume when it restarts", job.ID)
+		}
+	}
+}
+
+// findJob returns the job with the given ID from whichever section of the queue it is in
+// Sections are checked in the order jobs move through them, so a job moving on in between is still found
+func findJob(jobQueue *queue.Queue, jobID int) (queue.Job, bool) {
+	for _, section := range []func() []queue.Job{jobQueue.Pending, jobQueue.InProgress, jobQueue.Completed} {
+		for _, job := range section() {
+			if job.ID == jobID {
+				return job, true
+			}
+		}
+	}
+
+	return queue.Job{}, false
+}
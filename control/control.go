@@ -0,0 +1,217 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/ammesonb/dispersed-backup/logging"
+)
+
+// Request asks the daemon to run a command, with arguments specific to it
+// Each connection carries a single request, written as one line of JSON
+type Request struct {
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// DecodeArgs decodes the request's arguments into args, rejecting any it does not have fields for
+func (request Request) DecodeArgs(args interface{}) error {
+	if len(request.Args) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(request.Args))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(args); err != nil {
+		return fmt.Errorf("Invalid arguments for %s: %v", request.Command, err)
+	}
+
+	return nil
+}
+
+// Response is one line of JSON sent back for a request
+// Any number of responses carrying an event may be streamed before the final one, which is marked done
+type Response struct {
+	Event  json.RawMessage `json:"event,omitempty"`
+	Done   bool            `json:"done,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Stream sends an event to the client while a command is still running
+type Stream func(event interface{}) error
+
+// Handler runs a command, returning its result or the reason it failed
+type Handler func(request Request, stream Stream) (interface{}, error)
+
+// Server accepts connections on a Unix domain socket, handling each request as it arrives
+type Server struct {
+	listener net.Listener
+	handler  Handler
+	// Tracks connections being handled, so closing can wait for them
+	connections sync.WaitGroup
+	done        chan struct{}
+}
+
+// Listen creates the socket at the given path and starts serving requests on it
+// A socket left behind by a daemon which did not shut down cleanly is replaced,
+// but one still accepting connections is not
+func Listen(path string, handler Handler) (*Server, error) {
+	if Available(path) {
+		return nil, fmt.Errorf("A daemon is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to remove stale socket %s: %v", path, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Anyone able to connect can manage devices, so restrict it to the daemon's user
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	server := &Server{listener: listener, handler: handler, done: make(chan struct{})}
+	go server.accept()
+	return server, nil
+}
+
+// Close stops accepting connections, returning once every request in progress has finished
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	<-server.done
+	server.connections.Wait()
+	return err
+}
+
+// accept hands each connection off to be served until the listener is closed
+func (server *Server) accept() {
+	defer close(server.done)
+
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Default().Errorf("Control socket stopped accepting: %v", err)
+			}
+			return
+		}
+
+		server.connections.Add(1)
+		go func() {
+			defer server.connections.Done()
+			server.serve(conn)
+		}()
+	}
+}
+
+// serve reads a single request from the connection, streaming responses back until it is done
+func (server *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	var request Request
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&request); err != nil {
+		encoder.Encode(Response{Done: true, Error: fmt.Sprintf("Invalid request: %v", err)})
+		return
+	}
+
+	stream := func(event interface{}) error {
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		return encoder.Encode(Response{Event: encoded})
+	}
+
+	result, err := server.safeHandle(request, stream)
+	response := Response{Done: true}
+	if err != nil {
+		response.Error = err.Error()
+	} else if response.Result, err = json.Marshal(result); err != nil {
+		response.Error = fmt.Sprintf("Failed to encode result: %v", err)
+	}
+
+	if err = encoder.Encode(response); err != nil {
+		logging.Default().Warnf("Failed to send %s result: %v", request.Command, err)
+	}
+}
+
+// safeHandle runs the handler, converting a panic into an error so the client still gets a response
+func (server *Server) safeHandle(request Request, stream Stream) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Default().Errorf("Recovered from panic handling %s: %v", request.Command, r)
+			result, err = nil, fmt.Errorf("Panic during %s", request.Command)
+		}
+	}()
+
+	return server.handler(request, stream)
+}
+
+// Call sends a request to the daemon listening at path, passing each streamed event to onEvent if not nil,
+// and decoding the final result into result if not nil
+func Call(path string, command string, args interface{}, onEvent func(json.RawMessage) error, result interface{}) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("Failed to reach daemon: %v", err)
+	}
+	defer conn.Close()
+
+	request := Request{Command: command}
+	if args != nil {
+		if request.Args, err = json.Marshal(args); err != nil {
+			return err
+		}
+	}
+	if err = json.NewEncoder(conn).Encode(request); err != nil {
+		return fmt.Errorf("Failed to send request: %v", err)
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var response Response
+		if err = decoder.Decode(&response); err != nil {
+			return fmt.Errorf("Failed to read response: %v", err)
+		}
+
+		if !response.Done {
+			if onEvent != nil {
+				if err = onEvent(response.Event); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if len(response.Error) > 0 {
+			return errors.New(response.Error)
+		}
+		if result != nil {
+			return json.Unmarshal(response.Result, result)
+		}
+
+		return nil
+	}
+}
+
+// Available returns whether a daemon is accepting connections at path
+func Available(path string) bool {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
@@ -0,0 +1,120 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoArgs is the arguments of the test handler's commands
+type echoArgs struct {
+	Text  string `json:"text"`
+	Times int    `json:"times"`
+}
+
+// echo streams its text the requested number of times, returning how many were sent
+func echo(request Request, stream Stream) (interface{}, error) {
+	var args echoArgs
+	if err := request.DecodeArgs(&args); err != nil {
+		return nil, err
+	}
+
+	switch request.Command {
+	case "echo":
+		for sent := 0; sent < args.Times; sent++ {
+			if err := stream(args.Text); err != nil {
+				return nil, err
+			}
+		}
+
+		return args.Times, nil
+	case "panic":
+		panic("handler failed")
+	default:
+		return nil, fmt.Errorf("%s is not a recognized command", request.Command)
+	}
+}
+
+// listenTest starts a server with the echo handler in a temporary directory
+func listenTest(t *testing.T) (string, *Server) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	server, err := Listen(path, echo)
+	if err != nil {
+		panic(err)
+	}
+
+	return path, server
+}
+
+// Check streamed events arrive in order before the result
+func TestCall(t *testing.T) {
+	path, server := listenTest(t)
+	defer server.Close()
+
+	var events []string
+	var sent int
+	err := Call(path, "echo", echoArgs{Text: "hi", Times: 3}, func(event json.RawMessage) error {
+		var text string
+		if err := json.Unmarshal(event, &text); err != nil {
+			return err
+		}
+
+		events = append(events, text)
+		return nil
+	}, &sent)
+	assert.Nil(t, err, "No error calling")
+	assert.Equal(t, []string{"hi", "hi", "hi"}, events, "Events streamed")
+	assert.Equal(t, 3, sent, "Result decoded")
+
+	assert.Nil(t, Call(path, "echo", nil, nil, nil), "Arguments and events optional")
+}
+
+// Check handler failures, including panics and invalid arguments, are returned as errors
+func TestCallErrors(t *testing.T) {
+	path, server := listenTest(t)
+	defer server.Close()
+
+	assert.EqualError(t, Call(path, "shout", nil, nil, nil), "shout is not a recognized command", "Handler error returned")
+	assert.EqualError(t, Call(path, "panic", nil, nil, nil), "Panic during panic", "Panic returned as error")
+
+	err := Call(path, "echo", map[string]int{"volume": 11}, nil, nil)
+	assert.Contains(t, err.Error(), "Invalid arguments for echo", "Unknown arguments rejected")
+
+	assert.Nil(t, Call(path, "echo", nil, nil, nil), "Server still running after failures")
+}
+
+// Check a running daemon's socket is kept, but a stale one replaced
+func TestListen(t *testing.T) {
+	path, server := listenTest(t)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "Socket created")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Socket restricted to owner")
+	assert.True(t, Available(path), "Socket accepting connections")
+
+	_, err = Listen(path, echo)
+	assert.EqualError(t, err, "A daemon is already listening on "+path, "Running daemon not replaced")
+
+	server.Close()
+	assert.False(t, Available(path), "Socket closed")
+
+	// Leave a socket file behind with nothing listening on it
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		panic(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	server, err = Listen(path, echo)
+	assert.Nil(t, err, "Stale socket replaced")
+	assert.Nil(t, Call(path, "echo", nil, nil, nil), "Replacement serving")
+	server.Close()
+
+	assert.NotNil(t, Call(path, "echo", nil, nil, nil), "Unreachable daemon reported")
+}
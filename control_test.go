@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/control"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestControl returns a handler over an empty queue, with no devices
+func makeTestControl(t *testing.T) *controlHandler {
+	return newControlHandler(&sql.DB{}, makeTestDevMan(t, nil), queue.New(), progress.NewTracker())
+}
+
+// Check commands are dispatched by name, and unknown ones rejected
+func TestControlHandle(t *testing.T) {
+	handler := makeTestControl(t)
+
+	result, err := handler.handle(control.Request{Command: "queue status"}, nil)
+	assert.Nil(t, err, "No error getting queue")
+	assert.IsType(t, queueView{}, result, "Queue returned")
+
+	_, err = handler.handle(control.Request{Command: "device add", Args: []byte(`{"mountPoint": ""}`)}, nil)
+	assert.ErrorIs(t, err, ErrMountRequired, "Device commands go through the manager")
+
+	_, err = handler.handle(control.Request{Command: "device eject"}, nil)
+	assert.EqualError(t, err, "device eject is not a recognized command", "Unknown command rejected")
+}
+
+// Check waiting on a backup streams its progress until it completes
+func TestControlBackupWait(t *testing.T) {
+	realInterval := waitInterval
+	waitInterval = time.Millisecond
+	defer func() { waitInterval = realInterval }()
+
+	handler := makeTestControl(t)
+	root := makeTestTree(t, "a.txt")
+
+	work := make(chan queue.Job)
+	updates := make(chan queue.StatusUpdate)
+	go handler.jobQueue.Dispatch(work, updates)
+	defer close(updates)
+
+	// Only finish the job once its progress has been seen
+	streamed := make(chan jobView, 100)
+	go func() {
+		job := <-work
+		updates <- queue.StatusUpdate{JobID: job.ID, WorkerID: 1, State: queue.StateInProgress, Message: "Started"}
+		<-streamed
+		updates <- queue.StatusUpdate{JobID: job.ID, WorkerID: 1, State: queue.StateCompleted, Message: "Failed", Err: fmt.Errorf("No space")}
+	}()
+
+	job, err := handler.backup(backupRequest{Path: root + "/a.txt", Wait: true}, func(event interface{}) error {
+		streamed <- event.(jobView)
+		return nil
+	})
+	assert.Nil(t, err, "No error waiting for backup")
+	assert.Equal(t, queue.StateCompleted, job.State, "Completed job returned")
+	assert.Equal(t, "No space", job.Error, "Job failure returned")
+	assert.Equal(t, JobBackupFile, job.Action, "File backed up")
+
+	handler.jobQueue.Stop()
+}
+
+// Check waiting ends when the daemon shuts down, or the job's outcome is lost
+func TestControlBackupWaitEnds(t *testing.T) {
+	realInterval := waitInterval
+	waitInterval = time.Millisecond
+	defer func() { waitInterval = realInterval }()
+
+	handler := makeTestControl(t)
+	root := makeTestTree(t, "a.txt")
+	handler.stop()
+
+	_, err := handler.backup(backupRequest{Path: root, Wait: true}, nil)
+	assert.EqualError(t, err, "Daemon is shutting down, job 1 will resume when it restarts", "Shutdown ends wait")
+
+	_, ok := findJob(handler.jobQueue, 1)
+	assert.True(t, ok, "Pending job found")
+	_, ok = findJob(handler.jobQueue, 2)
+	assert.False(t, ok, "Missing job not found")
+}
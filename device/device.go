@@ -1,7 +1,13 @@
 package device
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/shirou/gopsutil/disk"
 )
@@ -9,14 +15,48 @@ import (
 var getParts = disk.Partitions
 var getUsage = disk.Usage
 var getSerial = disk.GetDiskSerialNumber
+var getUUID = partitionUUID
+var probeMount = probeWrite
+var getBlockSize = blockSize
+
+// metadataBlocks is how many blocks each file is assumed to need beyond its contents, for directory entries and extents
+const metadataBlocks = 1
+
+// ErrReadOnly is returned by the write probe when a device is mounted read-only
+var ErrReadOnly = fmt.Errorf("Mounted read-only")
+
+// probeContents is written to the probe file and must be read back unchanged
+var probeContents = []byte("dispersed-backup write probe\n")
+
+// uuidDir contains a link to each partition named by its filesystem UUID
+var uuidDir = "/dev/disk/by-uuid"
 
 // Device represents a mount point on the system that can be used for backing up files
 type Device struct {
-	DeviceID       int
-	MountPoint     string
-	DeviceSerial   string
+	DeviceID     int
+	MountPoint   string
+	DeviceSerial string
+	// Filesystem UUID, to find the device if its serial cannot be read
+	UUID           string
 	AvailableSpace uint64
 	AllocatedSpace uint64
+	TotalSpace     uint64
+	// Offline devices are registered but could not be measured, so hold no usage data and cannot be written to
+	Offline       bool
+	OfflineReason string
+	// Read-only devices are mounted and measured, but failed the write probe so cannot store files
+	ReadOnly       bool
+	ReadOnlyReason string
+	// Filesystem block size, which every file's space is rounded up to, or 0 if unknown
+	BlockSize uint64
+	// Inodes on the filesystem, with a total of 0 for filesystems which do not limit the number of files
+	TotalInodes uint64
+	FreeInodes  uint64
+}
+
+// Writable returns whether new files can be stored on the device
+func (dev *Device) Writable() bool {
+	return !dev.Offline && !dev.ReadOnly
 }
 
 // RemainingSpace returns the amount of space remaining on the device
@@ -24,19 +64,99 @@ func (dev *Device) RemainingSpace() uint64 {
 	return dev.AvailableSpace - dev.AllocatedSpace
 }
 
+// FillPercent returns how full the device is, from 0 to 100, counting space reserved as used
+func (dev *Device) FillPercent() float64 {
+	if dev.TotalSpace == 0 {
+		return 0
+	}
+
+	used := dev.TotalSpace - dev.RemainingSpace()
+	return float64(used) / float64(dev.TotalSpace) * 100
+}
+
+// Footprint returns the space a file of the given size will really occupy, rounded up to whole blocks plus its metadata
+func (dev *Device) Footprint(size int64) uint64 {
+	if dev.BlockSize == 0 {
+		return uint64(size)
+	}
+
+	blocks := (uint64(size) + dev.BlockSize - 1) / dev.BlockSize
+	return (blocks + metadataBlocks) * dev.BlockSize
+}
+
+// Fits returns whether a file of the given size can be stored, leaving space remaining and an inode for it
+func (dev *Device) Fits(size int64) bool {
+	return dev.RemainingSpace() > dev.Footprint(size) && (dev.TotalInodes == 0 || dev.FreeInodes > 0)
+}
+
+// ReserveFile reserves the space a file of the given size will occupy, and an inode for it
+func (dev *Device) ReserveFile(size int64) {
+	dev.AllocatedSpace += dev.Footprint(size)
+	if dev.TotalInodes > 0 {
+		dev.FreeInodes--
+	}
+}
+
+// UnreserveFile cancels a reservation for a file which was not stored
+func (dev *Device) UnreserveFile(size int64) {
+	dev.AllocatedSpace -= dev.Footprint(size)
+	if dev.TotalInodes > 0 {
+		dev.FreeInodes++
+	}
+}
+
 // ReserveSpace reserves the requested space on the device
 // Space can be negative, to free allocated space
 func (dev *Device) ReserveSpace(needed int64) {
 	if needed > 0 {
 		dev.AllocatedSpace += uint64(needed)
 	} else {
-		dev.AllocatedSpace -= uint64(needed)
+		dev.AllocatedSpace -= uint64(-needed)
+	}
+}
+
+// ReleaseSpace accounts for a stored file being deleted from the device, freeing its footprint and inode
+// Space reserved since the device was measured is released first, since the measurement counted it as available,
+// with the remainder having been in use when measured
+func (dev *Device) ReleaseSpace(size int64) {
+	if dev.TotalInodes > 0 {
+		dev.FreeInodes++
+	}
+
+	freed := dev.Footprint(size)
+	if freed <= dev.AllocatedSpace {
+		dev.AllocatedSpace -= freed
+		return
+	}
+
+	dev.AvailableSpace += freed - dev.AllocatedSpace
+	dev.AllocatedSpace = 0
+}
+
+// Remeasure reads the current usage of the device's partition, updating its available and total space
+// Fails if nothing is mounted at the device's mount point, since the usage would be of whichever filesystem contains it
+func (dev *Device) Remeasure() error {
+	mounted, err := IsMounted(dev.MountPoint)
+	if err != nil {
+		return err
+	} else if !mounted {
+		return fmt.Errorf("No device mounted on %s", dev.MountPoint)
 	}
+
+	usage, err := getUsage(dev.MountPoint)
+	if err != nil {
+		return fmt.Errorf("Failed to get disk usage: %v", err)
+	}
+
+	dev.AvailableSpace = usage.Free
+	dev.TotalSpace = usage.Total
+	dev.TotalInodes = usage.InodesTotal
+	dev.FreeInodes = usage.InodesFree
+	return nil
 }
 
 // MakeDevice creates a device based on the provided path and optional serial
 func MakeDevice(devID int, path string, serial string) (Device, error) {
-	// TODO: make sure device is read & writable
 	parts, err := getParts(false)
 	if err != nil {
 		return Device{}, fmt.Errorf("Failed to get partitions: %v", err)
@@ -44,24 +164,216 @@ func MakeDevice(devID int, path string, serial string) (Device, error) {
 
 	for _, part := range parts {
 		if part.Mountpoint == path {
-			usage, err := getUsage(path)
-			if err != nil {
-				return Device{}, fmt.Errorf("Failed to get disk usage: %v", err)
-			}
+			return measure(devID, part, serial)
+		}
+	}
+
+	return Device{}, fmt.Errorf("No device mounted on %s", path)
+}
+
+// LocateDevice finds where a registered device is mounted by its serial, or else its filesystem UUID, and measures it
+// The mount point is only trusted for devices with neither, since drives may be mounted at each other's paths
+func LocateDevice(known Device) (Device, error) {
+	parts, err := getParts(false)
+	if err != nil {
+		return Device{}, fmt.Errorf("Failed to get partitions: %v", err)
+	}
+
+	part, found := findBySerial(parts, known)
+	if !found {
+		part, found = findByUUID(parts, known)
+	}
+	if !found && len(known.DeviceSerial) == 0 && len(known.UUID) == 0 {
+		return MakeDevice(known.DeviceID, known.MountPoint, known.DeviceSerial)
+	}
+	if !found {
+		return Device{}, fmt.Errorf("No device with serial %q or UUID %q is mounted", known.DeviceSerial, known.UUID)
+	}
+
+	return measure(known.DeviceID, part, known.DeviceSerial)
+}
+
+// findBySerial returns the partition of the device with the known serial, preferring the one at its known mount point
+func findBySerial(parts []disk.PartitionStat, known Device) (disk.PartitionStat, bool) {
+	if len(known.DeviceSerial) == 0 {
+		return disk.PartitionStat{}, false
+	}
 
-			if serial == "" {
-				serial = getSerial(part.Device)
+	var matched []disk.PartitionStat
+	for _, part := range parts {
+		if getSerial(part.Device) == known.DeviceSerial {
+			if part.Mountpoint == known.MountPoint {
+				return part, true
 			}
 
-			return Device{
-				devID,
-				path,
-				serial,
-				usage.Free,
-				0,
-			}, nil
+			matched = append(matched, part)
 		}
 	}
 
-	return Device{}, fmt.Errorf("No device mounted on %s", path)
+	if len(matched) == 0 {
+		return disk.PartitionStat{}, false
+	}
+
+	return matched[0], true
+}
+
+// findByUUID returns the partition with the known filesystem UUID
+func findByUUID(parts []disk.PartitionStat, known Device) (disk.PartitionStat, bool) {
+	if len(known.UUID) == 0 {
+		return disk.PartitionStat{}, false
+	}
+
+	for _, part := range parts {
+		if getUUID(part.Device) == known.UUID {
+			return part, true
+		}
+	}
+
+	return disk.PartitionStat{}, false
+}
+
+// measure creates a device for a mounted partition with its current usage and block size, detecting the serial if not given
+// The partition is probed to check files can be stored on it, marking it read-only if not
+func measure(devID int, part disk.PartitionStat, serial string) (Device, error) {
+	usage, err := getUsage(part.Mountpoint)
+	if err != nil {
+		return Device{}, fmt.Errorf("Failed to get disk usage: %v", err)
+	}
+
+	block, err := getBlockSize(part.Mountpoint)
+	if err != nil {
+		return Device{}, fmt.Errorf("Failed to get block size: %v", err)
+	}
+
+	if serial == "" {
+		serial = getSerial(part.Device)
+	}
+
+	readOnlyReason := ""
+	if err = checkWritable(part); err != nil {
+		readOnlyReason = err.Error()
+	}
+
+	return Device{
+		devID,
+		part.Mountpoint,
+		serial,
+		getUUID(part.Device),
+		usage.Free,
+		0,
+		usage.Total,
+		false,
+		"",
+		len(readOnlyReason) > 0,
+		readOnlyReason,
+		block,
+		usage.InodesTotal,
+		usage.InodesFree,
+	}, nil
+}
+
+// blockSize returns the block size of the filesystem containing the path
+func blockSize(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bsize), nil
+}
+
+// checkWritable returns why files cannot be stored on a partition, or nil if they can
+func checkWritable(part disk.PartitionStat) error {
+	for _, opt := range strings.Split(part.Opts, ",") {
+		if opt == "ro" {
+			return ErrReadOnly
+		}
+	}
+
+	return probeMount(part.Mountpoint)
+}
+
+// probeWrite creates, syncs, reads back and deletes a file at the mount point, returning the first step to fail
+func probeWrite(mountPoint string) error {
+	probe, err := os.CreateTemp(mountPoint, ".dispersed-backup-probe-")
+	if errors.Is(err, syscall.EROFS) {
+		return ErrReadOnly
+	} else if err != nil {
+		return fmt.Errorf("Failed to create probe file: %v", err)
+	}
+	defer os.Remove(probe.Name())
+
+	_, err = probe.Write(probeContents)
+	if err == nil {
+		err = probe.Sync()
+	}
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write probe file: %v", err)
+	}
+
+	contents, err := os.ReadFile(probe.Name())
+	if err != nil {
+		return fmt.Errorf("Failed to read probe file: %v", err)
+	} else if !bytes.Equal(contents, probeContents) {
+		return fmt.Errorf("Probe file read back differently than written")
+	}
+
+	if err = os.Remove(probe.Name()); err != nil {
+		return fmt.Errorf("Failed to delete probe file: %v", err)
+	}
+
+	return nil
+}
+
+// partitionUUID returns the filesystem UUID of a partition's device node, or empty if it has none
+func partitionUUID(devicePath string) string {
+	entries, err := os.ReadDir(uuidDir)
+	if err != nil {
+		return ""
+	}
+
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		resolved = devicePath
+	}
+
+	for _, entry := range entries {
+		target, err := filepath.EvalSymlinks(filepath.Join(uuidDir, entry.Name()))
+		if err == nil && target == resolved {
+			return entry.Name()
+		}
+	}
+
+	return ""
+}
+
+// MakeOfflineDevice creates a registered device which could not be measured, recording why
+func MakeOfflineDevice(known Device, reason string) Device {
+	return Device{
+		DeviceID:      known.DeviceID,
+		MountPoint:    known.MountPoint,
+		DeviceSerial:  known.DeviceSerial,
+		UUID:          known.UUID,
+		Offline:       true,
+		OfflineReason: reason,
+	}
+}
+
+// IsMounted returns whether a partition is currently mounted at the given path
+func IsMounted(path string) (bool, error) {
+	parts, err := getParts(false)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get partitions: %v", err)
+	}
+
+	for _, part := range parts {
+		if part.Mountpoint == path {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
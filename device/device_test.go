@@ -2,6 +2,8 @@ package device
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/shirou/gopsutil/disk"
@@ -16,8 +18,17 @@ func TestReserveSpace(t *testing.T) {
 		123,
 		"/mount",
 		"123abc",
+		"",
 		available,
 		allocated,
+		200,
+		false,
+		"",
+		false,
+		"",
+		0,
+		0,
+		0,
 	}
 	dev.ReserveSpace(needed)
 	assert.Equal(t, 123, dev.DeviceID, "DeviceID persisted")
@@ -27,6 +38,48 @@ func TestReserveSpace(t *testing.T) {
 	assert.Equal(t, allocated+uint64(needed), dev.AllocatedSpace, "AllocatedSpace incremented")
 }
 
+func TestFreeSpace(t *testing.T) {
+	dev := Device{
+		123,
+		"/mount",
+		"123abc",
+		"",
+		100,
+		60,
+		200,
+		false,
+		"",
+		false,
+		"",
+		0,
+		0,
+		0,
+	}
+	dev.ReserveSpace(-50)
+	assert.Equal(t, uint64(10), dev.AllocatedSpace, "AllocatedSpace decremented")
+	assert.Equal(t, uint64(90), dev.RemainingSpace(), "Freed space is available again")
+}
+
+func TestReleaseSpace(t *testing.T) {
+	dev := Device{AvailableSpace: 100, AllocatedSpace: 60, TotalSpace: 200}
+	dev.ReleaseSpace(40)
+	assert.Equal(t, uint64(20), dev.AllocatedSpace, "Reserved space released first")
+	assert.Equal(t, uint64(100), dev.AvailableSpace, "AvailableSpace unchanged while reservations cover it")
+
+	dev.ReleaseSpace(50)
+	assert.Equal(t, uint64(0), dev.AllocatedSpace, "Reservations exhausted")
+	assert.Equal(t, uint64(130), dev.AvailableSpace, "Remainder made available")
+	assert.Equal(t, uint64(130), dev.RemainingSpace(), "Every released byte remaining")
+}
+
+func TestFillPercent(t *testing.T) {
+	dev := Device{AvailableSpace: 100, AllocatedSpace: 50, TotalSpace: 200}
+	assert.Equal(t, float64(75), dev.FillPercent(), "Used and reserved space counted")
+
+	dev = Device{}
+	assert.Equal(t, float64(0), dev.FillPercent(), "Unknown size is empty")
+}
+
 func makeTestParts(resultCount int, err string) func(bool) ([]disk.PartitionStat, error) {
 	return func(all bool) ([]disk.PartitionStat, error) {
 		var parts []disk.PartitionStat = make([]disk.PartitionStat, resultCount)
@@ -101,6 +154,7 @@ func TestMakeDeviceNoUsage(t *testing.T) {
 func TestMakeDeviceGetsSerial(t *testing.T) {
 	realParts := getParts
 	realUsage := getUsage
+	realBlock := getBlockSize
 	realSerial := getSerial
 
 	getParts = makeTestParts(2, "")
@@ -108,21 +162,26 @@ func TestMakeDeviceGetsSerial(t *testing.T) {
 	getSerial = func(path string) string {
 		return "a-very-real-serial"
 	}
+	getBlockSize = func(_ string) (uint64, error) { return 4096, nil }
 	defer func() {
 		getParts = realParts
 		getUsage = realUsage
+		getBlockSize = realBlock
 		getSerial = realSerial
 	}()
 
 	dev, err := MakeDevice(123, "/mnt/1", "")
 	assert.Nil(t, err, "No error thrown when serial auto-detected")
 	assert.Equal(t, "a-very-real-serial", dev.DeviceSerial, "Serial provided")
+	assert.Equal(t, uint64(123), dev.AvailableSpace, "Free space recorded")
+	assert.Equal(t, uint64(246), dev.TotalSpace, "Total space recorded")
 }
 
 // Pass in serial number gets passed through
 func TestMakeDeviceWithSerial(t *testing.T) {
 	realParts := getParts
 	realUsage := getUsage
+	realBlock := getBlockSize
 	realSerial := getSerial
 
 	getParts = makeTestParts(2, "")
@@ -132,9 +191,11 @@ func TestMakeDeviceWithSerial(t *testing.T) {
 		called = true
 		return "a-very-real-serial"
 	}
+	getBlockSize = func(_ string) (uint64, error) { return 4096, nil }
 	defer func() {
 		getParts = realParts
 		getUsage = realUsage
+		getBlockSize = realBlock
 		getSerial = realSerial
 	}()
 
@@ -160,3 +221,225 @@ func TestMakeDevicePartitionNotFound(t *testing.T) {
 	assert.EqualErrorf(t, err, "No device mounted on /mnt/2", "No mounted device error returned")
 	assert.Equal(t, Device{}, dev, "Device empty if mountpoint not matched")
 }
+
+// Check mount detection
+func TestIsMounted(t *testing.T) {
+	realParts := getParts
+	defer func() { getParts = realParts }()
+
+	getParts = makeTestParts(2, "")
+	mounted, err := IsMounted("/mnt/1")
+	assert.Nil(t, err, "No error checking mount")
+	assert.True(t, mounted, "Mounted path found")
+
+	mounted, err = IsMounted("/mnt/2")
+	assert.Nil(t, err, "No error checking mount")
+	assert.False(t, mounted, "Unmounted path not found")
+
+	getParts = makeTestParts(0, "access denied")
+	_, err = IsMounted("/mnt/1")
+	assert.EqualErrorf(t, err, "Failed to get partitions: access denied", "Partition error returned")
+}
+
+// Check registered devices are found by serial, then UUID, wherever they are now mounted
+func TestLocateDevice(t *testing.T) {
+	realParts := getParts
+	realUsage := getUsage
+	realBlock := getBlockSize
+	realSerial := getSerial
+	realUUID := getUUID
+	realProbe := probeMount
+
+	getParts = makeTestParts(3, "")
+	getUsage = makeTestUsage("")
+	serials := map[string]string{"/dev/sda0": "", "/dev/sda1": "disk-b", "/dev/sda2": "disk-b"}
+	getSerial = func(path string) string {
+		return serials[path]
+	}
+	getUUID = func(path string) string {
+		return "uuid-" + path[len(path)-1:]
+	}
+	probeMount = func(_ string) error { return nil }
+	getBlockSize = func(_ string) (uint64, error) { return 4096, nil }
+	defer func() {
+		getParts = realParts
+		getUsage = realUsage
+		getBlockSize = realBlock
+		getSerial = realSerial
+		getUUID = realUUID
+		probeMount = realProbe
+	}()
+
+	dev, err := LocateDevice(Device{DeviceID: 1, MountPoint: "/media/disk", DeviceSerial: "disk-b"})
+	assert.Nil(t, err, "No error locating by serial")
+	assert.Equal(t, Device{1, "/mnt/1", "disk-b", "uuid-1", 123, 0, 246, false, "", false, "", 4096, 2000, 1000}, dev, "Device measured at new mount point")
+
+	dev, _ = LocateDevice(Device{DeviceID: 1, MountPoint: "/mnt/2", DeviceSerial: "disk-b"})
+	assert.Equal(t, "/mnt/2", dev.MountPoint, "Known mount point preferred among partitions with the serial")
+
+	dev, err = LocateDevice(Device{DeviceID: 2, MountPoint: "/media/other", DeviceSerial: "gone", UUID: "uuid-0"})
+	assert.Nil(t, err, "No error locating by UUID")
+	assert.Equal(t, "/mnt/0", dev.MountPoint, "Device found by UUID when serial not found")
+	assert.Equal(t, "gone", dev.DeviceSerial, "Registered serial kept")
+
+	dev, err = LocateDevice(Device{DeviceID: 3, MountPoint: "/mnt/0"})
+	assert.Nil(t, err, "No error locating by mount point")
+	assert.Equal(t, "uuid-0", dev.UUID, "Mount point used without serial or UUID")
+
+	_, err = LocateDevice(Device{DeviceID: 4, MountPoint: "/mnt/0", DeviceSerial: "gone", UUID: "uuid-9"})
+	assert.EqualError(t, err, `No device with serial "gone" or UUID "uuid-9" is mounted`, "Other drive at known mount point not accepted")
+}
+
+// Check UUIDs are read from the links to each partition
+func TestPartitionUUID(t *testing.T) {
+	realDir := uuidDir
+	uuidDir = t.TempDir()
+	defer func() { uuidDir = realDir }()
+
+	node := filepath.Join(t.TempDir(), "sdb1")
+	if err := os.WriteFile(node, nil, 0600); err != nil {
+		panic(err)
+	}
+	if err := os.Symlink(node, filepath.Join(uuidDir, "1234-ABCD")); err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, "1234-ABCD", partitionUUID(node), "UUID found for partition")
+	assert.Equal(t, "", partitionUUID("/dev/missing"), "No UUID for unknown partition")
+}
+
+// Check devices are marked read-only when mounted so, or when the write probe fails
+func TestMakeDeviceReadOnly(t *testing.T) {
+	realParts := getParts
+	realUsage := getUsage
+	realBlock := getBlockSize
+	realProbe := probeMount
+
+	getUsage = makeTestUsage("")
+	probed := ""
+	probeMount = func(mountPoint string) error {
+		probed = mountPoint
+		if mountPoint == "/mnt/1" {
+			return fmt.Errorf("Failed to create probe file: permission denied")
+		}
+
+		return nil
+	}
+	getBlockSize = func(_ string) (uint64, error) { return 4096, nil }
+	defer func() {
+		getParts = realParts
+		getUsage = realUsage
+		getBlockSize = realBlock
+		probeMount = realProbe
+	}()
+
+	getParts = makeTestParts(2, "")
+	dev, err := MakeDevice(1, "/mnt/0", "serial")
+	assert.Nil(t, err, "No error making writable device")
+	assert.Equal(t, "/mnt/0", probed, "Mount probed")
+	assert.False(t, dev.ReadOnly, "Device writable")
+	assert.True(t, dev.Writable(), "Files can be stored")
+
+	dev, err = MakeDevice(2, "/mnt/1", "serial")
+	assert.Nil(t, err, "Failed probe is recorded rather than returned")
+	assert.True(t, dev.ReadOnly, "Device read-only")
+	assert.Equal(t, "Failed to create probe file: permission denied", dev.ReadOnlyReason, "Probe failure recorded")
+	assert.False(t, dev.Writable(), "Files cannot be stored")
+
+	getParts = func(_ bool) ([]disk.PartitionStat, error) {
+		return []disk.PartitionStat{{Mountpoint: "/mnt/ro", Device: "/dev/sdb1", Opts: "ro,relatime"}}, nil
+	}
+	probed = ""
+	dev, _ = MakeDevice(3, "/mnt/ro", "serial")
+	assert.True(t, dev.ReadOnly, "Read-only mount detected")
+	assert.Equal(t, ErrReadOnly.Error(), dev.ReadOnlyReason, "Read-only mount reason recorded")
+	assert.Equal(t, "", probed, "Read-only mount not probed")
+}
+
+// Check the write probe leaves nothing behind, and reports where it fails
+func TestProbeWrite(t *testing.T) {
+	mount := t.TempDir()
+	assert.Nil(t, probeWrite(mount), "Probe succeeds on writable directory")
+
+	entries, err := os.ReadDir(mount)
+	assert.Nil(t, err, "Mount readable")
+	assert.Empty(t, entries, "Probe file removed")
+
+	err = probeWrite(filepath.Join(mount, "missing"))
+	assert.Contains(t, err.Error(), "Failed to create probe file", "Missing mount fails probe")
+}
+
+// Check usage is re-read only while the device is still mounted
+func TestRemeasure(t *testing.T) {
+	realParts := getParts
+	realUsage := getUsage
+
+	getParts = makeTestParts(2, "")
+	getUsage = makeTestUsage("")
+	defer func() {
+		getParts = realParts
+		getUsage = realUsage
+	}()
+
+	dev := Device{MountPoint: "/mnt/1", AvailableSpace: 50, AllocatedSpace: 5, TotalSpace: 200}
+	assert.Nil(t, dev.Remeasure(), "No error remeasuring")
+	assert.Equal(t, uint64(123), dev.AvailableSpace, "Free space updated")
+	assert.Equal(t, uint64(246), dev.TotalSpace, "Total space updated")
+	assert.Equal(t, uint64(5), dev.AllocatedSpace, "Reservations kept")
+	assert.Equal(t, uint64(1000), dev.FreeInodes, "Free inodes updated")
+
+	dev = Device{MountPoint: "/mnt/2", AvailableSpace: 50}
+	assert.EqualError(t, dev.Remeasure(), "No device mounted on /mnt/2", "Unmounted device not measured")
+	assert.Equal(t, uint64(50), dev.AvailableSpace, "Free space unchanged")
+
+	getUsage = makeTestUsage("access denied")
+	dev = Device{MountPoint: "/mnt/0"}
+	assert.EqualError(t, dev.Remeasure(), "Failed to get disk usage: access denied", "Usage error returned")
+}
+
+// Check files are rounded up to whole blocks plus their metadata, when the block size is known
+func TestFootprint(t *testing.T) {
+	dev := Device{}
+	assert.Equal(t, uint64(100), dev.Footprint(100), "Raw size used without block size")
+
+	dev.BlockSize = 4096
+	assert.Equal(t, uint64(4096), dev.Footprint(0), "Empty file needs its metadata")
+	assert.Equal(t, uint64(8192), dev.Footprint(1), "Partial block rounded up")
+	assert.Equal(t, uint64(8192), dev.Footprint(4096), "Whole block not rounded")
+	assert.Equal(t, uint64(12288), dev.Footprint(4097), "Next block started")
+}
+
+// Check files only fit with room for their footprint, and an inode if the filesystem limits them
+func TestReserveFile(t *testing.T) {
+	dev := Device{AvailableSpace: 10000, BlockSize: 4096, TotalInodes: 10, FreeInodes: 1}
+	assert.True(t, dev.Fits(1000), "Footprint fits")
+	assert.False(t, dev.Fits(6000), "Footprint of 12 KiB does not fit, though the bytes would")
+
+	dev.ReserveFile(1000)
+	assert.Equal(t, uint64(8192), dev.AllocatedSpace, "Footprint reserved")
+	assert.Equal(t, uint64(0), dev.FreeInodes, "Inode reserved")
+	assert.False(t, dev.Fits(0), "No inode left")
+
+	dev.UnreserveFile(1000)
+	assert.Equal(t, uint64(0), dev.AllocatedSpace, "Footprint unreserved")
+	assert.Equal(t, uint64(1), dev.FreeInodes, "Inode unreserved")
+
+	dev.ReleaseSpace(1)
+	assert.Equal(t, uint64(18192), dev.AvailableSpace, "Deleted file's footprint freed")
+	assert.Equal(t, uint64(2), dev.FreeInodes, "Deleted file's inode freed")
+
+	dev = Device{AvailableSpace: 100}
+	dev.ReserveFile(10)
+	assert.True(t, dev.Fits(50), "Filesystems without inode limits always have room for files")
+	assert.Equal(t, uint64(0), dev.FreeInodes, "Unlimited inodes not counted")
+}
+
+// Check the block size is read from the filesystem
+func TestBlockSize(t *testing.T) {
+	size, err := blockSize(t.TempDir())
+	assert.Nil(t, err, "No error getting block size")
+	assert.Greater(t, size, uint64(0), "Block size found")
+
+	_, err = blockSize("/nonexistent/mount")
+	assert.NotNil(t, err, "Missing path fails")
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// addDeviceRequest is the body of a request to add a device
+type addDeviceRequest struct {
+	MountPoint   string `json:"mountPoint"`
+	DeviceSerial string `json:"deviceSerial"`
+}
+
+// spaceRequest is the body of a request to reserve space
+// Mount point is optional, in which case any device with room is used
+type spaceRequest struct {
+	MountPoint string `json:"mountPoint"`
+	Space      int64  `json:"space"`
+	// Seconds until the reservation is reclaimed if neither freed nor committed, or 0 to hold it until then
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// reservationRequest is the body of a request to free or commit a reservation
+type reservationRequest struct {
+	ReservationID int `json:"reservationId"`
+}
+
+// rebalanceRequest is the body of a request to even out how full the devices are
+type rebalanceRequest struct {
+	Band   float64 `json:"band"`
+	DryRun bool    `json:"dryRun"`
+}
+
+// moveRequest is the body of a request to move backed up files onto a device
+type moveRequest struct {
+	Path       string `json:"path"`
+	MountPoint string `json:"mountPoint"`
+}
+
+// moveView is a file moved, or to be moved, between devices
+type moveView struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// movePlanView is the files moved between devices, or those which would be if a dry run
+type movePlanView struct {
+	DryRun bool       `json:"dryRun"`
+	Moves  []moveView `json:"moves"`
+	Bytes  int64      `json:"bytes"`
+	// Fill percentage of each device after the moves, by mount point
+	Fill map[string]float64 `json:"fill"`
+}
+
+// handleDevices lists, adds or removes devices
+func (server *WebServer) handleDevices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		devices, err := server.devMan.ListDevices()
+		if err != nil {
+			writeDeviceError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, deviceViews(devices))
+	case http.MethodPost:
+		var request addDeviceRequest
+		if err := readJSON(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		added, err := server.devMan.AddDevice(request.MountPoint, request.DeviceSerial)
+		if err != nil {
+			// Anything not categorized is a problem with the device itself, such as it not being mounted
+			writeDeviceError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, makeDeviceView(added))
+	case http.MethodDelete:
+		mountPoint := r.URL.Query().Get("mountPoint")
+		if err := server.devMan.RemoveDevice(mountPoint); err != nil {
+			writeDeviceError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]string{"removed": mountPoint})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "GET, POST or DELETE required")
+	}
+}
+
+// handleReserve reserves space, returning the reservation and the device it was made on
+func (server *WebServer) handleReserve(w http.ResponseWriter, r *http.Request) {
+	request, ok := readSpaceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	mountPoint, reservation, err := server.devMan.ReserveSpace(
+		request.Space,
+		request.MountPoint,
+		0,
+		time.Duration(request.ExpiresIn)*time.Second,
+	)
+	if err != nil {
+		writeDeviceError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	dev, err := server.findDeviceView(mountPoint)
+	if err != nil {
+		writeDeviceError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, makeReservationView(reservation, dev))
+}
+
+// handleFree frees the space held by a reservation, for a file which was not stored
+func (server *WebServer) handleFree(w http.ResponseWriter, r *http.Request) {
+	server.endReservation(w, r, server.devMan.FreeSpace, "freed")
+}
+
+// handleCommit ends a reservation once its file is stored, keeping its space in use
+func (server *WebServer) handleCommit(w http.ResponseWriter, r *http.Request) {
+	server.endReservation(w, r, server.devMan.CommitSpace, "committed")
+}
+
+// endReservation frees or commits the requested reservation, returning its ID under the given key
+func (server *WebServer) endReservation(w http.ResponseWriter, r *http.Request, end func(int) error, key string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "POST required")
+		return
+	}
+
+	var request reservationRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.ReservationID <= 0 {
+		writeError(w, http.StatusBadRequest, "Reservation ID required")
+		return
+	}
+
+	if err := end(request.ReservationID); err != nil {
+		writeDeviceError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{key: request.ReservationID})
+}
+
+// handleRebalance moves files between devices to even out their fill, or only plans the moves if a dry run
+func (server *WebServer) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "POST required")
+		return
+	}
+
+	var request rebalanceRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	plan, err := server.devMan.Rebalance(request.Band, request.DryRun)
+	if err != nil {
+		writeDeviceError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, makeMovePlanView(plan, request.DryRun))
+}
+
+// handleMove moves the backed up files at or beneath a path onto the requested device
+func (server *WebServer) handleMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "POST required")
+		return
+	}
+
+	var request moveRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	plan, err := server.devMan.MoveFiles(request.Path, request.MountPoint)
+	if err != nil {
+		writeDeviceError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, makeMovePlanView(plan, false))
+}
+
+// makeMovePlanView converts moves planned or made for display
+func makeMovePlanView(plan MovePlan, dryRun bool) movePlanView {
+	view := movePlanView{DryRun: dryRun, Moves: make([]moveView, 0, len(plan.Moves)), Bytes: plan.Bytes, Fill: plan.Fill}
+	for _, move := range plan.Moves {
+		view.Moves = append(view.Moves, moveView{Path: move.File.SourcePath, Size: move.File.Size, From: move.From, To: move.To})
+	}
+
+	return view
+}
+
+// findDeviceView returns the current state of the device at the given mount point
+func (server *WebServer) findDeviceView(mountPoint string) (deviceView, error) {
+	devices, err := server.devMan.ListDevices()
+	if err != nil {
+		return deviceView{}, err
+	}
+
+	for _, dev := range devices {
+		if dev.MountPoint == mountPoint {
+			return makeDeviceView(dev), nil
+		}
+	}
+
+	return deviceView{}, ErrNoSuchMount
+}
+
+// readSpaceRequest parses a request to reserve space, sending an error response if invalid
+func readSpaceRequest(w http.ResponseWriter, r *http.Request) (spaceRequest, bool) {
+	var request spaceRequest
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "POST required")
+		return request, false
+	}
+
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return request, false
+	}
+	if request.Space <= 0 {
+		writeError(w, http.StatusBadRequest, "Space must be positive")
+		return request, false
+	}
+	if request.ExpiresIn < 0 {
+		writeError(w, http.StatusBadRequest, "Expiry cannot be negative")
+		return request, false
+	}
+
+	return request, true
+}
+
+// readJSON decodes the request body into value, rejecting unknown fields
+func readJSON(r *http.Request, value interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		return fmt.Errorf("Invalid request body: %v", err)
+	}
+
+	return nil
+}
+
+// deviceErrorStatus returns the HTTP status for errors from the device manager, or fallback if not recognized
+func deviceErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrMountRequired), errors.Is(err, ErrInvalidBand):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNoSuchMount), errors.Is(err, ErrNoFiles), errors.Is(err, ErrNoSuchReservation):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDeviceExists), errors.Is(err, ErrDeviceReadOnly), errors.Is(err, ErrDeviceInUse):
+		return http.StatusConflict
+	case errors.Is(err, ErrNoDevices), errors.Is(err, ErrDeviceFull), errors.Is(err, ErrNoSpace),
+		errors.Is(err, ErrEvacuateSpace):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrDeviceOffline):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrCommandPanicked):
+		return http.StatusInternalServerError
+	default:
+		return fallback
+	}
+}
+
+// writeDeviceError sends an error from the device manager with its matching status
+func writeDeviceError(w http.ResponseWriter, err error, fallback int) {
+	writeError(w, deviceErrorStatus(err, fallback), err.Error())
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// sendTest performs a request with a JSON body against the server, decoding the JSON response into body
+func sendTest(t *testing.T, server *WebServer, method string, url string, request string, body interface{}) int {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, strings.NewReader(request))
+	req.Host = "127.0.0.1:8080"
+	req.Header.Set("Content-Type", "application/json")
+	server.Handler().ServeHTTP(recorder, req)
+
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"), "JSON returned")
+	if err := json.NewDecoder(recorder.Body).Decode(body); err != nil {
+		panic(err)
+	}
+
+	return recorder.Code
+}
+
+// Check devices are listed with their space usage
+func TestDeviceAPIList(t *testing.T) {
+	server := makeTestWebServer(t, []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC123", AvailableSpace: 100, AllocatedSpace: 40},
+	})
+
+	var devices []deviceView
+	assert.Equal(t, http.StatusOK, serveTest(t, server, http.MethodGet, "/api/devices", &devices), "Devices listed")
+	assert.Equal(
+		t,
+		[]deviceView{{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC123", AvailableSpace: 100, AllocatedSpace: 40, RemainingSpace: 60}},
+		devices,
+		"Device details returned",
+	)
+
+	var failed map[string]string
+	assert.Equal(
+		t,
+		http.StatusMethodNotAllowed,
+		serveTest(t, server, http.MethodPut, "/api/devices", &failed),
+		"Unsupported method rejected",
+	)
+}
+
+// Check adding a device reports each failure with a matching status
+func TestDeviceAPIAdd(t *testing.T) {
+	realAdd := addDevice
+
+	addDevice = func(command DeviceCommand, _ *sql.DB) (device.Device, error) {
+		if command.mountPoint == "/mnt/missing" {
+			return device.Device{}, fmt.Errorf("No device mounted on %s", command.mountPoint)
+		}
+
+		return device.Device{DeviceID: 2, MountPoint: command.mountPoint, DeviceSerial: command.serial, AvailableSpace: 50}, nil
+	}
+	defer func() { addDevice = realAdd }()
+
+	server := makeTestWebServer(t, []*device.Device{{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC123"}})
+
+	var added deviceView
+	assert.Equal(
+		t,
+		http.StatusCreated,
+		sendTest(t, server, http.MethodPost, "/api/devices", `{"mountPoint": "/mnt/2", "deviceSerial": "DEF456"}`, &added),
+		"Device created",
+	)
+	assert.Equal(t, deviceView{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "DEF456", AvailableSpace: 50, RemainingSpace: 50}, added, "Added device returned")
+
+	failures := []struct {
+		request string
+		status  int
+		message string
+	}{
+		{`{"mountPoint": ""}`, http.StatusBadRequest, "Mountpoint required"},
+		{`{"mountPoint": "/mnt/1"}`, http.StatusConflict, "Device already added as 1"},
+		{`{"mountPoint": "/mnt/missing"}`, http.StatusUnprocessableEntity, "No device mounted on /mnt/missing"},
+		{`{"mount": "/mnt/3"}`, http.StatusBadRequest, ""},
+		{`not json`, http.StatusBadRequest, ""},
+	}
+	for _, failure := range failures {
+		var failed map[string]string
+		assert.Equal(
+			t,
+			failure.status,
+			sendTest(t, server, http.MethodPost, "/api/devices", failure.request, &failed),
+			"Status for %s",
+			failure.request,
+		)
+		if len(failure.message) > 0 {
+			assert.Equal(t, failure.message, failed["error"], "Error for %s", failure.request)
+		}
+	}
+}
+
+// Check space is reserved and freed or committed by reservation, with failures reported by status
+func TestDeviceAPISpace(t *testing.T) {
+	server := makeTestWebServer(t, []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 200},
+	})
+
+	var reserved reservationView
+	assert.Equal(
+		t,
+		http.StatusOK,
+		sendTest(t, server, http.MethodPost, "/api/devices/reserve", `{"space": 150, "expiresIn": 60}`, &reserved),
+		"Space reserved",
+	)
+	assert.Greater(t, reserved.ReservationID, 0, "Reservation identified")
+	assert.Equal(t, int64(150), reserved.Size, "Size reserved")
+	assert.WithinDuration(t, reserved.Created.Add(time.Minute), *reserved.Expires, time.Millisecond, "Expiry set")
+	assert.Equal(t, "/mnt/2", reserved.Device.MountPoint, "Device with room used")
+	assert.Equal(t, uint64(50), reserved.Device.RemainingSpace, "Reservation reflected")
+
+	var freed map[string]int
+	request := fmt.Sprintf(`{"reservationId": %d}`, reserved.ReservationID)
+	assert.Equal(
+		t,
+		http.StatusOK,
+		sendTest(t, server, http.MethodPost, "/api/devices/free", request, &freed),
+		"Space freed",
+	)
+	assert.Equal(t, reserved.ReservationID, freed["freed"], "Freed reservation returned")
+
+	var committed map[string]int
+	reserved = reservationView{}
+	sendTest(t, server, http.MethodPost, "/api/devices/reserve", `{"space": 150}`, &reserved)
+	assert.Nil(t, reserved.Expires, "No expiry unless requested")
+	assert.Equal(t, uint64(50), reserved.Device.RemainingSpace, "Freed space reserved again")
+	request = fmt.Sprintf(`{"reservationId": %d}`, reserved.ReservationID)
+	assert.Equal(
+		t,
+		http.StatusOK,
+		sendTest(t, server, http.MethodPost, "/api/devices/commit", request, &committed),
+		"Space committed",
+	)
+	assert.Equal(t, reserved.ReservationID, committed["committed"], "Committed reservation returned")
+
+	failures := []struct {
+		url     string
+		request string
+		status  int
+	}{
+		{"/api/devices/reserve", `{"space": 500}`, http.StatusInsufficientStorage},
+		{"/api/devices/reserve", `{"mountPoint": "/mnt/1", "space": 500}`, http.StatusInsufficientStorage},
+		{"/api/devices/reserve", `{"mountPoint": "/mnt/missing", "space": 5}`, http.StatusNotFound},
+		{"/api/devices/reserve", `{"space": -5}`, http.StatusBadRequest},
+		{"/api/devices/reserve", `{"space": 5, "expiresIn": -1}`, http.StatusBadRequest},
+		{"/api/devices/free", `{"space": 5}`, http.StatusBadRequest},
+		{"/api/devices/free", `{}`, http.StatusBadRequest},
+		{"/api/devices/free", request, http.StatusNotFound},
+		{"/api/devices/commit", request, http.StatusNotFound},
+	}
+	for _, failure := range failures {
+		var failed map[string]string
+		assert.Equal(
+			t,
+			failure.status,
+			sendTest(t, server, http.MethodPost, failure.url, failure.request, &failed),
+			"Status for %s to %s",
+			failure.request,
+			failure.url,
+		)
+		assert.NotEmpty(t, failed["error"], "Error returned for %s to %s", failure.request, failure.url)
+	}
+
+	var failed map[string]string
+	assert.Equal(
+		t,
+		http.StatusMethodNotAllowed,
+		serveTest(t, server, http.MethodGet, "/api/devices/reserve", &failed),
+		"Reserving requires POST",
+	)
+	assert.Equal(
+		t,
+		http.StatusMethodNotAllowed,
+		serveTest(t, server, http.MethodGet, "/api/devices/free", &failed),
+		"Freeing requires POST",
+	)
+}
+
+// Check device manager errors map to statuses, including when wrapped
+func TestDeviceErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, deviceErrorStatus(ErrNoSuchMount, http.StatusTeapot), "Sentinel mapped")
+	assert.Equal(t, http.StatusConflict, deviceErrorStatus(fmt.Errorf("%w as 1", ErrDeviceExists), http.StatusTeapot), "Wrapped error mapped")
+	assert.Equal(t, http.StatusInternalServerError, deviceErrorStatus(ErrCommandPanicked, http.StatusTeapot), "Panic is a server error")
+	assert.Equal(t, http.StatusTeapot, deviceErrorStatus(fmt.Errorf("Other"), http.StatusTeapot), "Fallback used")
+}
+
+// Check a dry run rebalance returns its plan, without moving anything
+func TestDeviceAPIRebalance(t *testing.T) {
+	realFilter := filterDBFiles
+	realCopy := copyMove
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return []mydb.File{{FileID: 1, SourcePath: "/home/a.txt", DeviceID: 1, Size: 40}}, nil
+	}
+	moved := false
+	copyMove = func(_ FileMove) error {
+		moved = true
+		return nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		copyMove = realCopy
+	}()
+
+	server := makeTestWebServer(t, []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 20, TotalSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 100, TotalSpace: 100},
+	})
+
+	var plan movePlanView
+	assert.Equal(
+		t,
+		http.StatusOK,
+		sendTest(t, server, http.MethodPost, "/api/devices/rebalance", `{"band": 5, "dryRun": true}`, &plan),
+		"Rebalance planned",
+	)
+	assert.Equal(
+		t,
+		movePlanView{
+			DryRun: true,
+			Moves:  []moveView{{Path: "/home/a.txt", Size: 40, From: "/mnt/1", To: "/mnt/2"}},
+			Bytes:  40,
+			Fill:   map[string]float64{"/mnt/1": 40, "/mnt/2": 40},
+		},
+		plan,
+		"Plan returned",
+	)
+	assert.False(t, moved, "Nothing moved")
+
+	var failed map[string]string
+	assert.Equal(
+		t,
+		http.StatusBadRequest,
+		sendTest(t, server, http.MethodPost, "/api/devices/rebalance", `{"band": 0}`, &failed),
+		"Band required",
+	)
+	assert.Equal(t, ErrInvalidBand.Error(), failed["error"], "Band error returned")
+}
+
+// Check moving files onto a device reports missing devices and files as not found
+func TestDeviceAPIMove(t *testing.T) {
+	realFilter := filterDBFiles
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return nil, nil
+	}
+	defer func() { filterDBFiles = realFilter }()
+
+	server := makeTestWebServer(t, []*device.Device{{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100}})
+
+	var failed map[string]string
+	assert.Equal(
+		t,
+		http.StatusNotFound,
+		sendTest(t, server, http.MethodPost, "/api/devices/move", `{"path": "/home", "mountPoint": "/mnt/2"}`, &failed),
+		"Unknown device not found",
+	)
+	assert.Equal(
+		t,
+		http.StatusNotFound,
+		sendTest(t, server, http.MethodPost, "/api/devices/move", `{"path": "/home", "mountPoint": "/mnt/1"}`, &failed),
+		"Files not found",
+	)
+	assert.Equal(t, "No backed up files found for /home", failed["error"], "Missing path returned")
+	assert.Equal(
+		t,
+		http.StatusMethodNotAllowed,
+		serveTest(t, server, http.MethodGet, "/api/devices/move", &failed),
+		"Moving requires POST",
+	)
+}
@@ -3,15 +3,19 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/logging"
 	"github.com/ammesonb/dispersed-backup/mydb"
 )
 
 var getDevices = mydb.GetDevices
 var makeDevice = device.MakeDevice
 var addDBDevice = mydb.AddDevice
+var removeDBDevice = mydb.RemoveDevice
 
 // DevCommandAddDevice instructs the manager to add a new device by mount
 const DevCommandAddDevice int = 1
@@ -19,9 +23,73 @@ const DevCommandAddDevice int = 1
 // DevCommandReserveSpace instructs the manager to reserve an amount of space, optionally on a specific mount
 const DevCommandReserveSpace int = 2
 
-// DevCommandFreeSpace instructs the manager to free an amount of space on a given mount
+// DevCommandFreeSpace instructs the manager to release the space held by a reservation, by its ID
 const DevCommandFreeSpace int = 3
 
+// DevCommandListDevices instructs the manager to return a snapshot of every device
+const DevCommandListDevices int = 4
+
+// ErrMountRequired is returned for commands which must name a mount point
+var ErrMountRequired = fmt.Errorf("Mountpoint required")
+
+// ErrNoSuchMount is returned when a command names a mount point with no device
+var ErrNoSuchMount = fmt.Errorf("No such mountpoint")
+
+// ErrDeviceExists is returned when adding a device whose mount point or serial is already known
+var ErrDeviceExists = fmt.Errorf("Device already added")
+
+// ErrNoDevices is returned when reserving space before any device is added
+var ErrNoDevices = fmt.Errorf("No devices available -- add one first")
+
+// ErrDeviceFull is returned when the requested device has too little space for a reservation
+var ErrDeviceFull = fmt.Errorf("Insufficient space on requested device")
+
+// ErrNoSpace is returned when no device has enough space for a reservation
+var ErrNoSpace = fmt.Errorf("No device with sufficient space -- add another or make space")
+
+// ErrDeviceOffline is returned when a command needs a device which is registered but could not be measured
+var ErrDeviceOffline = fmt.Errorf("Device offline")
+
+// ErrDeviceReadOnly is returned when a command needs to store files on a device which failed its write probe
+var ErrDeviceReadOnly = fmt.Errorf("Device is not writable")
+
+// ErrDeviceInUse is returned when removing a device which still holds files, or has space reserved for them
+var ErrDeviceInUse = fmt.Errorf("Device still in use")
+
+// removingReason is why a device whose files are being moved off so it can be removed is read-only
+const removingReason = "Being removed"
+
+// ErrCommandPanicked is returned when the manager recovered from a panic while handling a command
+var ErrCommandPanicked = fmt.Errorf("Panic during execution")
+
+// DevCommandRemoveDevice instructs the manager to remove the device at a mount, once its files are moved to the others
+const DevCommandRemoveDevice int = 5
+
+// DevCommandRebalance instructs the manager to plan moving files between devices until they are similarly full
+const DevCommandRebalance int = 6
+
+// DevCommandMoveFiles instructs the manager to plan moving the files at or beneath a path onto the device at a mount
+const DevCommandMoveFiles int = 7
+
+// DevCommandCommitSpace instructs the manager that the file a reservation was made for is stored, ending the reservation
+const DevCommandCommitSpace int = 8
+
+// DevCommandReserveCopies instructs the manager to reserve space for each copy of a file, on different drives
+const DevCommandReserveCopies int = 9
+
+// DevCommandRenewSpace instructs the manager to push back the expiry of a reservation whose file is still being written
+const DevCommandRenewSpace int = 10
+
+// DevCommandPlanRemoval instructs the manager to plan moving the files off the device at a mount,
+// storing nothing new on it until it is removed or the removal is cancelled
+const DevCommandPlanRemoval int = 11
+
+// DevCommandCancelRemoval instructs the manager to store files on a device again, after it could not be emptied
+const DevCommandCancelRemoval int = 12
+
+// DevCommandFinishMove instructs the manager that a moved file is copied onto its new device, so it can be recorded there
+const DevCommandFinishMove int = 13
+
 // DeviceCommand contains information needed to execute a command
 type DeviceCommand struct {
 	// Command integer, see variables above
@@ -30,8 +98,22 @@ type DeviceCommand struct {
 	// Mountpoint may also be used to request storing a file on a specific mountpoint
 	mountPoint string
 	serial     string
-	// Space to allocate or free
-	space int64
+	// Space to allocate, for each of a number of copies when reserving copies
+	space  int64
+	copies int
+	// Devices not to reserve space on, by device ID, since they hold another copy of the file
+	avoid map[int]bool
+	// Reservation to free, commit or renew
+	reservationID int
+	// Job a reservation is made for, if any, and how long until it expires, or 0 to never expire
+	jobID  int
+	expiry time.Duration
+	// Backed up file, or folder containing them, to move
+	path string
+	// Percentage either side of the average fill each device should end up within when rebalancing
+	band float64
+	// File copied onto a new device, or being moved when reserving space for it
+	move FileMove
 }
 
 // DeviceResult contains details about the executed action
@@ -39,6 +121,12 @@ type DeviceResult struct {
 	success bool
 	message string
 	err     error
+	// Copies of the devices, for listing
+	devices []device.Device
+	// Moves planned or made when rebalancing
+	plan *MovePlan
+	// Reservations made when reserving space, one for each copy
+	reservations []mydb.Reservation
 }
 
 // DevMan contains the necessary components for interacting with the device manager goroutine
@@ -48,19 +136,210 @@ type DevMan struct {
 	lock     sync.Mutex
 }
 
+// execute sends a command to the manager and waits for its result
+// The lock ensures the result received is the one for this command
+func (devMan *DevMan) execute(command DeviceCommand) DeviceResult {
+	devMan.lock.Lock()
+	defer devMan.lock.Unlock()
+
+	devMan.commands <- command
+	return <-devMan.results
+}
+
+// AddDevice adds the device mounted at the given path, detecting the serial if not given
+func (devMan *DevMan) AddDevice(mountPoint string, serial string) (device.Device, error) {
+	result := devMan.execute(DeviceCommand{command: DevCommandAddDevice, mountPoint: mountPoint, serial: serial})
+	if !result.success {
+		return device.Device{}, result.err
+	}
+
+	return result.devices[0], nil
+}
+
+// RemoveDevice removes the device at the given mount point, after moving its files to the other devices
+// Nothing new is stored on the device while its files are moved, and it is kept if any cannot be
+func (devMan *DevMan) RemoveDevice(mountPoint string) error {
+	result := devMan.execute(DeviceCommand{command: DevCommandPlanRemoval, mountPoint: mountPoint})
+	if !result.success {
+		return result.err
+	}
+
+	if moved, err := devMan.makeMoves(*result.plan); err != nil {
+		devMan.execute(DeviceCommand{command: DevCommandCancelRemoval, mountPoint: mountPoint})
+		return fmt.Errorf("%v (%d of %d files moved, device kept)", err, moved, len(result.plan.Moves))
+	}
+
+	result = devMan.execute(DeviceCommand{command: DevCommandRemoveDevice, mountPoint: mountPoint})
+	if !result.success {
+		devMan.execute(DeviceCommand{command: DevCommandCancelRemoval, mountPoint: mountPoint})
+		return result.err
+	}
+
+	return nil
+}
+
+// ReserveSpace reserves space on a device, optionally on a specific mount, returning the mount point used and the reservation
+// The reservation is made for a job if its ID is not 0, and expires after the given duration unless it is 0
+func (devMan *DevMan) ReserveSpace(space int64, mountPoint string, jobID int, expiry time.Duration) (string, mydb.Reservation, error) {
+	result := devMan.execute(DeviceCommand{
+		command:    DevCommandReserveSpace,
+		mountPoint: mountPoint,
+		space:      space,
+		jobID:      jobID,
+		expiry:     expiry,
+	})
+	if !result.success {
+		return "", mydb.Reservation{}, result.err
+	}
+
+	return result.message, result.reservations[0], nil
+}
+
+// ReserveCopies reserves space for the given number of copies of a file, each on a different drive,
+// returning the mount point and reservation of each copy
+// Either space is reserved for every copy, or for none of them
+func (devMan *DevMan) ReserveCopies(space int64, copies int, jobID int, expiry time.Duration) ([]string, []mydb.Reservation, error) {
+	result := devMan.execute(DeviceCommand{
+		command: DevCommandReserveCopies,
+		space:   space,
+		copies:  copies,
+		jobID:   jobID,
+		expiry:  expiry,
+	})
+	if !result.success {
+		return nil, nil, result.err
+	}
+
+	mounts := make([]string, 0, len(result.devices))
+	for _, dev := range result.devices {
+		mounts = append(mounts, dev.MountPoint)
+	}
+
+	return mounts, result.reservations, nil
+}
+
+// ListDevices returns a snapshot of every device known to the manager
+func (devMan *DevMan) ListDevices() ([]device.Device, error) {
+	result := devMan.execute(DeviceCommand{command: DevCommandListDevices})
+	if !result.success {
+		return nil, result.err
+	}
+
+	return result.devices, nil
+}
+
+// FreeSpace releases the space held by a reservation, for a file which was not stored
+func (devMan *DevMan) FreeSpace(reservationID int) error {
+	result := devMan.execute(DeviceCommand{command: DevCommandFreeSpace, reservationID: reservationID})
+	if !result.success {
+		return result.err
+	}
+
+	return nil
+}
+
+// CommitSpace ends a reservation once its file is stored, keeping its space in use
+func (devMan *DevMan) CommitSpace(reservationID int) error {
+	result := devMan.execute(DeviceCommand{command: DevCommandCommitSpace, reservationID: reservationID})
+	if !result.success {
+		return result.err
+	}
+
+	return nil
+}
+
+// RenewSpace extends a reservation to expire after the given duration from now, while its file is still being written
+func (devMan *DevMan) RenewSpace(reservationID int, expiry time.Duration) error {
+	result := devMan.execute(DeviceCommand{command: DevCommandRenewSpace, reservationID: reservationID, expiry: expiry})
+	if !result.success {
+		return result.err
+	}
+
+	return nil
+}
+
+// Rebalance moves files until every device is within band percent of the average fill, returning the moves
+// A dry run only plans the moves, leaving every file where it is
+func (devMan *DevMan) Rebalance(band float64, dryRun bool) (MovePlan, error) {
+	result := devMan.execute(DeviceCommand{command: DevCommandRebalance, band: band})
+	if !result.success || dryRun {
+		return planOf(result)
+	}
+
+	if moved, err := devMan.makeMoves(*result.plan); err != nil {
+		return MovePlan{}, fmt.Errorf("%v (%d of %d files moved)", err, moved, len(result.plan.Moves))
+	}
+
+	return *result.plan, nil
+}
+
+// MoveFiles moves the backed up files at or beneath a path onto the device at the given mount point, returning the moves
+func (devMan *DevMan) MoveFiles(path string, mountPoint string) (MovePlan, error) {
+	result := devMan.execute(DeviceCommand{command: DevCommandMoveFiles, path: path, mountPoint: mountPoint})
+	if !result.success {
+		return MovePlan{}, result.err
+	}
+
+	if moved, err := devMan.makeMoves(*result.plan); err != nil {
+		return MovePlan{}, fmt.Errorf("%v (%d of %d files moved)", err, moved, len(result.plan.Moves))
+	}
+
+	devices, err := devMan.ListDevices()
+	if err != nil {
+		return MovePlan{}, err
+	}
+
+	return measuredFill(*result.plan, devices, mountPoint), nil
+}
+
+// planOf returns the plan from the result of planning moves, or its error
+func planOf(result DeviceResult) (MovePlan, error) {
+	if !result.success {
+		return MovePlan{}, result.err
+	}
+
+	return *result.plan, nil
+}
+
 // RunManager should be used in a goroutine, and is responsible for managing available device space for file backups
 // A MutEx should be used to maintain one-to-one command -> result behavior
 func RunManager(db *sql.DB, commands <-chan DeviceCommand, results chan<- DeviceResult) {
 	devices := getDevices(db)
+	restoreReservations(&devices, db)
+	for _, dev := range devices {
+		if dev.Offline {
+			logging.Default().Warnf("Device %d (serial %s) at %s is offline: %s", dev.DeviceID, dev.DeviceSerial, dev.MountPoint, dev.OfflineReason)
+		} else if dev.ReadOnly {
+			logging.Default().Warnf("Device %d (serial %s) at %s is read-only: %s", dev.DeviceID, dev.DeviceSerial, dev.MountPoint, dev.ReadOnlyReason)
+		}
+	}
 
 	go func() {
 		process(&devices, db, commands, results)
 	}()
 }
 
+// process handles commands until the channel is closed, reclaiming expired reservations and refreshing idle devices
+// between them every refresh interval
 func process(devices *[]*device.Device, db *sql.DB, commands <-chan DeviceCommand, results chan<- DeviceResult) {
-	for command := range commands {
-		handle(command, devices, db, commands, results)
+	var tick <-chan time.Time
+	if refreshInterval > 0 {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case command, ok := <-commands:
+			if !ok {
+				return
+			}
+			handle(command, devices, db, commands, results)
+		case <-tick:
+			reclaimReservations(devices, db)
+			refreshDevices(devices, db)
+		}
 	}
 }
 
@@ -68,44 +347,143 @@ var handle = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB,
 	defer func() {
 		if r := recover(); r != nil {
 			// Ignore errors, since need to keep processing requests
-			fmt.Println("Recovered. Error:\n", r)
+			logging.Default().Errorf("Recovered from panic handling device command %d: %v", command.command, r)
 			// Since only called when command received, ensure we inform the caller there was an error
-			results <- DeviceResult{false, "", fmt.Errorf("Panic during execution")}
+			results <- DeviceResult{false, "", ErrCommandPanicked, nil, nil, nil}
 		}
 	}()
 
 	switch command.command {
 	case DevCommandAddDevice:
 		if len(command.mountPoint) == 0 {
-			results <- DeviceResult{false, "", fmt.Errorf("Mountpoint required")}
+			results <- DeviceResult{false, "", ErrMountRequired, nil, nil, nil}
+			break
+		}
+		if existing := findDevice(devices, command.mountPoint, command.serial); existing != nil {
+			results <- DeviceResult{false, "", fmt.Errorf("%w as %d", ErrDeviceExists, existing.DeviceID), nil, nil, nil}
 			break
 		}
 
-		device, err := addDevice(command, db)
+		added, err := addDevice(command, db)
 		if err == nil {
-			*devices = append(*devices, &device)
-			results <- DeviceResult{true, "Device added successfully", nil}
+			*devices = append(*devices, &added)
+			results <- DeviceResult{true, "Device added successfully", nil, []device.Device{added}, nil, nil}
 		} else {
-			results <- DeviceResult{false, "", err}
+			results <- DeviceResult{false, "", err, nil, nil, nil}
 		}
 	case DevCommandReserveSpace:
-		mount, err := reserveSpace(command, devices)
+		reservation, mount, err := holdSpace(command, devices, db)
+		if err != nil {
+			results <- DeviceResult{false, "", err, nil, nil, nil}
+		} else {
+			results <- DeviceResult{true, mount, nil, nil, nil, []mydb.Reservation{reservation}}
+		}
+	case DevCommandReserveCopies:
+		held, reservations, err := holdCopies(command, devices, db)
 		if err != nil {
-			results <- DeviceResult{false, "", err}
+			results <- DeviceResult{false, "", err, nil, nil, nil}
 		} else {
-			results <- DeviceResult{true, mount, nil}
+			results <- DeviceResult{true, "Space reserved", nil, listDevices(&held), nil, reservations}
 		}
 	case DevCommandFreeSpace:
-		err := freeSpace(command, devices)
+		err := freeSpace(command, devices, db)
 		if err != nil {
-			results <- DeviceResult{false, "", err}
+			results <- DeviceResult{false, "", err, nil, nil, nil}
 		} else {
-			results <- DeviceResult{true, "Space freed", nil}
+			results <- DeviceResult{true, "Space freed", nil, nil, nil, nil}
 		}
+	case DevCommandCommitSpace:
+		if err := commitSpace(command, db); err != nil {
+			results <- DeviceResult{false, "", err, nil, nil, nil}
+		} else {
+			results <- DeviceResult{true, "Space committed", nil, nil, nil, nil}
+		}
+	case DevCommandRenewSpace:
+		if err := renewSpace(command, db); err != nil {
+			results <- DeviceResult{false, "", err, nil, nil, nil}
+		} else {
+			results <- DeviceResult{true, "Space renewed", nil, nil, nil, nil}
+		}
+	case DevCommandListDevices:
+		results <- DeviceResult{true, "", nil, listDevices(devices), nil, nil}
+	case DevCommandRemoveDevice, DevCommandPlanRemoval, DevCommandCancelRemoval,
+		DevCommandRebalance, DevCommandMoveFiles, DevCommandFinishMove:
+		results <- handleMove(command, devices, db)
 
 	default:
-		results <- DeviceResult{false, "", fmt.Errorf("%d at path %s is not a recognized command", command.command, command.mountPoint)}
+		results <- DeviceResult{false, "", fmt.Errorf("%d at path %s is not a recognized command", command.command, command.mountPoint), nil, nil, nil}
+	}
+}
+
+// handleMove handles the commands for planning and recording moves of files between devices, returning the result
+func handleMove(command DeviceCommand, devices *[]*device.Device, db *sql.DB) DeviceResult {
+	var err error
+	switch command.command {
+	case DevCommandRemoveDevice:
+		err = removeDevice(command, devices, db)
+	case DevCommandPlanRemoval:
+		return planResult(planRemoval(command, devices, db))
+	case DevCommandCancelRemoval:
+		cancelRemoval(command, devices)
+	case DevCommandRebalance:
+		return planResult(rebalance(command, devices, db))
+	case DevCommandMoveFiles:
+		return planResult(moveToDevice(command, devices, db))
+	case DevCommandFinishMove:
+		err = finishMove(command, devices, db)
+	}
+
+	if err != nil {
+		return DeviceResult{false, "", err, nil, nil, nil}
+	}
+
+	return DeviceResult{true, "Done", nil, nil, nil, nil}
+}
+
+// planResult returns the result of a command which plans moving files
+func planResult(plan MovePlan, err error) DeviceResult {
+	if err != nil {
+		return DeviceResult{false, "", err, nil, nil, nil}
+	}
+
+	return DeviceResult{true, fmt.Sprintf("%d files to move", len(plan.Moves)), nil, nil, &plan, nil}
+}
+
+// findDevice returns the device with the given mount point, or serial if not empty, or nil if there is none
+func findDevice(devices *[]*device.Device, mountPoint string, serial string) *device.Device {
+	for _, dev := range *devices {
+		if dev.MountPoint == mountPoint || (len(serial) > 0 && dev.DeviceSerial == serial) {
+			return dev
+		}
+	}
+
+	return nil
+}
+
+// sameDrive returns whether two devices are the same drive, by ID or by serial if it is known
+func sameDrive(dev *device.Device, other *device.Device) bool {
+	return dev.DeviceID == other.DeviceID || (len(dev.DeviceSerial) > 0 && dev.DeviceSerial == other.DeviceSerial)
+}
+
+// findDeviceByID returns the device with the given ID, or nil if there is none
+func findDeviceByID(devices *[]*device.Device, deviceID int) *device.Device {
+	for _, dev := range *devices {
+		if dev.DeviceID == deviceID {
+			return dev
+		}
+	}
+
+	return nil
+}
+
+// listDevices returns copies of the devices, so they can be read outside the manager
+func listDevices(devices *[]*device.Device) []device.Device {
+	listed := make([]device.Device, 0, len(*devices))
+	for _, dev := range *devices {
+		listed = append(listed, *dev)
 	}
+
+	return listed
 }
 
 // addDevice wraps functionality to add a new device, returning the result
@@ -113,6 +491,8 @@ var addDevice = func(command DeviceCommand, db *sql.DB) (device.Device, error) {
 	toAdd, err := makeDevice(0, command.mountPoint, command.serial)
 	if err != nil {
 		return device.Device{}, err
+	} else if toAdd.ReadOnly {
+		return device.Device{}, fmt.Errorf("%w: %s, %s", ErrDeviceReadOnly, toAdd.MountPoint, toAdd.ReadOnlyReason)
 	}
 
 	addedDev, err := addDBDevice(db, toAdd)
@@ -123,48 +503,158 @@ var addDevice = func(command DeviceCommand, db *sql.DB) (device.Device, error) {
 	return addedDev, nil
 }
 
-// reserveSpace attempts to allocate space on
-var reserveSpace = func(command DeviceCommand, devices *[]*device.Device) (string, error) {
-	if len(*devices) == 0 {
-		return "", fmt.Errorf("No devices available -- add one first")
+// removeDevice deletes the device at the command's mount point, once no files are stored or reserved on it
+var removeDevice = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB) error {
+	selected, err := removalTarget(command, devices)
+	if err != nil {
+		return err
 	}
 
-	for _, dev := range *devices {
-		// If requested size is negative, then would be less than an int64 representation of remaining space anyways
-		if len(command.mountPoint) > 0 && command.mountPoint == dev.MountPoint {
-			if dev.RemainingSpace() > uint64(command.space) {
-				dev.ReserveSpace(command.space)
-				return dev.MountPoint, nil
-			}
+	if err = checkEmpty(db, selected); err != nil {
+		return err
+	}
+
+	if err = removeDBDevice(db, selected.DeviceID); err != nil {
+		return err
+	}
 
-			return "", fmt.Errorf("Insufficient space on requested device")
-			// Check device space
-		} else if len(command.mountPoint) == 0 && dev.RemainingSpace() > uint64(command.space) {
-			dev.ReserveSpace(command.space)
-			return dev.MountPoint, nil
+	for index, dev := range *devices {
+		if dev == selected {
+			*devices = append((*devices)[:index], (*devices)[index+1:]...)
+			break
 		}
 	}
 
-	return "", fmt.Errorf("No device with sufficient space -- add another or make space")
+	return nil
+}
+
+// planRemoval plans moving every file off the device at the command's mount point,
+// marking it read-only so nothing new is stored on it while they are moved
+var planRemoval = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB) (MovePlan, error) {
+	selected, err := removalTarget(command, devices)
+	if err != nil {
+		return MovePlan{}, err
+	}
+
+	plan, err := evacuationPlan(db, devices, selected)
+	if err != nil {
+		return MovePlan{}, err
+	}
+
+	if selected.Writable() {
+		selected.ReadOnly = true
+		selected.ReadOnlyReason = removingReason
+	}
+
+	return plan, nil
+}
+
+// cancelRemoval lets files be stored on the device at the command's mount point again, if it was marked for removal
+func cancelRemoval(command DeviceCommand, devices *[]*device.Device) {
+	if dev := findDevice(devices, command.mountPoint, ""); dev != nil && dev.ReadOnlyReason == removingReason {
+		dev.ReadOnly = false
+		dev.ReadOnlyReason = ""
+	}
 }
 
-var freeSpace = func(command DeviceCommand, devices *[]*device.Device) error {
+// removalTarget returns the device at the command's mount point, to be removed
+func removalTarget(command DeviceCommand, devices *[]*device.Device) (*device.Device, error) {
 	if len(command.mountPoint) == 0 {
-		return fmt.Errorf("Mountpoint required")
+		return nil, ErrMountRequired
+	}
+
+	selected := findDevice(devices, command.mountPoint, "")
+	if selected == nil {
+		return nil, ErrNoSuchMount
+	}
+
+	return selected, nil
+}
+
+// checkEmpty returns an error if files are still stored on the device, or space is reserved on it for more
+func checkEmpty(db *sql.DB, dev *device.Device) error {
+	files, err := filterDBFiles(db, mydb.FileFilter{DeviceID: dev.DeviceID})
+	if err != nil {
+		return err
+	} else if len(files) > 0 {
+		return fmt.Errorf("%w: %d files stored on %s", ErrDeviceInUse, len(files), dev.MountPoint)
+	}
+
+	reservations, err := getDBReservations(db)
+	if err != nil {
+		return err
+	}
+	for _, reservation := range reservations {
+		if reservation.DeviceID == dev.DeviceID {
+			return fmt.Errorf("%w: space reserved on %s for a file being stored", ErrDeviceInUse, dev.MountPoint)
+		}
+	}
+
+	return nil
+}
+
+// reserveSpace attempts to allocate space on the requested device, or one chosen by the placement strategy if none requested
+// Devices the command avoids are never chosen
+var reserveSpace = func(command DeviceCommand, devices *[]*device.Device) (string, error) {
+	if len(*devices) == 0 {
+		return "", ErrNoDevices
 	}
 
-	var selected *device.Device = &device.Device{}
+	if len(command.mountPoint) > 0 {
+		return reserveOn(command, devices)
+	}
 
+	var candidates []*device.Device
+	var unusable []string
 	for _, dev := range *devices {
-		if dev.MountPoint == command.mountPoint {
-			selected = dev
-			break
+		// Space is reserved for what the file will occupy on each device, rounded to its blocks
+		if command.avoid[dev.DeviceID] {
+			continue
+		} else if !dev.Writable() {
+			unusable = append(unusable, unwritableError(dev).Error())
+		} else if dev.Fits(command.space) {
+			candidates = append(candidates, dev)
 		}
 	}
-	if selected.DeviceID == 0 {
-		return fmt.Errorf("No such mountpoint")
+
+	if len(candidates) > 0 {
+		dev := placement.Choose(candidates, command.space)
+		dev.ReserveFile(command.space)
+		return dev.MountPoint, nil
 	}
 
-	selected.ReserveSpace(-1 * command.space)
-	return nil
+	if len(unusable) > 0 {
+		return "", fmt.Errorf("%w; %s", ErrNoSpace, strings.Join(unusable, "; "))
+	}
+
+	return "", ErrNoSpace
+}
+
+// reserveOn reserves space on the device requested by the command
+func reserveOn(command DeviceCommand, devices *[]*device.Device) (string, error) {
+	dev := findDevice(devices, command.mountPoint, "")
+	if dev == nil {
+		return "", ErrNoSuchMount
+	} else if !dev.Writable() {
+		return "", unwritableError(dev)
+	} else if !dev.Fits(command.space) {
+		return "", ErrDeviceFull
+	}
+
+	dev.ReserveFile(command.space)
+	return dev.MountPoint, nil
+}
+
+// offlineError returns why an offline device cannot be used, identifying it so it can be plugged back in
+func offlineError(dev *device.Device) error {
+	return fmt.Errorf("%w: %d (serial %s) at %s, %s", ErrDeviceOffline, dev.DeviceID, dev.DeviceSerial, dev.MountPoint, dev.OfflineReason)
+}
+
+// unwritableError returns why files cannot be stored on a device which is offline or read-only
+func unwritableError(dev *device.Device) error {
+	if dev.Offline {
+		return offlineError(dev)
+	}
+
+	return fmt.Errorf("%w: %d (serial %s) at %s, %s", ErrDeviceReadOnly, dev.DeviceID, dev.DeviceSerial, dev.MountPoint, dev.ReadOnlyReason)
 }
@@ -8,6 +8,7 @@ import (
 	_ "time"
 
 	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,7 +26,7 @@ import (
 
 	// Can't use simple bool since this runs in separate goroutine
 	handle = func(_ *bool, _ DeviceCommand, _ *[]*device.Device, _ *sql.DB, _ <-chan DeviceCommand, result chan<- DeviceResult) {
-		result <- DeviceResult{true, "Called", nil}
+		result <- DeviceResult{true, "Called", nil, nil, nil, nil}
 	}
 
 	commands := make(chan DeviceCommand, 1)
@@ -60,12 +61,12 @@ import (
 
 // Check process calls handle, and restarts it with state on panic
 func TestProcessRestartsAndPersists(t *testing.T) {
-	realReserve := reserveSpace
+	realHold := holdSpace
 
 	loops := 3
 
 	called := 0
-	reserveSpace = func(_ DeviceCommand, devices *[]*device.Device) (string, error) {
+	holdSpace = func(_ DeviceCommand, devices *[]*device.Device, _ *sql.DB) (mydb.Reservation, string, error) {
 		called++
 
 		(*devices)[0].ReserveSpace(int64(10 * called))
@@ -73,7 +74,7 @@ func TestProcessRestartsAndPersists(t *testing.T) {
 			panic("Persist - call handle again")
 		}
 
-		return "/mnt", nil
+		return mydb.Reservation{}, "/mnt", nil
 	}
 
 	devices := make([]*device.Device, 0)
@@ -83,7 +84,7 @@ func TestProcessRestartsAndPersists(t *testing.T) {
 
 	defer func() {
 		close(results)
-		reserveSpace = realReserve
+		holdSpace = realHold
 	}()
 
 	// Ensure handle gets called three times
@@ -202,17 +203,17 @@ func TestDeviceAdding(t *testing.T) {
 }
 
 func TestReserving(t *testing.T) {
-	realRes := reserveSpace
+	realHold := holdSpace
 
 	count := 0
-	reserveSpace = func(_ DeviceCommand, _ *[]*device.Device) (string, error) {
+	holdSpace = func(_ DeviceCommand, _ *[]*device.Device, _ *sql.DB) (mydb.Reservation, string, error) {
 		count++
 
 		if count == 1 {
-			return "", fmt.Errorf("Invalid")
+			return mydb.Reservation{}, "", fmt.Errorf("Invalid")
 		}
 
-		return "/mnt/1", nil
+		return mydb.Reservation{ReservationID: 7}, "/mnt/1", nil
 	}
 
 	devices := make([]*device.Device, 0)
@@ -220,7 +221,7 @@ func TestReserving(t *testing.T) {
 	results := make(chan DeviceResult, 10)
 
 	defer func() {
-		reserveSpace = realRes
+		holdSpace = realHold
 		close(results)
 	}()
 
@@ -239,6 +240,7 @@ func TestReserving(t *testing.T) {
 	assert.True(t, result.success, "Should succeed")
 	assert.Nil(t, result.err, "No error returned")
 	assert.Equal(t, "/mnt/1", result.message, "Mount path returned")
+	assert.Equal(t, 7, result.reservations[0].ReservationID, "Reservation returned")
 }
 
 // Check device adding works as expected
@@ -246,7 +248,7 @@ func TestFreeing(t *testing.T) {
 	realRes := freeSpace
 
 	count := 0
-	freeSpace = func(_ DeviceCommand, _ *[]*device.Device) error {
+	freeSpace = func(_ DeviceCommand, _ *[]*device.Device, _ *sql.DB) error {
 		count++
 
 		if count == 1 {
@@ -307,6 +309,17 @@ func TestAddDevice(t *testing.T) {
 	_, err = addDevice(DeviceCommand{mountPoint: "", serial: ""}, &sql.DB{})
 	assert.EqualErrorf(t, err, "Already exists", "DB error correct")
 
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{MountPoint: mountPoint, ReadOnly: true, ReadOnlyReason: "Mounted read-only"}, nil
+	}
+	_, err = addDevice(DeviceCommand{mountPoint: "/mnt/ro", serial: ""}, &sql.DB{})
+	assert.ErrorIs(t, err, ErrDeviceReadOnly, "Read-only device rejected")
+	assert.EqualError(t, err, "Device is not writable: /mnt/ro, Mounted read-only", "Mount and reason reported")
+
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{DeviceID: 1}, nil
+	}
+
 	addDBDevice = func(_ *sql.DB, dev device.Device) (device.Device, error) {
 		dev.DeviceID = 5
 		return dev, nil
@@ -330,6 +343,9 @@ func TestReserveSpace(t *testing.T) {
 	assert.Equal(t, mount, "", "Mount is empty")
 	assert.EqualErrorf(t, err, "Insufficient space on requested device", "Expected insufficient space")
 
+	_, err = reserveSpace(DeviceCommand{mountPoint: "/mnt/missing"}, &devices)
+	assert.ErrorIs(t, err, ErrNoSuchMount, "Unknown requested mount reported")
+
 	mount, err = reserveSpace(DeviceCommand{space: 200}, &devices)
 	assert.Equal(t, mount, "", "Mount is empty")
 	assert.EqualErrorf(t, err, "No device with sufficient space -- add another or make space", "Expected no device with space")
@@ -358,22 +374,271 @@ func TestReserveSpace(t *testing.T) {
 	assert.Equal(t, uint64(50), devices[2].RemainingSpace(), "25 remaining on device 3")
 }
 
-func TestFreeSpace(t *testing.T) {
-	devices := make([]*device.Device, 0)
-	err := freeSpace(DeviceCommand{}, &devices)
-	assert.EqualErrorf(t, err, "Mountpoint required", "Requires mountpoint error returned")
+// Check listed devices are copies, which do not change with the manager's state
+func TestListDevices(t *testing.T) {
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC123", AvailableSpace: 100, AllocatedSpace: 10},
+		{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "ABC223", AvailableSpace: 200},
+	}
+	devMan := makeTestDevMan(t, devices)
 
-	err = freeSpace(DeviceCommand{mountPoint: "/mnt2"}, &devices)
-	assert.EqualErrorf(t, err, "No such mountpoint", "Mountpoint not found error returned")
+	listed, err := devMan.ListDevices()
+	assert.Nil(t, err, "No error listing devices")
+	assert.Len(t, listed, 2, "Every device listed")
+	assert.Equal(t, "/mnt/2", listed[1].MountPoint, "Device details listed")
 
-	devices = append(devices, &device.Device{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC123", AvailableSpace: 100, AllocatedSpace: 100})
-	devices = append(devices, &device.Device{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "ABC223", AvailableSpace: 200, AllocatedSpace: 100})
-	devices = append(devices, &device.Device{DeviceID: 3, MountPoint: "/mnt/3", DeviceSerial: "ABC223", AvailableSpace: 200, AllocatedSpace: 50})
+	_, _, err = devMan.ReserveSpace(50, "/mnt/1", 0, 0)
+	assert.Nil(t, err, "No error reserving space")
+	assert.Equal(t, uint64(10), listed[0].AllocatedSpace, "Listed copy unchanged")
 
-	err = freeSpace(DeviceCommand{mountPoint: "/mnt/2", space: 50}, &devices)
-	assert.Nil(t, err, "No error decreasing space")
+	listed, _ = devMan.ListDevices()
+	assert.Equal(t, uint64(60), listed[0].AllocatedSpace, "Reservation reflected in new listing")
+}
 
-	assert.Equal(t, uint64(0), devices[0].RemainingSpace(), "No space remaining on device 1")
-	assert.Equal(t, uint64(50), devices[1].RemainingSpace(), "50 remaining on device 2")
-	assert.Equal(t, uint64(150), devices[2].RemainingSpace(), "150 remaining on device 3")
+// Check devices already known by mount point or serial are not added again
+func TestDeviceAddingDuplicate(t *testing.T) {
+	realAdd := addDevice
+
+	addDevice = func(command DeviceCommand, _ *sql.DB) (device.Device, error) {
+		return device.Device{DeviceID: 3, MountPoint: command.mountPoint, DeviceSerial: "NEW123"}, nil
+	}
+	defer func() { addDevice = realAdd }()
+
+	devMan := makeTestDevMan(t, []*device.Device{{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC123"}})
+
+	_, err := devMan.AddDevice("/mnt/1", "")
+	assert.ErrorIs(t, err, ErrDeviceExists, "Known mount point rejected")
+
+	_, err = devMan.AddDevice("/mnt/2", "ABC123")
+	assert.ErrorIs(t, err, ErrDeviceExists, "Known serial rejected")
+
+	added, err := devMan.AddDevice("/mnt/3", "")
+	assert.Nil(t, err, "No error adding new device")
+	assert.Equal(t, device.Device{DeviceID: 3, MountPoint: "/mnt/3", DeviceSerial: "NEW123"}, added, "Added device returned")
+
+	listed, _ := devMan.ListDevices()
+	assert.Len(t, listed, 2, "New device managed")
+}
+
+// Check a device is only removed once its files have been moved to the others
+func TestRemoveDevice(t *testing.T) {
+	realFilter := filterDBFiles
+	realCopy := copyMove
+	realMove := moveDBFile
+	realRemove := removeDBDevice
+
+	stored := map[int]int{1: 1}
+	filterDBFiles = func(_ *sql.DB, filter mydb.FileFilter) ([]mydb.File, error) {
+		if filter.DeviceID == 0 || stored[1] == filter.DeviceID {
+			return []mydb.File{{FileID: 1, SourcePath: "/home/a.txt", DeviceID: stored[1], Size: 150}}, nil
+		}
+
+		return nil, nil
+	}
+	copyMove = func(_ FileMove) error { return nil }
+	moveDBFile = func(_ *sql.DB, fileID int, deviceID int) error {
+		stored[fileID] = deviceID
+		return nil
+	}
+	removed := 0
+	removeDBDevice = func(_ *sql.DB, deviceID int) error {
+		removed = deviceID
+		return nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		copyMove = realCopy
+		moveDBFile = realMove
+		removeDBDevice = realRemove
+	}()
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1"},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 100},
+	}
+	devMan := makeTestDevMan(t, devices)
+	defer close(devMan.commands)
+
+	assert.ErrorIs(t, devMan.RemoveDevice(""), ErrMountRequired, "Mount required")
+	assert.ErrorIs(t, devMan.RemoveDevice("/mnt/3"), ErrNoSuchMount, "Unknown mount rejected")
+
+	err := devMan.RemoveDevice("/mnt/1")
+	assert.ErrorIs(t, err, ErrEvacuateSpace, "Device kept if files do not fit elsewhere")
+	assert.EqualError(t, err, "Not enough space on other devices for the files on /mnt/1: 150 B (150 bytes) more needed", "Shortfall reported")
+	assert.Equal(t, 1, stored[1], "Nothing moved")
+	listed, _ := devMan.ListDevices()
+	assert.Len(t, listed, 2, "Device holding files still managed")
+	assert.True(t, listed[0].Writable(), "Kept device still stores files")
+
+	devices[1].AvailableSpace = 200
+	assert.ErrorIs(t, removeDevice(DeviceCommand{mountPoint: "/mnt/1"}, &devices, &sql.DB{}), ErrDeviceInUse, "Device holding files not removed")
+	assert.Nil(t, devMan.RemoveDevice("/mnt/1"), "Device removed once files fit elsewhere")
+	assert.Equal(t, 2, stored[1], "File moved to other device")
+	assert.Equal(t, 1, removed, "Device removed from database")
+	listed, _ = devMan.ListDevices()
+	assert.Len(t, listed, 1, "Device no longer managed")
+	assert.Equal(t, "/mnt/2", listed[0].MountPoint, "Other device still managed")
+}
+
+// Check a device is kept, and stores files again, if any of its files cannot be moved
+func TestRemoveDeviceFails(t *testing.T) {
+	realFilter := filterDBFiles
+	realCopy := copyMove
+	realMove := moveDBFile
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return []mydb.File{
+			{FileID: 1, SourcePath: "/home/a.txt", DeviceID: 1, Size: 10},
+			{FileID: 2, SourcePath: "/home/b.txt", DeviceID: 1, Size: 10},
+		}, nil
+	}
+	planned := make(chan bool, 1)
+	copyMove = func(move FileMove) error {
+		if move.File.FileID == 2 {
+			return fmt.Errorf("Failed to move %s", move.File.SourcePath)
+		}
+
+		planned <- true
+		return nil
+	}
+	moveDBFile = func(_ *sql.DB, _ int, _ int) error { return nil }
+	defer func() {
+		filterDBFiles = realFilter
+		copyMove = realCopy
+		moveDBFile = realMove
+	}()
+
+	devMan := makeTestDevMan(t, []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1"},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 100},
+	})
+	defer close(devMan.commands)
+
+	err := devMan.RemoveDevice("/mnt/1")
+	assert.EqualError(t, err, "Failed to move /home/b.txt (1 of 2 files moved, device kept)", "Progress reported")
+	assert.True(t, <-planned, "First file moved")
+
+	listed, _ := devMan.ListDevices()
+	assert.Len(t, listed, 2, "Device kept")
+	assert.True(t, listed[0].Writable(), "Kept device stores files again")
+}
+
+// Check a device being emptied stores nothing new, and cannot be removed while space is reserved on it
+func TestPlanRemoval(t *testing.T) {
+	db := makeTestDB(t)
+	devices := []*device.Device{{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100}}
+
+	reservation, _, err := holdSpace(DeviceCommand{space: 10}, &devices, db)
+	if err != nil {
+		panic(err)
+	}
+
+	plan, err := planRemoval(DeviceCommand{mountPoint: "/mnt/1"}, &devices, db)
+	assert.Nil(t, err, "No error planning empty device's removal")
+	assert.Empty(t, plan.Moves, "Nothing to move")
+	_, _, err = holdSpace(DeviceCommand{space: 10}, &devices, db)
+	assert.ErrorIs(t, err, ErrNoSpace, "Nothing new stored while being removed")
+
+	err = removeDevice(DeviceCommand{mountPoint: "/mnt/1"}, &devices, db)
+	assert.ErrorIs(t, err, ErrDeviceInUse, "Device with reservations kept")
+
+	cancelRemoval(DeviceCommand{mountPoint: "/mnt/1"}, &devices)
+	assert.True(t, devices[0].Writable(), "Files stored again once cancelled")
+	assert.Nil(t, freeSpace(DeviceCommand{reservationID: reservation.ReservationID}, &devices, db), "No error freeing")
+
+	devices[0].ReadOnly, devices[0].ReadOnlyReason = true, "Mounted read-only"
+	if _, err = planRemoval(DeviceCommand{mountPoint: "/mnt/1"}, &devices, db); err != nil {
+		panic(err)
+	}
+	cancelRemoval(DeviceCommand{mountPoint: "/mnt/1"}, &devices)
+	assert.Equal(t, "Mounted read-only", devices[0].ReadOnlyReason, "Device which failed its probe left read-only")
+}
+
+// Check offline devices are never reserved on, with the reason given when they would have been
+func TestReserveSpaceOffline(t *testing.T) {
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC", Offline: true, OfflineReason: "No device mounted on /mnt/1"},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 100},
+	}
+
+	mount, err := reserveSpace(DeviceCommand{space: 10}, &devices)
+	assert.Nil(t, err, "No error reserving")
+	assert.Equal(t, "/mnt/2", mount, "Online device used")
+
+	_, err = reserveSpace(DeviceCommand{mountPoint: "/mnt/1", space: 10}, &devices)
+	assert.ErrorIs(t, err, ErrDeviceOffline, "Requested offline device rejected")
+	assert.EqualError(t, err, "Device offline: 1 (serial ABC) at /mnt/1, No device mounted on /mnt/1", "Device and reason reported")
+
+	_, err = reserveSpace(DeviceCommand{space: 200}, &devices)
+	assert.ErrorIs(t, err, ErrNoSpace, "No space on online devices")
+	assert.Contains(t, err.Error(), "Device offline: 1 (serial ABC)", "Offline devices reported")
+}
+
+// Check read-only devices are never picked to store files
+func TestReserveSpaceReadOnly(t *testing.T) {
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC", AvailableSpace: 500, ReadOnly: true, ReadOnlyReason: "Mounted read-only"},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 100},
+	}
+
+	mount, err := reserveSpace(DeviceCommand{space: 10}, &devices)
+	assert.Nil(t, err, "No error reserving")
+	assert.Equal(t, "/mnt/2", mount, "Writable device used")
+
+	_, err = reserveSpace(DeviceCommand{mountPoint: "/mnt/1", space: 10}, &devices)
+	assert.ErrorIs(t, err, ErrDeviceReadOnly, "Requested read-only device rejected")
+	assert.EqualError(t, err, "Device is not writable: 1 (serial ABC) at /mnt/1, Mounted read-only", "Device and reason reported")
+
+	_, err = reserveSpace(DeviceCommand{space: 200}, &devices)
+	assert.ErrorIs(t, err, ErrNoSpace, "Read-only space not offered")
+	assert.Contains(t, err.Error(), "Device is not writable: 1 (serial ABC)", "Read-only devices reported")
+	assert.Equal(t, uint64(0), devices[0].AllocatedSpace, "Nothing reserved on read-only device")
+}
+
+// Check reservations cover the blocks a file will occupy, and are freed the same way
+func TestReserveSpaceBlocks(t *testing.T) {
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 10000, BlockSize: 4096},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 20000, BlockSize: 4096, TotalInodes: 100, FreeInodes: 5},
+	}
+
+	mount, err := reserveSpace(DeviceCommand{space: 5000}, &devices)
+	assert.Nil(t, err, "No error reserving")
+	assert.Equal(t, "/mnt/2", mount, "Device with room for the rounded size used")
+	assert.Equal(t, uint64(12288), devices[1].AllocatedSpace, "Whole blocks and metadata reserved")
+	assert.Equal(t, uint64(4), devices[1].FreeInodes, "Inode reserved")
+
+	_, err = reserveSpace(DeviceCommand{mountPoint: "/mnt/1", space: 5000}, &devices)
+	assert.ErrorIs(t, err, ErrDeviceFull, "Raw size fitting is not enough")
+
+	devices[1].FreeInodes = 0
+	_, err = reserveSpace(DeviceCommand{mountPoint: "/mnt/2", space: 10}, &devices)
+	assert.ErrorIs(t, err, ErrDeviceFull, "No inodes left")
+}
+
+// Check the placement strategy chooses among the devices with room, unless a device is requested
+func TestReserveSpacePlacement(t *testing.T) {
+	realPlacement := placement
+	placement = mostFree{}
+	defer func() {
+		placement = realPlacement
+	}()
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 50},
+		{DeviceID: 3, MountPoint: "/mnt/3", AvailableSpace: 1000, ReadOnly: true},
+	}
+
+	mount, err := reserveSpace(DeviceCommand{space: 10}, &devices)
+	assert.Nil(t, err, "No error reserving")
+	assert.Equal(t, "/mnt/1", mount, "Writable device with most space chosen")
+
+	mount, err = reserveSpace(DeviceCommand{space: 80}, &devices)
+	assert.Nil(t, err, "No error reserving")
+	assert.Equal(t, "/mnt/1", mount, "Only device with room chosen")
+
+	mount, err = reserveSpace(DeviceCommand{mountPoint: "/mnt/2", space: 10}, &devices)
+	assert.Nil(t, err, "No error reserving on requested device")
+	assert.Equal(t, "/mnt/2", mount, "Requested device used")
 }
@@ -0,0 +1,149 @@
+package erasure
+
+import (
+	"fmt"
+)
+
+// MaxShards is the most data and parity shards a code can have, limited by the size of the field
+const MaxShards = 256
+
+// ErrShardCount is returned when creating a code with too few or too many shards
+var ErrShardCount = fmt.Errorf("At least one data shard is required, with at most %d shards in total", MaxShards)
+
+// ErrShardSize is returned when the shards given are not all the same size
+var ErrShardSize = fmt.Errorf("Shards must all be the same size")
+
+// ErrTooFewShards is returned when rebuilding from fewer shards than there are data shards
+var ErrTooFewShards = fmt.Errorf("Too few shards to rebuild from")
+
+// Code is a systematic Reed-Solomon code, which computes parity shards from data shards so that
+// the data can be rebuilt from any of them, as long as there are as many as there are data shards
+type Code struct {
+	dataShards   int
+	parityShards int
+	// Each shard is the product of its row with the data shards, with the data shards' rows forming the identity
+	encoding matrix
+}
+
+// New creates a code with the given number of data and parity shards
+func New(dataShards int, parityShards int) (*Code, error) {
+	if dataShards < 1 || parityShards < 0 || dataShards+parityShards > MaxShards {
+		return nil, ErrShardCount
+	}
+
+	// Rows of a Vandermonde matrix are independent, which multiplying by the inverse of its top rows preserves,
+	// while turning those rows into the identity so data shards are stored as they are
+	total := dataShards + parityShards
+	vand := vandermonde(total, dataShards)
+	top, _ := vand[:dataShards].invert()
+
+	return &Code{dataShards: dataShards, parityShards: parityShards, encoding: vand.multiply(top)}, nil
+}
+
+// DataShards returns how many shards the data is split into
+func (code *Code) DataShards() int {
+	return code.dataShards
+}
+
+// ParityShards returns how many shards can be lost while still being able to rebuild the data
+func (code *Code) ParityShards() int {
+	return code.parityShards
+}
+
+// Encode computes the parity shards from the data shards, which come first
+// Every shard, including the parity shards it overwrites, must be the same size
+func (code *Code) Encode(shards [][]byte) error {
+	if err := code.checkShards(shards, false); err != nil {
+		return err
+	}
+
+	for index := code.dataShards; index < len(shards); index++ {
+		code.apply(code.encoding[index], shards[:code.dataShards], shards[index])
+	}
+
+	return nil
+}
+
+// Reconstruct rebuilds the missing shards, given as nil, from those present
+// At least as many shards as there are data shards must be present
+func (code *Code) Reconstruct(shards [][]byte) error {
+	if err := code.checkShards(shards, true); err != nil {
+		return err
+	}
+
+	present := make([]int, 0, code.dataShards)
+	size := 0
+	for index, shard := range shards {
+		if shard != nil && len(present) < code.dataShards {
+			present = append(present, index)
+			size = len(shard)
+		}
+	}
+	if len(present) < code.dataShards {
+		return ErrTooFewShards
+	}
+
+	// The present shards are their rows times the data, so the data is the inverse of those rows times the shards
+	rows := make(matrix, 0, code.dataShards)
+	inputs := make([][]byte, 0, code.dataShards)
+	for _, index := range present {
+		rows = append(rows, code.encoding[index])
+		inputs = append(inputs, shards[index])
+	}
+	decoding, _ := rows.invert()
+
+	for index := 0; index < code.dataShards; index++ {
+		if shards[index] == nil {
+			shards[index] = make([]byte, size)
+			code.apply(decoding[index], inputs, shards[index])
+		}
+	}
+
+	for index := code.dataShards; index < len(shards); index++ {
+		if shards[index] == nil {
+			shards[index] = make([]byte, size)
+			code.apply(code.encoding[index], shards[:code.dataShards], shards[index])
+		}
+	}
+
+	return nil
+}
+
+// apply sets the output to the sum of the inputs, each multiplied by its coefficient
+func (code *Code) apply(coefficients []byte, inputs [][]byte, output []byte) {
+	for index := range output {
+		output[index] = 0
+	}
+
+	for input, shard := range inputs {
+		coefficient := coefficients[input]
+		if coefficient == 0 {
+			continue
+		}
+
+		for index, value := range shard {
+			output[index] ^= mul(coefficient, value)
+		}
+	}
+}
+
+// checkShards returns an error unless there is a shard for every index, all the same size, with nil allowed if missing
+func (code *Code) checkShards(shards [][]byte, allowMissing bool) error {
+	if len(shards) != code.dataShards+code.parityShards {
+		return fmt.Errorf("Expected %d shards, got %d", code.dataShards+code.parityShards, len(shards))
+	}
+
+	size := -1
+	for _, shard := range shards {
+		if shard == nil && allowMissing {
+			continue
+		}
+
+		if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+	}
+
+	return nil
+}
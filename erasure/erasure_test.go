@@ -0,0 +1,96 @@
+package erasure
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeShards returns data shards with differing contents, followed by empty parity shards
+func makeShards(dataShards int, parityShards int, size int) [][]byte {
+	shards := make([][]byte, dataShards+parityShards)
+	for index := range shards {
+		shards[index] = make([]byte, size)
+		if index < dataShards {
+			for offset := range shards[index] {
+				shards[index][offset] = byte(index*31 + offset*7)
+			}
+		}
+	}
+
+	return shards
+}
+
+// Check codes are only created with usable shard counts
+func TestNew(t *testing.T) {
+	code, err := New(4, 2)
+	assert.Nil(t, err, "No error creating code")
+	assert.Equal(t, 4, code.DataShards(), "Data shards kept")
+	assert.Equal(t, 2, code.ParityShards(), "Parity shards kept")
+
+	_, err = New(0, 2)
+	assert.ErrorIs(t, err, ErrShardCount, "Data shard required")
+	_, err = New(200, 57)
+	assert.ErrorIs(t, err, ErrShardCount, "Shards limited by the field")
+	_, err = New(200, 56)
+	assert.Nil(t, err, "Largest code allowed")
+}
+
+// Check data shards are kept as they are, with parity computed alongside
+func TestEncode(t *testing.T) {
+	code, _ := New(3, 2)
+	shards := makeShards(3, 2, 16)
+	original := makeShards(3, 2, 16)
+
+	assert.Nil(t, code.Encode(shards), "No error encoding")
+	assert.Equal(t, original[:3], shards[:3], "Data shards unchanged")
+	assert.NotEqual(t, original[3], shards[3], "Parity computed")
+	assert.NotEqual(t, shards[3], shards[4], "Parity shards differ")
+
+	assert.Error(t, code.Encode(shards[:4]), "Every shard needed")
+	shards[4] = shards[4][:8]
+	assert.ErrorIs(t, code.Encode(shards), ErrShardSize, "Shards must be the same size")
+}
+
+// Check the shards are rebuilt from every combination of as many shards as there are data shards
+func TestReconstruct(t *testing.T) {
+	code, _ := New(3, 3)
+	encoded := makeShards(3, 3, 32)
+	if err := code.Encode(encoded); err != nil {
+		panic(err)
+	}
+
+	for lost := 0; lost < 1<<6; lost++ {
+		shards := make([][]byte, len(encoded))
+		kept := 0
+		for index := range encoded {
+			if lost&(1<<index) == 0 {
+				shards[index] = append([]byte{}, encoded[index]...)
+				kept++
+			}
+		}
+
+		err := code.Reconstruct(shards)
+		if kept < 3 {
+			assert.ErrorIs(t, err, ErrTooFewShards, "Too few shards kept with mask %b", lost)
+			continue
+		}
+
+		assert.Nil(t, err, "No error rebuilding with mask %b", lost)
+		for index := range encoded {
+			assert.True(t, bytes.Equal(encoded[index], shards[index]), "Shard %d rebuilt with mask %b", index, lost)
+		}
+	}
+}
+
+// Check a code without parity still splits and joins data
+func TestNoParity(t *testing.T) {
+	code, _ := New(2, 0)
+	shards := makeShards(2, 0, 4)
+	assert.Nil(t, code.Encode(shards), "No error encoding")
+	assert.Nil(t, code.Reconstruct(shards), "Nothing to rebuild")
+
+	shards[0] = nil
+	assert.ErrorIs(t, code.Reconstruct(shards), ErrTooFewShards, "Lost data cannot be rebuilt without parity")
+}
@@ -0,0 +1,132 @@
+package erasure
+
+// fieldPolynomial is the irreducible polynomial generating GF(2^8), x^8 + x^4 + x^3 + x^2 + 1
+const fieldPolynomial = 0x11d
+
+// expTable holds the powers of the generator 2, repeated so products of logarithms need no reduction
+var expTable [510]byte
+
+// logTable holds the power of the generator giving each non-zero element
+var logTable [256]int
+
+func init() {
+	value := 1
+	for power := 0; power < 255; power++ {
+		expTable[power] = byte(value)
+		expTable[power+255] = byte(value)
+		logTable[value] = power
+
+		value <<= 1
+		if value&0x100 != 0 {
+			value ^= fieldPolynomial
+		}
+	}
+}
+
+// mul multiplies two field elements
+func mul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return expTable[logTable[a]+logTable[b]]
+}
+
+// inverse returns the multiplicative inverse of a non-zero field element
+func inverse(a byte) byte {
+	return expTable[255-logTable[a]]
+}
+
+// power raises a field element to a non-negative exponent, with any element to the power 0 being 1
+func power(a byte, exponent int) byte {
+	if exponent == 0 {
+		return 1
+	} else if a == 0 {
+		return 0
+	}
+
+	return expTable[logTable[a]*exponent%255]
+}
+
+// matrix is a row-major matrix of field elements
+type matrix [][]byte
+
+// newMatrix returns a zero matrix of the given size
+func newMatrix(rows int, columns int) matrix {
+	result := make(matrix, rows)
+	for row := range result {
+		result[row] = make([]byte, columns)
+	}
+
+	return result
+}
+
+// vandermonde returns the matrix whose rows are the powers of each row's index, so any square subset of its rows is invertible
+func vandermonde(rows int, columns int) matrix {
+	result := newMatrix(rows, columns)
+	for row := range result {
+		for column := range result[row] {
+			result[row][column] = power(byte(row), column)
+		}
+	}
+
+	return result
+}
+
+// multiply returns the product of two matrices
+func (m matrix) multiply(other matrix) matrix {
+	result := newMatrix(len(m), len(other[0]))
+	for row := range m {
+		for column := range result[row] {
+			var sum byte
+			for index := range other {
+				sum ^= mul(m[row][index], other[index][column])
+			}
+			result[row][column] = sum
+		}
+	}
+
+	return result
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan elimination, and false if it is singular
+func (m matrix) invert() (matrix, bool) {
+	size := len(m)
+	work := newMatrix(size, size*2)
+	for row := range m {
+		copy(work[row], m[row])
+		work[row][size+row] = 1
+	}
+
+	for column := 0; column < size; column++ {
+		pivot := column
+		for pivot < size && work[pivot][column] == 0 {
+			pivot++
+		}
+		if pivot == size {
+			return nil, false
+		}
+		work[column], work[pivot] = work[pivot], work[column]
+
+		scale := inverse(work[column][column])
+		for index := range work[column] {
+			work[column][index] = mul(work[column][index], scale)
+		}
+
+		for row := range work {
+			if row != column && work[row][column] != 0 {
+				factor := work[row][column]
+				for index := range work[row] {
+					work[row][index] ^= mul(factor, work[column][index])
+				}
+			}
+		}
+	}
+
+	result := newMatrix(size, size)
+	for row := range work {
+		copy(result[row], work[row][size:])
+	}
+
+	return result, true
+}
@@ -0,0 +1,33 @@
+package erasure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Check field arithmetic follows the field's rules
+func TestFieldArithmetic(t *testing.T) {
+	assert.Equal(t, byte(0), mul(0, 7), "Zero absorbs")
+	assert.Equal(t, byte(7), mul(1, 7), "One is the identity")
+	assert.Equal(t, byte(4), mul(2, 2), "Small products unreduced")
+	assert.Equal(t, byte(0x1d), mul(0x80, 2), "Products reduced by the polynomial")
+	assert.Equal(t, byte(1), power(0, 0), "Anything to the power 0 is 1")
+	assert.Equal(t, byte(0), power(0, 3), "Zero to a power is 0")
+	assert.Equal(t, mul(3, mul(3, 3)), power(3, 3), "Powers are repeated products")
+
+	for value := 1; value < 256; value++ {
+		assert.Equal(t, byte(1), mul(byte(value), inverse(byte(value))), "Inverse of %d", value)
+	}
+}
+
+// Check matrices invert, and singular ones are detected
+func TestMatrixInvert(t *testing.T) {
+	vand := vandermonde(4, 4)
+	inverted, ok := vand.invert()
+	assert.True(t, ok, "Vandermonde matrix invertible")
+	assert.Equal(t, matrix{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}, vand.multiply(inverted), "Product is the identity")
+
+	_, ok = matrix{{1, 2}, {1, 2}}.invert()
+	assert.False(t, ok, "Repeated rows are singular")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+var addDBFolder = mydb.AddFolder
+var getDBFile = mydb.GetFile
+var backupFile = BackupFile
+
+// FolderResult contains the outcome of backing up each file in a folder
+type FolderResult struct {
+	Folder mydb.Folder
+	// Copies of the files newly backed up by this run
+	Files []mydb.File
+	// Files which were already in the catalog
+	Skipped []string
+	// Files, or directories, which could not be backed up
+	Failed map[string]error
+}
+
+// BackupFolder walks the given directory, backing up every regular file not already in the catalog with the given redundancy
+// The folder is recorded so its completeness can be checked later
+// The meter, which may be nil, expects the size of every copy or shard to back up before any are made
+func BackupFolder(db *sql.DB, devMan *DevMan, path string, redundancy queue.Redundancy, meter *progress.Meter) (FolderResult, error) {
+	folderPath, err := filepath.Abs(path)
+	if err != nil {
+		return FolderResult{}, err
+	}
+
+	files, failed, err := listFiles(folderPath)
+	if err != nil {
+		return FolderResult{}, err
+	}
+
+	folder, err := addDBFolder(db, mydb.Folder{FolderPath: folderPath, FileCount: len(files)})
+	if err != nil {
+		return FolderResult{}, fmt.Errorf("Failed to record folder %s: %v", folderPath, err)
+	}
+
+	result := FolderResult{Folder: folder, Failed: failed}
+	var toBackup []string
+	var total int64
+	for _, file := range files {
+		if _, err := getDBFile(db, file); err == nil {
+			result.Skipped = append(result.Skipped, file)
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			result.Failed[file] = err
+			continue
+		}
+
+		toBackup = append(toBackup, file)
+		total += storedSize(redundancy, info.Size())
+	}
+
+	meter.AddTotal(total)
+	for _, file := range toBackup {
+		backedUp, err := backupFile(db, devMan, file, redundancy, meter)
+		if err != nil {
+			result.Failed[file] = err
+		} else {
+			result.Files = append(result.Files, backedUp...)
+		}
+	}
+
+	return result, nil
+}
+
+// listFiles returns every regular file under a directory, along with any paths which could not be read
+var listFiles = func(folderPath string) ([]string, map[string]error, error) {
+	var files []string
+	failed := make(map[string]error)
+
+	err := filepath.WalkDir(folderPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == folderPath {
+				return err
+			}
+
+			failed[path] = err
+			return nil
+		}
+
+		if path == folderPath && !entry.IsDir() {
+			return fmt.Errorf("%s is not a directory", folderPath)
+		}
+
+		if entry.Type().IsRegular() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+
+	return files, failed, err
+}
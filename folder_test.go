@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestTree creates a directory containing the given relative files
+func makeTestTree(t *testing.T, files ...string) string {
+	root := t.TempDir()
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	return root
+}
+
+// Check only regular files are listed, recursively
+func TestListFiles(t *testing.T) {
+	root := makeTestTree(t, "a.txt", "sub/b.txt", "sub/deeper/c.txt")
+	if err := os.Symlink(filepath.Join(root, "a.txt"), filepath.Join(root, "link")); err != nil {
+		panic(err)
+	}
+
+	files, failed, err := listFiles(root)
+	assert.Nil(t, err, "No error listing files")
+	assert.Empty(t, failed, "No failures listing files")
+	assert.Equal(
+		t,
+		[]string{filepath.Join(root, "a.txt"), filepath.Join(root, "sub/b.txt"), filepath.Join(root, "sub/deeper/c.txt")},
+		files,
+		"Regular files listed",
+	)
+
+	_, _, err = listFiles(filepath.Join(root, "a.txt"))
+	assert.EqualErrorf(t, err, fmt.Sprintf("%s/a.txt is not a directory", root), "Files are rejected")
+
+	_, _, err = listFiles(filepath.Join(root, "missing"))
+	assert.True(t, os.IsNotExist(err), "Missing folder rejected")
+}
+
+// Check each file is backed up, skipping known ones, and failures are collected
+func TestBackupFolder(t *testing.T) {
+	realAdd := addDBFolder
+	realGet := getDBFile
+	realBackup := backupFile
+
+	root := makeTestTree(t, "known.txt", "new.txt", "sub/broken.txt")
+
+	var recorded mydb.Folder
+	addDBFolder = func(_ *sql.DB, folder mydb.Folder) (mydb.Folder, error) {
+		recorded = folder
+		folder.FolderID = 3
+		return folder, nil
+	}
+	getDBFile = func(_ *sql.DB, path string) (mydb.File, error) {
+		if path == filepath.Join(root, "known.txt") {
+			return mydb.File{FileID: 1}, nil
+		}
+		return mydb.File{}, sql.ErrNoRows
+	}
+	backupFile = func(_ *sql.DB, _ *DevMan, path string, redundancy queue.Redundancy, _ *progress.Meter) ([]mydb.File, error) {
+		assert.Equal(t, 2, redundancy.Copies, "Copies passed to each file")
+		if path == filepath.Join(root, "sub/broken.txt") {
+			return nil, fmt.Errorf("No device with sufficient space -- add another or make space")
+		}
+		return []mydb.File{{FileID: 2, SourcePath: path}, {FileID: 3, SourcePath: path}}, nil
+	}
+	defer func() {
+		addDBFolder = realAdd
+		getDBFile = realGet
+		backupFile = realBackup
+	}()
+
+	reports := make(chan progress.Report, 10)
+	meter := progress.NewMeter(1, 1, reports)
+
+	result, err := BackupFolder(&sql.DB{}, &DevMan{}, root, queue.Redundancy{Copies: 2}, meter)
+	assert.Nil(t, err, "No error backing up folder")
+	assert.Equal(t, int64(2*(len("new.txt")+len("sub/broken.txt"))), (<-reports).BytesTotal, "Size of every copy expected")
+	assert.Equal(t, mydb.Folder{FolderPath: root, FileCount: 3}, recorded, "Folder recorded with file count")
+	assert.Equal(t, 3, result.Folder.FolderID, "Recorded folder returned")
+	assert.Equal(t, []string{filepath.Join(root, "known.txt")}, result.Skipped, "Known file skipped")
+	assert.Equal(
+		t,
+		[]mydb.File{{FileID: 2, SourcePath: filepath.Join(root, "new.txt")}, {FileID: 3, SourcePath: filepath.Join(root, "new.txt")}},
+		result.Files,
+		"Copies of new file backed up",
+	)
+	assert.Len(t, result.Failed, 1, "One failure")
+	assert.EqualErrorf(
+		t,
+		result.Failed[filepath.Join(root, "sub/broken.txt")],
+		"No device with sufficient space -- add another or make space",
+		"Backup failure recorded",
+	)
+}
+
+// Check folder recording failure aborts the backup
+func TestBackupFolderRecordFails(t *testing.T) {
+	realAdd := addDBFolder
+
+	addDBFolder = func(_ *sql.DB, _ mydb.Folder) (mydb.Folder, error) {
+		return mydb.Folder{}, fmt.Errorf("database is locked")
+	}
+	defer func() { addDBFolder = realAdd }()
+
+	root := makeTestTree(t, "a.txt")
+	_, err := BackupFolder(&sql.DB{}, &DevMan{}, root, queue.Redundancy{Copies: 1}, nil)
+	assert.EqualErrorf(t, err, fmt.Sprintf("Failed to record folder %s: database is locked", root), "Record error returned")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+var getDBJobs = mydb.GetJobs
+
+// jobStore persists the job queue to the database
+type jobStore struct {
+	db *sql.DB
+}
+
+func (store jobStore) AddJob(job queue.Job) (queue.Job, error) {
+	return mydb.AddJob(store.db, job)
+}
+
+func (store jobStore) UpdateJob(job queue.Job) error {
+	return mydb.UpdateJob(store.db, job)
+}
+
+func (store jobStore) DeleteJob(jobID int) error {
+	return mydb.DeleteJob(store.db, jobID)
+}
+
+// LoadQueue reloads the persisted job queue, retrying any jobs interrupted by the last shutdown
+// Partial copies left behind by interrupted jobs are removed first, releasing the space they used
+func LoadQueue(db *sql.DB, devMan *DevMan) (*queue.Queue, error) {
+	jobs, err := getDBJobs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var interrupted []queue.Job
+	for _, job := range jobs {
+		if job.State == queue.StateInProgress {
+			interrupted = append(interrupted, job)
+		}
+	}
+
+	if err = releaseInterrupted(db, devMan, interrupted); err != nil {
+		return nil, err
+	}
+
+	return queue.Restore(jobStore{db}, jobs)
+}
+
+// releaseInterrupted removes copies under the paths of interrupted jobs which are not in the catalog,
+// since the job was stopped before it could record them
+// Only devices the manager found by serial or UUID and can write to are cleaned,
+// so nothing is removed from another drive mounted at a device's registered path
+var releaseInterrupted = func(db *sql.DB, devMan *DevMan, jobs []queue.Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	devices, err := devMan.ListDevices()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		for _, dev := range devices {
+			if !dev.Writable() {
+				continue
+			}
+
+			mount := dev.MountPoint
+			err = filepath.WalkDir(backupPath(mount, job.Path), func(path string, entry fs.DirEntry, err error) error {
+				if err != nil || !entry.Type().IsRegular() {
+					return nil
+				}
+
+				relative, err := filepath.Rel(mount, path)
+				if err != nil {
+					return err
+				}
+
+				held, err := heldOn(db, string(filepath.Separator)+relative, dev.DeviceID)
+				if err == nil && !held {
+					return os.Remove(path)
+				}
+
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// heldOn returns whether the catalog records a copy or shard of the file at the source path on the given device
+func heldOn(db *sql.DB, sourcePath string, deviceID int) (bool, error) {
+	files, err := getDBFiles(db, sourcePath)
+	if err != nil {
+		return false, err
+	}
+
+	for _, file := range files {
+		if file.SourcePath == sourcePath && file.DeviceID == deviceID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// Check partial copies of interrupted jobs are removed, keeping catalogued ones
+func TestReleaseInterrupted(t *testing.T) {
+	realGet := getDBFiles
+
+	mount := t.TempDir()
+	for _, path := range []string{"/home/photos/done.jpg", "/home/photos/partial.jpg", "/home/other.txt"} {
+		makeTestBackup(t, mount, path, path)
+	}
+
+	devMan := makeTestDevMan(t, []*device.Device{
+		{DeviceID: 1, MountPoint: mount},
+		{DeviceID: 2, MountPoint: "/mnt/unplugged", Offline: true},
+	})
+	defer close(devMan.commands)
+
+	getDBFiles = func(_ *sql.DB, path string) ([]mydb.File, error) {
+		if path == "/home/photos/done.jpg" {
+			return []mydb.File{{SourcePath: path, DeviceID: 1}}, nil
+		}
+		return nil, nil
+	}
+	defer func() { getDBFiles = realGet }()
+
+	err := releaseInterrupted(&sql.DB{}, devMan, []queue.Job{
+		{ID: 1, Path: "/home/photos", State: queue.StateInProgress},
+		{ID: 2, Path: "/home/missing", State: queue.StateInProgress},
+	})
+	assert.Nil(t, err, "No error releasing interrupted jobs")
+
+	_, err = os.Stat(filepath.Join(mount, "/home/photos/done.jpg"))
+	assert.Nil(t, err, "Catalogued copy kept")
+	_, err = os.Stat(filepath.Join(mount, "/home/photos/partial.jpg"))
+	assert.True(t, os.IsNotExist(err), "Partial copy removed")
+	_, err = os.Stat(filepath.Join(mount, "/home/other.txt"))
+	assert.Nil(t, err, "Copies outside interrupted jobs kept")
+}
+
+// Check every catalogued copy and shard of a file is kept, not only the first one recorded
+func TestReleaseInterruptedReplicas(t *testing.T) {
+	realGet := getDBFiles
+
+	mounts := map[int]string{1: t.TempDir(), 2: t.TempDir(), 3: t.TempDir()}
+	var devices []*device.Device
+	for id := 1; id <= len(mounts); id++ {
+		makeTestBackup(t, mounts[id], "/home/photos/copied.jpg", "copied")
+		makeTestBackup(t, mounts[id], "/home/photos/sharded.jpg", "sharded")
+		devices = append(devices, &device.Device{DeviceID: id, MountPoint: mounts[id]})
+	}
+
+	devMan := makeTestDevMan(t, devices)
+	defer close(devMan.commands)
+
+	getDBFiles = func(_ *sql.DB, path string) ([]mydb.File, error) {
+		if path == "/home/photos/copied.jpg" {
+			return []mydb.File{{SourcePath: path, DeviceID: 1}, {SourcePath: path, DeviceID: 2}}, nil
+		}
+		return []mydb.File{
+			{SourcePath: path, DeviceID: 3, Shard: 0, DataShards: 1, ParityShards: 1},
+			{SourcePath: path, DeviceID: 2, Shard: 1, DataShards: 1, ParityShards: 1},
+		}, nil
+	}
+	defer func() { getDBFiles = realGet }()
+
+	err := releaseInterrupted(&sql.DB{}, devMan, []queue.Job{{ID: 1, Path: "/home/photos", State: queue.StateInProgress}})
+	assert.Nil(t, err, "No error releasing interrupted job")
+
+	for _, check := range []struct {
+		deviceID int
+		path     string
+		kept     bool
+	}{
+		{1, "/home/photos/copied.jpg", true},
+		{2, "/home/photos/copied.jpg", true},
+		{3, "/home/photos/copied.jpg", false},
+		{1, "/home/photos/sharded.jpg", false},
+		{2, "/home/photos/sharded.jpg", true},
+		{3, "/home/photos/sharded.jpg", true},
+	} {
+		_, err = os.Stat(filepath.Join(mounts[check.deviceID], check.path))
+		assert.Equal(t, check.kept, err == nil, fmt.Sprintf("%s on device %d kept: %t", check.path, check.deviceID, check.kept))
+	}
+}
+
+// Check nothing is removed from a foreign drive mounted at a device's registered path,
+// or from a device which cannot be written to
+func TestReleaseInterruptedForeignDrive(t *testing.T) {
+	realGet := getDBFiles
+
+	foreign := t.TempDir()
+	readOnly := t.TempDir()
+	for _, mount := range []string{foreign, readOnly} {
+		makeTestBackup(t, mount, "/home/photos/other.jpg", "belongs to another device")
+	}
+
+	// The drive registered at the first mount could not be found by its serial, so another drive is mounted there
+	devMan := makeTestDevMan(t, []*device.Device{
+		{DeviceID: 1, MountPoint: foreign, Offline: true, OfflineReason: `No device with serial "ABC" or UUID "" is mounted`},
+		{DeviceID: 2, MountPoint: readOnly, ReadOnly: true, ReadOnlyReason: "Mounted read-only"},
+	})
+	defer close(devMan.commands)
+
+	getDBFiles = func(_ *sql.DB, _ string) ([]mydb.File, error) {
+		return nil, nil
+	}
+	defer func() { getDBFiles = realGet }()
+
+	err := releaseInterrupted(&sql.DB{}, devMan, []queue.Job{{ID: 1, Path: "/home/photos", State: queue.StateInProgress}})
+	assert.Nil(t, err, "No error releasing interrupted job")
+
+	_, err = os.Stat(filepath.Join(foreign, "/home/photos/other.jpg"))
+	assert.Nil(t, err, "File on foreign drive kept")
+	_, err = os.Stat(filepath.Join(readOnly, "/home/photos/other.jpg"))
+	assert.Nil(t, err, "File on read-only device kept")
+}
+
+// Check the queue is reloaded from the database, releasing only interrupted jobs
+func TestLoadQueue(t *testing.T) {
+	realRelease := releaseInterrupted
+
+	var released []queue.Job
+	releaseInterrupted = func(_ *sql.DB, _ *DevMan, jobs []queue.Job) error {
+		released = jobs
+		return nil
+	}
+	defer func() { releaseInterrupted = realRelease }()
+
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db := mydb.OpenDB(dbPath)
+
+	for _, state := range []queue.State{queue.StatePending, queue.StateInProgress, queue.StateCompleted} {
+		if _, err := mydb.AddJob(db, queue.Job{Action: JobBackupFile, Path: "/home/a.txt", State: state}); err != nil {
+			panic(err)
+		}
+	}
+
+	jobQueue, err := LoadQueue(db, &DevMan{})
+	assert.Nil(t, err, "No error loading queue")
+	assert.Len(t, released, 1, "Interrupted job released")
+	assert.Equal(t, 2, released[0].ID, "In progress job was interrupted")
+	assert.Len(t, jobQueue.Pending(), 2, "Pending and interrupted jobs queued")
+	assert.Len(t, jobQueue.Completed(), 1, "Completed job restored")
+
+	jobs, err := mydb.GetJobs(db)
+	assert.Nil(t, err, "No error getting jobs")
+	assert.Equal(t, queue.StatePending, jobs[1].State, "Interrupted job persisted as pending")
+
+	added, err := jobQueue.Add(JobBackupFolder, "/home/photos", queue.Redundancy{Copies: 1})
+	assert.Nil(t, err, "No error adding to loaded queue")
+	assert.Equal(t, 4, added.ID, "New job persisted")
+}
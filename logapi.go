@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/logging"
+)
+
+// logEntryView is a logged message, as returned by the API
+type logEntryView struct {
+	Time     time.Time `json:"time"`
+	Level    string    `json:"level"`
+	WorkerID int       `json:"workerId,omitempty"`
+	JobID    int       `json:"jobId,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// handleLogs returns the log entries kept in memory, oldest first, filtered by the query parameters:
+// the lowest level to include, RFC 3339 times to return entries since and until, and the worker or job they relate to
+func (server *WebServer) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "GET required")
+		return
+	}
+
+	filter, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries := logging.Default().Query(filter)
+	views := make([]logEntryView, 0, len(entries))
+	for _, entry := range entries {
+		views = append(views, logEntryView{
+			Time:     entry.Time,
+			Level:    entry.Level.String(),
+			WorkerID: entry.WorkerID,
+			JobID:    entry.JobID,
+			Message:  entry.Message,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+// parseLogFilter returns the filter given by the query parameters of a request for log entries
+func parseLogFilter(query url.Values) (logging.Filter, error) {
+	var filter logging.Filter
+	var err error
+	if level := query.Get("level"); len(level) > 0 {
+		if filter.MinLevel, err = logging.ParseLevel(level); err != nil {
+			return logging.Filter{}, err
+		}
+	}
+
+	if filter.Since, err = parseLogTime(query, "since"); err != nil {
+		return logging.Filter{}, err
+	}
+	if filter.Until, err = parseLogTime(query, "until"); err != nil {
+		return logging.Filter{}, err
+	}
+	if filter.WorkerID, err = parseLogID(query, "worker"); err != nil {
+		return logging.Filter{}, err
+	}
+	if filter.JobID, err = parseLogID(query, "job"); err != nil {
+		return logging.Filter{}, err
+	}
+
+	return filter, nil
+}
+
+// parseLogTime returns the RFC 3339 time in a query parameter, or the zero time if it is not given
+func parseLogTime(query url.Values, name string) (time.Time, error) {
+	value := query.Get(name)
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time: %q", name, value)
+	}
+
+	return parsed, nil
+}
+
+// parseLogID returns the positive ID in a query parameter, or 0 if it is not given
+func parseLogID(query url.Values, name string) (int, error) {
+	value := query.Get(name)
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%s must be a positive ID: %q", name, value)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+// Check log entries are returned oldest first, filtered by level, time, worker and job
+func TestHandleLogs(t *testing.T) {
+	realLogger := logging.Default()
+
+	logger := logging.New(10, nil)
+	logging.SetDefault(logger)
+	defer logging.SetDefault(realLogger)
+
+	logger.Infof("Started")
+	logger.Job(2, 5).Warnf("Copy failed")
+	logger.Job(3, 6).Errorf("Device gone")
+	logger.Close()
+
+	server := makeTestWebServer(t, []*device.Device{})
+	defer close(server.devMan.commands)
+
+	var entries []logEntryView
+	assert.Equal(t, http.StatusOK, serveTest(t, server, http.MethodGet, "/api/logs", &entries), "Logs returned")
+	assert.Len(t, entries, 3, "Every entry returned")
+	assert.Equal(t, "Started", entries[0].Message, "Oldest first")
+	assert.Equal(t, "INFO", entries[0].Level, "Level named")
+	assert.Equal(
+		t,
+		logEntryView{Time: entries[1].Time, Level: "WARN", WorkerID: 2, JobID: 5, Message: "Copy failed"},
+		entries[1],
+		"Job entry returned",
+	)
+
+	serveTest(t, server, http.MethodGet, "/api/logs?level=warn", &entries)
+	assert.Len(t, entries, 2, "Filtered by level")
+	serveTest(t, server, http.MethodGet, "/api/logs?worker=3", &entries)
+	assert.Equal(t, "Device gone", entries[0].Message, "Filtered by worker")
+	serveTest(t, server, http.MethodGet, "/api/logs?job=5&level=debug", &entries)
+	assert.Equal(t, "Copy failed", entries[0].Message, "Filtered by job")
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	serveTest(t, server, http.MethodGet, "/api/logs?since="+future, &entries)
+	assert.Empty(t, entries, "Filtered by time")
+	serveTest(t, server, http.MethodGet, "/api/logs?until="+future, &entries)
+	assert.Len(t, entries, 3, "Entries before a time returned")
+
+	var failed map[string]string
+	for _, query := range []string{"level=loud", "since=yesterday", "worker=abc", "job=-1"} {
+		status := serveTest(t, server, http.MethodGet, "/api/logs?"+query, &failed)
+		assert.Equal(t, http.StatusBadRequest, status, "Invalid "+query+" rejected")
+	}
+	assert.Equal(t, `job must be a positive ID: "-1"`, failed["error"], "Reason given")
+	assert.Equal(t, http.StatusMethodNotAllowed, serveTest(t, server, http.MethodPost, "/api/logs", &failed), "Only GET allowed")
+}
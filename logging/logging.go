@@ -0,0 +1,286 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCapacity is the number of entries kept in memory by the default logger
+const DefaultCapacity = 1000
+
+// bufferSize is how many entries may be waiting to be written before logging blocks
+const bufferSize = 100
+
+// Level is the severity of a log entry
+type Level int
+
+// LevelDebug entries are detailed information, for diagnosing problems
+const LevelDebug Level = 1
+
+// LevelInfo entries record normal operation
+const LevelInfo Level = 2
+
+// LevelWarn entries are problems which were recovered from
+const LevelWarn Level = 3
+
+// LevelError entries are failures of an operation
+const LevelError Level = 4
+
+// String returns the name of the level, as written to log output
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL%d", int(level))
+	}
+}
+
+// ParseLevel returns the level with the given name, ignoring case
+func ParseLevel(name string) (Level, error) {
+	for level := LevelDebug; level <= LevelError; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown log level %q", name)
+}
+
+// Entry is a single logged message
+type Entry struct {
+	Time  time.Time
+	Level Level
+	// Worker and job the entry relates to, zero if not from one
+	WorkerID int
+	JobID    int
+	Message  string
+}
+
+// String formats the entry as a line of log output
+func (entry Entry) String() string {
+	source := ""
+	if entry.WorkerID > 0 {
+		source += fmt.Sprintf(" [worker %d]", entry.WorkerID)
+	}
+	if entry.JobID > 0 {
+		source += fmt.Sprintf(" [job %d]", entry.JobID)
+	}
+
+	return fmt.Sprintf("%s %-5s%s %s", entry.Time.Format(time.RFC3339Nano), entry.Level, source, entry.Message)
+}
+
+// Filter restricts which entries are returned by a query, with zero values matching everything
+type Filter struct {
+	MinLevel Level
+	Since    time.Time
+	Until    time.Time
+	WorkerID int
+	JobID    int
+}
+
+// matches returns whether the entry satisfies every condition of the filter
+func (filter Filter) matches(entry Entry) bool {
+	return entry.Level >= filter.MinLevel &&
+		(filter.Since.IsZero() || !entry.Time.Before(filter.Since)) &&
+		(filter.Until.IsZero() || entry.Time.Before(filter.Until)) &&
+		(filter.WorkerID == 0 || entry.WorkerID == filter.WorkerID) &&
+		(filter.JobID == 0 || entry.JobID == filter.JobID)
+}
+
+// Logger receives entries on a dedicated buffered channel, keeping the most recent in memory
+// and optionally writing every entry to an output
+type Logger struct {
+	entries chan Entry
+	done    chan struct{}
+	output  io.Writer
+
+	// Guards against logging after the channel is closed
+	closeLock sync.RWMutex
+	closed    bool
+
+	ringLock sync.Mutex
+	ring     []Entry
+	// Index the next entry will be written to in the ring, and whether it has wrapped
+	next    int
+	wrapped bool
+}
+
+// New creates a logger keeping the given number of entries in memory, also writing them to output if not nil
+func New(capacity int, output io.Writer) *Logger {
+	logger := &Logger{
+		entries: make(chan Entry, bufferSize),
+		done:    make(chan struct{}),
+		output:  output,
+		ring:    make([]Entry, capacity),
+	}
+
+	go logger.run()
+	return logger
+}
+
+var defaultLogger *Logger
+var defaultLock sync.Mutex
+
+// Default returns the logger shared by subsystems, creating one without output if none was set
+func Default() *Logger {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+
+	if defaultLogger == nil {
+		defaultLogger = New(DefaultCapacity, nil)
+	}
+
+	return defaultLogger
+}
+
+// SetDefault replaces the logger shared by subsystems
+func SetDefault(logger *Logger) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+
+	defaultLogger = logger
+}
+
+// Close stops accepting entries, returning once every queued entry has been written
+// Entries logged after closing are discarded
+func (logger *Logger) Close() {
+	logger.closeLock.Lock()
+	if !logger.closed {
+		logger.closed = true
+		close(logger.entries)
+	}
+	logger.closeLock.Unlock()
+
+	<-logger.done
+}
+
+// Query returns the entries in memory matching the filter, oldest first
+func (logger *Logger) Query(filter Filter) []Entry {
+	logger.ringLock.Lock()
+	defer logger.ringLock.Unlock()
+
+	var ordered []Entry
+	if logger.wrapped {
+		ordered = append(ordered, logger.ring[logger.next:]...)
+	}
+	ordered = append(ordered, logger.ring[:logger.next]...)
+
+	matched := make([]Entry, 0, len(ordered))
+	for _, entry := range ordered {
+		if filter.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+
+	return matched
+}
+
+// Job returns a logger attributing its entries to the given worker and job
+func (logger *Logger) Job(workerID int, jobID int) JobLogger {
+	return JobLogger{logger, workerID, jobID}
+}
+
+// Debugf logs a formatted debug message
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.log(LevelDebug, 0, 0, format, args...)
+}
+
+// Infof logs a formatted informational message
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.log(LevelInfo, 0, 0, format, args...)
+}
+
+// Warnf logs a formatted warning
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.log(LevelWarn, 0, 0, format, args...)
+}
+
+// Errorf logs a formatted error
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.log(LevelError, 0, 0, format, args...)
+}
+
+// log queues an entry to be recorded
+func (logger *Logger) log(level Level, workerID int, jobID int, format string, args ...interface{}) {
+	entry := Entry{
+		Time:     time.Now(),
+		Level:    level,
+		WorkerID: workerID,
+		JobID:    jobID,
+		Message:  fmt.Sprintf(format, args...),
+	}
+
+	logger.closeLock.RLock()
+	defer logger.closeLock.RUnlock()
+
+	if !logger.closed {
+		logger.entries <- entry
+	}
+}
+
+// run records entries until the channel is closed
+func (logger *Logger) run() {
+	defer close(logger.done)
+
+	for entry := range logger.entries {
+		logger.record(entry)
+
+		if logger.output != nil {
+			fmt.Fprintln(logger.output, entry.String())
+		}
+	}
+}
+
+// record stores an entry in the ring, overwriting the oldest once full
+func (logger *Logger) record(entry Entry) {
+	logger.ringLock.Lock()
+	defer logger.ringLock.Unlock()
+
+	if len(logger.ring) == 0 {
+		return
+	}
+
+	logger.ring[logger.next] = entry
+	logger.next++
+	if logger.next == len(logger.ring) {
+		logger.next = 0
+		logger.wrapped = true
+	}
+}
+
+// JobLogger attributes the entries it logs to a worker and job
+type JobLogger struct {
+	logger   *Logger
+	workerID int
+	jobID    int
+}
+
+// Debugf logs a formatted debug message for the job
+func (jobLogger JobLogger) Debugf(format string, args ...interface{}) {
+	jobLogger.logger.log(LevelDebug, jobLogger.workerID, jobLogger.jobID, format, args...)
+}
+
+// Infof logs a formatted informational message for the job
+func (jobLogger JobLogger) Infof(format string, args ...interface{}) {
+	jobLogger.logger.log(LevelInfo, jobLogger.workerID, jobLogger.jobID, format, args...)
+}
+
+// Warnf logs a formatted warning for the job
+func (jobLogger JobLogger) Warnf(format string, args ...interface{}) {
+	jobLogger.logger.log(LevelWarn, jobLogger.workerID, jobLogger.jobID, format, args...)
+}
+
+// Errorf logs a formatted error for the job
+func (jobLogger JobLogger) Errorf(format string, args ...interface{}) {
+	jobLogger.logger.log(LevelError, jobLogger.workerID, jobLogger.jobID, format, args...)
+}
@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelString(t *testing.T) {
+	assert.Equal(t, "DEBUG", LevelDebug.String(), "Debug named")
+	assert.Equal(t, "INFO", LevelInfo.String(), "Info named")
+	assert.Equal(t, "WARN", LevelWarn.String(), "Warn named")
+	assert.Equal(t, "ERROR", LevelError.String(), "Error named")
+	assert.Equal(t, "LEVEL9", Level(9).String(), "Unknown level numbered")
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("warn")
+	assert.Nil(t, err, "No error parsing level")
+	assert.Equal(t, LevelWarn, level, "Level parsed ignoring case")
+
+	level, _ = ParseLevel("ERROR")
+	assert.Equal(t, LevelError, level, "Level parsed by its name")
+
+	_, err = ParseLevel("loud")
+	assert.EqualError(t, err, `Unknown log level "loud"`, "Unknown level rejected")
+}
+
+func TestEntryString(t *testing.T) {
+	at := time.Date(2022, 1, 15, 10, 30, 0, 0, time.UTC)
+
+	entry := Entry{Time: at, Level: LevelInfo, Message: "Started"}
+	assert.Equal(t, "2022-01-15T10:30:00Z INFO  Started", entry.String(), "Unattributed entry formatted")
+
+	entry = Entry{Time: at, Level: LevelError, WorkerID: 2, JobID: 15, Message: "Failed"}
+	assert.Equal(t, "2022-01-15T10:30:00Z ERROR [worker 2] [job 15] Failed", entry.String(), "Attribution included")
+}
+
+// Check entries are written to the output and kept for querying
+func TestLoggerOutput(t *testing.T) {
+	var output bytes.Buffer
+	logger := New(10, &output)
+
+	logger.Infof("Started with %d workers", 4)
+	logger.Job(2, 15).Errorf("Failed %s", "/home/a.txt")
+	logger.Close()
+	logger.Close()
+	logger.Warnf("Discarded after close")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Len(t, lines, 2, "Both entries written")
+	assert.True(t, strings.HasSuffix(lines[0], "INFO  Started with 4 workers"), "Info entry written")
+	assert.True(t, strings.HasSuffix(lines[1], "ERROR [worker 2] [job 15] Failed /home/a.txt"), "Job entry written")
+
+	entries := logger.Query(Filter{})
+	assert.Len(t, entries, 2, "Both entries kept")
+	assert.Equal(t, 2, entries[1].WorkerID, "Worker attributed")
+	assert.Equal(t, 15, entries[1].JobID, "Job attributed")
+}
+
+// Check only the most recent entries are kept, oldest first
+func TestLoggerRing(t *testing.T) {
+	logger := New(3, nil)
+	for n := 1; n <= 5; n++ {
+		logger.Infof("Entry %d", n)
+	}
+	logger.Close()
+
+	entries := logger.Query(Filter{})
+	assert.Len(t, entries, 3, "Ring is bounded")
+	assert.Equal(t, "Entry 3", entries[0].Message, "Oldest kept entry first")
+	assert.Equal(t, "Entry 5", entries[2].Message, "Newest entry last")
+}
+
+// Check each filter condition
+func TestLoggerQuery(t *testing.T) {
+	logger := New(10, nil)
+	logger.Debugf("debug")
+	logger.Job(1, 10).Infof("info")
+	logger.Job(2, 20).Warnf("warn")
+	logger.Job(2, 21).Errorf("error")
+	logger.Job(1, 10).Debugf("job debug")
+	logger.Close()
+
+	messages := func(filter Filter) []string {
+		var found []string
+		for _, entry := range logger.Query(filter) {
+			found = append(found, entry.Message)
+		}
+		return found
+	}
+
+	assert.Equal(t, []string{"warn", "error"}, messages(Filter{MinLevel: LevelWarn}), "Filtered by level")
+	assert.Equal(t, []string{"warn", "error"}, messages(Filter{WorkerID: 2}), "Filtered by worker")
+	assert.Equal(t, []string{"info", "job debug"}, messages(Filter{JobID: 10}), "Filtered by job")
+	assert.Equal(t, []string{"info"}, messages(Filter{JobID: 10, MinLevel: LevelInfo}), "Conditions combined")
+
+	all := logger.Query(Filter{})
+	assert.Equal(t, []string{"warn", "error", "job debug"}, messages(Filter{Since: all[2].Time}), "Filtered by start time")
+	assert.Empty(t, messages(Filter{Until: all[0].Time}), "Filtered by end time")
+	assert.Empty(t, messages(Filter{Since: time.Now().Add(time.Hour)}), "Future start time matches nothing")
+}
+
+// Check the default logger can be replaced
+func TestDefault(t *testing.T) {
+	original := Default()
+	assert.Equal(t, original, Default(), "Default is shared")
+
+	replacement := New(1, nil)
+	SetDefault(replacement)
+	defer SetDefault(original)
+
+	assert.Equal(t, replacement, Default(), "Default replaced")
+}
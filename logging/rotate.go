@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file which is rotated once it reaches a maximum size
+// Rotated files are suffixed with .1 (most recent) up to the number of backups kept
+type RotatingFile struct {
+	lock     sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+// OpenRotatingFile opens, or creates, a log file for appending
+func OpenRotatingFile(path string, maxBytes int64, backups int) (*RotatingFile, error) {
+	rotating := &RotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+
+	return rotating, nil
+}
+
+// Write appends to the log file, rotating it first if the write would exceed the maximum size
+func (rotating *RotatingFile) Write(p []byte) (int, error) {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+
+	if rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxBytes {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	written, err := rotating.file.Write(p)
+	rotating.size += int64(written)
+	return written, err
+}
+
+// Close closes the current log file
+func (rotating *RotatingFile) Close() error {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+
+	return rotating.file.Close()
+}
+
+// open opens the log file, picking up its current size
+func (rotating *RotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+// rotate shifts each backup up by one, discarding the oldest, and starts a new log file
+func (rotating *RotatingFile) rotate() error {
+	if err := rotating.file.Close(); err != nil {
+		return err
+	}
+
+	if rotating.backups > 0 {
+		for n := rotating.backups - 1; n > 0; n-- {
+			from := fmt.Sprintf("%s.%d", rotating.path, n)
+			if _, err := os.Stat(from); err == nil {
+				if err = os.Rename(from, fmt.Sprintf("%s.%d", rotating.path, n+1)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := os.Rename(rotating.path, rotating.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rotating.path); err != nil {
+		return err
+	}
+
+	return rotating.open()
+}
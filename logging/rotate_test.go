@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readLog(path string) string {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return string(contents)
+}
+
+// Check files rotate once full, keeping only the configured backups
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.log")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	rotating, err := OpenRotatingFile(path, 10, 2)
+	assert.Nil(t, err, "No error opening log")
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err = rotating.Write([]byte(line))
+		assert.Nil(t, err, "No error writing log")
+	}
+	assert.Nil(t, rotating.Close(), "No error closing log")
+
+	assert.Equal(t, "fourth\n", readLog(path), "Current log has latest entry")
+	assert.Equal(t, "third\n", readLog(path+".1"), "Most recent backup first")
+	assert.Equal(t, "second\n", readLog(path+".2"), "Older backup shifted")
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "Oldest backups discarded")
+}
+
+// Check a log without backups is truncated when full
+func TestRotatingFileNoBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.log")
+	rotating, err := OpenRotatingFile(path, 8, 0)
+	assert.Nil(t, err, "No error opening log")
+
+	rotating.Write([]byte("first\n"))
+	rotating.Write([]byte("second\n"))
+	rotating.Close()
+
+	assert.Equal(t, "second\n", readLog(path), "Log restarted")
+	_, err = os.Stat(path + ".1")
+	assert.True(t, os.IsNotExist(err), "No backup kept")
+}
+
+func TestOpenRotatingFileFails(t *testing.T) {
+	_, err := OpenRotatingFile(filepath.Join(t.TempDir(), "missing", "backup.log"), 10, 1)
+	assert.NotNil(t, err, "Missing directory reported")
+}
@@ -1,26 +1,163 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"sync"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/ammesonb/dispersed-backup/control"
+	"github.com/ammesonb/dispersed-backup/logging"
 	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
 )
 
 func main() {
 	dbPath := flag.String("db", "/var/lib/dispersed-backup/metadata.db", "Path to database file")
+	workerCount := flag.Int("workers", runtime.NumCPU(), "Number of workers to perform backups with")
+	logPath := flag.String("log", "", "Path to log file, rotated when full (default standard error)")
+	logSize := flag.Int64("log-size", 10*1024*1024, "Size in bytes at which the log file is rotated")
+	logBackups := flag.Int("log-backups", 5, "Number of rotated log files to keep")
+	listen := flag.String("listen", "127.0.0.1:8080", "Address to serve the web interface on, empty to disable")
+	socket := flag.String("socket", "/run/dispersed-backup.sock", "Path to the daemon's control socket, empty to disable")
+	refresh := flag.Duration("refresh", refreshInterval, "How often to re-measure free space on idle devices, 0 to disable")
+	expiry := flag.Duration("reservation-expiry", reservationExpiry, "How long a backup holds reserved space before it is reclaimed")
+	placementName := flag.String("placement", "first-fit", "How to choose the device for each file: "+strings.Join(placementNames, ", "))
+	largeFile := flag.Int64("large-file", 0, "Size in bytes from which files are placed with -large-placement instead, 0 to disable")
+	largePlacement := flag.String("large-placement", "most-free", "How to choose the device for large files")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n%s\nFlags:\n", os.Args[0], cliUsage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Commands are sent to a daemon listening on the control socket, if one is running
+	if flag.NArg() > 0 && flag.Arg(0) != "daemon" {
+		os.Exit(runCommand(flag.Args(), clientOptions{dbPath: *dbPath, socket: *socket}, os.Stdout, os.Stderr))
+	}
+
+	if *workerCount < 1 {
+		fmt.Fprintln(os.Stderr, "At least one worker is required")
+		os.Exit(2)
+	}
+
+	strategy, err := makePlacement(*placementName, *largePlacement, *largeFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if len(*logPath) > 0 {
+		logFile, err := logging.OpenRotatingFile(*logPath, *logSize, *logBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open log file: %v\n", err)
+			os.Exit(1)
+		}
+		defer logFile.Close()
+		logOutput = logFile
+	}
+
+	logger := logging.New(logging.DefaultCapacity, logOutput)
+	logging.SetDefault(logger)
+	defer logger.Close()
+
+	// Interrupted jobs are cleaned up on startup, which would break those of a daemon already running
+	if len(*socket) > 0 && control.Available(*socket) {
+		logger.Errorf("A daemon is already running on %s", *socket)
+		logger.Close()
+		os.Exit(1)
+	}
+
 	db := mydb.OpenDB(*dbPath)
 
+	refreshInterval = *refresh
+	reservationExpiry = *expiry
+	placement = strategy
 	devCommands := make(chan DeviceCommand, 1)
 	devResults := make(chan DeviceResult, 1)
 	RunManager(db, devCommands, devResults)
 
 	// Device Manager for controlled access to device status & availability
-	_ = DevMan{devCommands, devResults, sync.Mutex{}}
+	devMan := &DevMan{commands: devCommands, results: devResults}
+
+	// Pending jobs are owned here, and handed to workers as they become free
+	jobQueue, err := LoadQueue(db, devMan)
+	if err != nil {
+		panic(err)
+	}
+
+	jobs := make(chan queue.Job)
+	updates := make(chan queue.StatusUpdate, *workerCount)
+	dispatched := make(chan bool)
+	go func() {
+		jobQueue.Dispatch(jobs, updates)
+		dispatched <- true
+	}()
+
+	// Progress of in-flight copies, aggregated from every worker
+	tracker := progress.NewTracker()
+	reports := make(chan progress.Report, 100)
+	go tracker.Run(reports)
+
+	workers := StartWorkers(*workerCount, db, devMan, jobs, updates, reports)
+	logger.Infof("Started with %d workers", *workerCount)
+
+	var webServer *http.Server
+	if len(*listen) > 0 {
+		web := &WebServer{db: db, devMan: devMan, jobQueue: jobQueue, tracker: tracker, hostname: listenHostname(*listen)}
+		webServer = &http.Server{Addr: *listen, Handler: web.Handler()}
+		go func() {
+			if err := webServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Errorf("Web interface stopped: %v", err)
+			}
+		}()
+		logger.Infof("Serving web interface on %s", *listen)
+	}
+
+	var controlServer *control.Server
+	handler := newControlHandler(db, devMan, jobQueue, tracker)
+	if len(*socket) > 0 {
+		if controlServer, err = control.Listen(*socket, handler.handle); err != nil {
+			logger.Errorf("Failed to listen on control socket: %v", err)
+		} else {
+			logger.Infof("Accepting commands on %s", *socket)
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	logger.Infof("Shutting down once in progress jobs finish")
+
+	// The interfaces use the device manager, so must stop before its channels close
+	handler.stop()
+	if controlServer != nil {
+		controlServer.Close()
+	}
+	if webServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		webServer.Shutdown(ctx)
+		cancel()
+	}
 
-	// TODO: create worker pool here
+	// Workers finish any jobs already handed to them before exiting,
+	// and the device channels must remain open until they have
+	jobQueue.Stop()
+	workers.Wait()
+	close(updates)
+	close(reports)
+	<-dispatched
 
-	// TODO: only close dev channels after all workers complete
 	close(devCommands)
 	close(devResults)
+	logger.Infof("Shut down")
 }
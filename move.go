@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/logging"
+	"github.com/ammesonb/dispersed-backup/mydb"
+)
+
+var moveDBFile = mydb.MoveFile
+
+// ErrEvacuateSpace is returned when removing a device whose files will not fit on the other devices
+var ErrEvacuateSpace = fmt.Errorf("Not enough space on other devices")
+
+// FileMove is a backed up file to be moved between devices, by mount point
+type FileMove struct {
+	File mydb.File
+	From string
+	To   string
+}
+
+// MovePlan contains moves of files between devices, planned or made
+type MovePlan struct {
+	Moves []FileMove
+	// Total size of the files moved
+	Bytes int64
+	// Fill percentage of each device involved once every move is made, by mount point
+	Fill map[string]float64
+}
+
+// replicaHolders records the devices holding a copy of each file, by source path
+type replicaHolders map[string][]*device.Device
+
+// makeReplicaHolders finds the device holding each of the copies, leaving out those on unknown devices
+func makeReplicaHolders(files []mydb.File, devices []*device.Device) replicaHolders {
+	holders := make(replicaHolders)
+	for _, file := range files {
+		if dev := findDeviceByID(&devices, file.DeviceID); dev != nil {
+			holders[file.SourcePath] = append(holders[file.SourcePath], dev)
+		}
+	}
+
+	return holders
+}
+
+// blocks returns whether another copy of the file is on the same drive as the target, so this copy cannot move there
+func (holders replicaHolders) blocks(file mydb.File, target *device.Device) bool {
+	for _, holder := range holders[file.SourcePath] {
+		if holder.DeviceID != file.DeviceID && sameDrive(holder, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// move records a copy of the file as being on the target instead of its current device
+func (holders replicaHolders) move(file mydb.File, target *device.Device) {
+	for index, holder := range holders[file.SourcePath] {
+		if holder.DeviceID == file.DeviceID {
+			holders[file.SourcePath][index] = target
+		}
+	}
+}
+
+// evacuationPlan plans moving every file stored on a device to the other devices
+// Nothing is planned unless the other devices have room for all of the files, on drives without another copy of them
+func evacuationPlan(db *sql.DB, devices *[]*device.Device, selected *device.Device) (MovePlan, error) {
+	files, err := filterDBFiles(db, mydb.FileFilter{DeviceID: selected.DeviceID})
+	if err != nil {
+		return MovePlan{}, err
+	}
+
+	all, err := filterDBFiles(db, mydb.FileFilter{})
+	if err != nil {
+		return MovePlan{}, err
+	}
+
+	if selected.Offline && len(files) > 0 {
+		return MovePlan{}, fmt.Errorf("Cannot move %d files: %w", len(files), offlineError(selected))
+	}
+
+	var targets []*device.Device
+	for _, dev := range *devices {
+		if dev != selected && dev.Writable() {
+			targets = append(targets, dev)
+		}
+	}
+
+	targetOf, missing := planEvacuation(files, targets, makeReplicaHolders(all, *devices))
+	if missing > 0 {
+		return MovePlan{}, fmt.Errorf(
+			"%w for the files on %s: %s (%d bytes) more needed",
+			ErrEvacuateSpace,
+			selected.MountPoint,
+			formatBytes(uint64(missing)),
+			missing,
+		)
+	}
+
+	plan := MovePlan{Fill: make(map[string]float64)}
+	for _, file := range files {
+		plan.Moves = append(plan.Moves, FileMove{File: file, From: selected.MountPoint, To: targetOf[file.FileID].MountPoint})
+		plan.Bytes += file.Size
+	}
+
+	return plan, nil
+}
+
+// planEvacuation assigns each file to the target with the most remaining space, largest files first,
+// never putting a file on a drive which holds another copy of it
+// Returns the target of each file by file ID, and the total size of the files with nowhere to go
+func planEvacuation(files []mydb.File, targets []*device.Device, holders replicaHolders) (map[int]*device.Device, int64) {
+	sorted := append([]mydb.File{}, files...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Size > sorted[j].Size })
+
+	remaining := make(map[*device.Device]uint64)
+	for _, target := range targets {
+		remaining[target] = target.RemainingSpace()
+	}
+
+	plan := make(map[int]*device.Device)
+	var missing int64
+	for _, file := range sorted {
+		var best *device.Device
+		for _, target := range targets {
+			if holders.blocks(file, target) || remaining[target] <= target.Footprint(file.Size) {
+				continue
+			}
+			if best == nil || remaining[target] > remaining[best] {
+				best = target
+			}
+		}
+
+		if best == nil {
+			missing += file.Size
+			continue
+		}
+
+		remaining[best] -= best.Footprint(file.Size)
+		holders.move(file, best)
+		plan[file.FileID] = best
+	}
+
+	return plan, missing
+}
+
+// moveToDevice plans moving the backed up files at or beneath the command's path onto the device at its mount point
+// Files already on that device are left alone, and nothing is planned unless there is room for all of the others
+// Only one copy of a file with several is moved, and none if the device's drive already holds one
+var moveToDevice = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB) (MovePlan, error) {
+	if len(command.mountPoint) == 0 {
+		return MovePlan{}, ErrMountRequired
+	}
+
+	target := findDevice(devices, command.mountPoint, "")
+	if target == nil {
+		return MovePlan{}, ErrNoSuchMount
+	} else if !target.Writable() {
+		return MovePlan{}, unwritableError(target)
+	}
+
+	path, err := filepath.Abs(command.path)
+	if err != nil {
+		return MovePlan{}, err
+	}
+
+	files, err := filterDBFiles(db, mydb.FileFilter{Path: path})
+	if err != nil {
+		return MovePlan{}, err
+	}
+	if len(files) == 0 {
+		return MovePlan{}, fmt.Errorf("%w for %s", ErrNoFiles, path)
+	}
+
+	return planMoveToDevice(files, devices, target)
+}
+
+// planMoveToDevice lists the moves needed to put the files on the target, checking it has room for them
+func planMoveToDevice(files []mydb.File, devices *[]*device.Device, target *device.Device) (MovePlan, error) {
+	plan := MovePlan{Fill: make(map[string]float64)}
+	holders := makeReplicaHolders(files, *devices)
+	var needed uint64
+	for _, file := range files {
+		if file.DeviceID == target.DeviceID || holders.blocks(file, target) {
+			continue
+		}
+
+		source := findDeviceByID(devices, file.DeviceID)
+		if source == nil {
+			return MovePlan{}, fmt.Errorf("%s is stored on device %d, which is not available", file.SourcePath, file.DeviceID)
+		} else if source.Offline {
+			return MovePlan{}, fmt.Errorf("Cannot move %s: %w", file.SourcePath, offlineError(source))
+		}
+
+		holders.move(file, target)
+		plan.Moves = append(plan.Moves, FileMove{File: file, From: source.MountPoint, To: target.MountPoint})
+		plan.Bytes += file.Size
+		needed += target.Footprint(file.Size)
+	}
+
+	// Reservations need more space remaining than is reserved, so one extra byte is needed
+	if remaining := target.RemainingSpace(); len(plan.Moves) > 0 && remaining <= needed {
+		missing := needed - remaining + 1
+		return MovePlan{}, fmt.Errorf("%w: %s (%d bytes) more needed on %s", ErrDeviceFull, formatBytes(missing), missing, target.MountPoint)
+	}
+
+	return plan, nil
+}
+
+// makeMoves moves each planned file in turn, stopping at the first which cannot be moved,
+// and returns how many were moved
+// Files are copied outside the manager, so it can handle other commands meanwhile
+func (devMan *DevMan) makeMoves(plan MovePlan) (int, error) {
+	for moved, move := range plan.Moves {
+		if err := devMan.moveFile(move); err != nil {
+			return moved, err
+		}
+	}
+
+	return len(plan.Moves), nil
+}
+
+// moveFile reserves space for a file on its destination, copies it there, and has the manager record the move
+// The copy is removed and its space freed if the file cannot be moved
+func (devMan *DevMan) moveFile(move FileMove) error {
+	result := devMan.execute(DeviceCommand{
+		command:    DevCommandReserveSpace,
+		mountPoint: move.To,
+		space:      move.File.Size,
+		expiry:     reservationExpiry,
+		move:       move,
+	})
+	if err := result.err; !result.success {
+		return fmt.Errorf("Failed to move %s: %w", move.File.SourcePath, err)
+	}
+
+	reservation := result.reservations[0]
+	stopRenewing := keepReserved(devMan, []mydb.Reservation{reservation}, reservationExpiry)
+	err := copyMove(move)
+	stopRenewing()
+	if err == nil {
+		err = devMan.finishMove(move, reservation.ReservationID)
+	}
+
+	if err != nil {
+		os.Remove(backupPath(move.To, move.File.SourcePath))
+		return releaseFailed(devMan, []mydb.Reservation{reservation}, err)
+	}
+
+	return nil
+}
+
+// finishMove has the manager record a copied file on its new device, ending the reservation made for it
+func (devMan *DevMan) finishMove(move FileMove, reservationID int) error {
+	result := devMan.execute(DeviceCommand{command: DevCommandFinishMove, move: move, reservationID: reservationID})
+	if !result.success {
+		return result.err
+	}
+
+	return nil
+}
+
+// copyMove copies a backed up file to the device it is moving to under a temporary name,
+// and moves it into place once it matches its checksum
+var copyMove = func(move FileMove) error {
+	destination := backupPath(move.To, move.File.SourcePath)
+	partial, err := makePartial(destination)
+	if err != nil {
+		return fmt.Errorf("Failed to move %s: %v", move.File.SourcePath, err)
+	}
+
+	checksum, err := copyFile(backupPath(move.From, move.File.SourcePath), partial, nil)
+	if err != nil {
+		err = fmt.Errorf("Failed to move %s: %v", move.File.SourcePath, err)
+	} else if checksum != move.File.Checksum {
+		err = fmt.Errorf("Moved %s does not match checksum: expected %s, got %s", move.File.SourcePath, move.File.Checksum, checksum)
+	} else {
+		err = os.Rename(partial, destination)
+	}
+
+	if err != nil {
+		os.Remove(partial)
+	}
+
+	return err
+}
+
+// finishMove records the command's copied file on its new device and ends its reservation,
+// then removes the original copy and releases its space from the source
+var finishMove = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB) error {
+	move := command.move
+	from := findDevice(devices, move.From, "")
+	to := findDevice(devices, move.To, "")
+	if from == nil || to == nil {
+		return ErrNoSuchMount
+	}
+
+	if err := moveDBFile(db, move.File.FileID, to.DeviceID); err != nil {
+		return fmt.Errorf("Failed to record %s on device %d: %v", move.File.SourcePath, to.DeviceID, err)
+	}
+	if err := commitSpace(command, db); err != nil {
+		logging.Default().Warnf("Moved %s, but its reservation could not be committed: %v", move.File.SourcePath, err)
+	}
+
+	logging.Default().Infof("Moved %s from device %d to device %d", move.File.SourcePath, from.DeviceID, to.DeviceID)
+	if err := os.Remove(backupPath(from.MountPoint, move.File.SourcePath)); err != nil {
+		logging.Default().Warnf("Failed to remove original copy of %s: %v", move.File.SourcePath, err)
+	} else {
+		from.ReleaseSpace(move.File.Size)
+	}
+
+	return nil
+}
+
+// measuredFill sets the plan's fill of the target and each device moved from to how full it is now
+func measuredFill(plan MovePlan, devices []device.Device, target string) MovePlan {
+	involved := map[string]bool{target: true}
+	for _, move := range plan.Moves {
+		involved[move.From] = true
+	}
+
+	for _, dev := range devices {
+		if involved[dev.MountPoint] {
+			plan.Fill[dev.MountPoint] = dev.FillPercent()
+		}
+	}
+
+	return plan
+}
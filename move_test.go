@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestCopy writes a backed up copy of a file onto a mount, returning its record
+func makeTestCopy(t *testing.T, dev *device.Device, sourcePath string, contents string) mydb.File {
+	path := backupPath(dev.MountPoint, sourcePath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		panic(err)
+	}
+
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		panic(err)
+	}
+
+	return mydb.File{FileID: 1, SourcePath: sourcePath, DeviceID: dev.DeviceID, Size: int64(len(contents)), Checksum: checksum}
+}
+
+// Check the largest files are placed first, on whichever device has the most room
+func TestPlanEvacuation(t *testing.T) {
+	targets := []*device.Device{
+		{DeviceID: 2, AvailableSpace: 100},
+		{DeviceID: 3, AvailableSpace: 200, AllocatedSpace: 50},
+	}
+	files := []mydb.File{
+		{FileID: 1, Size: 20},
+		{FileID: 2, Size: 120},
+		{FileID: 3, Size: 60},
+	}
+
+	plan, missing := planEvacuation(files, targets, nil)
+	assert.Equal(t, int64(0), missing, "Every file placed")
+	assert.Equal(t, map[int]*device.Device{1: targets[0], 2: targets[1], 3: targets[0]}, plan, "Files spread by remaining space")
+	assert.Equal(t, uint64(150), targets[1].RemainingSpace(), "Planning reserves nothing")
+
+	files = append(files, mydb.File{FileID: 4, Size: 90}, mydb.File{FileID: 5, Size: 500})
+	plan, missing = planEvacuation(files, targets, nil)
+	assert.Equal(t, int64(560), missing, "Files which do not fit counted")
+	assert.Len(t, plan, 3, "Only files which fit placed")
+
+	_, missing = planEvacuation(files, nil, nil)
+	assert.Equal(t, int64(790), missing, "Nothing fits without other devices")
+}
+
+// Check copies of a file are never planned onto a drive already holding another copy
+func TestPlanReplicaMoves(t *testing.T) {
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC", AvailableSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "DEF", AvailableSpace: 500},
+		{DeviceID: 3, MountPoint: "/mnt/3", DeviceSerial: "DEF", AvailableSpace: 400},
+		{DeviceID: 4, MountPoint: "/mnt/4", DeviceSerial: "GHI", AvailableSpace: 300},
+	}
+	files := []mydb.File{
+		{FileID: 1, SourcePath: "/home/a.txt", DeviceID: 1, Size: 10},
+		{FileID: 2, SourcePath: "/home/a.txt", DeviceID: 2, Size: 10},
+		{FileID: 3, SourcePath: "/home/b.txt", DeviceID: 1, Size: 10},
+	}
+	holders := makeReplicaHolders(files, devices)
+
+	plan, missing := planEvacuation(files[:1], devices[2:], holders)
+	assert.Equal(t, int64(0), missing, "Copy placed")
+	assert.Equal(t, devices[3], plan[1], "Drive holding another copy skipped, despite more space")
+
+	_, missing = planEvacuation(files[:1], devices[2:3], makeReplicaHolders(files, devices))
+	assert.Equal(t, int64(10), missing, "Copy with only its other copy's drive left has nowhere to go")
+
+	moves, err := planMoveToDevice(files, &devices, devices[3])
+	assert.Nil(t, err, "No error planning moves")
+	assert.Equal(
+		t,
+		[]FileMove{{File: files[0], From: "/mnt/1", To: "/mnt/4"}, {File: files[2], From: "/mnt/1", To: "/mnt/4"}},
+		moves.Moves,
+		"Only one copy of each file moved",
+	)
+
+	moves, err = planMoveToDevice(files, &devices, devices[2])
+	assert.Nil(t, err, "No error planning moves")
+	assert.Equal(
+		t,
+		[]FileMove{{File: files[1], From: "/mnt/2", To: "/mnt/3"}, {File: files[2], From: "/mnt/1", To: "/mnt/3"}},
+		moves.Moves,
+		"Only the copy already on the drive moved between its partitions",
+	)
+}
+
+// Check a file is copied, recorded on its new device, and the original removed
+func TestMoveFile(t *testing.T) {
+	realMove := moveDBFile
+
+	recorded := 0
+	moveDBFile = func(_ *sql.DB, fileID int, deviceID int) error {
+		recorded = deviceID
+		return nil
+	}
+	defer func() { moveDBFile = realMove }()
+
+	from := &device.Device{DeviceID: 1, MountPoint: t.TempDir()}
+	to := &device.Device{DeviceID: 2, MountPoint: t.TempDir(), AvailableSpace: 100}
+	file := makeTestCopy(t, from, "/home/a.txt", "backed up")
+	devMan := makeTestDevMan(t, []*device.Device{from, to})
+	defer close(devMan.commands)
+
+	assert.Nil(t, devMan.moveFile(FileMove{File: file, From: from.MountPoint, To: to.MountPoint}), "No error moving file")
+	assert.Equal(t, 2, recorded, "New device recorded")
+	assert.Equal(t, uint64(9), to.AllocatedSpace, "Space reserved on new device")
+	assert.Equal(t, uint64(9), from.RemainingSpace(), "Space released on old device")
+
+	contents, err := ioutil.ReadFile(backupPath(to.MountPoint, "/home/a.txt"))
+	assert.Nil(t, err, "Copy on new device")
+	assert.Equal(t, "backed up", string(contents), "Contents moved")
+	_, err = os.Stat(backupPath(from.MountPoint, "/home/a.txt"))
+	assert.True(t, os.IsNotExist(err), "Original removed")
+	partials, _ := filepath.Glob(filepath.Join(to.MountPoint, "home", ".*.partial"))
+	assert.Empty(t, partials, "No partial copy left")
+}
+
+// Check a file which cannot be moved is left where it was, without reserving space
+func TestMoveFileFails(t *testing.T) {
+	realMove := moveDBFile
+
+	moveDBFile = func(_ *sql.DB, _ int, _ int) error {
+		return fmt.Errorf("Database locked")
+	}
+	defer func() { moveDBFile = realMove }()
+
+	from := &device.Device{DeviceID: 1, MountPoint: t.TempDir()}
+	to := &device.Device{DeviceID: 2, MountPoint: t.TempDir(), AvailableSpace: 100}
+	file := makeTestCopy(t, from, "/home/a.txt", "backed up")
+	devMan := makeTestDevMan(t, []*device.Device{from, to})
+	defer close(devMan.commands)
+	move := func(file mydb.File) error {
+		return devMan.moveFile(FileMove{File: file, From: from.MountPoint, To: to.MountPoint})
+	}
+
+	assert.EqualError(t, move(file), "Failed to record /home/a.txt on device 2: Database locked", "Record failure returned")
+
+	file.Checksum = "abc"
+	assert.Contains(t, move(file).Error(), "Moved /home/a.txt does not match checksum", "Mismatch returned")
+
+	missing := mydb.File{SourcePath: "/home/b.txt", Size: 5}
+	assert.Contains(t, move(missing).Error(), "Failed to move /home/b.txt", "Copy failure returned")
+
+	assert.ErrorIs(t, move(mydb.File{SourcePath: "/home/c.txt", Size: 100}), ErrDeviceFull, "File must fit on destination")
+
+	if _, err := devMan.ListDevices(); err != nil {
+		panic(err)
+	}
+	assert.Equal(t, uint64(0), to.AllocatedSpace, "Reservations released")
+	_, err := os.Stat(backupPath(to.MountPoint, "/home/a.txt"))
+	assert.True(t, os.IsNotExist(err), "Copy removed")
+	partials, _ := filepath.Glob(filepath.Join(to.MountPoint, "home", ".*.partial"))
+	assert.Empty(t, partials, "No partial copy left")
+	_, err = os.Stat(backupPath(from.MountPoint, "/home/a.txt"))
+	assert.Nil(t, err, "Original kept")
+}
+
+// Check the manager handles other commands while a file is being copied
+func TestMoveFileOutsideManager(t *testing.T) {
+	realCopy := copyMove
+	realMove := moveDBFile
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1"},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 100},
+	}
+	devMan := makeTestDevMan(t, devices)
+	defer close(devMan.commands)
+
+	listed := make(chan int)
+	copyMove = func(_ FileMove) error {
+		listing, err := devMan.ListDevices()
+		if err != nil {
+			panic(err)
+		}
+
+		listed <- len(listing)
+		return nil
+	}
+	moveDBFile = func(_ *sql.DB, _ int, _ int) error { return nil }
+	defer func() {
+		copyMove = realCopy
+		moveDBFile = realMove
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- devMan.moveFile(FileMove{File: mydb.File{SourcePath: "/home/a.txt", Size: 10}, From: "/mnt/1", To: "/mnt/2"})
+	}()
+
+	select {
+	case count := <-listed:
+		assert.Equal(t, 2, count, "Devices listed while copying")
+	case <-time.After(time.Second):
+		t.Fatal("Manager blocked while copying")
+	}
+	assert.Nil(t, <-done, "No error moving file")
+}
+
+// Check files at or beneath a path are moved onto the named device, if it has room for them
+func TestMoveToDevice(t *testing.T) {
+	realFilter := filterDBFiles
+	realMove := moveDBFile
+
+	first := &device.Device{DeviceID: 1, MountPoint: t.TempDir(), AvailableSpace: 50, AllocatedSpace: 10, TotalSpace: 100}
+	second := &device.Device{DeviceID: 2, MountPoint: t.TempDir(), AvailableSpace: 20, TotalSpace: 100}
+	target := &device.Device{DeviceID: 3, MountPoint: t.TempDir(), AvailableSpace: 100, TotalSpace: 100}
+	files := []mydb.File{
+		makeTestCopy(t, first, "/home/project/a.txt", strings.Repeat("a", 10)),
+		makeTestCopy(t, second, "/home/project/b.txt", strings.Repeat("b", 20)),
+		makeTestCopy(t, target, "/home/project/c.txt", strings.Repeat("c", 30)),
+	}
+	files[1].FileID = 2
+	files[2].FileID = 3
+
+	filterDBFiles = func(_ *sql.DB, filter mydb.FileFilter) ([]mydb.File, error) {
+		if filter.Path == "/home/project" {
+			return files, nil
+		} else if filter.Path == "/home/gone" {
+			return []mydb.File{{SourcePath: "/home/gone", DeviceID: 4}}, nil
+		}
+
+		return nil, nil
+	}
+	recorded := make(map[int]int)
+	moveDBFile = func(_ *sql.DB, fileID int, deviceID int) error {
+		recorded[fileID] = deviceID
+		return nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		moveDBFile = realMove
+	}()
+
+	devMan := makeTestDevMan(t, []*device.Device{first, second, target})
+	defer close(devMan.commands)
+	move := devMan.MoveFiles
+
+	_, err := move("/home/project", "")
+	assert.ErrorIs(t, err, ErrMountRequired, "Mount required")
+	_, err = move("/home/project", "/mnt/missing")
+	assert.ErrorIs(t, err, ErrNoSuchMount, "Unknown mount rejected")
+	_, err = move("/home/other", target.MountPoint)
+	assert.ErrorIs(t, err, ErrNoFiles, "Path must be backed up")
+	_, err = move("/home/gone", target.MountPoint)
+	assert.EqualError(t, err, "/home/gone is stored on device 4, which is not available", "Source device required")
+	_, err = move("/home/project", second.MountPoint)
+	assert.EqualError(t, err, "Insufficient space on requested device: 21 B (21 bytes) more needed on "+second.MountPoint, "Shortfall reported")
+	assert.Empty(t, recorded, "Nothing moved without room")
+
+	plan, err := move("/home/project", target.MountPoint)
+	assert.Nil(t, err, "No error moving files")
+	assert.Equal(t, map[int]int{1: 3, 2: 3}, recorded, "Files not already on the device moved")
+	assert.Equal(t, int64(30), plan.Bytes, "Bytes moved totalled")
+	assert.Equal(t, uint64(30), target.AllocatedSpace, "Space reserved on target")
+	assert.Equal(t, uint64(0), first.AllocatedSpace, "Source reservation freed")
+	assert.Equal(t, uint64(40), second.RemainingSpace(), "Space released from source")
+	assert.Equal(t, map[string]float64{first.MountPoint: 50, second.MountPoint: 60, target.MountPoint: 30}, plan.Fill, "Fill of each device involved returned")
+
+	_, err = os.Stat(backupPath(target.MountPoint, "/home/project/a.txt"))
+	assert.Nil(t, err, "File copied to target")
+}
+
+// Check files are never moved to or from offline devices
+func TestMoveOffline(t *testing.T) {
+	realFilter := filterDBFiles
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return []mydb.File{{FileID: 1, SourcePath: "/home/a.txt", DeviceID: 1, Size: 10}}, nil
+	}
+	defer func() { filterDBFiles = realFilter }()
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", Offline: true, OfflineReason: "No device mounted on /mnt/2"},
+	}
+
+	_, err := evacuationPlan(&sql.DB{}, &devices, devices[0])
+	assert.ErrorIs(t, err, ErrEvacuateSpace, "Offline devices cannot take files")
+
+	_, err = evacuationPlan(&sql.DB{}, &devices, devices[1])
+	assert.ErrorIs(t, err, ErrDeviceOffline, "Files cannot be read from offline device")
+
+	_, err = moveToDevice(DeviceCommand{path: "/home", mountPoint: "/mnt/2"}, &devices, &sql.DB{})
+	assert.ErrorIs(t, err, ErrDeviceOffline, "Offline device cannot be moved to")
+
+	devices[1].Offline = false
+	devices[1].ReadOnly = true
+	_, err = moveToDevice(DeviceCommand{path: "/home", mountPoint: "/mnt/2"}, &devices, &sql.DB{})
+	assert.ErrorIs(t, err, ErrDeviceReadOnly, "Read-only device cannot be moved to")
+
+	devices[0].Offline = true
+	devices[1].ReadOnly = false
+	devices[1].AvailableSpace = 100
+	_, err = moveToDevice(DeviceCommand{path: "/home", mountPoint: "/mnt/2"}, &devices, &sql.DB{})
+	assert.ErrorIs(t, err, ErrDeviceOffline, "Offline device cannot be moved from")
+}
@@ -21,7 +21,7 @@ var migrateInstance = migrate.NewWithInstance
 
 // getConnStr returns a DSN for a given database path
 func getConnStr(dbPath string) string {
-	return fmt.Sprintf("file:%s?_foreign_keys=true", dbPath)
+	return fmt.Sprintf("file:%s?_foreign_keys=true&_busy_timeout=5000", dbPath)
 }
 
 // OpenDB opens and returns a new connection to the DB
@@ -23,7 +23,7 @@ func DeleteDB(dbPath string) {
 // Test connection string is correct
 func TestGetConnStr(t *testing.T) {
 	conn := getConnStr("/test/foo")
-	assert.Equal(t, "file:/test/foo?_foreign_keys=true", conn, "Expected connection string returned")
+	assert.Equal(t, "file:/test/foo?_foreign_keys=true&_busy_timeout=5000", conn, "Expected connection string returned")
 }
 
 // Test opening database fails
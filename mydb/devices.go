@@ -2,51 +2,144 @@ package mydb
 
 import (
 	"database/sql"
+	"fmt"
+	"sort"
 
 	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/logging"
 )
 
 var makeDevice = device.MakeDevice
+var locateDevice = device.LocateDevice
 
-// GetDevices returns the cached devices from the provided database connection
+// GetDevices returns the registered devices from the provided database connection, with their current usage
+// Devices are found by serial or filesystem UUID, and any now mounted elsewhere have their new mount point saved
+// Devices which cannot be found or measured are returned offline along with the reason
 func GetDevices(db *sql.DB) []*device.Device {
-	rows, err := db.Query("SELECT * FROM devices")
+	records, err := GetDeviceRecords(db)
 	if err != nil {
 		panic(err)
 	}
-	defer rows.Close()
 
-	var devs []*device.Device
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
 
-	for rows.Next() {
-		var (
-			deviceID     int
-			mountPoint   string
-			serialNumber string
-		)
-		err := rows.Scan(&deviceID, &mountPoint, &serialNumber)
+	devs := make([]*device.Device, 0, len(ids))
+	var relocated []*device.Device
+	for _, id := range ids {
+		record := records[id]
+		newDev, err := locateDevice(record)
 		if err != nil {
-			panic(err)
+			newDev = device.MakeOfflineDevice(record, err.Error())
+		} else if newDev.MountPoint != record.MountPoint || newDev.UUID != record.UUID {
+			relocated = append(relocated, &newDev)
 		}
 
-		newDev, err := makeDevice(
-			deviceID,
-			mountPoint,
-			serialNumber,
-		)
-		if err != nil {
-			panic(err)
+		devs = append(devs, &newDev)
+	}
+
+	saveRelocations(db, records, relocated)
+	return devs
+}
+
+// saveRelocations records where devices were found, logging those which moved
+// Devices which cannot be saved are taken offline, since files would be recorded against the wrong mount point
+func saveRelocations(db *sql.DB, records map[int]device.Device, relocated []*device.Device) {
+	relocated = withoutConflicts(records, relocated)
+	if len(relocated) == 0 {
+		return
+	}
+
+	found := make([]device.Device, 0, len(relocated))
+	for _, dev := range relocated {
+		found = append(found, *dev)
+	}
+
+	if err := RelocateDevices(db, found); err != nil {
+		logging.Default().Errorf("Failed to save new mount points of devices: %v", err)
+		for _, dev := range relocated {
+			*dev = device.MakeOfflineDevice(records[dev.DeviceID], fmt.Sprintf("Found at %s, but failed to save it: %v", dev.MountPoint, err))
 		}
 
-		devs = append(devs, &newDev)
+		return
+	}
 
-		if !rows.NextResultSet() {
-			break
+	for _, dev := range relocated {
+		if previous := records[dev.DeviceID].MountPoint; previous != dev.MountPoint {
+			logging.Default().Infof("Device %d (serial %s) moved from %s to %s", dev.DeviceID, dev.DeviceSerial, previous, dev.MountPoint)
+		}
+	}
+}
+
+// withoutConflicts takes offline any relocated device found at a mount point registered to a device staying put,
+// returning the rest
+// Taking a device offline keeps it at its registered mount point, so this repeats until no conflicts remain
+func withoutConflicts(records map[int]device.Device, relocated []*device.Device) []*device.Device {
+	for {
+		moving := make(map[int]bool)
+		for _, dev := range relocated {
+			moving[dev.DeviceID] = true
+		}
+
+		held := make(map[string]int)
+		for id, record := range records {
+			if !moving[id] {
+				held[record.MountPoint] = id
+			}
+		}
+
+		var remaining []*device.Device
+		for _, dev := range relocated {
+			if holder, ok := held[dev.MountPoint]; ok {
+				reason := fmt.Sprintf("Found at %s, which is registered to device %d", dev.MountPoint, holder)
+				logging.Default().Errorf("Device %d (serial %s) not moved: %s", dev.DeviceID, dev.DeviceSerial, reason)
+				*dev = device.MakeOfflineDevice(records[dev.DeviceID], reason)
+			} else {
+				remaining = append(remaining, dev)
+			}
 		}
 
+		if len(remaining) == len(relocated) {
+			return remaining
+		}
+		relocated = remaining
 	}
+}
 
-	return devs
+// RelocateDevices saves the mount point and filesystem UUID of each device given
+// Devices may have swapped mount points, so each is moved aside before any is given its new one
+func RelocateDevices(db *sql.DB, devices []device.Device) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, dev := range devices {
+		if _, err = tx.Exec(`
+    UPDATE devices
+    SET    mountPoint = 'relocating:' || deviceID
+    WHERE  deviceID = $1
+  `, dev.DeviceID); err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range devices {
+		if _, err = tx.Exec(`
+    UPDATE devices
+    SET    mountPoint = $1,
+           uuid = $2
+    WHERE  deviceID = $3
+  `, dev.MountPoint, dev.UUID, dev.DeviceID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 // AddDevice adds a new device to the given database instance
@@ -55,17 +148,82 @@ func AddDevice(db *sql.DB, newDevice device.Device) (device.Device, error) {
 	err := db.QueryRow(`
     INSERT INTO devices (
       mountPoint,
-      serialNumber
+      serialNumber,
+      uuid
     )
     VALUES (
       $1,
-      $2
+      $2,
+      $3
     )
     RETURNING deviceID
-  `, newDevice.MountPoint, newDevice.DeviceSerial).Scan(&id)
+  `, newDevice.MountPoint, newDevice.DeviceSerial, newDevice.UUID).Scan(&id)
 	if err != nil {
 		return device.Device{}, err
 	}
 
 	return makeDevice(id, newDevice.MountPoint, newDevice.DeviceSerial)
 }
+
+// GetDeviceID returns the ID of the device registered for the given mount point
+func GetDeviceID(db *sql.DB, mountPoint string) (int, error) {
+	var id int
+	err := db.QueryRow(`
+    SELECT deviceID
+    FROM   devices
+    WHERE  mountPoint = $1
+  `, mountPoint).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetDeviceRecords returns the registered devices as stored, without checking they are mounted
+func GetDeviceRecords(db *sql.DB) (map[int]device.Device, error) {
+	rows, err := db.Query(`
+    SELECT deviceID,
+           mountPoint,
+           serialNumber,
+           uuid
+    FROM   devices
+  `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devs := make(map[int]device.Device)
+	for rows.Next() {
+		var dev device.Device
+		if err = rows.Scan(&dev.DeviceID, &dev.MountPoint, &dev.DeviceSerial, &dev.UUID); err != nil {
+			return nil, err
+		}
+
+		devs[dev.DeviceID] = dev
+	}
+
+	return devs, rows.Err()
+}
+
+// RemoveDevice deletes a device, which fails while files are still recorded on it
+func RemoveDevice(db *sql.DB, deviceID int) error {
+	result, err := db.Exec(`
+    DELETE FROM devices
+    WHERE       deviceID = $1
+  `, deviceID)
+	if err != nil {
+		return err
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package mydb
 
 import (
+	"database/sql"
+	"fmt"
 	"testing"
 
 	"github.com/ammesonb/dispersed-backup/device"
@@ -46,3 +48,150 @@ func TestAddAndGetDevice(t *testing.T) {
 	assert.Equal(t, devices[0].MountPoint, dev.MountPoint, "Correct device mount returned")
 	assert.Equal(t, devices[0].DeviceSerial, dev.DeviceSerial, "Correct device serial returned")
 }
+
+// addTestDevices registers devices at each mount point, with serials based on them
+func addTestDevices(db *sql.DB, mounts ...string) {
+	for _, mount := range mounts {
+		if _, err := db.Exec("INSERT INTO devices (mountPoint, serialNumber) VALUES ($1, $2)", mount, "serial"+mount); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestGetDevicesOffline(t *testing.T) {
+	realLocate := locateDevice
+	locateDevice = func(known device.Device) (device.Device, error) {
+		if known.MountPoint == "/mnt/2" {
+			return device.Device{}, fmt.Errorf("No device mounted on %s", known.MountPoint)
+		}
+
+		known.TotalSpace = 100
+		return known, nil
+	}
+	defer func() {
+		locateDevice = realLocate
+	}()
+
+	DeleteDB("test.db")
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	addTestDevices(db, "/mnt/1", "/mnt/2", "/mnt/3")
+
+	devices := GetDevices(db)
+	assert.Len(t, devices, 3, "Every device returned")
+	assert.Equal(
+		t,
+		&device.Device{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "serial/mnt/2", Offline: true, OfflineReason: "No device mounted on /mnt/2"},
+		devices[1],
+		"Unmounted device offline with reason",
+	)
+	assert.False(t, devices[0].Offline, "Mounted device online")
+	assert.Equal(t, uint64(100), devices[2].TotalSpace, "Devices after offline one measured")
+}
+
+func TestGetDevicesRelocated(t *testing.T) {
+	realLocate := locateDevice
+	// The first two devices have swapped mount points, and the third is now where the fourth was
+	found := map[int]string{1: "/media/disk1", 2: "/media/disk", 3: "/media/disk3"}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		if known.DeviceID == 4 {
+			return device.Device{}, fmt.Errorf("No device with serial %q or UUID %q is mounted", known.DeviceSerial, known.UUID)
+		}
+
+		known.MountPoint = found[known.DeviceID]
+		known.UUID = fmt.Sprintf("uuid-%d", known.DeviceID)
+		return known, nil
+	}
+	defer func() {
+		locateDevice = realLocate
+	}()
+
+	DeleteDB("test.db")
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	addTestDevices(db, "/media/disk", "/media/disk1", "/media/disk2", "/media/disk3")
+
+	devices := GetDevices(db)
+	assert.Equal(t, "/media/disk1", devices[0].MountPoint, "First device relocated")
+	assert.Equal(t, "/media/disk", devices[1].MountPoint, "Second device relocated")
+	assert.True(t, devices[2].Offline, "Device which could not be saved offline")
+	assert.Equal(t, "Found at /media/disk3, which is registered to device 4", devices[2].OfflineReason, "Reason given")
+	assert.Equal(t, "/media/disk2", devices[2].MountPoint, "Registered mount point kept")
+
+	// Once the stale device is removed, the conflicting device can be saved
+	if _, err := db.Exec("DELETE FROM devices WHERE deviceID = 4"); err != nil {
+		panic(err)
+	}
+	GetDevices(db)
+
+	records, err := GetDeviceRecords(db)
+	assert.Nil(t, err, "No error getting records")
+	assert.Equal(t, "/media/disk1", records[1].MountPoint, "New mount point saved")
+	assert.Equal(t, "uuid-1", records[1].UUID, "UUID saved")
+	assert.Equal(t, "/media/disk", records[2].MountPoint, "Swapped mount point saved")
+	assert.Equal(t, "/media/disk3", records[3].MountPoint, "Mount point saved once free")
+}
+
+func TestGetDeviceRecords(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{DeviceID: devID, MountPoint: mountPoint, DeviceSerial: serial}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	dev1, err := AddDevice(db, device.Device{MountPoint: "/mnt/1", DeviceSerial: "abc1"})
+	if err != nil {
+		panic(err)
+	}
+	dev2, err := AddDevice(db, device.Device{MountPoint: "/mnt/2", DeviceSerial: "abc2"})
+	if err != nil {
+		panic(err)
+	}
+
+	devs, err := GetDeviceRecords(db)
+	assert.Nil(t, err, "No error getting device records")
+	assert.Equal(t, map[int]device.Device{dev1.DeviceID: dev1, dev2.DeviceID: dev2}, devs, "All devices returned by ID")
+}
+
+func TestRemoveDevice(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{DeviceID: devID, MountPoint: mountPoint, DeviceSerial: serial}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	empty, err := AddDevice(db, device.Device{MountPoint: "/mnt/1", DeviceSerial: "abc1"})
+	if err != nil {
+		panic(err)
+	}
+	used, err := AddDevice(db, device.Device{MountPoint: "/mnt/2", DeviceSerial: "abc2"})
+	if err != nil {
+		panic(err)
+	}
+	if _, err = AddFile(db, File{SourcePath: "/home/a.txt", DeviceID: used.DeviceID, Size: 1, Checksum: "abc"}); err != nil {
+		panic(err)
+	}
+
+	assert.Nil(t, RemoveDevice(db, empty.DeviceID), "Empty device removed")
+	assert.NotNil(t, RemoveDevice(db, used.DeviceID), "Device holding files not removed")
+	assert.Equal(t, sql.ErrNoRows, RemoveDevice(db, empty.DeviceID), "Missing device reported")
+
+	devs, err := GetDeviceRecords(db)
+	assert.Nil(t, err, "No error getting device records")
+	assert.Equal(t, map[int]device.Device{used.DeviceID: used}, devs, "Only used device remains")
+}
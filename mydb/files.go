@@ -0,0 +1,267 @@
+package mydb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// underPath matches files whose source path is within the directory given by the query parameter
+func underPath(param string) string {
+	return fmt.Sprintf("substr(sourcePath, 1, length(%[1]s) + 1) = %[1]s || '/'", param)
+}
+
+// fileColumns are the columns selected to populate a File, in scanFile order
+const fileColumns = `
+      fileID,
+      sourcePath,
+      deviceID,
+      size,
+      checksum,
+      lastVerified,
+      verifyStatus,
+      shard,
+      dataShards,
+      parityShards,
+      sourceSize,
+      sourceChecksum
+`
+
+// File represents a copy of a file which has been backed up to a device
+// A file backed up with several copies has one, with its own ID, on each device holding a replica,
+// while an erasure-coded file has one for each of its shards
+// The size and checksum are of what is stored on the device, so for a shard differ from those of the source file
+type File struct {
+	FileID     int
+	SourcePath string
+	DeviceID   int
+	Size       int64
+	Checksum   string
+	// Zero if the file has never been verified
+	LastVerified time.Time
+	VerifyStatus string
+	// Index of the shard, and how many data and parity shards the file was split into, both 0 unless erasure-coded
+	Shard        int
+	DataShards   int
+	ParityShards int
+	// Size and checksum of the source file, set only for shards
+	SourceSize     int64
+	SourceChecksum string
+}
+
+// Sharded returns whether this is a shard of an erasure-coded file, rather than a whole copy
+func (file File) Sharded() bool {
+	return file.DataShards > 0
+}
+
+// FileFilter restricts which files are returned, with zero values matching everything
+type FileFilter struct {
+	// Source path to match exactly, or a directory containing the files
+	Path     string
+	DeviceID int
+	// Only include files which have not been verified since this time
+	VerifiedBefore time.Time
+}
+
+// AddFile records a backed up file in the given database instance
+func AddFile(db *sql.DB, newFile File) (File, error) {
+	return insertFile(db, newFile)
+}
+
+// AddReplicas records every copy of a backed up file, or none of them if any cannot be recorded
+func AddReplicas(db *sql.DB, replicas []File) ([]File, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	added := make([]File, 0, len(replicas))
+	for _, replica := range replicas {
+		replica, err = insertFile(tx, replica)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		added = append(added, replica)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return added, nil
+}
+
+// insertFile adds a row for a copy of a file, using either the database or a transaction
+func insertFile(db interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, newFile File) (File, error) {
+	var id int
+	err := db.QueryRow(`
+    INSERT INTO files (
+      sourcePath,
+      deviceID,
+      size,
+      checksum,
+      shard,
+      dataShards,
+      parityShards,
+      sourceSize,
+      sourceChecksum
+    )
+    VALUES (
+      $1,
+      $2,
+      $3,
+      $4,
+      $5,
+      $6,
+      $7,
+      $8,
+      $9
+    )
+    RETURNING fileID
+  `,
+		newFile.SourcePath,
+		newFile.DeviceID,
+		newFile.Size,
+		newFile.Checksum,
+		newFile.Shard,
+		newFile.DataShards,
+		newFile.ParityShards,
+		newFile.SourceSize,
+		newFile.SourceChecksum,
+	).Scan(&id)
+	if err != nil {
+		return File{}, err
+	}
+
+	newFile.FileID = id
+	return newFile, nil
+}
+
+// scanFile populates a file from a row selected using fileColumns
+func scanFile(row interface{ Scan(...interface{}) error }) (File, error) {
+	var (
+		file         File
+		lastVerified sql.NullTime
+		verifyStatus sql.NullString
+	)
+
+	err := row.Scan(
+		&file.FileID,
+		&file.SourcePath,
+		&file.DeviceID,
+		&file.Size,
+		&file.Checksum,
+		&lastVerified,
+		&verifyStatus,
+		&file.Shard,
+		&file.DataShards,
+		&file.ParityShards,
+		&file.SourceSize,
+		&file.SourceChecksum,
+	)
+	if err != nil {
+		return File{}, err
+	}
+
+	file.LastVerified = lastVerified.Time
+	file.VerifyStatus = verifyStatus.String
+	return file, nil
+}
+
+// GetFile returns the backed up file for the given source path, or its first copy if it has several
+func GetFile(db *sql.DB, sourcePath string) (File, error) {
+	return scanFile(db.QueryRow(`
+    SELECT   `+fileColumns+`
+    FROM     files
+    WHERE    sourcePath = $1
+    ORDER BY fileID
+    LIMIT    1
+  `, sourcePath))
+}
+
+// GetFiles returns the backed up files matching the given source path exactly, or contained within it
+func GetFiles(db *sql.DB, path string) ([]File, error) {
+	return FilterFiles(db, FileFilter{Path: path})
+}
+
+// FilterFiles returns the backed up files matching every condition of the filter, ordered by source path
+// Each copy of a file is returned separately, in the order they were recorded
+func FilterFiles(db *sql.DB, filter FileFilter) ([]File, error) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if len(filter.Path) > 0 {
+		args = append(args, filter.Path)
+		param := fmt.Sprintf("$%d", len(args))
+		conditions = append(conditions, fmt.Sprintf("(sourcePath = %s OR %s)", param, underPath(param)))
+	}
+	if filter.DeviceID > 0 {
+		args = append(args, filter.DeviceID)
+		conditions = append(conditions, fmt.Sprintf("deviceID = $%d", len(args)))
+	}
+	if !filter.VerifiedBefore.IsZero() {
+		args = append(args, filter.VerifiedBefore.UTC())
+		conditions = append(conditions, fmt.Sprintf("(lastVerified IS NULL OR lastVerified < $%d)", len(args)))
+	}
+
+	rows, err := db.Query(`
+    SELECT   `+fileColumns+`
+    FROM     files
+    WHERE    `+strings.Join(conditions, " AND ")+`
+    ORDER BY sourcePath, fileID
+  `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// RecordVerification stores the outcome of verifying a file, and when it happened
+func RecordVerification(db *sql.DB, fileID int, status string, verifiedAt time.Time) error {
+	_, err := db.Exec(`
+    UPDATE files
+    SET    lastVerified = $1,
+           verifyStatus = $2
+    WHERE  fileID = $3
+  `, verifiedAt.UTC(), status, fileID)
+	return err
+}
+
+// MoveFile records that a copy of a file is now stored on a different device
+func MoveFile(db *sql.DB, fileID int, deviceID int) error {
+	result, err := db.Exec(`
+    UPDATE files
+    SET    deviceID = $1
+    WHERE  fileID = $2
+  `, deviceID, fileID)
+	if err != nil {
+		return err
+	}
+
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package mydb
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddAndGetFile(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{
+			DeviceID:     devID,
+			MountPoint:   mountPoint,
+			DeviceSerial: serial,
+		}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	dev, err := AddDevice(db, device.Device{MountPoint: "/mnt/foo", DeviceSerial: "abc123"})
+	if err != nil {
+		panic(err)
+	}
+
+	deviceID, err := GetDeviceID(db, "/mnt/foo")
+	assert.Nil(t, err, "No error getting device ID")
+	assert.Equal(t, dev.DeviceID, deviceID, "Device ID found by mount")
+
+	_, err = GetDeviceID(db, "/mnt/bar")
+	assert.Equal(t, sql.ErrNoRows, err, "Unknown mount not found")
+
+	file, err := AddFile(db, File{SourcePath: "/home/foo.txt", DeviceID: dev.DeviceID, Size: 10, Checksum: "abc"})
+	assert.Nil(t, err, "No error adding file")
+	assert.Greater(t, file.FileID, 0, "File ID is set")
+
+	_, err = AddFile(db, File{SourcePath: "/home/foo.txt", DeviceID: dev.DeviceID, Size: 10, Checksum: "abc"})
+	assert.NotNil(t, err, "Source path may only be backed up once on each device")
+
+	_, err = AddFile(db, File{SourcePath: "/home/bar.txt", DeviceID: 999, Size: 10, Checksum: "abc"})
+	assert.NotNil(t, err, "Device must exist")
+
+	found, err := GetFile(db, "/home/foo.txt")
+	assert.Nil(t, err, "No error getting file")
+	assert.Equal(t, file, found, "Recorded file returned")
+}
+
+func TestGetFiles(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{DeviceID: devID, MountPoint: mountPoint, DeviceSerial: serial}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	dev, err := AddDevice(db, device.Device{MountPoint: "/mnt/foo", DeviceSerial: "abc123"})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, path := range []string{"/home/docs/b.txt", "/home/docs/a.txt", "/home/docs2/c.txt", "/home/docs"} {
+		if _, err = AddFile(db, File{SourcePath: path, DeviceID: dev.DeviceID}); err != nil {
+			panic(err)
+		}
+	}
+
+	files, err := GetFiles(db, "/home/docs")
+	assert.Nil(t, err, "No error getting files")
+	assert.Len(t, files, 3, "Exact match and contained files returned")
+	assert.Equal(t, "/home/docs", files[0].SourcePath, "Exact match returned")
+	assert.Equal(t, "/home/docs/a.txt", files[1].SourcePath, "Sorted by path")
+	assert.Equal(t, "/home/docs/b.txt", files[2].SourcePath, "Sorted by path")
+
+	files, err = GetFiles(db, "/home/docs2/c.txt")
+	assert.Nil(t, err, "No error getting files")
+	assert.Len(t, files, 1, "Single file returned")
+
+	files, err = GetFiles(db, "/home/music")
+	assert.Nil(t, err, "No error getting files")
+	assert.Empty(t, files, "No files matched")
+}
+
+func TestFilterFilesAndVerification(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{DeviceID: devID, MountPoint: mountPoint, DeviceSerial: serial}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	dev1, err := AddDevice(db, device.Device{MountPoint: "/mnt/1", DeviceSerial: "abc1"})
+	if err != nil {
+		panic(err)
+	}
+	dev2, err := AddDevice(db, device.Device{MountPoint: "/mnt/2", DeviceSerial: "abc2"})
+	if err != nil {
+		panic(err)
+	}
+
+	a, _ := AddFile(db, File{SourcePath: "/home/a.txt", DeviceID: dev1.DeviceID})
+	b, _ := AddFile(db, File{SourcePath: "/home/b.txt", DeviceID: dev2.DeviceID})
+	c, _ := AddFile(db, File{SourcePath: "/srv/c.txt", DeviceID: dev1.DeviceID})
+
+	now := time.Now()
+	assert.Nil(t, RecordVerification(db, a.FileID, "ok", now.Add(-48*time.Hour)), "No error recording verification")
+	assert.Nil(t, RecordVerification(db, b.FileID, "mismatch", now), "No error recording verification")
+
+	found, err := GetFile(db, "/home/b.txt")
+	assert.Nil(t, err, "No error getting file")
+	assert.Equal(t, "mismatch", found.VerifyStatus, "Status recorded")
+	assert.WithinDuration(t, now, found.LastVerified, time.Second, "Verification time recorded")
+
+	files, err := FilterFiles(db, FileFilter{})
+	assert.Nil(t, err, "No error filtering files")
+	assert.Len(t, files, 3, "Empty filter matches everything")
+
+	files, err = FilterFiles(db, FileFilter{DeviceID: dev1.DeviceID})
+	assert.Nil(t, err, "No error filtering files")
+	assert.Equal(t, []int{a.FileID, c.FileID}, fileIDs(files), "Filtered by device")
+
+	files, err = FilterFiles(db, FileFilter{VerifiedBefore: now.Add(-time.Hour)})
+	assert.Nil(t, err, "No error filtering files")
+	assert.Equal(t, []int{a.FileID, c.FileID}, fileIDs(files), "Stale and never verified files matched")
+
+	files, err = FilterFiles(db, FileFilter{Path: "/home", DeviceID: dev1.DeviceID, VerifiedBefore: now.Add(-time.Hour)})
+	assert.Nil(t, err, "No error filtering files")
+	assert.Equal(t, []int{a.FileID}, fileIDs(files), "All conditions combined")
+}
+
+func fileIDs(files []File) []int {
+	ids := make([]int, 0, len(files))
+	for _, file := range files {
+		ids = append(ids, file.FileID)
+	}
+
+	return ids
+}
+
+func TestMoveFile(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{DeviceID: devID, MountPoint: mountPoint, DeviceSerial: serial}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	first, err := AddDevice(db, device.Device{MountPoint: "/mnt/foo", DeviceSerial: "abc123"})
+	if err != nil {
+		panic(err)
+	}
+	second, err := AddDevice(db, device.Device{MountPoint: "/mnt/bar", DeviceSerial: "def456"})
+	if err != nil {
+		panic(err)
+	}
+
+	file, err := AddFile(db, File{SourcePath: "/home/foo.txt", DeviceID: first.DeviceID, Size: 10, Checksum: "abc"})
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Nil(t, MoveFile(db, file.FileID, second.DeviceID), "No error moving file")
+	found, _ := GetFile(db, "/home/foo.txt")
+	assert.Equal(t, second.DeviceID, found.DeviceID, "File recorded on new device")
+
+	assert.NotNil(t, MoveFile(db, file.FileID, 999), "Device must exist")
+	assert.Equal(t, sql.ErrNoRows, MoveFile(db, 999, first.DeviceID), "Unknown file not moved")
+	assert.Nil(t, RemoveDevice(db, first.DeviceID), "Device removable once file moved")
+}
+
+func TestAddReplicas(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{DeviceID: devID, MountPoint: mountPoint, DeviceSerial: serial}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	first, err := AddDevice(db, device.Device{MountPoint: "/mnt/foo", DeviceSerial: "abc123"})
+	if err != nil {
+		panic(err)
+	}
+	second, err := AddDevice(db, device.Device{MountPoint: "/mnt/bar", DeviceSerial: "def456"})
+	if err != nil {
+		panic(err)
+	}
+
+	replicas, err := AddReplicas(db, []File{
+		{SourcePath: "/home/foo.txt", DeviceID: second.DeviceID, Size: 10, Checksum: "abc"},
+		{SourcePath: "/home/foo.txt", DeviceID: first.DeviceID, Size: 10, Checksum: "abc"},
+	})
+	assert.Nil(t, err, "No error adding replicas")
+	assert.Len(t, replicas, 2, "Every replica returned")
+	assert.NotEqual(t, replicas[0].FileID, replicas[1].FileID, "Each replica has its own ID")
+
+	files, err := GetFiles(db, "/home/foo.txt")
+	assert.Nil(t, err, "No error getting files")
+	assert.Equal(t, replicas, files, "Replicas returned in the order recorded")
+
+	found, err := GetFile(db, "/home/foo.txt")
+	assert.Nil(t, err, "No error getting file")
+	assert.Equal(t, replicas[0], found, "First replica returned")
+
+	_, err = AddReplicas(db, []File{
+		{SourcePath: "/home/bar.txt", DeviceID: first.DeviceID, Size: 10, Checksum: "abc"},
+		{SourcePath: "/home/bar.txt", DeviceID: first.DeviceID, Size: 10, Checksum: "abc"},
+	})
+	assert.NotNil(t, err, "Replicas must be on different devices")
+	files, _ = GetFiles(db, "/home/bar.txt")
+	assert.Empty(t, files, "No replica recorded unless all are")
+}
+
+func TestShardPersistence(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{DeviceID: devID, MountPoint: mountPoint, DeviceSerial: serial}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	dev, err := AddDevice(db, device.Device{MountPoint: "/mnt/foo", DeviceSerial: "abc123"})
+	if err != nil {
+		panic(err)
+	}
+
+	shard, err := AddFile(db, File{
+		SourcePath:     "/home/foo.txt",
+		DeviceID:       dev.DeviceID,
+		Size:           4,
+		Checksum:       "shard",
+		Shard:          2,
+		DataShards:     3,
+		ParityShards:   1,
+		SourceSize:     10,
+		SourceChecksum: "source",
+	})
+	assert.Nil(t, err, "No error adding shard")
+	assert.True(t, shard.Sharded(), "Shard recognised")
+
+	found, err := GetFile(db, "/home/foo.txt")
+	assert.Nil(t, err, "No error getting shard")
+	assert.Equal(t, shard, found, "Shard layout persisted")
+
+	whole, err := AddFile(db, File{SourcePath: "/home/bar.txt", DeviceID: dev.DeviceID, Size: 10, Checksum: "abc"})
+	assert.Nil(t, err, "No error adding whole copy")
+	assert.False(t, whole.Sharded(), "Whole copy is not a shard")
+}
@@ -0,0 +1,95 @@
+package mydb
+
+import (
+	"database/sql"
+)
+
+// Folder represents a directory tree which has been backed up
+// FileCount is the number of regular files found the last time it was walked
+type Folder struct {
+	FolderID   int
+	FolderPath string
+	FileCount  int
+}
+
+// FolderStatus summarizes how much of a folder is backed up, and where
+type FolderStatus struct {
+	Folder
+	BackedUpFiles int
+	DeviceIDs     []int
+}
+
+// Complete returns whether every file found in the folder has been backed up
+func (status FolderStatus) Complete() bool {
+	return status.BackedUpFiles >= status.FileCount
+}
+
+// AddFolder records a folder in the given database instance, updating the file count if it already exists
+func AddFolder(db *sql.DB, newFolder Folder) (Folder, error) {
+	var id int
+	err := db.QueryRow(`
+    INSERT INTO folders (
+      folderPath,
+      fileCount
+    )
+    VALUES (
+      $1,
+      $2
+    )
+    ON CONFLICT (folderPath) DO UPDATE SET fileCount = excluded.fileCount
+    RETURNING folderID
+  `, newFolder.FolderPath, newFolder.FileCount).Scan(&id)
+	if err != nil {
+		return Folder{}, err
+	}
+
+	newFolder.FolderID = id
+	return newFolder, nil
+}
+
+// GetFolderStatus returns the recorded folder along with how many of its files are backed up, and on which devices
+func GetFolderStatus(db *sql.DB, folderPath string) (FolderStatus, error) {
+	var status FolderStatus
+	err := db.QueryRow(`
+    SELECT folderID,
+           folderPath,
+           fileCount
+    FROM   folders
+    WHERE  folderPath = $1
+  `, folderPath).Scan(&status.FolderID, &status.FolderPath, &status.FileCount)
+	if err != nil {
+		return FolderStatus{}, err
+	}
+
+	// Files with several copies are only counted once, but each device holding a copy is listed
+	err = db.QueryRow(`
+    SELECT COUNT(DISTINCT sourcePath)
+    FROM   files
+    WHERE  `+underPath("$1")+`
+  `, folderPath).Scan(&status.BackedUpFiles)
+	if err != nil {
+		return FolderStatus{}, err
+	}
+
+	rows, err := db.Query(`
+    SELECT DISTINCT deviceID
+    FROM            files
+    WHERE           `+underPath("$1")+`
+    ORDER BY        deviceID
+  `, folderPath)
+	if err != nil {
+		return FolderStatus{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deviceID int
+		if err = rows.Scan(&deviceID); err != nil {
+			return FolderStatus{}, err
+		}
+
+		status.DeviceIDs = append(status.DeviceIDs, deviceID)
+	}
+
+	return status, rows.Err()
+}
@@ -0,0 +1,73 @@
+package mydb
+
+import (
+	"testing"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFolderStatus(t *testing.T) {
+	realMake := makeDevice
+	makeDevice = func(devID int, mountPoint string, serial string) (device.Device, error) {
+		return device.Device{
+			DeviceID:     devID,
+			MountPoint:   mountPoint,
+			DeviceSerial: serial,
+		}, nil
+	}
+	defer func() {
+		makeDevice = realMake
+	}()
+
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	dev1, err := AddDevice(db, device.Device{MountPoint: "/mnt/1", DeviceSerial: "abc1"})
+	if err != nil {
+		panic(err)
+	}
+	dev2, err := AddDevice(db, device.Device{MountPoint: "/mnt/2", DeviceSerial: "abc2"})
+	if err != nil {
+		panic(err)
+	}
+
+	folder, err := AddFolder(db, Folder{FolderPath: "/home/photos", FileCount: 3})
+	assert.Nil(t, err, "No error adding folder")
+	assert.Greater(t, folder.FolderID, 0, "Folder ID set")
+
+	updated, err := AddFolder(db, Folder{FolderPath: "/home/photos", FileCount: 2})
+	assert.Nil(t, err, "No error re-adding folder")
+	assert.Equal(t, folder.FolderID, updated.FolderID, "Existing folder updated")
+
+	for _, file := range []File{
+		{SourcePath: "/home/photos/a.jpg", DeviceID: dev1.DeviceID},
+		{SourcePath: "/home/photos/2021/b.jpg", DeviceID: dev2.DeviceID},
+		{SourcePath: "/home/photos/2021/b.jpg", DeviceID: dev1.DeviceID},
+		{SourcePath: "/home/photos-old/c.jpg", DeviceID: dev1.DeviceID},
+	} {
+		if _, err = AddFile(db, file); err != nil {
+			panic(err)
+		}
+	}
+
+	status, err := GetFolderStatus(db, "/home/photos")
+	assert.Nil(t, err, "No error getting status")
+	assert.Equal(t, 2, status.FileCount, "Latest file count returned")
+	assert.Equal(t, 2, status.BackedUpFiles, "Only files inside folder counted, once for each replica")
+	assert.Equal(t, []int{dev1.DeviceID, dev2.DeviceID}, status.DeviceIDs, "Devices holding folder returned")
+	assert.True(t, status.Complete(), "Folder fully backed up")
+
+	_, err = AddFolder(db, Folder{FolderPath: "/home/photos", FileCount: 5})
+	if err != nil {
+		panic(err)
+	}
+	status, err = GetFolderStatus(db, "/home/photos")
+	assert.Nil(t, err, "No error getting status")
+	assert.False(t, status.Complete(), "Folder with new files is incomplete")
+
+	_, err = GetFolderStatus(db, "/home/music")
+	assert.NotNil(t, err, "Unknown folder errors")
+}
@@ -0,0 +1,156 @@
+package mydb
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+// nullTime converts zero times to NULL, so unset times are not stored as year one
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// AddJob persists a new job, returning it with its assigned ID
+func AddJob(db *sql.DB, job queue.Job) (queue.Job, error) {
+	var id int
+	err := db.QueryRow(`
+    INSERT INTO jobs (
+      action,
+      path,
+      copies,
+      dataShards,
+      parityShards,
+      state,
+      workerID,
+      message,
+      error,
+      added,
+      started,
+      finished
+    )
+    VALUES (
+      $1,
+      $2,
+      $3,
+      $4,
+      $5,
+      $6,
+      $7,
+      $8,
+      $9,
+      $10,
+      $11,
+      $12
+    )
+    RETURNING jobID
+  `,
+		job.Action,
+		job.Path,
+		job.Copies,
+		job.DataShards,
+		job.ParityShards,
+		job.State,
+		job.WorkerID,
+		job.Message,
+		job.Error,
+		job.Added.UTC(),
+		nullTime(job.Started),
+		nullTime(job.Finished),
+	).Scan(&id)
+	if err != nil {
+		return queue.Job{}, err
+	}
+
+	job.ID = id
+	return job, nil
+}
+
+// UpdateJob stores the current state of a persisted job
+func UpdateJob(db *sql.DB, job queue.Job) error {
+	_, err := db.Exec(`
+    UPDATE jobs
+    SET    state = $1,
+           workerID = $2,
+           message = $3,
+           error = $4,
+           started = $5,
+           finished = $6
+    WHERE  jobID = $7
+  `,
+		job.State,
+		job.WorkerID,
+		job.Message,
+		job.Error,
+		nullTime(job.Started),
+		nullTime(job.Finished),
+		job.ID,
+	)
+	return err
+}
+
+// DeleteJob removes a persisted job
+func DeleteJob(db *sql.DB, jobID int) error {
+	_, err := db.Exec("DELETE FROM jobs WHERE jobID = $1", jobID)
+	return err
+}
+
+// GetJobs returns every persisted job, in the order they were added
+func GetJobs(db *sql.DB) ([]queue.Job, error) {
+	rows, err := db.Query(`
+    SELECT   jobID,
+             action,
+             path,
+             copies,
+             dataShards,
+             parityShards,
+             state,
+             workerID,
+             message,
+             error,
+             added,
+             started,
+             finished
+    FROM     jobs
+    ORDER BY jobID
+  `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []queue.Job
+	for rows.Next() {
+		var (
+			job      queue.Job
+			started  sql.NullTime
+			finished sql.NullTime
+		)
+
+		err = rows.Scan(
+			&job.ID,
+			&job.Action,
+			&job.Path,
+			&job.Copies,
+			&job.DataShards,
+			&job.ParityShards,
+			&job.State,
+			&job.WorkerID,
+			&job.Message,
+			&job.Error,
+			&job.Added,
+			&started,
+			&finished,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		job.Started = started.Time
+		job.Finished = finished.Time
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
@@ -0,0 +1,56 @@
+package mydb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobPersistence(t *testing.T) {
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	added := time.Now().Add(-time.Minute)
+	job, err := AddJob(db, queue.Job{Action: 2, Path: "/home/photos", Redundancy: queue.Redundancy{Copies: 2, DataShards: 4, ParityShards: 2}, State: queue.StatePending, Added: added})
+	assert.Nil(t, err, "No error adding job")
+	assert.Greater(t, job.ID, 0, "Job ID assigned")
+
+	other, err := AddJob(db, queue.Job{Action: 1, Path: "/home/a.txt", State: queue.StatePending, Added: added})
+	if err != nil {
+		panic(err)
+	}
+
+	jobs, err := GetJobs(db)
+	assert.Nil(t, err, "No error getting jobs")
+	assert.Len(t, jobs, 2, "Both jobs returned")
+	assert.Equal(t, job.ID, jobs[0].ID, "Jobs in order added")
+	assert.Equal(t, "/home/photos", jobs[0].Path, "Path persisted")
+	assert.Equal(t, 2, jobs[0].Action, "Action persisted")
+	assert.Equal(t, queue.Redundancy{Copies: 2, DataShards: 4, ParityShards: 2}, jobs[0].Redundancy, "Redundancy persisted")
+	assert.WithinDuration(t, added, jobs[0].Added, time.Millisecond, "Added time persisted")
+	assert.True(t, jobs[0].Started.IsZero(), "Unset start time is zero")
+
+	job.State = queue.StateCompleted
+	job.WorkerID = 3
+	job.Message = "Failed"
+	job.Error = "disk full"
+	job.Started = time.Now()
+	job.Finished = time.Now()
+	assert.Nil(t, UpdateJob(db, job), "No error updating job")
+
+	jobs, _ = GetJobs(db)
+	assert.Equal(t, queue.StateCompleted, jobs[0].State, "State persisted")
+	assert.Equal(t, 3, jobs[0].WorkerID, "Worker persisted")
+	assert.Equal(t, "Failed", jobs[0].Message, "Message persisted")
+	assert.Equal(t, "disk full", jobs[0].Error, "Error persisted")
+	assert.WithinDuration(t, job.Finished, jobs[0].Finished, time.Millisecond, "Finish time persisted")
+
+	assert.Nil(t, DeleteJob(db, job.ID), "No error deleting job")
+	jobs, _ = GetJobs(db)
+	assert.Len(t, jobs, 1, "Job deleted")
+	assert.Equal(t, other.ID, jobs[0].ID, "Other job kept")
+}
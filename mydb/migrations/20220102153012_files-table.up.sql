@@ -0,0 +1,7 @@
+CREATE TABLE files (
+  fileID INTEGER PRIMARY KEY AUTOINCREMENT,
+  sourcePath TEXT NOT NULL UNIQUE,
+  deviceID INTEGER NOT NULL REFERENCES devices(deviceID),
+  size INTEGER NOT NULL,
+  checksum TEXT NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE TABLE folders (
+  folderID INTEGER PRIMARY KEY AUTOINCREMENT,
+  folderPath TEXT NOT NULL UNIQUE,
+  fileCount INTEGER NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE files DROP COLUMN verifyStatus;
+ALTER TABLE files DROP COLUMN lastVerified;
@@ -0,0 +1,2 @@
+ALTER TABLE files ADD COLUMN lastVerified DATETIME;
+ALTER TABLE files ADD COLUMN verifyStatus TEXT;
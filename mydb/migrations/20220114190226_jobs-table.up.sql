@@ -0,0 +1,12 @@
+CREATE TABLE jobs (
+  jobID INTEGER PRIMARY KEY AUTOINCREMENT,
+  action INTEGER NOT NULL,
+  path TEXT NOT NULL,
+  state INTEGER NOT NULL,
+  workerID INTEGER NOT NULL DEFAULT 0,
+  message TEXT NOT NULL DEFAULT '',
+  error TEXT NOT NULL DEFAULT '',
+  added DATETIME NOT NULL,
+  started DATETIME,
+  finished DATETIME
+);
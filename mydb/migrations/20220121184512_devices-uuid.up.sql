@@ -0,0 +1 @@
+ALTER TABLE devices ADD COLUMN uuid TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+CREATE TABLE reservations (
+  reservationID INTEGER PRIMARY KEY AUTOINCREMENT,
+  jobID INTEGER NOT NULL DEFAULT 0,
+  deviceID INTEGER NOT NULL,
+  size INTEGER NOT NULL,
+  created DATETIME NOT NULL,
+  expires DATETIME
+);
@@ -0,0 +1,16 @@
+ALTER TABLE jobs DROP COLUMN copies;
+CREATE TABLE primaries (
+  fileID INTEGER PRIMARY KEY AUTOINCREMENT,
+  sourcePath TEXT NOT NULL UNIQUE,
+  deviceID INTEGER NOT NULL REFERENCES devices(deviceID),
+  size INTEGER NOT NULL,
+  checksum TEXT NOT NULL,
+  lastVerified DATETIME,
+  verifyStatus TEXT
+);
+INSERT INTO primaries
+SELECT fileID, sourcePath, deviceID, size, checksum, lastVerified, verifyStatus
+FROM   files
+WHERE  fileID IN (SELECT MIN(fileID) FROM files GROUP BY sourcePath);
+DROP TABLE files;
+ALTER TABLE primaries RENAME TO files;
@@ -0,0 +1,14 @@
+CREATE TABLE replicas (
+  fileID INTEGER PRIMARY KEY AUTOINCREMENT,
+  sourcePath TEXT NOT NULL,
+  deviceID INTEGER NOT NULL REFERENCES devices(deviceID),
+  size INTEGER NOT NULL,
+  checksum TEXT NOT NULL,
+  lastVerified DATETIME,
+  verifyStatus TEXT,
+  UNIQUE (sourcePath, deviceID)
+);
+INSERT INTO replicas SELECT fileID, sourcePath, deviceID, size, checksum, lastVerified, verifyStatus FROM files;
+DROP TABLE files;
+ALTER TABLE replicas RENAME TO files;
+ALTER TABLE jobs ADD COLUMN copies INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,8 @@
+ALTER TABLE jobs DROP COLUMN parityShards;
+ALTER TABLE jobs DROP COLUMN dataShards;
+DELETE FROM files WHERE dataShards > 0;
+ALTER TABLE files DROP COLUMN sourceChecksum;
+ALTER TABLE files DROP COLUMN sourceSize;
+ALTER TABLE files DROP COLUMN parityShards;
+ALTER TABLE files DROP COLUMN dataShards;
+ALTER TABLE files DROP COLUMN shard;
@@ -0,0 +1,7 @@
+ALTER TABLE files ADD COLUMN shard INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN dataShards INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN parityShards INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN sourceSize INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN sourceChecksum TEXT NOT NULL DEFAULT '';
+ALTER TABLE jobs ADD COLUMN dataShards INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN parityShards INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE reservations ADD COLUMN move BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,160 @@
+package mydb
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Reservation is space held on a device for a file being written to it
+type Reservation struct {
+	ReservationID int
+	// Job the space is held for, or 0 if not held by a job
+	JobID    int
+	DeviceID int
+	// Size of the file the space is held for
+	Size    int64
+	Created time.Time
+	// When the space is reclaimed if not yet freed, or zero to hold it until freed
+	Expires time.Time
+	// Whether the space is held for a file being moved between devices
+	Move bool
+}
+
+// Expired returns whether the reservation has an expiry which has passed
+func (reservation Reservation) Expired(now time.Time) bool {
+	return !reservation.Expires.IsZero() && !now.Before(reservation.Expires)
+}
+
+// AddReservation persists a new reservation, returning it with its assigned ID
+func AddReservation(db *sql.DB, reservation Reservation) (Reservation, error) {
+	var id int
+	err := db.QueryRow(`
+    INSERT INTO reservations (
+      jobID,
+      deviceID,
+      size,
+      created,
+      expires,
+      move
+    )
+    VALUES (
+      $1,
+      $2,
+      $3,
+      $4,
+      $5,
+      $6
+    )
+    RETURNING reservationID
+  `,
+		reservation.JobID,
+		reservation.DeviceID,
+		reservation.Size,
+		reservation.Created.UTC(),
+		nullTime(reservation.Expires),
+		reservation.Move,
+	).Scan(&id)
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	reservation.ReservationID = id
+	return reservation, nil
+}
+
+// GetReservation returns the reservation with the given ID, or sql.ErrNoRows if there is none
+func GetReservation(db *sql.DB, reservationID int) (Reservation, error) {
+	reservations, err := queryReservations(db, "WHERE reservationID = $1", reservationID)
+	if err != nil {
+		return Reservation{}, err
+	} else if len(reservations) == 0 {
+		return Reservation{}, sql.ErrNoRows
+	}
+
+	return reservations[0], nil
+}
+
+// GetReservations returns every outstanding reservation, in the order they were made
+func GetReservations(db *sql.DB) ([]Reservation, error) {
+	return queryReservations(db, "")
+}
+
+// DeleteReservation removes a reservation, returning sql.ErrNoRows if there was none with the ID
+func DeleteReservation(db *sql.DB, reservationID int) error {
+	result, err := db.Exec("DELETE FROM reservations WHERE reservationID = $1", reservationID)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RenewReservation moves a reservation's expiry, returning sql.ErrNoRows if there was none with the ID
+func RenewReservation(db *sql.DB, reservationID int, expires time.Time) error {
+	result, err := db.Exec("UPDATE reservations SET expires = $1 WHERE reservationID = $2", nullTime(expires), reservationID)
+	if err != nil {
+		return err
+	}
+
+	renewed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if renewed == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// queryReservations returns the reservations matching a WHERE clause, in the order they were made
+func queryReservations(db *sql.DB, where string, args ...interface{}) ([]Reservation, error) {
+	rows, err := db.Query(`
+    SELECT   reservationID,
+             jobID,
+             deviceID,
+             size,
+             created,
+             expires,
+             move
+    FROM     reservations
+    `+where+`
+    ORDER BY reservationID
+  `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []Reservation
+	for rows.Next() {
+		var (
+			reservation Reservation
+			expires     sql.NullTime
+		)
+
+		err = rows.Scan(
+			&reservation.ReservationID,
+			&reservation.JobID,
+			&reservation.DeviceID,
+			&reservation.Size,
+			&reservation.Created,
+			&expires,
+			&reservation.Move,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		reservation.Expires = expires.Time
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, rows.Err()
+}
@@ -0,0 +1,60 @@
+package mydb
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservationPersistence(t *testing.T) {
+	DeleteDB("test.db")
+
+	db := OpenDB("test.db")
+	defer DeleteDB("test.db")
+
+	created := time.Now().Add(-time.Minute)
+	held, err := AddReservation(db, Reservation{JobID: 3, DeviceID: 1, Size: 4096, Created: created})
+	assert.Nil(t, err, "No error adding reservation")
+	assert.Greater(t, held.ReservationID, 0, "Reservation ID assigned")
+
+	expiring, err := AddReservation(db, Reservation{DeviceID: 2, Size: 10, Created: created, Expires: created.Add(time.Hour), Move: true})
+	if err != nil {
+		panic(err)
+	}
+
+	reservations, err := GetReservations(db)
+	assert.Nil(t, err, "No error getting reservations")
+	assert.Len(t, reservations, 2, "Both reservations returned")
+	assert.Equal(t, held.ReservationID, reservations[0].ReservationID, "Reservations in order made")
+	assert.Equal(t, 3, reservations[0].JobID, "Owner persisted")
+	assert.Equal(t, int64(4096), reservations[0].Size, "Size persisted")
+	assert.WithinDuration(t, created, reservations[0].Created, time.Millisecond, "Creation time persisted")
+	assert.True(t, reservations[0].Expires.IsZero(), "Unset expiry is zero")
+	assert.WithinDuration(t, created.Add(time.Hour), reservations[1].Expires, time.Millisecond, "Expiry persisted")
+	assert.False(t, reservations[0].Move, "Reservation not for a move by default")
+	assert.True(t, reservations[1].Move, "Move persisted")
+
+	found, err := GetReservation(db, expiring.ReservationID)
+	assert.Nil(t, err, "No error getting reservation")
+	assert.Equal(t, 2, found.DeviceID, "Reservation found by ID")
+
+	renewed := created.Add(2 * time.Hour)
+	assert.Nil(t, RenewReservation(db, expiring.ReservationID, renewed), "No error renewing reservation")
+	found, _ = GetReservation(db, expiring.ReservationID)
+	assert.WithinDuration(t, renewed, found.Expires, time.Millisecond, "Renewed expiry persisted")
+
+	assert.Nil(t, DeleteReservation(db, held.ReservationID), "No error deleting reservation")
+	assert.ErrorIs(t, DeleteReservation(db, held.ReservationID), sql.ErrNoRows, "Reservation only deleted once")
+	assert.ErrorIs(t, RenewReservation(db, held.ReservationID, renewed), sql.ErrNoRows, "Deleted reservation not renewed")
+	_, err = GetReservation(db, held.ReservationID)
+	assert.ErrorIs(t, err, sql.ErrNoRows, "Deleted reservation not found")
+}
+
+func TestReservationExpired(t *testing.T) {
+	now := time.Now()
+	assert.False(t, Reservation{}.Expired(now), "Reservation without expiry never expires")
+	assert.False(t, Reservation{Expires: now.Add(time.Second)}.Expired(now), "Future expiry not passed")
+	assert.True(t, Reservation{Expires: now}.Expired(now), "Expiry reached")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ammesonb/dispersed-backup/device"
+)
+
+// PlacementStrategy chooses which device a file is stored on, when no device is requested
+type PlacementStrategy interface {
+	// Choose returns one of the candidates, each of which has room for a file of the given size
+	Choose(candidates []*device.Device, size int64) *device.Device
+}
+
+// placement is the strategy used by the manager, which only uses it from its own goroutine
+var placement PlacementStrategy = firstFit{}
+
+// placementNames lists the strategies which can be configured by name
+var placementNames = []string{"first-fit", "best-fit", "most-free", "round-robin", "balance"}
+
+// makePlacement returns the named strategy, or if a threshold is given, one using the large strategy for files of at least that size
+func makePlacement(name string, largeName string, threshold int64) (PlacementStrategy, error) {
+	strategy, err := parsePlacement(name)
+	if err != nil || threshold <= 0 {
+		return strategy, err
+	}
+
+	large, err := parsePlacement(largeName)
+	if err != nil {
+		return nil, err
+	}
+
+	return bySize{threshold: threshold, small: strategy, large: large}, nil
+}
+
+// parsePlacement returns the strategy with the given name
+func parsePlacement(name string) (PlacementStrategy, error) {
+	switch name {
+	case "first-fit":
+		return firstFit{}, nil
+	case "best-fit":
+		return bestFit{}, nil
+	case "most-free":
+		return mostFree{}, nil
+	case "round-robin":
+		return &roundRobin{}, nil
+	case "balance":
+		return balanceFill{}, nil
+	default:
+		return nil, fmt.Errorf("%s is not a placement strategy, use one of %s", name, strings.Join(placementNames, ", "))
+	}
+}
+
+// firstFit stores files on the first device with room, in the order devices were added
+type firstFit struct{}
+
+// Choose returns the first candidate
+func (firstFit) Choose(candidates []*device.Device, _ int64) *device.Device {
+	return candidates[0]
+}
+
+// bestFit stores files on the device they fill most tightly, packing nearly full devices first
+type bestFit struct{}
+
+// Choose returns the candidate with the least space remaining
+func (bestFit) Choose(candidates []*device.Device, _ int64) *device.Device {
+	best := candidates[0]
+	for _, dev := range candidates[1:] {
+		if dev.RemainingSpace() < best.RemainingSpace() {
+			best = dev
+		}
+	}
+
+	return best
+}
+
+// mostFree stores files on the device with the most space remaining
+type mostFree struct{}
+
+// Choose returns the candidate with the most space remaining
+func (mostFree) Choose(candidates []*device.Device, _ int64) *device.Device {
+	best := candidates[0]
+	for _, dev := range candidates[1:] {
+		if dev.RemainingSpace() > best.RemainingSpace() {
+			best = dev
+		}
+	}
+
+	return best
+}
+
+// roundRobin stores each file on the next device in order of ID after the one last used
+type roundRobin struct {
+	last int
+}
+
+// Choose returns the candidate with the lowest ID after the last one chosen, wrapping around to the lowest ID
+func (strategy *roundRobin) Choose(candidates []*device.Device, _ int64) *device.Device {
+	var next, lowest *device.Device
+	for _, dev := range candidates {
+		if dev.DeviceID > strategy.last && (next == nil || dev.DeviceID < next.DeviceID) {
+			next = dev
+		}
+		if lowest == nil || dev.DeviceID < lowest.DeviceID {
+			lowest = dev
+		}
+	}
+
+	if next == nil {
+		next = lowest
+	}
+
+	strategy.last = next.DeviceID
+	return next
+}
+
+// balanceFill stores files on the device which would be least full once the file is stored
+type balanceFill struct{}
+
+// Choose returns the candidate with the lowest fill percentage after storing the file
+// Devices of unknown size are only chosen if there is no other candidate
+func (balanceFill) Choose(candidates []*device.Device, size int64) *device.Device {
+	var best *device.Device
+	var bestFill float64
+	for _, dev := range candidates {
+		fill := float64(100)
+		if dev.TotalSpace > 0 {
+			fill = float64(dev.TotalSpace-dev.RemainingSpace()+dev.Footprint(size)) / float64(dev.TotalSpace) * 100
+		}
+
+		if best == nil || fill < bestFill {
+			best, bestFill = dev, fill
+		}
+	}
+
+	return best
+}
+
+// bySize stores files of at least the threshold size with one strategy, and smaller files with another
+type bySize struct {
+	threshold int64
+	small     PlacementStrategy
+	large     PlacementStrategy
+}
+
+// Choose returns the candidate chosen by the strategy for the file's size
+func (strategy bySize) Choose(candidates []*device.Device, size int64) *device.Device {
+	if size >= strategy.threshold {
+		return strategy.large.Choose(candidates, size)
+	}
+
+	return strategy.small.Choose(candidates, size)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/stretchr/testify/assert"
+)
+
+// makePlacementDevices returns devices with differing space and fill, in order of ID
+func makePlacementDevices() []*device.Device {
+	return []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 500, TotalSpace: 1000},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 150, TotalSpace: 200},
+		{DeviceID: 3, MountPoint: "/mnt/3", AvailableSpace: 900, AllocatedSpace: 100, TotalSpace: 4000},
+	}
+}
+
+// Check each strategy chooses the expected device
+func TestPlacementStrategies(t *testing.T) {
+	devices := makePlacementDevices()
+
+	assert.Equal(t, devices[0], firstFit{}.Choose(devices, 10), "First device chosen")
+	assert.Equal(t, devices[1], bestFit{}.Choose(devices, 10), "Device with least space chosen")
+	assert.Equal(t, devices[2], mostFree{}.Choose(devices, 10), "Device with most space chosen")
+	assert.Equal(t, devices[1], balanceFill{}.Choose(devices, 10), "Least full device chosen, rather than most space")
+	assert.Equal(t, devices[0], balanceFill{}.Choose(devices, 140), "Fill compared once the file is stored")
+
+	unknown := &device.Device{DeviceID: 4, AvailableSpace: 5000}
+	assert.Equal(t, devices[2], balanceFill{}.Choose([]*device.Device{unknown, devices[2]}, 10), "Device of unknown size avoided")
+	assert.Equal(t, unknown, balanceFill{}.Choose([]*device.Device{unknown}, 10), "Device of unknown size used if only candidate")
+}
+
+// Check round-robin takes each device in turn, skipping those which are not candidates
+func TestRoundRobin(t *testing.T) {
+	devices := makePlacementDevices()
+	strategy := &roundRobin{}
+
+	assert.Equal(t, devices[0], strategy.Choose(devices, 10), "Lowest ID first")
+	assert.Equal(t, devices[1], strategy.Choose(devices, 10), "Next ID used")
+	assert.Equal(t, devices[2], strategy.Choose(devices, 10), "Last ID used")
+	assert.Equal(t, devices[0], strategy.Choose(devices, 10), "Wrapped back to lowest ID")
+	assert.Equal(t, devices[2], strategy.Choose([]*device.Device{devices[0], devices[2]}, 10), "Device without room skipped")
+	assert.Equal(t, devices[1], strategy.Choose(devices[1:2], 10), "Only candidate used")
+}
+
+// Check strategies are found by name, with large files placed separately if configured
+func TestMakePlacement(t *testing.T) {
+	for _, name := range placementNames {
+		strategy, err := makePlacement(name, "", 0)
+		assert.Nil(t, err, "No error for "+name)
+		assert.NotNil(t, strategy, "Strategy returned for "+name)
+	}
+
+	_, err := makePlacement("fastest", "most-free", 0)
+	assert.EqualError(
+		t,
+		err,
+		"fastest is not a placement strategy, use one of first-fit, best-fit, most-free, round-robin, balance",
+		"Unknown strategy rejected",
+	)
+	_, err = makePlacement("best-fit", "fastest", 100)
+	assert.Error(t, err, "Unknown large file strategy rejected")
+
+	strategy, err := makePlacement("best-fit", "fastest", 0)
+	assert.Nil(t, err, "Large file strategy ignored without threshold")
+	assert.Equal(t, bestFit{}, strategy, "Named strategy used alone")
+
+	strategy, err = makePlacement("best-fit", "most-free", 100)
+	assert.Nil(t, err, "No error with threshold")
+	devices := makePlacementDevices()
+	assert.Equal(t, devices[1], strategy.Choose(devices, 99), "Small file packed onto nearly full device")
+	assert.Equal(t, devices[2], strategy.Choose(devices, 100), "Large file placed on emptiest device")
+}
@@ -0,0 +1,194 @@
+package progress
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is the most often a meter will publish a report while copying
+const DefaultInterval = 500 * time.Millisecond
+
+// Report is a snapshot of the bytes copied so far for a job
+type Report struct {
+	JobID    int
+	WorkerID int
+	// File currently being copied
+	Path       string
+	BytesDone  int64
+	BytesTotal int64
+	Started    time.Time
+	Updated    time.Time
+	// Set on the last report for a job
+	Finished bool
+}
+
+// Rate returns the average bytes copied per second
+func (report Report) Rate() float64 {
+	elapsed := report.Updated.Sub(report.Started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(report.BytesDone) / elapsed
+}
+
+// ETA returns the estimated time until the copy completes, or zero if it cannot be estimated
+func (report Report) ETA() time.Duration {
+	rate := report.Rate()
+	remaining := report.BytesTotal - report.BytesDone
+	if rate <= 0 || remaining <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(remaining) / rate * float64(time.Second))
+}
+
+// Percent returns how much of the total has been copied, from 0 to 100
+func (report Report) Percent() float64 {
+	if report.BytesTotal <= 0 {
+		return 0
+	}
+
+	return float64(report.BytesDone) / float64(report.BytesTotal) * 100
+}
+
+// Meter counts the bytes written for a job, publishing reports while it does
+// A nil meter may be used where progress is not needed
+type Meter struct {
+	report   Report
+	reports  chan<- Report
+	interval time.Duration
+	lastSent time.Time
+}
+
+// NewMeter creates a meter publishing to the given channel for a job
+func NewMeter(jobID int, workerID int, reports chan<- Report) *Meter {
+	now := time.Now()
+	return &Meter{
+		report:   Report{JobID: jobID, WorkerID: workerID, Started: now, Updated: now},
+		reports:  reports,
+		interval: DefaultInterval,
+	}
+}
+
+// JobID returns the job the meter counts bytes for, or 0 for a nil meter
+func (meter *Meter) JobID() int {
+	if meter == nil {
+		return 0
+	}
+
+	return meter.report.JobID
+}
+
+// AddTotal increases the number of bytes the job is expected to copy
+func (meter *Meter) AddTotal(bytes int64) {
+	if meter == nil {
+		return
+	}
+
+	meter.report.BytesTotal += bytes
+	meter.publish(true)
+}
+
+// SetPath records the file currently being copied
+func (meter *Meter) SetPath(path string) {
+	if meter == nil {
+		return
+	}
+
+	meter.report.Path = path
+	meter.publish(true)
+}
+
+// Write counts the bytes written, so a meter can be used alongside the real destination
+func (meter *Meter) Write(p []byte) (int, error) {
+	if meter == nil {
+		return len(p), nil
+	}
+
+	meter.report.BytesDone += int64(len(p))
+	meter.publish(false)
+	return len(p), nil
+}
+
+// Finish publishes the final report for the job, which removes it from the tracker
+func (meter *Meter) Finish() {
+	if meter == nil {
+		return
+	}
+
+	meter.report.Finished = true
+	meter.report.Updated = time.Now()
+	meter.reports <- meter.report
+}
+
+// publish sends the current report if forced or the interval has passed
+// Intermediate reports are dropped rather than slowing the copy if the channel is full
+func (meter *Meter) publish(force bool) {
+	now := time.Now()
+	if !force && now.Sub(meter.lastSent) < meter.interval {
+		return
+	}
+
+	meter.report.Updated = now
+	select {
+	case meter.reports <- meter.report:
+		meter.lastSent = now
+	default:
+	}
+}
+
+// Tracker aggregates the latest report published for each in-flight job
+type Tracker struct {
+	lock    sync.Mutex
+	reports map[int]Report
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{reports: make(map[int]Report)}
+}
+
+// Run applies published reports until the channel is closed
+func (tracker *Tracker) Run(reports <-chan Report) {
+	for report := range reports {
+		tracker.apply(report)
+	}
+}
+
+// Get returns the latest report for a job, if it is in flight
+func (tracker *Tracker) Get(jobID int) (Report, bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	report, ok := tracker.reports[jobID]
+	return report, ok
+}
+
+// All returns the latest report for every in-flight job, ordered by job ID
+func (tracker *Tracker) All() []Report {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	reports := make([]Report, 0, len(tracker.reports))
+	for _, report := range tracker.reports {
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].JobID < reports[j].JobID })
+	return reports
+}
+
+// apply records a report, removing the job once it has finished
+func (tracker *Tracker) apply(report Report) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if report.Finished {
+		delete(tracker.reports, report.JobID)
+		return
+	}
+
+	tracker.reports[report.JobID] = report
+}
@@ -0,0 +1,121 @@
+package progress
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Check rate, ETA and percentage are derived from the report
+func TestReportCalculations(t *testing.T) {
+	started := time.Now()
+	report := Report{BytesDone: 100, BytesTotal: 400, Started: started, Updated: started.Add(2 * time.Second)}
+
+	assert.Equal(t, float64(50), report.Rate(), "Bytes per second")
+	assert.Equal(t, 6*time.Second, report.ETA(), "Remaining bytes at current rate")
+	assert.Equal(t, float64(25), report.Percent(), "Percent copied")
+
+	report.Updated = started
+	assert.Equal(t, float64(0), report.Rate(), "No rate without elapsed time")
+	assert.Equal(t, time.Duration(0), report.ETA(), "No ETA without rate")
+
+	report.BytesTotal = 0
+	assert.Equal(t, float64(0), report.Percent(), "No percent without total")
+}
+
+// Check a meter counts writes, throttling intermediate reports
+func TestMeter(t *testing.T) {
+	reports := make(chan Report, 10)
+	meter := NewMeter(3, 2, reports)
+	meter.interval = time.Hour
+	assert.Equal(t, 3, meter.JobID(), "Job returned")
+
+	meter.AddTotal(10)
+	report := <-reports
+	assert.Equal(t, 3, report.JobID, "Job identified")
+	assert.Equal(t, 2, report.WorkerID, "Worker identified")
+	assert.Equal(t, int64(10), report.BytesTotal, "Total published immediately")
+
+	meter.SetPath("/home/a.txt")
+	assert.Equal(t, "/home/a.txt", (<-reports).Path, "Path published immediately")
+
+	written, err := meter.Write([]byte("hello"))
+	assert.Nil(t, err, "No error counting bytes")
+	assert.Equal(t, 5, written, "All bytes accepted")
+	assert.Len(t, reports, 0, "Writes within the interval not published")
+
+	meter.interval = 0
+	meter.Write([]byte("world"))
+	assert.Equal(t, int64(10), (<-reports).BytesDone, "Writes after the interval published")
+
+	meter.Finish()
+	report = <-reports
+	assert.True(t, report.Finished, "Final report marked finished")
+	assert.Equal(t, int64(10), report.BytesDone, "Final count published")
+}
+
+// Check intermediate reports are dropped rather than blocking a full channel
+func TestMeterDoesNotBlock(t *testing.T) {
+	reports := make(chan Report)
+	meter := NewMeter(1, 1, reports)
+	meter.interval = 0
+
+	done := make(chan bool)
+	go func() {
+		meter.AddTotal(5)
+		meter.Write([]byte("hello"))
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		break
+	case <-time.After(time.Second):
+		assert.Fail(t, "Meter blocked on full channel")
+	}
+}
+
+// Check a nil meter can be used freely
+func TestNilMeter(t *testing.T) {
+	var meter *Meter
+
+	meter.AddTotal(5)
+	meter.SetPath("/home/a.txt")
+	written, err := meter.Write([]byte("hello"))
+	meter.Finish()
+
+	assert.Nil(t, err, "No error writing to nil meter")
+	assert.Equal(t, 5, written, "All bytes accepted")
+	assert.Equal(t, 0, meter.JobID(), "No job for nil meter")
+}
+
+// Check the tracker keeps the latest report per job, until finished
+func TestTracker(t *testing.T) {
+	tracker := NewTracker()
+	reports := make(chan Report)
+	done := make(chan bool)
+
+	go func() {
+		tracker.Run(reports)
+		done <- true
+	}()
+
+	reports <- Report{JobID: 2, BytesDone: 10}
+	reports <- Report{JobID: 1, BytesDone: 5}
+	reports <- Report{JobID: 2, BytesDone: 20}
+	reports <- Report{JobID: 1, BytesDone: 5, Finished: true}
+	close(reports)
+	<-done
+
+	report, ok := tracker.Get(2)
+	assert.True(t, ok, "In-flight job tracked")
+	assert.Equal(t, int64(20), report.BytesDone, "Latest report kept")
+
+	_, ok = tracker.Get(1)
+	assert.False(t, ok, "Finished job removed")
+
+	all := tracker.All()
+	assert.Len(t, all, 1, "Only in-flight jobs listed")
+	assert.Equal(t, 2, all[0].JobID, "In-flight job listed")
+}
@@ -0,0 +1,329 @@
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/logging"
+)
+
+// State is the section of the queue a job is in, which determines who owns it
+type State int
+
+// StatePending jobs are owned by the main thread, waiting for a worker
+const StatePending State = 1
+
+// StateInProgress jobs have been passed off to, and are owned by, a worker
+const StateInProgress State = 2
+
+// StateCompleted jobs have finished, and ownership has returned to the main thread
+const StateCompleted State = 3
+
+// Redundancy is how each file a job backs up is protected against losing drives
+type Redundancy struct {
+	// Number of whole copies of each file, each on a different drive
+	Copies int
+	// Number of shards each file is split into, and parity shards computed from them, each on a different drive
+	// Files are erasure-coded instead of copied when there are data shards
+	DataShards   int
+	ParityShards int
+}
+
+// Job is a unit of backup work
+type Job struct {
+	ID int
+	// Action to perform, interpreted by the worker
+	Action int
+	// Path to the file or folder to act on
+	Path string
+	Redundancy
+	State State
+	// Worker which owns the job, once in progress
+	WorkerID int
+	// Latest status message from the worker
+	Message string
+	// Reason the job failed, empty if it has not or succeeded
+	Error    string
+	Added    time.Time
+	Started  time.Time
+	Finished time.Time
+}
+
+// StatusUpdate is sent by a worker to report on a job it owns
+// Sending one with StateCompleted returns ownership of the job to the main thread
+type StatusUpdate struct {
+	JobID    int
+	WorkerID int
+	State    State
+	Message  string
+	Err      error
+}
+
+// Store persists jobs as they move through the queue, so they survive restarts
+type Store interface {
+	// AddJob persists a new job, returning it with its assigned ID
+	AddJob(job Job) (Job, error)
+	UpdateJob(job Job) error
+	DeleteJob(jobID int) error
+}
+
+// Queue tracks jobs through the pending, in progress and completed sections
+type Queue struct {
+	lock       sync.Mutex
+	store      Store
+	nextID     int
+	pending    []*Job
+	inProgress []*Job
+	completed  []*Job
+	// Signals the dispatcher that a job was added
+	added chan struct{}
+	// Closed to stop handing out jobs
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates an empty queue, which is not persisted
+func New() *Queue {
+	return &Queue{
+		nextID: 1,
+		added:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Restore creates a queue which persists to the given store, containing the jobs previously loaded from it
+// Jobs which were in progress were interrupted, so are returned to pending to be retried
+func Restore(store Store, jobs []Job) (*Queue, error) {
+	q := New()
+	q.store = store
+
+	for index := range jobs {
+		job := jobs[index]
+		switch job.State {
+		case StateCompleted:
+			q.completed = append(q.completed, &job)
+			continue
+		case StateInProgress:
+			job.State = StatePending
+			job.WorkerID = 0
+			job.Message = "Interrupted, will retry"
+			job.Started = time.Time{}
+			if err := store.UpdateJob(job); err != nil {
+				return nil, err
+			}
+		}
+
+		q.pending = append(q.pending, &job)
+	}
+
+	if len(q.pending) > 0 {
+		q.added <- struct{}{}
+	}
+
+	return q, nil
+}
+
+// Add appends a new pending job to the queue, returning it
+func (q *Queue) Add(action int, path string, redundancy Redundancy) (Job, error) {
+	q.lock.Lock()
+	job := &Job{
+		Action:     action,
+		Path:       path,
+		Redundancy: redundancy,
+		State:      StatePending,
+		Added:      time.Now(),
+	}
+
+	if q.store != nil {
+		stored, err := q.store.AddJob(*job)
+		if err != nil {
+			q.lock.Unlock()
+			return Job{}, err
+		}
+		job.ID = stored.ID
+	} else {
+		job.ID = q.nextID
+		q.nextID++
+	}
+
+	q.pending = append(q.pending, job)
+	q.lock.Unlock()
+
+	select {
+	case q.added <- struct{}{}:
+	default:
+	}
+
+	return *job, nil
+}
+
+// Pending returns a copy of the jobs waiting for a worker, in the order they will be handed out
+func (q *Queue) Pending() []Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return copyJobs(q.pending)
+}
+
+// InProgress returns a copy of the jobs currently owned by workers
+func (q *Queue) InProgress() []Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return copyJobs(q.inProgress)
+}
+
+// Completed returns a copy of the finished jobs, in the order they finished
+func (q *Queue) Completed() []Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return copyJobs(q.completed)
+}
+
+// ClearCompleted removes every finished job from the queue, returning how many were removed
+func (q *Queue) ClearCompleted() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	cleared := 0
+	for _, job := range q.completed {
+		if q.store != nil {
+			if err := q.store.DeleteJob(job.ID); err != nil {
+				q.completed = q.completed[cleared:]
+				return cleared, err
+			}
+		}
+		cleared++
+	}
+
+	q.completed = nil
+	return cleared, nil
+}
+
+// Stop prevents any further jobs being handed to workers, leaving them pending
+func (q *Queue) Stop() {
+	q.stopOnce.Do(func() { close(q.stop) })
+}
+
+// Dispatch hands pending jobs to workers and applies their status updates
+// The work channel is closed once the queue is stopped, and this returns after the updates channel is closed
+func (q *Queue) Dispatch(work chan<- Job, updates <-chan StatusUpdate) {
+	stop := q.stop
+	for {
+		var next chan<- Job
+		job, ok := q.peek()
+		if ok && stop != nil {
+			next = work
+		}
+
+		select {
+		case next <- job:
+			q.start(job.ID)
+		case update, ok := <-updates:
+			if !ok {
+				if stop != nil {
+					close(work)
+				}
+				return
+			}
+			q.Update(update)
+		case <-q.added:
+		case <-stop:
+			stop = nil
+			close(work)
+		}
+	}
+}
+
+// Update applies a status update from a worker, moving the job to the completed section if finished
+func (q *Queue) Update(update StatusUpdate) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	index := findJob(q.inProgress, update.JobID)
+	if index < 0 {
+		return
+	}
+
+	job := q.inProgress[index]
+	job.WorkerID = update.WorkerID
+	job.Message = update.Message
+
+	if update.State == StateCompleted {
+		job.State = StateCompleted
+		job.Finished = time.Now()
+		if update.Err != nil {
+			job.Error = update.Err.Error()
+		}
+
+		q.inProgress = append(q.inProgress[:index], q.inProgress[index+1:]...)
+		q.completed = append(q.completed, job)
+	}
+
+	q.persist(job)
+}
+
+// persist stores the current state of a job, if the queue has a store
+// Failures are reported but not fatal, since the in-memory queue remains correct
+func (q *Queue) persist(job *Job) {
+	if q.store == nil {
+		return
+	}
+
+	if err := q.store.UpdateJob(*job); err != nil {
+		logging.Default().Errorf("Failed to persist job %d: %v", job.ID, err)
+	}
+}
+
+// peek returns the next pending job, if any
+func (q *Queue) peek() (Job, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.pending) == 0 {
+		return Job{}, false
+	}
+
+	return *q.pending[0], true
+}
+
+// start moves a job from pending to in progress, once it has been passed to a worker
+func (q *Queue) start(jobID int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	index := findJob(q.pending, jobID)
+	if index < 0 {
+		return
+	}
+
+	job := q.pending[index]
+	job.State = StateInProgress
+	job.Started = time.Now()
+
+	q.pending = append(q.pending[:index], q.pending[index+1:]...)
+	q.inProgress = append(q.inProgress, job)
+	q.persist(job)
+}
+
+// findJob returns the index of the job with the given ID, or -1 if not present
+func findJob(jobs []*Job, jobID int) int {
+	for index, job := range jobs {
+		if job.ID == jobID {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// copyJobs returns copies of the given jobs, so they can be read without holding the lock
+func copyJobs(jobs []*Job) []Job {
+	copied := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		copied = append(copied, *job)
+	}
+
+	return copied
+}
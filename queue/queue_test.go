@@ -0,0 +1,234 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Check jobs are added as pending, with increasing IDs
+func TestAdd(t *testing.T) {
+	q := New()
+
+	first, err := q.Add(1, "/home/a", Redundancy{Copies: 1})
+	assert.Nil(t, err, "No error adding job")
+	second, _ := q.Add(2, "/home/b", Redundancy{Copies: 3})
+
+	assert.Equal(t, 1, first.ID, "First job ID")
+	assert.Equal(t, 2, second.ID, "IDs increase")
+	assert.Equal(t, StatePending, first.State, "Added jobs are pending")
+	assert.False(t, first.Added.IsZero(), "Added time set")
+
+	pending := q.Pending()
+	assert.Len(t, pending, 2, "Both jobs pending")
+	assert.Equal(t, "/home/a", pending[0].Path, "Pending in order added")
+	assert.Equal(t, 2, pending[1].Action, "Action kept")
+	assert.Equal(t, 3, pending[1].Copies, "Copies kept")
+	assert.Empty(t, q.InProgress(), "Nothing in progress")
+	assert.Empty(t, q.Completed(), "Nothing completed")
+}
+
+// Check jobs move between sections, and status updates are applied
+func TestJobLifecycle(t *testing.T) {
+	q := New()
+	job, _ := q.Add(1, "/home/a", Redundancy{Copies: 1})
+	q.Add(1, "/home/b", Redundancy{Copies: 1})
+
+	q.start(job.ID)
+	assert.Len(t, q.Pending(), 1, "Started job no longer pending")
+
+	inProgress := q.InProgress()
+	assert.Len(t, inProgress, 1, "Started job in progress")
+	assert.Equal(t, StateInProgress, inProgress[0].State, "State updated")
+	assert.False(t, inProgress[0].Started.IsZero(), "Start time set")
+
+	q.Update(StatusUpdate{JobID: job.ID, WorkerID: 3, State: StateInProgress, Message: "Copying"})
+	inProgress = q.InProgress()
+	assert.Equal(t, 3, inProgress[0].WorkerID, "Owning worker recorded")
+	assert.Equal(t, "Copying", inProgress[0].Message, "Message recorded")
+
+	q.Update(StatusUpdate{JobID: 99, State: StateCompleted})
+	assert.Len(t, q.InProgress(), 1, "Unknown job updates ignored")
+
+	q.Update(StatusUpdate{JobID: job.ID, WorkerID: 3, State: StateCompleted, Message: "Failed", Err: fmt.Errorf("disk full")})
+	assert.Empty(t, q.InProgress(), "Finished job no longer in progress")
+
+	completed := q.Completed()
+	assert.Len(t, completed, 1, "Finished job completed")
+	assert.Equal(t, StateCompleted, completed[0].State, "State updated")
+	assert.Equal(t, "disk full", completed[0].Error, "Failure recorded")
+	assert.False(t, completed[0].Finished.IsZero(), "Finish time set")
+
+	cleared, err := q.ClearCompleted()
+	assert.Nil(t, err, "No error clearing without a store")
+	assert.Equal(t, 1, cleared, "One job cleared")
+	assert.Empty(t, q.Completed(), "Completed section cleared")
+	assert.Len(t, q.Pending(), 1, "Pending untouched by clear")
+}
+
+// Check returned jobs are copies which cannot modify the queue
+func TestSectionsAreCopies(t *testing.T) {
+	q := New()
+	q.Add(1, "/home/a", Redundancy{Copies: 1})
+
+	pending := q.Pending()
+	pending[0].Path = "/changed"
+
+	assert.Equal(t, "/home/a", q.Pending()[0].Path, "Queue unchanged")
+}
+
+// Check the dispatcher hands out jobs as workers free up, and stops cleanly
+func TestDispatch(t *testing.T) {
+	q := New()
+	work := make(chan Job)
+	updates := make(chan StatusUpdate)
+	dispatched := make(chan bool)
+
+	go func() {
+		q.Dispatch(work, updates)
+		dispatched <- true
+	}()
+
+	q.Add(1, "/home/a", Redundancy{Copies: 1})
+	job := receiveJob(t, work)
+	assert.Equal(t, "/home/a", job.Path, "Pending job handed out")
+
+	q.Add(1, "/home/b", Redundancy{Copies: 1})
+	updates <- StatusUpdate{JobID: job.ID, WorkerID: 1, State: StateCompleted, Message: "Finished"}
+
+	next := receiveJob(t, work)
+	assert.Equal(t, "/home/b", next.Path, "Job added later handed out")
+
+	q.Stop()
+	q.Stop()
+
+	_, ok := <-work
+	assert.False(t, ok, "Work closed once stopped")
+	q.Add(1, "/home/c", Redundancy{Copies: 1})
+
+	updates <- StatusUpdate{JobID: next.ID, WorkerID: 2, State: StateCompleted, Message: "Finished"}
+	close(updates)
+
+	select {
+	case <-dispatched:
+		break
+	case <-time.After(time.Second):
+		assert.Fail(t, "Dispatch did not return after updates closed")
+	}
+
+	assert.Len(t, q.Completed(), 2, "Both handed out jobs completed")
+	assert.Empty(t, q.InProgress(), "Nothing left in progress")
+	assert.Len(t, q.Pending(), 1, "Job added after stopping stays pending")
+}
+
+// testStore records persisted jobs in memory
+type testStore struct {
+	nextID  int
+	jobs    map[int]Job
+	deleted []int
+	fail    bool
+}
+
+func (store *testStore) AddJob(job Job) (Job, error) {
+	if store.fail {
+		return Job{}, fmt.Errorf("database is locked")
+	}
+
+	store.nextID++
+	job.ID = store.nextID
+	store.jobs[job.ID] = job
+	return job, nil
+}
+
+func (store *testStore) UpdateJob(job Job) error {
+	if store.fail {
+		return fmt.Errorf("database is locked")
+	}
+
+	store.jobs[job.ID] = job
+	return nil
+}
+
+func (store *testStore) DeleteJob(jobID int) error {
+	if store.fail {
+		return fmt.Errorf("database is locked")
+	}
+
+	delete(store.jobs, jobID)
+	store.deleted = append(store.deleted, jobID)
+	return nil
+}
+
+// Check restored jobs are placed in the right sections, with interrupted ones retried
+func TestRestore(t *testing.T) {
+	store := &testStore{nextID: 10, jobs: make(map[int]Job)}
+	started := time.Now().Add(-time.Hour)
+
+	q, err := Restore(store, []Job{
+		{ID: 1, Path: "/done", State: StateCompleted},
+		{ID: 2, Path: "/interrupted", State: StateInProgress, WorkerID: 4, Started: started},
+		{ID: 3, Path: "/waiting", State: StatePending},
+	})
+	assert.Nil(t, err, "No error restoring")
+
+	pending := q.Pending()
+	assert.Len(t, pending, 2, "Interrupted and pending jobs are pending")
+	assert.Equal(t, "/interrupted", pending[0].Path, "Original order kept")
+	assert.Equal(t, StatePending, pending[0].State, "Interrupted job made pending")
+	assert.Equal(t, 0, pending[0].WorkerID, "Worker ownership dropped")
+	assert.True(t, pending[0].Started.IsZero(), "Start time reset")
+	assert.Equal(t, "Interrupted, will retry", pending[0].Message, "Retry noted")
+	assert.Equal(t, pending[0], store.jobs[2], "Interrupted job persisted as pending")
+	assert.Len(t, q.Completed(), 1, "Completed job restored")
+	assert.Empty(t, q.InProgress(), "Nothing in progress after restore")
+
+	store.fail = true
+	_, err = Restore(store, []Job{{ID: 2, State: StateInProgress}})
+	assert.EqualErrorf(t, err, "database is locked", "Persistence failure returned")
+}
+
+// Check jobs are persisted as they move through the queue
+func TestPersistence(t *testing.T) {
+	store := &testStore{jobs: make(map[int]Job)}
+	q, _ := Restore(store, nil)
+
+	job, err := q.Add(1, "/home/a", Redundancy{Copies: 1})
+	assert.Nil(t, err, "No error adding job")
+	assert.Equal(t, 1, job.ID, "ID assigned by store")
+	assert.Equal(t, StatePending, store.jobs[1].State, "Pending job persisted")
+
+	q.start(job.ID)
+	assert.Equal(t, StateInProgress, store.jobs[1].State, "In progress job persisted")
+
+	q.Update(StatusUpdate{JobID: job.ID, WorkerID: 2, State: StateCompleted, Err: fmt.Errorf("disk full")})
+	assert.Equal(t, StateCompleted, store.jobs[1].State, "Completed job persisted")
+	assert.Equal(t, "disk full", store.jobs[1].Error, "Failure persisted")
+
+	store.fail = true
+	_, err = q.Add(1, "/home/b", Redundancy{Copies: 1})
+	assert.EqualErrorf(t, err, "database is locked", "Add fails if not persisted")
+	assert.Empty(t, q.Pending(), "Unpersisted job not queued")
+
+	cleared, err := q.ClearCompleted()
+	assert.EqualErrorf(t, err, "database is locked", "Clear failure returned")
+	assert.Equal(t, 0, cleared, "Nothing cleared")
+	assert.Len(t, q.Completed(), 1, "Completed job kept if not deleted")
+
+	store.fail = false
+	cleared, err = q.ClearCompleted()
+	assert.Nil(t, err, "No error clearing")
+	assert.Equal(t, 1, cleared, "Completed job cleared")
+	assert.Equal(t, []int{1}, store.deleted, "Cleared job deleted from store")
+}
+
+func receiveJob(t *testing.T, work <-chan Job) Job {
+	select {
+	case job := <-work:
+		return job
+	case <-time.After(time.Second):
+		assert.Fail(t, "No job handed out")
+		return Job{}
+	}
+}
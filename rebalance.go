@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+)
+
+// ErrInvalidBand is returned when rebalancing with a band which is not a usable percentage
+var ErrInvalidBand = fmt.Errorf("Band must be more than 0 and at most 100 percent")
+
+// rebalance plans moves so every device's fill is within the command's band of the average
+var rebalance = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB) (MovePlan, error) {
+	if command.band <= 0 || command.band > 100 {
+		return MovePlan{}, ErrInvalidBand
+	}
+
+	files, err := filterDBFiles(db, mydb.FileFilter{})
+	if err != nil {
+		return MovePlan{}, err
+	}
+
+	return planRebalance(*devices, files, command.band), nil
+}
+
+// fillLevels tracks how much of each device would be used as moves are planned
+type fillLevels map[*device.Device]int64
+
+// fill returns the percentage of the device which would be used
+func (levels fillLevels) fill(dev *device.Device) float64 {
+	return float64(levels[dev]) / float64(dev.TotalSpace) * 100
+}
+
+// extremes returns the fullest and emptiest devices, preferring those listed first if equal
+func (levels fillLevels) extremes(devices []*device.Device) (*device.Device, *device.Device) {
+	var fullest, emptiest *device.Device
+	for _, dev := range devices {
+		if _, ok := levels[dev]; !ok {
+			continue
+		}
+
+		if fullest == nil || levels.fill(dev) > levels.fill(fullest) {
+			fullest = dev
+		}
+		if emptiest == nil || levels.fill(dev) < levels.fill(emptiest) {
+			emptiest = dev
+		}
+	}
+
+	return fullest, emptiest
+}
+
+// planRebalance repeatedly moves the largest suitable file from the fullest device to the emptiest,
+// until every device is within band percent of the average fill or no file would keep both devices within it
+// Each file is moved at most once, never onto a drive holding another copy of it,
+// and offline or read-only devices or those of unknown size are left alone
+func planRebalance(devices []*device.Device, files []mydb.File, band float64) MovePlan {
+	levels := make(fillLevels)
+	byID := make(map[int]*device.Device)
+	var used, total int64
+	for _, dev := range devices {
+		if !dev.Writable() || dev.TotalSpace == 0 {
+			continue
+		}
+
+		levels[dev] = int64(dev.TotalSpace - dev.RemainingSpace())
+		byID[dev.DeviceID] = dev
+		used += levels[dev]
+		total += int64(dev.TotalSpace)
+	}
+
+	holders := makeReplicaHolders(files, devices)
+	candidates := make(map[*device.Device][]mydb.File)
+	for _, file := range files {
+		if dev, ok := byID[file.DeviceID]; ok {
+			candidates[dev] = append(candidates[dev], file)
+		}
+	}
+	for _, stored := range candidates {
+		sort.SliceStable(stored, func(i, j int) bool { return stored[i].Size > stored[j].Size })
+	}
+
+	plan := MovePlan{Fill: make(map[string]float64)}
+	if total > 0 {
+		average := float64(used) / float64(total) * 100
+		for {
+			from, to := levels.extremes(devices)
+			if from == to || (levels.fill(from) <= average+band && levels.fill(to) >= average-band) {
+				break
+			}
+
+			index := pickMove(levels, holders, candidates[from], from, to, average, band)
+			if index < 0 {
+				break
+			}
+
+			file := candidates[from][index]
+			candidates[from] = append(candidates[from][:index], candidates[from][index+1:]...)
+			levels[from] -= file.Size
+			levels[to] += file.Size
+			holders.move(file, to)
+			plan.Moves = append(plan.Moves, FileMove{File: file, From: from.MountPoint, To: to.MountPoint})
+			plan.Bytes += file.Size
+		}
+	}
+
+	for dev := range levels {
+		plan.Fill[dev.MountPoint] = levels.fill(dev)
+	}
+
+	return plan
+}
+
+// pickMove returns the index of the largest file which leaves both devices within band of the average once moved,
+// and fits in the space remaining on the destination without another copy of it, or -1 if there is none
+func pickMove(
+	levels fillLevels,
+	holders replicaHolders,
+	files []mydb.File,
+	from *device.Device,
+	to *device.Device,
+	average float64,
+	band float64,
+) int {
+	for index, file := range files {
+		if holders.blocks(file, to) {
+			continue
+		}
+
+		fromFill := float64(levels[from]-file.Size) / float64(from.TotalSpace) * 100
+		toFill := float64(levels[to]+file.Size) / float64(to.TotalSpace) * 100
+		remaining := int64(to.TotalSpace) - levels[to]
+
+		if fromFill >= average-band && toFill <= average+band && remaining > int64(to.Footprint(file.Size)) {
+			return index
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Check files move from the fullest to the emptiest devices until all are within the band
+func TestPlanRebalance(t *testing.T) {
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 20, TotalSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 80, TotalSpace: 100},
+		{DeviceID: 3, MountPoint: "/mnt/3", AvailableSpace: 60, AllocatedSpace: 10, TotalSpace: 100},
+		{DeviceID: 4, MountPoint: "/mnt/4"},
+	}
+	files := []mydb.File{
+		{FileID: 1, DeviceID: 1, Size: 10},
+		{FileID: 2, DeviceID: 1, Size: 30},
+		{FileID: 3, DeviceID: 1, Size: 20},
+		{FileID: 4, DeviceID: 5, Size: 50},
+	}
+
+	plan := planRebalance(devices, files, 5)
+	assert.Equal(t, []FileMove{{File: files[1], From: "/mnt/1", To: "/mnt/2"}}, plan.Moves, "Largest file which evens out fill moved")
+	assert.Equal(t, int64(30), plan.Bytes, "Bytes to move totalled")
+	assert.Equal(t, map[string]float64{"/mnt/1": 50, "/mnt/2": 50, "/mnt/3": 50}, plan.Fill, "Devices of unknown size left out")
+	assert.Equal(t, uint64(20), devices[0].AvailableSpace, "Planning changes no devices")
+
+	plan = planRebalance(devices, []mydb.File{{FileID: 1, DeviceID: 1, Size: 60}}, 5)
+	assert.Empty(t, plan.Moves, "File which would overshoot the band left")
+	assert.Equal(t, float64(80), plan.Fill["/mnt/1"], "Fill unchanged")
+
+	plan = planRebalance(devices[:1], files, 5)
+	assert.Empty(t, plan.Moves, "Nothing to balance with one device")
+
+	devices[1].Offline = true
+	plan = planRebalance(devices, files, 5)
+	assert.Equal(t, "/mnt/3", plan.Moves[0].To, "Offline device left out")
+	assert.NotContains(t, plan.Fill, "/mnt/2", "Offline device has no fill")
+
+	devices[1].Offline = false
+	devices[1].ReadOnly = true
+	plan = planRebalance(devices, files, 5)
+	assert.NotContains(t, plan.Fill, "/mnt/2", "Read-only device left out")
+}
+
+// Check devices only slightly above average still give files to one far below it
+func TestPlanRebalanceBelowBand(t *testing.T) {
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 48, TotalSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 48, TotalSpace: 100},
+		{DeviceID: 3, MountPoint: "/mnt/3", AvailableSpace: 48, TotalSpace: 100},
+		{DeviceID: 4, MountPoint: "/mnt/4", AvailableSpace: 80, TotalSpace: 100},
+	}
+	files := []mydb.File{
+		{FileID: 1, SourcePath: "/home/a.txt", DeviceID: 1, Size: 10},
+		{FileID: 2, SourcePath: "/home/b.txt", DeviceID: 2, Size: 10},
+		{FileID: 3, SourcePath: "/home/c.txt", DeviceID: 3, Size: 10},
+	}
+
+	plan := planRebalance(devices, files, 10)
+	assert.Equal(
+		t,
+		[]FileMove{{File: files[0], From: "/mnt/1", To: "/mnt/4"}, {File: files[1], From: "/mnt/2", To: "/mnt/4"}},
+		plan.Moves,
+		"Files moved until the emptiest device is within band",
+	)
+	assert.Equal(t, map[string]float64{"/mnt/1": 42, "/mnt/2": 42, "/mnt/3": 52, "/mnt/4": 40}, plan.Fill, "Final fill reported")
+}
+
+// Check a file is not moved onto a device holding another copy of it
+func TestPlanRebalanceReplicas(t *testing.T) {
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 20, TotalSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 80, TotalSpace: 100},
+	}
+	files := []mydb.File{
+		{FileID: 1, SourcePath: "/home/a.txt", DeviceID: 1, Size: 30},
+		{FileID: 2, SourcePath: "/home/a.txt", DeviceID: 2, Size: 30},
+		{FileID: 3, SourcePath: "/home/b.txt", DeviceID: 1, Size: 20},
+	}
+
+	plan := planRebalance(devices, files, 5)
+	assert.Equal(t, []FileMove{{File: files[2], From: "/mnt/1", To: "/mnt/2"}}, plan.Moves, "Smaller file without a copy there moved")
+}
+
+// Check rebalancing moves files and keeps each device's space accounted for
+func TestRebalance(t *testing.T) {
+	realFilter := filterDBFiles
+	realMove := moveDBFile
+
+	from := &device.Device{DeviceID: 1, MountPoint: t.TempDir(), AvailableSpace: 20, TotalSpace: 100}
+	to := &device.Device{DeviceID: 2, MountPoint: t.TempDir(), AvailableSpace: 100, AllocatedSpace: 10, TotalSpace: 100}
+	file := makeTestCopy(t, from, "/home/a.txt", strings.Repeat("a", 35))
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return []mydb.File{file}, nil
+	}
+	recorded := 0
+	moveDBFile = func(_ *sql.DB, _ int, deviceID int) error {
+		recorded = deviceID
+		return nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		moveDBFile = realMove
+	}()
+
+	devices := []*device.Device{from, to}
+	_, err := rebalance(DeviceCommand{band: 0}, &devices, &sql.DB{})
+	assert.ErrorIs(t, err, ErrInvalidBand, "Band required")
+	_, err = rebalance(DeviceCommand{band: 101}, &devices, &sql.DB{})
+	assert.ErrorIs(t, err, ErrInvalidBand, "Band must be a percentage")
+
+	devMan := makeTestDevMan(t, devices)
+	defer close(devMan.commands)
+
+	plan, err := devMan.Rebalance(5, true)
+	assert.Nil(t, err, "No error planning")
+	assert.Len(t, plan.Moves, 1, "Move planned")
+	assert.Equal(t, 0, recorded, "Nothing moved in dry run")
+	assert.Equal(t, uint64(20), from.RemainingSpace(), "No space released in dry run")
+
+	plan, err = devMan.Rebalance(5, false)
+	assert.Nil(t, err, "No error rebalancing")
+	assert.Equal(t, 2, recorded, "File moved")
+	assert.Equal(t, uint64(55), from.RemainingSpace(), "Space released from source")
+	assert.Equal(t, uint64(45), to.AllocatedSpace, "Space reserved on destination")
+	assert.Equal(t, from.FillPercent(), plan.Fill[from.MountPoint], "Planned fill reached on source")
+	assert.Equal(t, to.FillPercent(), plan.Fill[to.MountPoint], "Planned fill reached on destination")
+}
+
+// Check a failed move stops rebalancing, reporting how far it got
+func TestRebalanceFails(t *testing.T) {
+	realFilter := filterDBFiles
+	realCopy := copyMove
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return []mydb.File{{FileID: 1, SourcePath: "/home/a.txt", DeviceID: 1, Size: 30}}, nil
+	}
+	copyMove = func(move FileMove) error {
+		return fmt.Errorf("Failed to move %s", move.File.SourcePath)
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		copyMove = realCopy
+	}()
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 20, TotalSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 80, TotalSpace: 100},
+	}
+	devMan := makeTestDevMan(t, devices)
+	defer close(devMan.commands)
+
+	_, err := devMan.Rebalance(5, false)
+	assert.EqualError(t, err, "Failed to move /home/a.txt (0 of 1 files moved)", "Progress reported")
+	if _, err = devMan.ListDevices(); err != nil {
+		panic(err)
+	}
+	assert.Equal(t, uint64(0), devices[1].AllocatedSpace, "Reservation for failed move freed")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/logging"
+)
+
+var remeasure = (*device.Device).Remeasure
+
+// refreshInterval is how often the manager reclaims expired reservations and re-measures idle devices,
+// or never if not positive
+var refreshInterval = time.Minute
+
+// driftLogPercent is how much of a device's size its free space must change by outside of backups to be logged
+const driftLogPercent = 1
+
+// refreshDevices re-measures the free space of idle devices, so space used or freed by other programs is accounted for
+// Devices with outstanding reservations are skipped, since files being written to them would be counted twice
+func refreshDevices(devices *[]*device.Device, db *sql.DB) {
+	reservations, err := getDBReservations(db)
+	if err != nil {
+		logging.Default().Warnf("Failed to check reservations before refreshing devices: %v", err)
+		return
+	}
+
+	reserved := make(map[int]bool)
+	for _, reservation := range reservations {
+		reserved[reservation.DeviceID] = true
+	}
+
+	for _, dev := range *devices {
+		if dev.Offline || reserved[dev.DeviceID] {
+			continue
+		}
+
+		// Files stored since the device was last measured are expected to have used up the space allocated to them
+		expected := dev.RemainingSpace()
+		if err = remeasure(dev); err != nil {
+			logging.Default().Warnf("Failed to refresh free space of device %d at %s: %v", dev.DeviceID, dev.MountPoint, err)
+			continue
+		}
+		// Those files are now counted as used rather than allocated
+		dev.AllocatedSpace = 0
+
+		if drifted(expected, dev.AvailableSpace, dev.TotalSpace) {
+			logging.Default().Warnf(
+				"Free space on device %d at %s changed from the %s expected to %s outside of backups",
+				dev.DeviceID,
+				dev.MountPoint,
+				formatBytes(expected),
+				formatBytes(dev.AvailableSpace),
+			)
+		}
+	}
+}
+
+// drifted returns whether free space differs from what was expected by at least the logged percentage of the device's size
+func drifted(expected uint64, current uint64, total uint64) bool {
+	change := current - expected
+	if expected > current {
+		change = expected - current
+	}
+
+	return total > 0 && float64(change)/float64(total)*100 >= driftLogPercent
+}
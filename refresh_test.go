@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Check only online devices without reservations are re-measured
+func TestRefreshDevices(t *testing.T) {
+	realRemeasure := remeasure
+	realReservations := getDBReservations
+
+	measured := make(map[int]bool)
+	remeasure = func(dev *device.Device) error {
+		measured[dev.DeviceID] = true
+		if dev.DeviceID == 4 {
+			return fmt.Errorf("No device mounted on %s", dev.MountPoint)
+		}
+
+		dev.AvailableSpace = 40
+		return nil
+	}
+	getDBReservations = func(_ *sql.DB) ([]mydb.Reservation, error) {
+		return []mydb.Reservation{{ReservationID: 1, DeviceID: 2, Size: 10}}, nil
+	}
+	defer func() {
+		remeasure = realRemeasure
+		getDBReservations = realReservations
+	}()
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100, AllocatedSpace: 30, TotalSpace: 200},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 100, AllocatedSpace: 10, TotalSpace: 200},
+		{DeviceID: 3, MountPoint: "/mnt/3", Offline: true},
+		{DeviceID: 4, MountPoint: "/mnt/4", AvailableSpace: 100, TotalSpace: 200},
+	}
+
+	refreshDevices(&devices, &sql.DB{})
+	assert.Equal(t, map[int]bool{1: true, 4: true}, measured, "Idle online devices measured")
+	assert.Equal(t, uint64(40), devices[0].AvailableSpace, "Free space reconciled")
+	assert.Equal(t, uint64(0), devices[0].AllocatedSpace, "Stored files counted as used instead of allocated")
+	assert.Equal(t, uint64(100), devices[1].AvailableSpace, "Device with reservations left alone")
+	assert.Equal(t, uint64(100), devices[3].AvailableSpace, "Failed measurement leaves free space")
+}
+
+// Check drift from the expected free space is measured as a share of the device's size, in either direction
+func TestDrifted(t *testing.T) {
+	assert.True(t, drifted(100, 98, 200), "Shrinking by 1% logged")
+	assert.True(t, drifted(100, 150, 200), "Growing logged")
+	assert.False(t, drifted(1000, 999, 200000), "Small change ignored")
+	assert.False(t, drifted(0, 10, 0), "Unknown size ignored")
+
+	stored := device.Device{AvailableSpace: 100, AllocatedSpace: 30, TotalSpace: 200}
+	assert.False(t, drifted(stored.RemainingSpace(), 70, stored.TotalSpace), "Space used by stored files expected")
+}
+
+// Check the manager refreshes devices between commands on each tick
+func TestProcessRefreshes(t *testing.T) {
+	realRemeasure := remeasure
+	realInterval := refreshInterval
+	realReservations := getDBReservations
+
+	measured := make(chan int, 10)
+	remeasure = func(dev *device.Device) error {
+		measured <- dev.DeviceID
+		return nil
+	}
+	refreshInterval = time.Millisecond
+	getDBReservations = func(_ *sql.DB) ([]mydb.Reservation, error) {
+		return nil, nil
+	}
+	defer func() {
+		remeasure = realRemeasure
+		refreshInterval = realInterval
+		getDBReservations = realReservations
+	}()
+
+	commands := make(chan DeviceCommand)
+	devices := []*device.Device{{DeviceID: 1, MountPoint: "/mnt/1"}}
+	done := make(chan bool)
+	go func() {
+		process(&devices, &sql.DB{}, commands, nil)
+		done <- true
+	}()
+
+	select {
+	case deviceID := <-measured:
+		assert.Equal(t, 1, deviceID, "Device refreshed")
+	case <-time.After(time.Second):
+		assert.Fail(t, "Device not refreshed")
+	}
+
+	close(commands)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Manager did not stop")
+	}
+}
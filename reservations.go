@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/logging"
+	"github.com/ammesonb/dispersed-backup/mydb"
+)
+
+var addDBReservation = mydb.AddReservation
+var getDBReservation = mydb.GetReservation
+var getDBReservations = mydb.GetReservations
+var deleteDBReservation = mydb.DeleteReservation
+var renewDBReservation = mydb.RenewReservation
+
+// reservationExpiry is how long a backup holds its reservation before the space is reclaimed, if never freed
+// Backups renew their reservations while still writing, so only those of a worker which stopped are reclaimed
+var reservationExpiry = time.Hour
+
+// ErrNoSuchReservation is returned when freeing a reservation which was never made, or is already freed or reclaimed
+var ErrNoSuchReservation = fmt.Errorf("No such reservation")
+
+// holdSpace reserves space on a device as reserveSpace does, recording the reservation so it can be freed by its ID
+// The reservation expires after the command's expiry, if one is given
+var holdSpace = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB) (mydb.Reservation, string, error) {
+	mount, err := reserveSpace(command, devices)
+	if err != nil {
+		return mydb.Reservation{}, "", err
+	}
+
+	dev := findDevice(devices, mount, "")
+	reservation := mydb.Reservation{
+		JobID:    command.jobID,
+		DeviceID: dev.DeviceID,
+		Size:     command.space,
+		Created:  time.Now(),
+		Move:     len(command.move.File.SourcePath) > 0,
+	}
+	if command.expiry > 0 {
+		reservation.Expires = reservation.Created.Add(command.expiry)
+	}
+
+	reservation, err = addDBReservation(db, reservation)
+	if err != nil {
+		dev.UnreserveFile(command.space)
+		return mydb.Reservation{}, "", fmt.Errorf("Failed to record reservation: %v", err)
+	}
+
+	return reservation, mount, nil
+}
+
+// holdCopies holds space as holdSpace does for each of the command's copies, on devices with different serials
+// Either every copy is held, or none are, with the devices used returned in the same order as their reservations
+var holdCopies = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB) ([]*device.Device, []mydb.Reservation, error) {
+	command.avoid = make(map[int]bool)
+	var held []*device.Device
+	var reservations []mydb.Reservation
+	for len(reservations) < command.copies {
+		reservation, _, err := holdSpace(command, devices, db)
+		if err != nil {
+			releaseHeld(reservations, devices, db)
+			if len(reservations) > 0 {
+				err = fmt.Errorf("Only %d of %d copies have room on separate drives: %w", len(reservations), command.copies, err)
+			}
+
+			return nil, nil, err
+		}
+
+		dev := findDeviceByID(devices, reservation.DeviceID)
+		for _, other := range *devices {
+			if sameDrive(dev, other) {
+				command.avoid[other.DeviceID] = true
+			}
+		}
+
+		held = append(held, dev)
+		reservations = append(reservations, reservation)
+	}
+
+	return held, reservations, nil
+}
+
+// releaseHeld frees reservations made for copies of a file which cannot all be stored
+func releaseHeld(reservations []mydb.Reservation, devices *[]*device.Device, db *sql.DB) {
+	for _, reservation := range reservations {
+		if err := freeSpace(DeviceCommand{reservationID: reservation.ReservationID}, devices, db); err != nil {
+			logging.Default().Warnf("Failed to free reservation %d: %v", reservation.ReservationID, err)
+		}
+	}
+}
+
+// freeSpace releases the space held by the command's reservation, for a file which was not stored
+var freeSpace = func(command DeviceCommand, devices *[]*device.Device, db *sql.DB) error {
+	reservation, err := takeReservation(db, command.reservationID)
+	if err != nil {
+		return err
+	}
+
+	if dev := findDeviceByID(devices, reservation.DeviceID); dev != nil {
+		dev.UnreserveFile(reservation.Size)
+	}
+
+	return nil
+}
+
+// commitSpace ends the command's reservation once its file is stored
+// The space stays allocated until the device is next measured, which counts the file as used instead
+var commitSpace = func(command DeviceCommand, db *sql.DB) error {
+	_, err := takeReservation(db, command.reservationID)
+	return err
+}
+
+// renewSpace moves the expiry of the command's reservation to the command's expiry from now,
+// so a backup which is still writing keeps its space
+var renewSpace = func(command DeviceCommand, db *sql.DB) error {
+	err := renewDBReservation(db, command.reservationID, time.Now().Add(command.expiry))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %d", ErrNoSuchReservation, command.reservationID)
+	}
+
+	return err
+}
+
+// takeReservation removes a reservation from the ledger, returning it
+func takeReservation(db *sql.DB, reservationID int) (mydb.Reservation, error) {
+	reservation, err := getDBReservation(db, reservationID)
+	if err == nil {
+		err = deleteDBReservation(db, reservationID)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return mydb.Reservation{}, fmt.Errorf("%w: %d", ErrNoSuchReservation, reservationID)
+	} else if err != nil {
+		return mydb.Reservation{}, err
+	}
+
+	return reservation, nil
+}
+
+// restoreReservations holds the space of reservations made through the API before the manager started on their devices again
+// Reservations for jobs or moves are dropped, since whatever held them stopped with the previous process
+// and interrupted jobs reserve again when retried, as are expired reservations and those on devices which are gone
+// or cannot be written to
+func restoreReservations(devices *[]*device.Device, db *sql.DB) {
+	reservations, err := getDBReservations(db)
+	if err != nil {
+		logging.Default().Errorf("Failed to load reservations: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, reservation := range reservations {
+		dev := findDeviceByID(devices, reservation.DeviceID)
+		if dev != nil && dev.Writable() && !reservation.Expired(now) && reservation.JobID == 0 && !reservation.Move {
+			dev.ReserveFile(reservation.Size)
+			continue
+		}
+
+		if err = deleteDBReservation(db, reservation.ReservationID); err != nil {
+			logging.Default().Warnf("Failed to drop reservation %d: %v", reservation.ReservationID, err)
+		}
+	}
+}
+
+// reclaimReservations frees the space of expired reservations, such as those of a worker which stopped without freeing them
+func reclaimReservations(devices *[]*device.Device, db *sql.DB) {
+	reservations, err := getDBReservations(db)
+	if err != nil {
+		logging.Default().Warnf("Failed to check for expired reservations: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, reservation := range reservations {
+		if !reservation.Expired(now) {
+			continue
+		}
+
+		if err = freeSpace(DeviceCommand{reservationID: reservation.ReservationID}, devices, db); err != nil {
+			logging.Default().Warnf("Failed to reclaim reservation %d: %v", reservation.ReservationID, err)
+			continue
+		}
+
+		logging.Default().Warnf(
+			"Reclaimed %s reserved on device %d for job %d, which expired at %s",
+			formatBytes(uint64(reservation.Size)),
+			reservation.DeviceID,
+			reservation.JobID,
+			reservation.Expires.Format(time.RFC3339),
+		)
+	}
+}
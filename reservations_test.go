@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Check reservations are recorded, and can only be freed or committed once
+func TestHoldSpace(t *testing.T) {
+	db := makeTestDB(t)
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 4000},
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 20000, BlockSize: 4096},
+	}
+
+	reservation, mount, err := holdSpace(DeviceCommand{space: 5000, jobID: 3, expiry: time.Minute}, &devices, db)
+	assert.Nil(t, err, "No error holding space")
+	assert.Equal(t, "/mnt/2", mount, "Device with room used")
+	assert.Equal(t, 2, reservation.DeviceID, "Device recorded")
+	assert.Equal(t, 3, reservation.JobID, "Owner recorded")
+	assert.Equal(t, reservation.Created.Add(time.Minute), reservation.Expires, "Expiry recorded")
+	assert.Equal(t, uint64(12288), devices[1].AllocatedSpace, "Blocks reserved")
+
+	stored, err := mydb.GetReservations(db)
+	assert.Nil(t, err, "No error reading ledger")
+	assert.Len(t, stored, 1, "Reservation stored")
+
+	command := DeviceCommand{reservationID: reservation.ReservationID}
+	assert.Nil(t, freeSpace(command, &devices, db), "No error freeing")
+	assert.Equal(t, uint64(0), devices[1].AllocatedSpace, "Reserved blocks freed")
+	assert.ErrorIs(t, freeSpace(command, &devices, db), ErrNoSuchReservation, "Reservation only freed once")
+	assert.Equal(t, uint64(0), devices[1].AllocatedSpace, "Nothing more freed")
+
+	reservation, _, err = holdSpace(DeviceCommand{space: 50, mountPoint: "/mnt/1"}, &devices, db)
+	assert.Nil(t, err, "No error holding space on requested device")
+	assert.True(t, reservation.Expires.IsZero(), "No expiry unless requested")
+	assert.False(t, reservation.Move, "Not a move unless one is given")
+
+	command = DeviceCommand{reservationID: reservation.ReservationID}
+	assert.Nil(t, commitSpace(command, db), "No error committing")
+	assert.Equal(t, uint64(50), devices[0].AllocatedSpace, "Committed space kept until measured")
+	assert.ErrorIs(t, freeSpace(command, &devices, db), ErrNoSuchReservation, "Committed reservation cannot be freed")
+	assert.ErrorIs(t, commitSpace(command, db), ErrNoSuchReservation, "Reservation only committed once")
+
+	moving, _, err := holdSpace(DeviceCommand{space: 5, move: FileMove{File: mydb.File{SourcePath: "/home/a.txt"}}}, &devices, db)
+	assert.Nil(t, err, "No error holding space for a move")
+	assert.True(t, moving.Move, "Reservation for a move marked")
+	if err = freeSpace(DeviceCommand{reservationID: moving.ReservationID}, &devices, db); err != nil {
+		panic(err)
+	}
+
+	_, _, err = holdSpace(DeviceCommand{space: 50000}, &devices, db)
+	assert.ErrorIs(t, err, ErrNoSpace, "Space must be available")
+	stored, _ = mydb.GetReservations(db)
+	assert.Empty(t, stored, "Nothing recorded without space")
+}
+
+// Check reservations made through the API before a restart are held again, unless they can no longer be
+func TestRestoreReservations(t *testing.T) {
+	db := makeTestDB(t)
+	now := time.Now()
+	for _, reservation := range []mydb.Reservation{
+		{DeviceID: 1, Size: 10, Created: now},
+		{DeviceID: 1, Size: 20, Created: now, Expires: now.Add(-time.Second)},
+		{DeviceID: 2, Size: 30, Created: now},
+		{DeviceID: 3, Size: 40, Created: now},
+		{JobID: 4, DeviceID: 1, Size: 50, Created: now, Expires: now.Add(time.Hour)},
+		{DeviceID: 1, Size: 60, Created: now, Expires: now.Add(time.Hour), Move: true},
+	} {
+		if _, err := mydb.AddReservation(db, reservation); err != nil {
+			panic(err)
+		}
+	}
+
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", Offline: true},
+	}
+	restoreReservations(&devices, db)
+	assert.Equal(t, uint64(10), devices[0].AllocatedSpace, "Outstanding API reservation held, without those of jobs or moves")
+	assert.Equal(t, uint64(0), devices[1].AllocatedSpace, "Nothing held on offline device")
+
+	stored, err := mydb.GetReservations(db)
+	assert.Nil(t, err, "No error reading ledger")
+	assert.Len(t, stored, 1, "Expired reservations, those of jobs or moves, and those on unusable devices dropped")
+	assert.Equal(t, int64(10), stored[0].Size, "Held reservation kept")
+}
+
+// Check expired reservations are reclaimed, leaving the others
+func TestReclaimReservations(t *testing.T) {
+	db := makeTestDB(t)
+	devices := []*device.Device{{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100}}
+
+	held, _, err := holdSpace(DeviceCommand{space: 10, jobID: 1, expiry: time.Hour}, &devices, db)
+	if err != nil {
+		panic(err)
+	}
+	if _, _, err = holdSpace(DeviceCommand{space: 20, jobID: 2, expiry: time.Nanosecond}, &devices, db); err != nil {
+		panic(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	reclaimReservations(&devices, db)
+	assert.Equal(t, uint64(10), devices[0].AllocatedSpace, "Expired reservation reclaimed")
+
+	stored, err := mydb.GetReservations(db)
+	assert.Nil(t, err, "No error reading ledger")
+	assert.Len(t, stored, 1, "Outstanding reservation kept")
+	assert.Equal(t, held.ReservationID, stored[0].ReservationID, "Unexpired reservation kept")
+}
+
+// Check each copy is held on a different drive, and nothing is held unless every copy is
+func TestHoldCopies(t *testing.T) {
+	db := makeTestDB(t)
+	devices := []*device.Device{
+		{DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "ABC", AvailableSpace: 100},
+		{DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "ABC", AvailableSpace: 100},
+		{DeviceID: 3, MountPoint: "/mnt/3", AvailableSpace: 100},
+		{DeviceID: 4, MountPoint: "/mnt/4", AvailableSpace: 100},
+	}
+
+	held, reservations, err := holdCopies(DeviceCommand{space: 10, copies: 3, jobID: 2}, &devices, db)
+	assert.Nil(t, err, "No error holding copies")
+	assert.Equal(t, []*device.Device{devices[0], devices[2], devices[3]}, held, "Devices sharing a serial skipped")
+	assert.Len(t, reservations, 3, "Reservation for each copy")
+	for index, reservation := range reservations {
+		assert.Equal(t, held[index].DeviceID, reservation.DeviceID, "Reservations in order of devices")
+		assert.Equal(t, 2, reservation.JobID, "Owner recorded")
+	}
+	assert.Equal(t, uint64(0), devices[1].AllocatedSpace, "Nothing held on the same drive")
+
+	_, _, err = holdCopies(DeviceCommand{space: 10, copies: 4}, &devices, db)
+	assert.ErrorIs(t, err, ErrNoSpace, "Too few drives")
+	assert.EqualError(
+		t,
+		err,
+		"Only 3 of 4 copies have room on separate drives: No device with sufficient space -- add another or make space",
+		"Copies which fit reported",
+	)
+	assert.Equal(t, uint64(10), devices[0].AllocatedSpace, "Copies held for failed request released")
+
+	stored, err := mydb.GetReservations(db)
+	assert.Nil(t, err, "No error reading ledger")
+	assert.Len(t, stored, 3, "Only the first request's reservations kept")
+}
+
+// Check a reservation's expiry is pushed back from now when renewed
+func TestRenewSpace(t *testing.T) {
+	db := makeTestDB(t)
+	devices := []*device.Device{{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 100}}
+
+	held, _, err := holdSpace(DeviceCommand{space: 10, jobID: 1, expiry: time.Nanosecond}, &devices, db)
+	if err != nil {
+		panic(err)
+	}
+
+	command := DeviceCommand{reservationID: held.ReservationID, expiry: time.Hour}
+	assert.Nil(t, renewSpace(command, db), "No error renewing")
+	renewed, err := mydb.GetReservation(db, held.ReservationID)
+	assert.Nil(t, err, "Reservation still held")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), renewed.Expires, time.Minute, "Expiry pushed back")
+
+	time.Sleep(time.Millisecond)
+	reclaimReservations(&devices, db)
+	assert.Equal(t, uint64(10), devices[0].AllocatedSpace, "Renewed reservation not reclaimed")
+
+	assert.Nil(t, commitSpace(command, db), "No error committing")
+	assert.ErrorIs(t, renewSpace(command, db), ErrNoSuchReservation, "Ended reservation cannot be renewed")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+)
+
+var getDBFiles = mydb.GetFiles
+var getDeviceRecords = mydb.GetDeviceRecords
+var locateDevice = device.LocateDevice
+
+// ErrNoFiles is returned when nothing has been backed up at or beneath a path
+var ErrNoFiles = fmt.Errorf("No backed up files found")
+
+// UnavailableDevice is a registered device which is not mounted, along with the files which need it
+type UnavailableDevice struct {
+	Device device.Device
+	Files  []string
+}
+
+// RestoreResult contains the outcome of restoring each file
+type RestoreResult struct {
+	// Source paths of files which were restored and verified
+	Restored []string
+	// Files which could not be restored from any mounted device
+	Failed map[string]error
+	// Devices which must be mounted to restore the remaining files, by device ID
+	// A file with several copies or shards is listed under each device holding one
+	Unavailable map[int]*UnavailableDevice
+}
+
+// Restore copies backed up files matching the given path, or within it, back from their devices
+// Each copy of a file is tried in turn until one is restored intact,
+// while erasure-coded files are rebuilt from any of their intact shards
+// If a target root is given, files are restored beneath it instead of over their original location
+func Restore(db *sql.DB, path string, targetRoot string) (RestoreResult, error) {
+	sourcePath, err := filepath.Abs(path)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+
+	files, err := getDBFiles(db, sourcePath)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	if len(files) == 0 {
+		return RestoreResult{}, fmt.Errorf("%w for %s", ErrNoFiles, sourcePath)
+	}
+
+	devices, err := getDeviceRecords(db)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+
+	mounted := checkMounted(devices)
+
+	result := RestoreResult{Failed: make(map[string]error), Unavailable: make(map[int]*UnavailableDevice)}
+	for _, replicas := range groupReplicas(files) {
+		sourcePath := replicas[0].SourcePath
+		restore := restoreReplicas
+		if replicas[0].Sharded() {
+			restore = restoreShards
+		}
+
+		unmounted, err := restore(replicas, devices, mounted, restorePath(targetRoot, sourcePath))
+		if err == nil && len(unmounted) == 0 {
+			result.Restored = append(result.Restored, sourcePath)
+			continue
+		}
+
+		if err != nil {
+			result.Failed[sourcePath] = err
+		}
+		for _, dev := range unmounted {
+			markUnavailable(result.Unavailable, dev, sourcePath)
+		}
+	}
+
+	return result, nil
+}
+
+// groupReplicas splits files ordered by source path into the copies of each one
+func groupReplicas(files []mydb.File) [][]mydb.File {
+	var grouped [][]mydb.File
+	for index, file := range files {
+		if index > 0 && file.SourcePath == files[index-1].SourcePath {
+			grouped[len(grouped)-1] = append(grouped[len(grouped)-1], file)
+		} else {
+			grouped = append(grouped, []mydb.File{file})
+		}
+	}
+
+	return grouped
+}
+
+// restoreReplicas restores the first copy of a file which is on a mounted device and matches its checksum
+// If none can be restored, the devices of the copies which are not mounted are returned along with the last error, if any
+func restoreReplicas(
+	replicas []mydb.File,
+	devices map[int]device.Device,
+	mounted map[int]bool,
+	destination string,
+) ([]device.Device, error) {
+	var unmounted []device.Device
+	var err error
+	for _, file := range replicas {
+		if !mounted[file.DeviceID] {
+			unmounted = append(unmounted, devices[file.DeviceID])
+			continue
+		}
+
+		if err = restoreFile(file, devices[file.DeviceID].MountPoint, destination); err == nil {
+			return nil, nil
+		}
+	}
+
+	return unmounted, err
+}
+
+// restoreShards rebuilds an erasure-coded file from the intact shards on mounted devices,
+// replacing the existing file at the destination only once it matches the original's checksum
+// If too few are intact, the devices of the shards which are not mounted are returned,
+// with an error if mounting them would still not be enough
+var restoreShards = func(
+	shards []mydb.File,
+	devices map[int]device.Device,
+	mounted map[int]bool,
+	destination string,
+) ([]device.Device, error) {
+	intact, unmounted, err := findShards(shards, devices, mounted)
+	if err != nil || len(intact) < shards[0].DataShards {
+		return unmounted, err
+	}
+
+	return nil, writeRestored(destination, func(partial string) error {
+		out, err := os.OpenFile(partial, os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to restore %s: %v", shards[0].SourcePath, err)
+		}
+
+		err = joinShards(shards, intact, out)
+		if err == nil {
+			err = out.Sync()
+		}
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to restore %s: %v", shards[0].SourcePath, err)
+		}
+
+		return nil
+	})
+}
+
+// checkMounted returns which of the given devices are currently mounted, by device ID
+// Each device is found by its serial, or else its filesystem UUID, so another drive at its mount point is not mistaken for it
+// Devices found elsewhere are read from where they are mounted, while those not found are marked offline
+func checkMounted(devices map[int]device.Device) map[int]bool {
+	mounted := make(map[int]bool)
+	for id, dev := range devices {
+		found, err := locateDevice(dev)
+		if err != nil {
+			devices[id] = device.MakeOfflineDevice(dev, err.Error())
+			mounted[id] = false
+			continue
+		}
+
+		dev.MountPoint = found.MountPoint
+		devices[id] = dev
+		mounted[id] = true
+	}
+
+	return mounted
+}
+
+// markUnavailable records a file as needing the given unmounted device
+func markUnavailable(unavailable map[int]*UnavailableDevice, dev device.Device, sourcePath string) {
+	if _, ok := unavailable[dev.DeviceID]; !ok {
+		unavailable[dev.DeviceID] = &UnavailableDevice{Device: dev}
+	}
+
+	unavailable[dev.DeviceID].Files = append(unavailable[dev.DeviceID].Files, sourcePath)
+}
+
+// restorePath returns where a file should be restored to, optionally beneath an alternate root
+func restorePath(targetRoot string, sourcePath string) string {
+	if len(targetRoot) == 0 {
+		return sourcePath
+	}
+
+	return filepath.Join(targetRoot, sourcePath)
+}
+
+// restoreFile copies a file back from the given mount, checking the written copy matches its checksum
+// The existing file at the destination is only replaced once it does
+var restoreFile = func(file mydb.File, mount string, destination string) error {
+	return writeRestored(destination, func(partial string) error {
+		if _, err := copyFile(backupPath(mount, file.SourcePath), partial, nil); err != nil {
+			return fmt.Errorf("Failed to restore %s: %v", file.SourcePath, err)
+		}
+
+		checksum, err := fileChecksum(partial)
+		if err != nil {
+			return fmt.Errorf("Failed to read restored %s: %v", destination, err)
+		}
+		if checksum != file.Checksum {
+			return fmt.Errorf("Restored %s does not match checksum: expected %s, got %s", destination, file.Checksum, checksum)
+		}
+
+		return nil
+	})
+}
+
+// writeRestored has write fill a temporary file beside the destination, moving it over the destination if it succeeds
+// and removing it otherwise, so a failed restore leaves any file already at the destination untouched
+func writeRestored(destination string, write func(partial string) error) error {
+	partial, err := makePartial(destination)
+	if err != nil {
+		return fmt.Errorf("Failed to restore to %s: %v", destination, err)
+	}
+
+	if err = write(partial); err == nil {
+		err = os.Rename(partial, destination)
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+
+	return err
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestBackup stores a file with the given contents on a mount, as a backup would
+func makeTestBackup(t *testing.T, mount string, sourcePath string, contents string) mydb.File {
+	source := filepath.Join(t.TempDir(), "source")
+	if err := ioutil.WriteFile(source, []byte(contents), 0644); err != nil {
+		panic(err)
+	}
+
+	checksum, err := copyFile(source, backupPath(mount, sourcePath), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return mydb.File{SourcePath: sourcePath, Size: int64(len(contents)), Checksum: checksum}
+}
+
+func TestRestorePath(t *testing.T) {
+	assert.Equal(t, "/home/foo.txt", restorePath("", "/home/foo.txt"), "Original location used without target")
+	assert.Equal(t, "/tmp/restore/home/foo.txt", restorePath("/tmp/restore", "/home/foo.txt"), "Target root prefixed")
+}
+
+// Check restored copies are verified against their checksum
+func TestRestoreFile(t *testing.T) {
+	mount := t.TempDir()
+	file := makeTestBackup(t, mount, "/home/foo.txt", "hello")
+
+	destination := filepath.Join(t.TempDir(), "foo.txt")
+	err := restoreFile(file, mount, destination)
+	assert.Nil(t, err, "No error restoring file")
+
+	contents, err := ioutil.ReadFile(destination)
+	assert.Nil(t, err, "Restored file exists")
+	assert.Equal(t, "hello", string(contents), "Restored contents match")
+
+	if err = ioutil.WriteFile(destination, []byte("original"), 0644); err != nil {
+		panic(err)
+	}
+	file.Checksum = "bad"
+	err = restoreFile(file, mount, destination)
+	assert.EqualErrorf(
+		t,
+		err,
+		fmt.Sprintf(
+			"Restored %s does not match checksum: expected bad, got 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			destination,
+		),
+		"Checksum mismatch reported",
+	)
+
+	contents, err = ioutil.ReadFile(destination)
+	assert.Nil(t, err, "Existing file kept")
+	assert.Equal(t, "original", string(contents), "Existing file not replaced by mismatched copy")
+	entries, err := os.ReadDir(filepath.Dir(destination))
+	assert.Nil(t, err, "Destination directory readable")
+	assert.Len(t, entries, 1, "Partial restore removed")
+
+	file.SourcePath = "/home/missing.txt"
+	err = restoreFile(file, mount, destination)
+	assert.NotNil(t, err, "Missing backup copy reported")
+}
+
+// Check files are restored per device, with unmounted devices listed
+func TestRestore(t *testing.T) {
+	realGetFiles := getDBFiles
+	realGetDevices := getDeviceRecords
+	realLocate := locateDevice
+
+	mount := t.TempDir()
+	good := makeTestBackup(t, mount, "/home/docs/good.txt", "good")
+	good.DeviceID = 1
+	bad := makeTestBackup(t, mount, "/home/docs/bad.txt", "bad")
+	bad.DeviceID = 1
+	bad.Checksum = "corrupt"
+
+	getDBFiles = func(_ *sql.DB, path string) ([]mydb.File, error) {
+		assert.Equal(t, "/home/docs", path, "Requested path looked up")
+		return []mydb.File{
+			good,
+			bad,
+			{SourcePath: "/home/docs/away.txt", DeviceID: 2},
+		}, nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return map[int]device.Device{
+			1: {DeviceID: 1, MountPoint: mount, DeviceSerial: "ABC1"},
+			2: {DeviceID: 2, MountPoint: "/mnt/usb", DeviceSerial: "ABC2"},
+		}, nil
+	}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		if known.MountPoint != mount {
+			return device.Device{}, fmt.Errorf("No device with serial %q or UUID %q is mounted", known.DeviceSerial, known.UUID)
+		}
+		return known, nil
+	}
+	defer func() {
+		getDBFiles = realGetFiles
+		getDeviceRecords = realGetDevices
+		locateDevice = realLocate
+	}()
+
+	target := t.TempDir()
+	result, err := Restore(&sql.DB{}, "/home/docs", target)
+	assert.Nil(t, err, "No error restoring")
+	assert.Equal(t, []string{"/home/docs/good.txt"}, result.Restored, "Good file restored")
+	assert.Len(t, result.Failed, 1, "Corrupt file failed")
+	assert.Contains(t, result.Failed, "/home/docs/bad.txt", "Corrupt file reported")
+	assert.Len(t, result.Unavailable, 1, "One device unavailable")
+	assert.Equal(t, "ABC2", result.Unavailable[2].Device.DeviceSerial, "Unmounted device listed")
+	assert.Equal(t, []string{"/home/docs/away.txt"}, result.Unavailable[2].Files, "Files needing device listed")
+
+	contents, err := ioutil.ReadFile(filepath.Join(target, "/home/docs/good.txt"))
+	assert.Nil(t, err, "Restored under target root")
+	assert.Equal(t, "good", string(contents), "Restored contents match")
+}
+
+// Check each copy of a file is tried until one restores intact
+func TestRestoreReplicas(t *testing.T) {
+	realGetFiles := getDBFiles
+	realGetDevices := getDeviceRecords
+	realLocate := locateDevice
+
+	first := t.TempDir()
+	second := t.TempDir()
+	corrupt := makeTestBackup(t, first, "/home/docs/a.txt", "a")
+	corrupt.DeviceID = 1
+	corrupt.Checksum = "corrupt"
+	intact := makeTestBackup(t, second, "/home/docs/a.txt", "a")
+	intact.DeviceID = 2
+	away := makeTestBackup(t, first, "/home/docs/b.txt", "b")
+	away.DeviceID = 1
+	away.Checksum = "corrupt"
+
+	getDBFiles = func(_ *sql.DB, _ string) ([]mydb.File, error) {
+		return []mydb.File{corrupt, intact, away, {SourcePath: "/home/docs/b.txt", DeviceID: 3}}, nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return map[int]device.Device{
+			1: {DeviceID: 1, MountPoint: first},
+			2: {DeviceID: 2, MountPoint: second},
+			3: {DeviceID: 3, MountPoint: "/mnt/usb"},
+		}, nil
+	}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		if known.MountPoint == "/mnt/usb" {
+			return device.Device{}, fmt.Errorf("No device mounted on %s", known.MountPoint)
+		}
+		return known, nil
+	}
+	defer func() {
+		getDBFiles = realGetFiles
+		getDeviceRecords = realGetDevices
+		locateDevice = realLocate
+	}()
+
+	target := t.TempDir()
+	result, err := Restore(&sql.DB{}, "/home/docs", target)
+	assert.Nil(t, err, "No error restoring")
+	assert.Equal(t, []string{"/home/docs/a.txt"}, result.Restored, "Restored from intact copy")
+	assert.Contains(t, result.Failed, "/home/docs/b.txt", "Failure of mounted copy reported")
+	assert.Equal(t, []string{"/home/docs/b.txt"}, result.Unavailable[3].Files, "Device with another copy listed")
+
+	contents, err := ioutil.ReadFile(filepath.Join(target, "/home/docs/a.txt"))
+	assert.Nil(t, err, "Restored file exists")
+	assert.Equal(t, "a", string(contents), "Intact contents restored")
+}
+
+// Check erasure-coded files are rebuilt from intact shards, or wait on devices holding enough of the rest
+func TestRestoreShards(t *testing.T) {
+	realGetFiles := getDBFiles
+	realGetDevices := getDeviceRecords
+	realLocate := locateDevice
+
+	damaged, devices := makeTestShards(t, "/home/docs/a.txt", "the quick brown fox", 2, 2)
+	damaged[0].Checksum = "corrupt"
+	damaged[3].Checksum = "corrupt"
+	away, awayDevices := makeTestShards(t, "/home/docs/b.txt", "jumps over the lazy dog", 2, 1)
+	for index := range away {
+		dev := awayDevices[away[index].DeviceID]
+		dev.DeviceID += 4
+		away[index].DeviceID = dev.DeviceID
+		devices[dev.DeviceID] = dev
+	}
+
+	getDBFiles = func(_ *sql.DB, _ string) ([]mydb.File, error) {
+		return append(append([]mydb.File{}, damaged...), away...), nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return devices, nil
+	}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		if known.DeviceID == 5 || known.DeviceID == 6 {
+			return device.Device{}, fmt.Errorf("No device mounted on %s", known.MountPoint)
+		}
+		return known, nil
+	}
+	defer func() {
+		getDBFiles = realGetFiles
+		getDeviceRecords = realGetDevices
+		locateDevice = realLocate
+	}()
+
+	target := t.TempDir()
+	result, err := Restore(&sql.DB{}, "/home/docs", target)
+	assert.Nil(t, err, "No error restoring")
+	assert.Equal(t, []string{"/home/docs/a.txt"}, result.Restored, "Rebuilt from intact shards")
+	assert.Empty(t, result.Failed, "Nothing failed")
+	assert.Equal(t, []string{"/home/docs/b.txt"}, result.Unavailable[5].Files, "Device with needed shard listed")
+	assert.Equal(t, []string{"/home/docs/b.txt"}, result.Unavailable[6].Files, "Each unmounted shard listed")
+
+	contents, err := ioutil.ReadFile(filepath.Join(target, "/home/docs/a.txt"))
+	assert.Nil(t, err, "Rebuilt file exists")
+	assert.Equal(t, "the quick brown fox", string(contents), "Original contents rebuilt")
+	_, err = os.Stat(filepath.Join(target, "/home/docs/b.txt"))
+	assert.True(t, os.IsNotExist(err), "Nothing written for unavailable file")
+
+	sourceChecksum := damaged[0].SourceChecksum
+	for index := range damaged {
+		damaged[index].SourceChecksum = "changed"
+	}
+	result, err = Restore(&sql.DB{}, "/home/docs", target)
+	assert.Nil(t, err, "No error restoring")
+	assert.Contains(t, result.Failed["/home/docs/a.txt"].Error(), "does not match checksum", "Mismatched rebuild reported")
+	contents, err = ioutil.ReadFile(filepath.Join(target, "/home/docs/a.txt"))
+	assert.Nil(t, err, "Earlier restore kept")
+	assert.Equal(t, "the quick brown fox", string(contents), "Existing file not replaced by mismatched rebuild")
+
+	for index := range damaged {
+		damaged[index].SourceChecksum = sourceChecksum
+	}
+	damaged[1].Checksum = "corrupt"
+	result, err = Restore(&sql.DB{}, "/home/docs", target)
+	assert.Nil(t, err, "No error restoring")
+	assert.EqualError(
+		t,
+		result.Failed["/home/docs/a.txt"],
+		"Only 1 of the 2 shards needed to rebuild /home/docs/a.txt are intact",
+		"Too many damaged shards reported",
+	)
+}
+
+// Check nothing matching the path is an error
+func TestRestoreNothingFound(t *testing.T) {
+	realGetFiles := getDBFiles
+
+	getDBFiles = func(_ *sql.DB, _ string) ([]mydb.File, error) {
+		return nil, nil
+	}
+	defer func() { getDBFiles = realGetFiles }()
+
+	_, err := Restore(&sql.DB{}, "/home/nothing", "")
+	assert.EqualErrorf(t, err, "No backed up files found for /home/nothing", "Empty match reported")
+}
+
+// Check devices are only mounted when found by serial or UUID, and are read from where they were found
+func TestCheckMounted(t *testing.T) {
+	realLocate := locateDevice
+
+	locateDevice = func(known device.Device) (device.Device, error) {
+		switch known.DeviceSerial {
+		case "HERE":
+			return known, nil
+		case "MOVED":
+			known.MountPoint = "/mnt/elsewhere"
+			return known, nil
+		default:
+			return device.Device{}, fmt.Errorf("No device with serial %q or UUID %q is mounted", known.DeviceSerial, known.UUID)
+		}
+	}
+	defer func() { locateDevice = realLocate }()
+
+	devices := map[int]device.Device{
+		1: {DeviceID: 1, MountPoint: "/mnt/1", DeviceSerial: "HERE"},
+		2: {DeviceID: 2, MountPoint: "/mnt/2", DeviceSerial: "MOVED"},
+		3: {DeviceID: 3, MountPoint: "/mnt/3", DeviceSerial: "GONE"},
+	}
+
+	mounted := checkMounted(devices)
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: false}, mounted, "Only devices found are mounted")
+	assert.Equal(t, "/mnt/1", devices[1].MountPoint, "Device at its mount point read from there")
+	assert.Equal(t, "/mnt/elsewhere", devices[2].MountPoint, "Moved device read from where it was found")
+	assert.True(t, devices[3].Offline, "Device not found marked offline")
+	assert.Equal(t, "/mnt/3", devices[3].MountPoint, "Device not found keeps its mount point")
+	assert.Contains(t, devices[3].OfflineReason, "GONE", "Reason names the missing device")
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/erasure"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+// shardBlockSize is how much of each shard is encoded or rebuilt at once, bounding the memory used
+var shardBlockSize int64 = 1 << 20
+
+// shardSize returns the size of each shard of a file split into the given number of data shards
+func shardSize(size int64, dataShards int) int64 {
+	return (size + int64(dataShards) - 1) / int64(dataShards)
+}
+
+// dataLength returns how many bytes of the original file a shard holds, with the last data shard padded
+// and parity shards holding none
+func dataLength(shard int, dataShards int, pieceSize int64, size int64) int64 {
+	if shard >= dataShards {
+		return 0
+	}
+
+	length := size - int64(shard)*pieceSize
+	if length < 0 {
+		return 0
+	} else if length > pieceSize {
+		return pieceSize
+	}
+
+	return length
+}
+
+// writeShards splits a file into data shards, computes its parity shards, and writes one shard to the partial path on each mount,
+// checking each shard reads back with the checksum it was written with,
+// and returns the shards to record on the devices the reservations were made on
+// The file's checksum is taken from the data shards as written, so it always matches what can be rebuilt
+var writeShards = func(
+	sourcePath string,
+	size int64,
+	redundancy queue.Redundancy,
+	mounts []string,
+	partials []string,
+	reservations []mydb.Reservation,
+	meter *progress.Meter,
+) ([]mydb.File, error) {
+	code, err := erasure.New(redundancy.DataShards, redundancy.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	checksums, err := encodeShards(sourcePath, size, partials, code, meter)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to shard %s: %v", sourcePath, err)
+	}
+
+	written, sourceChecksum, err := readShards(partials, code.DataShards(), size)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read back shards of %s: %v", sourcePath, err)
+	}
+
+	pieceSize := shardSize(size, code.DataShards())
+	shards := make([]mydb.File, 0, len(mounts))
+	for index, mount := range mounts {
+		if written[index] != checksums[index] {
+			return nil, fmt.Errorf(
+				"Shard %d of %s on %s does not match checksum: expected %s, got %s",
+				index, sourcePath, mount, checksums[index], written[index],
+			)
+		}
+
+		shards = append(shards, mydb.File{
+			SourcePath:     sourcePath,
+			DeviceID:       reservations[index].DeviceID,
+			Size:           pieceSize,
+			Checksum:       checksums[index],
+			Shard:          index,
+			DataShards:     code.DataShards(),
+			ParityShards:   code.ParityShards(),
+			SourceSize:     size,
+			SourceChecksum: sourceChecksum,
+		})
+	}
+
+	return shards, nil
+}
+
+// encodeShards writes the data and parity shards of a file to each destination in turn, returning their checksums
+// Shards which were partly written are left for the caller to remove
+func encodeShards(
+	sourcePath string,
+	size int64,
+	destinations []string,
+	code *erasure.Code,
+	meter *progress.Meter,
+) ([]string, error) {
+	in, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	outputs := make([]*os.File, 0, len(destinations))
+	defer func() {
+		for _, out := range outputs {
+			out.Close()
+		}
+	}()
+
+	hashes := make([]hash.Hash, len(destinations))
+	writers := make([]io.Writer, len(destinations))
+	for index, destination := range destinations {
+		if err = os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return nil, err
+		}
+
+		out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, out)
+
+		hashes[index] = sha256.New()
+		writers[index] = io.MultiWriter(out, hashes[index], meter)
+	}
+
+	if err = encodeBlocks(in, size, writers, code); err != nil {
+		return nil, err
+	}
+
+	checksums := make([]string, len(destinations))
+	for index, out := range outputs {
+		if err = out.Sync(); err != nil {
+			return nil, err
+		}
+		checksums[index] = hex.EncodeToString(hashes[index].Sum(nil))
+	}
+
+	return checksums, nil
+}
+
+// encodeBlocks reads each data shard of a file a block at a time, writing it and the parity computed from it
+// to the writer of each shard, with the end of the last data shard padded with zeroes
+func encodeBlocks(in io.ReaderAt, size int64, writers []io.Writer, code *erasure.Code) error {
+	pieceSize := shardSize(size, code.DataShards())
+	buffers := make([][]byte, len(writers))
+	for index := range buffers {
+		buffers[index] = make([]byte, minSize(shardBlockSize, pieceSize))
+	}
+
+	for offset := int64(0); offset < pieceSize; offset += shardBlockSize {
+		length := minSize(shardBlockSize, pieceSize-offset)
+		shards := make([][]byte, len(writers))
+		for index := range shards {
+			shards[index] = buffers[index][:length]
+		}
+
+		for index := 0; index < code.DataShards(); index++ {
+			if err := readPadded(in, shards[index], int64(index)*pieceSize+offset, size); err != nil {
+				return err
+			}
+		}
+
+		if err := code.Encode(shards); err != nil {
+			return err
+		}
+
+		for index, writer := range writers {
+			if _, err := writer.Write(shards[index]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readPadded fills the buffer from the given offset of a file of the given size, with zeroes past its end
+func readPadded(in io.ReaderAt, buffer []byte, offset int64, size int64) error {
+	available := minSize(int64(len(buffer)), size-offset)
+	if available < 0 {
+		available = 0
+	}
+
+	read, err := in.ReadAt(buffer[:available], offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	for index := read; index < len(buffer); index++ {
+		buffer[index] = 0
+	}
+
+	return nil
+}
+
+// readShards returns the checksum of each written shard, along with that of the file they hold
+func readShards(destinations []string, dataShards int, size int64) ([]string, string, error) {
+	pieceSize := shardSize(size, dataShards)
+	source := sha256.New()
+	checksums := make([]string, len(destinations))
+	for index, destination := range destinations {
+		checksum, err := readShard(destination, source, dataLength(index, dataShards, pieceSize, size))
+		if err != nil {
+			return nil, "", err
+		}
+		checksums[index] = checksum
+	}
+
+	return checksums, hex.EncodeToString(source.Sum(nil)), nil
+}
+
+// readShard returns the checksum of a shard, writing the given length of file data it starts with to the output
+func readShard(path string, data io.Writer, length int64) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	checksum := sha256.New()
+	if _, err = io.CopyN(data, io.TeeReader(in, checksum), length); err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(checksum, in); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// findShards returns the paths of the shards of a file which are on mounted devices and match their checksums,
+// by shard number, along with the devices of the shards which are not mounted
+// An error is returned if too few are intact to rebuild the file, even once every device is mounted
+func findShards(
+	shards []mydb.File,
+	devices map[int]device.Device,
+	mounted map[int]bool,
+) (map[int]string, []device.Device, error) {
+	intact := make(map[int]string)
+	var unmounted []device.Device
+	for _, shard := range shards {
+		if !mounted[shard.DeviceID] {
+			unmounted = append(unmounted, devices[shard.DeviceID])
+			continue
+		}
+
+		path := backupPath(devices[shard.DeviceID].MountPoint, shard.SourcePath)
+		if checksum, err := fileChecksum(path); err == nil && checksum == shard.Checksum {
+			intact[shard.Shard] = path
+		}
+	}
+
+	needed := shards[0].DataShards
+	if len(intact)+len(unmounted) < needed {
+		return intact, unmounted, fmt.Errorf(
+			"Only %d of the %d shards needed to rebuild %s are intact",
+			len(intact), needed, shards[0].SourcePath,
+		)
+	}
+
+	return intact, unmounted, nil
+}
+
+// joinShards writes the file the shards were split from to the output, rebuilding any data shards
+// which are not intact from those which are, and checks it matches the file's checksum
+func joinShards(shards []mydb.File, intact map[int]string, out io.Writer) error {
+	first := shards[0]
+	code, err := erasure.New(first.DataShards, first.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	rebuilt := sha256.New()
+	out = io.MultiWriter(out, rebuilt)
+	for index := 0; index < first.DataShards; index++ {
+		length := dataLength(index, first.DataShards, first.Size, first.SourceSize)
+		if path, ok := intact[index]; ok {
+			err = copyShard(path, length, out)
+		} else {
+			err = rebuildShard(intact, code, index, length, out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if checksum := hex.EncodeToString(rebuilt.Sum(nil)); checksum != first.SourceChecksum {
+		return fmt.Errorf(
+			"Rebuilt %s does not match checksum: expected %s, got %s",
+			first.SourcePath, first.SourceChecksum, checksum,
+		)
+	}
+
+	return nil
+}
+
+// copyShard writes the start of an intact data shard to the output
+func copyShard(path string, length int64, out io.Writer) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.CopyN(out, in, length)
+	return err
+}
+
+// rebuildShard writes the start of a missing data shard to the output, a block at a time,
+// rebuilding it from as many intact shards as there are data shards
+func rebuildShard(intact map[int]string, code *erasure.Code, shard int, length int64, out io.Writer) error {
+	sources := make([]int, 0, len(intact))
+	for index := range intact {
+		sources = append(sources, index)
+	}
+	sort.Ints(sources)
+	if len(sources) < code.DataShards() {
+		return erasure.ErrTooFewShards
+	}
+	sources = sources[:code.DataShards()]
+
+	inputs := make(map[int]*os.File, len(sources))
+	defer func() {
+		for _, in := range inputs {
+			in.Close()
+		}
+	}()
+	for _, index := range sources {
+		in, err := os.Open(intact[index])
+		if err != nil {
+			return err
+		}
+		inputs[index] = in
+	}
+
+	for offset := int64(0); offset < length; offset += shardBlockSize {
+		blockLength := minSize(shardBlockSize, length-offset)
+		shards := make([][]byte, code.DataShards()+code.ParityShards())
+		for index, in := range inputs {
+			shards[index] = make([]byte, blockLength)
+			if _, err := in.ReadAt(shards[index], offset); err != nil {
+				return err
+			}
+		}
+
+		if err := code.Reconstruct(shards); err != nil {
+			return err
+		}
+		if _, err := out.Write(shards[shard]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// minSize returns the smaller of two sizes
+func minSize(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestShards erasure-codes a file with the given contents onto a new mount per shard, with device IDs counting from 1,
+// encoding a few bytes at a time so files span several blocks
+func makeTestShards(
+	t *testing.T,
+	sourcePath string,
+	contents string,
+	dataShards int,
+	parityShards int,
+) ([]mydb.File, map[int]device.Device) {
+	realBlockSize := shardBlockSize
+	shardBlockSize = 2
+	defer func() { shardBlockSize = realBlockSize }()
+
+	source := filepath.Join(t.TempDir(), "source")
+	if err := ioutil.WriteFile(source, []byte(contents), 0644); err != nil {
+		panic(err)
+	}
+
+	devices := make(map[int]device.Device)
+	mounts := make([]string, dataShards+parityShards)
+	destinations := make([]string, len(mounts))
+	reservations := make([]mydb.Reservation, len(mounts))
+	for index := range mounts {
+		mounts[index] = t.TempDir()
+		destinations[index] = backupPath(mounts[index], sourcePath)
+		reservations[index] = mydb.Reservation{DeviceID: index + 1}
+		devices[index+1] = device.Device{DeviceID: index + 1, MountPoint: mounts[index]}
+
+		if err := os.MkdirAll(filepath.Dir(destinations[index]), 0755); err != nil {
+			panic(err)
+		}
+	}
+
+	redundancy := queue.Redundancy{DataShards: dataShards, ParityShards: parityShards}
+	shards, err := writeShards(source, int64(len(contents)), redundancy, mounts, destinations, reservations, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	for index := range shards {
+		shards[index].SourcePath = sourcePath
+	}
+
+	return shards, devices
+}
+
+// allMounted returns every device as mounted
+func allMounted(devices map[int]device.Device) map[int]bool {
+	mounted := make(map[int]bool)
+	for id := range devices {
+		mounted[id] = true
+	}
+
+	return mounted
+}
+
+func TestShardSize(t *testing.T) {
+	assert.Equal(t, int64(6), shardSize(23, 4), "Size rounded up to fit every byte")
+	assert.Equal(t, int64(5), shardSize(20, 4), "Exact split not padded")
+	assert.Equal(t, int64(0), shardSize(0, 4), "Empty file has empty shards")
+
+	assert.Equal(t, int64(6), dataLength(0, 4, 6, 23), "Full data shard")
+	assert.Equal(t, int64(5), dataLength(3, 4, 6, 23), "Last data shard excludes padding")
+	assert.Equal(t, int64(0), dataLength(3, 4, 6, 12), "Data shard past the end holds nothing")
+	assert.Equal(t, int64(0), dataLength(4, 4, 6, 23), "Parity shard holds no file data")
+}
+
+// Check a file is split into equal data shards, with parity shards added and every shard recorded
+func TestWriteShards(t *testing.T) {
+	contents := "the quick brown fox ran"
+	shards, devices := makeTestShards(t, "/home/fox.txt", contents, 4, 2)
+
+	sum := sha256.Sum256([]byte(contents))
+	var joined []byte
+	assert.Len(t, shards, 6, "Every shard recorded")
+	for index, shard := range shards {
+		assert.Equal(t, index, shard.Shard, "Shard numbered")
+		assert.Equal(t, index+1, shard.DeviceID, "Shard recorded on its device")
+		assert.Equal(t, int64(6), shard.Size, "Shards all the same size")
+		assert.Equal(t, 4, shard.DataShards, "Data shards recorded")
+		assert.Equal(t, 2, shard.ParityShards, "Parity shards recorded")
+		assert.Equal(t, int64(len(contents)), shard.SourceSize, "Original size recorded")
+		assert.Equal(t, hex.EncodeToString(sum[:]), shard.SourceChecksum, "Original checksum recorded")
+		assert.True(t, shard.Sharded(), "Shard marked as sharded")
+
+		stored, err := ioutil.ReadFile(backupPath(devices[shard.DeviceID].MountPoint, shard.SourcePath))
+		assert.Nil(t, err, "Shard stored on its mount")
+		storedSum := sha256.Sum256(stored)
+		assert.Equal(t, hex.EncodeToString(storedSum[:]), shard.Checksum, "Shard checksum recorded")
+		if index < 4 {
+			joined = append(joined, stored...)
+		}
+	}
+
+	assert.Equal(t, contents+"\x00", string(joined), "Data shards hold the file, padded at the end")
+}
+
+// Check a file is rebuilt from any shards which are intact, as long as there are enough of them
+func TestJoinShards(t *testing.T) {
+	realBlockSize := shardBlockSize
+	shardBlockSize = 2
+	defer func() { shardBlockSize = realBlockSize }()
+
+	contents := "the quick brown fox ran"
+	shards, devices := makeTestShards(t, "/home/fox.txt", contents, 4, 2)
+	mounted := allMounted(devices)
+
+	for first := 0; first < 6; first++ {
+		for second := first + 1; second < 6; second++ {
+			damaged := append([]mydb.File{}, shards...)
+			damaged[first].Checksum = "corrupt"
+			damaged[second].Checksum = "corrupt"
+
+			intact, unmounted, err := findShards(damaged, devices, mounted)
+			assert.Nil(t, err, "Enough shards intact")
+			assert.Empty(t, unmounted, "Every device mounted")
+			assert.Len(t, intact, 4, "Damaged shards left out")
+
+			var out bytes.Buffer
+			err = joinShards(damaged, intact, &out)
+			assert.Nil(t, err, "No error rebuilding")
+			assert.Equal(t, contents, out.String(), "File rebuilt without damaged shards")
+		}
+	}
+
+	if err := os.Remove(backupPath(devices[1].MountPoint, shards[0].SourcePath)); err != nil {
+		panic(err)
+	}
+	shards[1].Checksum = "corrupt"
+	shards[5].Checksum = "corrupt"
+	_, _, err := findShards(shards, devices, mounted)
+	assert.EqualError(t, err, "Only 3 of the 4 shards needed to rebuild /home/fox.txt are intact", "Too few shards reported")
+
+	mounted[1], mounted[2] = false, false
+	intact, unmounted, err := findShards(shards, devices, mounted)
+	assert.Nil(t, err, "Unmounted shards may still be intact")
+	assert.Len(t, intact, 3, "Mounted intact shards found")
+	assert.Equal(t, []device.Device{devices[1], devices[2]}, unmounted, "Unmounted devices returned")
+}
+
+// Check a rebuilt file which does not match the original is rejected
+func TestJoinShardsMismatch(t *testing.T) {
+	shards, devices := makeTestShards(t, "/home/fox.txt", "the quick brown fox", 2, 1)
+	intact, _, err := findShards(shards, devices, allMounted(devices))
+	assert.Nil(t, err, "All shards intact")
+
+	shards[0].SourceChecksum = "changed"
+	err = joinShards(shards, intact, &bytes.Buffer{})
+	assert.Error(t, err, "Mismatched rebuild reported")
+	assert.Contains(t, err.Error(), "Rebuilt /home/fox.txt does not match checksum: expected changed", "Expected checksum given")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+)
+
+var filterDBFiles = mydb.FilterFiles
+var recordVerification = mydb.RecordVerification
+
+// VerifyOK indicates the backed up copy matches its checksum
+const VerifyOK string = "ok"
+
+// VerifyMismatch indicates the backed up copy does not match its checksum
+const VerifyMismatch string = "mismatch"
+
+// VerifyMissing indicates the backed up copy no longer exists on its device
+const VerifyMissing string = "missing"
+
+// VerifyUnreadable indicates the backed up copy exists, but could not be read
+const VerifyUnreadable string = "unreadable"
+
+// VerifyResult contains the outcome of verifying each file, by category
+// Each file is listed once per category, however many of its copies or shards were checked,
+// and is only verified if none of them are damaged
+type VerifyResult struct {
+	Verified   []string
+	Mismatched []string
+	Missing    []string
+	// Files which exist but could not be read
+	Failed map[string]error
+	// Devices which must be mounted to verify the remaining files, by device ID
+	Unavailable map[int]*UnavailableDevice
+	// Erasure-coded files with damaged shards, which can still be rebuilt from the others
+	Rebuildable []string
+	// Erasure-coded files which can no longer be rebuilt from their intact shards
+	Unrecoverable map[string]error
+}
+
+// Verify re-reads backed up files matching the filter from their devices, comparing them with their checksums
+// The outcome for each file on a mounted device is saved, along with when it was checked
+// Erasure-coded files with damaged shards are checked to still be rebuildable from their other shards
+func Verify(db *sql.DB, filter mydb.FileFilter) (VerifyResult, error) {
+	if len(filter.Path) > 0 {
+		path, err := filepath.Abs(filter.Path)
+		if err != nil {
+			return VerifyResult{}, err
+		}
+		filter.Path = path
+	}
+
+	files, err := filterDBFiles(db, filter)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	devices, err := getDeviceRecords(db)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	mounted := checkMounted(devices)
+
+	result := VerifyResult{
+		Failed:        make(map[string]error),
+		Unavailable:   make(map[int]*UnavailableDevice),
+		Unrecoverable: make(map[string]error),
+	}
+	var damaged []string
+	for _, file := range files {
+		dev := devices[file.DeviceID]
+		if !mounted[file.DeviceID] {
+			markUnavailable(result.Unavailable, dev, file.SourcePath)
+			continue
+		}
+
+		status, err := verifyFile(file, dev.MountPoint)
+		switch status {
+		case VerifyOK:
+			result.Verified = addPath(result.Verified, file.SourcePath)
+		case VerifyMismatch:
+			result.Mismatched = addPath(result.Mismatched, file.SourcePath)
+		case VerifyMissing:
+			result.Missing = addPath(result.Missing, file.SourcePath)
+		default:
+			result.Failed[file.SourcePath] = err
+		}
+
+		damaged = addDamaged(damaged, file, status)
+
+		if err = recordVerification(db, file.FileID, status, time.Now()); err != nil {
+			return result, err
+		}
+	}
+
+	result.Verified = withoutDamaged(result)
+	return result, checkRebuilds(db, &result, damaged, devices, mounted)
+}
+
+// addPath adds a file's path to those in a category, unless it was just added for another of its copies or shards
+// Files are ordered by path, so each is only added once
+func addPath(paths []string, sourcePath string) []string {
+	if len(paths) > 0 && paths[len(paths)-1] == sourcePath {
+		return paths
+	}
+
+	return append(paths, sourcePath)
+}
+
+// withoutDamaged returns the verified files which have no mismatched, missing or unreadable copies or shards
+func withoutDamaged(result VerifyResult) []string {
+	damaged := make(map[string]bool)
+	for _, sourcePath := range append(append([]string{}, result.Mismatched...), result.Missing...) {
+		damaged[sourcePath] = true
+	}
+
+	var verified []string
+	for _, sourcePath := range result.Verified {
+		if _, failed := result.Failed[sourcePath]; !failed && !damaged[sourcePath] {
+			verified = append(verified, sourcePath)
+		}
+	}
+
+	return verified
+}
+
+// addDamaged adds the path of an erasure-coded file to those with damaged shards, if the shard is not ok
+func addDamaged(damaged []string, file mydb.File, status string) []string {
+	if status == VerifyOK || !file.Sharded() {
+		return damaged
+	}
+
+	return addPath(damaged, file.SourcePath)
+}
+
+// checkRebuilds tries rebuilding each erasure-coded file with damaged shards from the rest of its shards,
+// recording whether it still can be, unless that depends on shards on devices which are not mounted
+func checkRebuilds(
+	db *sql.DB,
+	result *VerifyResult,
+	damaged []string,
+	devices map[int]device.Device,
+	mounted map[int]bool,
+) error {
+	for _, sourcePath := range damaged {
+		files, err := getDBFiles(db, sourcePath)
+		if err != nil {
+			return err
+		}
+
+		var shards []mydb.File
+		for _, file := range files {
+			if file.SourcePath == sourcePath {
+				shards = append(shards, file)
+			}
+		}
+
+		intact, _, err := findShards(shards, devices, mounted)
+		if err == nil && len(intact) < shards[0].DataShards {
+			continue
+		} else if err == nil {
+			err = joinShards(shards, intact, io.Discard)
+		}
+
+		if err != nil {
+			result.Unrecoverable[sourcePath] = err
+		} else {
+			result.Rebuildable = append(result.Rebuildable, sourcePath)
+		}
+	}
+
+	return nil
+}
+
+// verifyFile checks the copy of a file on the given mount, returning its status and any read error
+var verifyFile = func(file mydb.File, mount string) (string, error) {
+	checksum, err := fileChecksum(backupPath(mount, file.SourcePath))
+	if os.IsNotExist(err) {
+		return VerifyMissing, nil
+	} else if err != nil {
+		return VerifyUnreadable, err
+	}
+
+	if checksum != file.Checksum {
+		return VerifyMismatch, nil
+	}
+
+	return VerifyOK, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Check each verification status is detected
+func TestVerifyFile(t *testing.T) {
+	mount := t.TempDir()
+	file := makeTestBackup(t, mount, "/home/foo.txt", "hello")
+
+	status, err := verifyFile(file, mount)
+	assert.Nil(t, err, "No error verifying intact file")
+	assert.Equal(t, VerifyOK, status, "Intact file is ok")
+
+	file.Checksum = "changed"
+	status, err = verifyFile(file, mount)
+	assert.Nil(t, err, "No error verifying corrupt file")
+	assert.Equal(t, VerifyMismatch, status, "Corrupt file mismatches")
+
+	file.SourcePath = "/home/gone.txt"
+	status, err = verifyFile(file, mount)
+	assert.Nil(t, err, "No error verifying missing file")
+	assert.Equal(t, VerifyMissing, status, "Missing file detected")
+
+	if err = os.Mkdir(filepath.Join(mount, "home/dir.txt"), 0755); err != nil {
+		panic(err)
+	}
+	file.SourcePath = "/home/dir.txt"
+	status, err = verifyFile(file, mount)
+	assert.NotNil(t, err, "Read error returned")
+	assert.Equal(t, VerifyUnreadable, status, "Unreadable file detected")
+}
+
+// Check files are categorized and results recorded, except on unavailable devices
+func TestVerify(t *testing.T) {
+	realFilter := filterDBFiles
+	realRecord := recordVerification
+	realGetDevices := getDeviceRecords
+	realLocate := locateDevice
+
+	mount := t.TempDir()
+	good := makeTestBackup(t, mount, "/home/good.txt", "good")
+	good.FileID, good.DeviceID = 1, 1
+	bad := makeTestBackup(t, mount, "/home/bad.txt", "bad")
+	bad.FileID, bad.DeviceID, bad.Checksum = 2, 1, "corrupt"
+
+	filterDBFiles = func(_ *sql.DB, filter mydb.FileFilter) ([]mydb.File, error) {
+		assert.Equal(t, mydb.FileFilter{Path: "/home", DeviceID: 1}, filter, "Filter passed through")
+		return []mydb.File{
+			good,
+			bad,
+			{FileID: 3, SourcePath: "/home/gone.txt", DeviceID: 1},
+			{FileID: 4, SourcePath: "/home/away.txt", DeviceID: 2},
+		}, nil
+	}
+	recorded := make(map[int]string)
+	recordVerification = func(_ *sql.DB, fileID int, status string, verifiedAt time.Time) error {
+		assert.WithinDuration(t, time.Now(), verifiedAt, time.Second, "Verification time recorded")
+		recorded[fileID] = status
+		return nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return map[int]device.Device{
+			1: {DeviceID: 1, MountPoint: mount},
+			2: {DeviceID: 2, MountPoint: "/mnt/usb"},
+		}, nil
+	}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		if known.MountPoint != mount {
+			return device.Device{}, fmt.Errorf("No device mounted on %s", known.MountPoint)
+		}
+		return known, nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		recordVerification = realRecord
+		getDeviceRecords = realGetDevices
+		locateDevice = realLocate
+	}()
+
+	result, err := Verify(&sql.DB{}, mydb.FileFilter{Path: "/home", DeviceID: 1})
+	assert.Nil(t, err, "No error verifying")
+	assert.Equal(t, []string{"/home/good.txt"}, result.Verified, "Intact file verified")
+	assert.Equal(t, []string{"/home/bad.txt"}, result.Mismatched, "Corrupt file mismatched")
+	assert.Equal(t, []string{"/home/gone.txt"}, result.Missing, "Missing file reported")
+	assert.Empty(t, result.Failed, "No read failures")
+	assert.Equal(t, []string{"/home/away.txt"}, result.Unavailable[2].Files, "Unavailable device reported")
+	assert.Equal(
+		t,
+		map[int]string{1: VerifyOK, 2: VerifyMismatch, 3: VerifyMissing},
+		recorded,
+		"Statuses recorded for checked files only",
+	)
+}
+
+// Check another drive mounted at a device's registered path is not verified in its place
+func TestVerifyForeignDrive(t *testing.T) {
+	realFilter := filterDBFiles
+	realRecord := recordVerification
+	realGetDevices := getDeviceRecords
+	realLocate := locateDevice
+
+	// The drive at the mount point has a file at the same path, but it is not the registered device
+	mount := t.TempDir()
+	file := makeTestBackup(t, mount, "/home/a.txt", "another drive")
+	file.FileID, file.DeviceID, file.Checksum = 1, 1, "original"
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return []mydb.File{file, {FileID: 2, SourcePath: "/home/b.txt", DeviceID: 1}}, nil
+	}
+	recordVerification = func(_ *sql.DB, fileID int, status string, _ time.Time) error {
+		t.Errorf("File %d recorded as %s from another drive", fileID, status)
+		return nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return map[int]device.Device{1: {DeviceID: 1, MountPoint: mount, DeviceSerial: "ABC"}}, nil
+	}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		return device.Device{}, fmt.Errorf("No device with serial %q or UUID %q is mounted", known.DeviceSerial, known.UUID)
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		recordVerification = realRecord
+		getDeviceRecords = realGetDevices
+		locateDevice = realLocate
+	}()
+
+	result, err := Verify(&sql.DB{}, mydb.FileFilter{})
+	assert.Nil(t, err, "No error verifying")
+	assert.Empty(t, result.Mismatched, "Nothing mismatched")
+	assert.Empty(t, result.Missing, "Nothing missing")
+	assert.Equal(t, []string{"/home/a.txt", "/home/b.txt"}, result.Unavailable[1].Files, "Files need the registered device")
+	assert.Equal(t, "ABC", result.Unavailable[1].Device.DeviceSerial, "Device to plug in named")
+}
+
+// Check each file is listed once, however many copies of it were checked, and only verified if every copy is intact
+func TestVerifyCopies(t *testing.T) {
+	realFilter := filterDBFiles
+	realVerify := verifyFile
+	realRecord := recordVerification
+	realGetDevices := getDeviceRecords
+	realLocate := locateDevice
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return []mydb.File{
+			{FileID: 1, SourcePath: "/home/a.txt", DeviceID: 1},
+			{FileID: 2, SourcePath: "/home/a.txt", DeviceID: 2},
+			{FileID: 3, SourcePath: "/home/b.txt", DeviceID: 1},
+			{FileID: 4, SourcePath: "/home/b.txt", DeviceID: 2},
+		}, nil
+	}
+	verifyFile = func(file mydb.File, _ string) (string, error) {
+		if file.FileID == 4 {
+			return VerifyMismatch, nil
+		}
+
+		return VerifyOK, nil
+	}
+	recordVerification = func(_ *sql.DB, _ int, _ string, _ time.Time) error {
+		return nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return map[int]device.Device{1: {DeviceID: 1, MountPoint: "/mnt/1"}, 2: {DeviceID: 2, MountPoint: "/mnt/2"}}, nil
+	}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		return known, nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		verifyFile = realVerify
+		recordVerification = realRecord
+		getDeviceRecords = realGetDevices
+		locateDevice = realLocate
+	}()
+
+	result, err := Verify(&sql.DB{}, mydb.FileFilter{})
+	assert.Nil(t, err, "No error verifying")
+	assert.Equal(t, []string{"/home/a.txt"}, result.Verified, "File with every copy intact verified once")
+	assert.Equal(t, []string{"/home/b.txt"}, result.Mismatched, "File with a corrupt copy mismatched, and not verified")
+}
+
+// Check erasure-coded files with damaged shards are checked to still be rebuildable from the rest
+func TestVerifyShards(t *testing.T) {
+	realFilter := filterDBFiles
+	realGetFiles := getDBFiles
+	realRecord := recordVerification
+	realGetDevices := getDeviceRecords
+	realLocate := locateDevice
+
+	rebuildable, devices := makeTestShards(t, "/home/a.txt", "the quick brown fox", 2, 1)
+	rebuildable[0].Checksum = "corrupt"
+	lost, lostDevices := makeTestShards(t, "/home/b.txt", "jumps over the lazy dog", 2, 1)
+	lost[0].Checksum = "corrupt"
+	lost[1].Checksum = "corrupt"
+	for index := range lost {
+		dev := lostDevices[lost[index].DeviceID]
+		dev.DeviceID += 3
+		lost[index].DeviceID = dev.DeviceID
+		devices[dev.DeviceID] = dev
+	}
+	files := append(append([]mydb.File{}, rebuildable...), lost...)
+
+	filterDBFiles = func(_ *sql.DB, _ mydb.FileFilter) ([]mydb.File, error) {
+		return files, nil
+	}
+	getDBFiles = func(_ *sql.DB, _ string) ([]mydb.File, error) {
+		return files, nil
+	}
+	recordVerification = func(_ *sql.DB, _ int, _ string, _ time.Time) error {
+		return nil
+	}
+	getDeviceRecords = func(_ *sql.DB) (map[int]device.Device, error) {
+		return devices, nil
+	}
+	locateDevice = func(known device.Device) (device.Device, error) {
+		return known, nil
+	}
+	defer func() {
+		filterDBFiles = realFilter
+		getDBFiles = realGetFiles
+		recordVerification = realRecord
+		getDeviceRecords = realGetDevices
+		locateDevice = realLocate
+	}()
+
+	result, err := Verify(&sql.DB{}, mydb.FileFilter{})
+	assert.Nil(t, err, "No error verifying")
+	assert.Equal(t, []string{"/home/a.txt", "/home/b.txt"}, result.Mismatched, "Files with damaged shards listed once")
+	assert.Empty(t, result.Verified, "Files with damaged shards not verified")
+	assert.Equal(t, []string{"/home/a.txt"}, result.Rebuildable, "File with enough intact shards rebuildable")
+	assert.Len(t, result.Unrecoverable, 1, "One file unrecoverable")
+	assert.EqualError(
+		t,
+		result.Unrecoverable["/home/b.txt"],
+		"Only 1 of the 2 shards needed to rebuild /home/b.txt are intact",
+		"File with too few intact shards unrecoverable",
+	)
+}
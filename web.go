@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/logging"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+//go:embed web
+var webAssets embed.FS
+
+var getFolderStatus = mydb.GetFolderStatus
+
+// WebServer serves the local web interface, along with the data shown in each of its tabs
+// and a JSON API for managing devices and running operations
+type WebServer struct {
+	db       *sql.DB
+	devMan   *DevMan
+	jobQueue *queue.Queue
+	tracker  *progress.Tracker
+	// Name the server is reached by, besides localhost and its IP addresses
+	hostname string
+}
+
+// progressView is the progress of an in-flight job, as shown in the queue
+type progressView struct {
+	BytesDone  int64   `json:"bytesDone"`
+	BytesTotal int64   `json:"bytesTotal"`
+	Percent    float64 `json:"percent"`
+	Rate       float64 `json:"rate"`
+	ETASeconds float64 `json:"etaSeconds"`
+}
+
+// jobView is a job in one of the queue sections
+type jobView struct {
+	ID     int    `json:"id"`
+	Action int    `json:"action"`
+	Path   string `json:"path"`
+	Copies int    `json:"copies"`
+	// Data and parity shards of each file, if erasure-coded
+	DataShards   int           `json:"dataShards,omitempty"`
+	ParityShards int           `json:"parityShards,omitempty"`
+	State        queue.State   `json:"state"`
+	WorkerID     int           `json:"workerId,omitempty"`
+	Message      string        `json:"message"`
+	Error        string        `json:"error,omitempty"`
+	Added        time.Time     `json:"added"`
+	Progress     *progressView `json:"progress,omitempty"`
+}
+
+// queueView is the content of the queue tab
+type queueView struct {
+	Pending    []jobView `json:"pending"`
+	InProgress []jobView `json:"inProgress"`
+	Completed  []jobView `json:"completed"`
+}
+
+// localEntry is a file or directory on the source file system
+type localEntry struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	IsDir    bool   `json:"isDir"`
+	Size     int64  `json:"size"`
+	BackedUp bool   `json:"backedUp"`
+}
+
+// localView is the content of the local tab
+type localView struct {
+	Path    string       `json:"path"`
+	Parent  string       `json:"parent"`
+	Entries []localEntry `json:"entries"`
+}
+
+// deviceView is a device along with its space usage
+type deviceView struct {
+	DeviceID       int     `json:"deviceId"`
+	MountPoint     string  `json:"mountPoint"`
+	DeviceSerial   string  `json:"deviceSerial"`
+	AvailableSpace uint64  `json:"availableSpace"`
+	AllocatedSpace uint64  `json:"allocatedSpace"`
+	RemainingSpace uint64  `json:"remainingSpace"`
+	TotalSpace     uint64  `json:"totalSpace"`
+	FillPercent    float64 `json:"fillPercent"`
+	Offline        bool    `json:"offline"`
+	OfflineReason  string  `json:"offlineReason,omitempty"`
+	ReadOnly       bool    `json:"readOnly"`
+	ReadOnlyReason string  `json:"readOnlyReason,omitempty"`
+}
+
+// reservationView is space held on a device for a file being written to it
+type reservationView struct {
+	ReservationID int        `json:"reservationId"`
+	JobID         int        `json:"jobId,omitempty"`
+	Size          int64      `json:"size"`
+	Created       time.Time  `json:"created"`
+	Expires       *time.Time `json:"expires,omitempty"`
+	Device        deviceView `json:"device"`
+}
+
+// fileView is a backed up file, and where it is stored
+type fileView struct {
+	SourcePath   string     `json:"sourcePath"`
+	DeviceID     int        `json:"deviceId"`
+	Size         int64      `json:"size"`
+	Checksum     string     `json:"checksum"`
+	LastVerified *time.Time `json:"lastVerified,omitempty"`
+	VerifyStatus string     `json:"verifyStatus,omitempty"`
+}
+
+// backupView is the content of the backup tab
+type backupView struct {
+	Devices []deviceView `json:"devices"`
+	Files   []fileView   `json:"files"`
+}
+
+// Handler returns the routes for the interface and its data
+func (server *WebServer) Handler() http.Handler {
+	assets, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	api := http.NewServeMux()
+	api.HandleFunc("/api/queue", server.handleQueue)
+	api.HandleFunc("/api/queue/clear", server.handleClearQueue)
+	api.HandleFunc("/api/local", server.handleLocal)
+	api.HandleFunc("/api/backup", server.handleBackup)
+	api.HandleFunc("/api/devices", server.handleDevices)
+	api.HandleFunc("/api/devices/reserve", server.handleReserve)
+	api.HandleFunc("/api/devices/free", server.handleFree)
+	api.HandleFunc("/api/devices/commit", server.handleCommit)
+	api.HandleFunc("/api/devices/rebalance", server.handleRebalance)
+	api.HandleFunc("/api/devices/move", server.handleMove)
+	api.HandleFunc("/api/restore", server.handleRestore)
+	api.HandleFunc("/api/verify", server.handleVerify)
+	api.HandleFunc("/api/logs", server.handleLogs)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	mux.Handle("/api/", server.guard(api))
+	return mux
+}
+
+// guard rejects API requests which another website could make through a visitor's browser:
+// those naming a host other than this server, which could be another site's domain resolving to it,
+// those from pages of another origin, and changes without a JSON body, which pages cannot send elsewhere unchecked
+func (server *WebServer) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !server.allowedHost(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("%s is not an address of this server", r.Host))
+			return
+		} else if origin := r.Header.Get("Origin"); len(origin) > 0 && !sameOrigin(origin, r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("Requests from %s are not allowed", origin))
+			return
+		} else if r.Method != http.MethodGet && r.Method != http.MethodHead && !isJSON(r) {
+			writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost returns whether a Host header names this server, by IP address, as localhost or by its configured name
+func (server *WebServer) allowedHost(host string) bool {
+	name := host
+	if withoutPort, _, err := net.SplitHostPort(host); err == nil {
+		name = withoutPort
+	}
+	name = strings.Trim(name, "[]")
+
+	if strings.EqualFold(name, "localhost") || net.ParseIP(name) != nil {
+		return true
+	}
+
+	return len(server.hostname) > 0 && strings.EqualFold(name, server.hostname)
+}
+
+// listenHostname returns the host named in the address the server listens on, if any
+func listenHostname(listen string) string {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+
+	return host
+}
+
+// sameOrigin returns whether a request's Origin header is the server's own host
+func sameOrigin(origin string, host string) bool {
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, host)
+}
+
+// isJSON returns whether a request declares its body as JSON
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func (server *WebServer) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		server.handleEnqueue(w, r)
+		return
+	} else if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "GET or POST required")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, makeQueueView(server.jobQueue, server.tracker))
+}
+
+func (server *WebServer) handleClearQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "POST required")
+		return
+	}
+
+	cleared, err := server.jobQueue.ClearCompleted()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": cleared})
+}
+
+func (server *WebServer) handleLocal(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if len(path) == 0 {
+		path = string(filepath.Separator)
+	}
+	path = filepath.Clean(path)
+	if !filepath.IsAbs(path) {
+		writeError(w, http.StatusBadRequest, "Path must be absolute")
+		return
+	}
+
+	entries, err := os.ReadDir(path)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	view := localView{Path: path, Parent: filepath.Dir(path), Entries: make([]localEntry, 0, len(entries))}
+	for _, entry := range entries {
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			continue
+		}
+
+		local := localEntry{Name: entry.Name(), Path: filepath.Join(path, entry.Name()), IsDir: entry.IsDir()}
+		if local.IsDir {
+			status, err := getFolderStatus(server.db, local.Path)
+			local.BackedUp = err == nil && status.Complete()
+		} else {
+			if info, err := entry.Info(); err == nil {
+				local.Size = info.Size()
+			}
+			_, err := getDBFile(server.db, local.Path)
+			local.BackedUp = err == nil
+		}
+
+		view.Entries = append(view.Entries, local)
+	}
+
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (server *WebServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	devices, err := server.devMan.ListDevices()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	files, err := filterDBFiles(server.db, mydb.FileFilter{Path: r.URL.Query().Get("path")})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	view := backupView{Devices: deviceViews(devices), Files: make([]fileView, 0, len(files))}
+	for _, file := range files {
+		view.Files = append(view.Files, makeFileView(file))
+	}
+
+	writeJSON(w, http.StatusOK, view)
+}
+
+// makeQueueView converts each section of the queue for display
+func makeQueueView(jobQueue *queue.Queue, tracker *progress.Tracker) queueView {
+	return queueView{
+		Pending:    jobViews(jobQueue.Pending(), tracker),
+		InProgress: jobViews(jobQueue.InProgress(), tracker),
+		Completed:  jobViews(jobQueue.Completed(), tracker),
+	}
+}
+
+// jobViews converts jobs for display, including the progress of any in flight
+func jobViews(jobs []queue.Job, tracker *progress.Tracker) []jobView {
+	views := make([]jobView, 0, len(jobs))
+	for _, job := range jobs {
+		view := makeJobView(job)
+		if report, ok := tracker.Get(job.ID); ok {
+			view.Progress = &progressView{
+				BytesDone:  report.BytesDone,
+				BytesTotal: report.BytesTotal,
+				Percent:    report.Percent(),
+				Rate:       report.Rate(),
+				ETASeconds: report.ETA().Seconds(),
+			}
+		}
+
+		views = append(views, view)
+	}
+
+	return views
+}
+
+// makeJobView converts a job for display, without its progress
+func makeJobView(job queue.Job) jobView {
+	return jobView{
+		ID:           job.ID,
+		Action:       job.Action,
+		Path:         job.Path,
+		Copies:       job.Copies,
+		DataShards:   job.DataShards,
+		ParityShards: job.ParityShards,
+		State:        job.State,
+		WorkerID:     job.WorkerID,
+		Message:      job.Message,
+		Error:        job.Error,
+		Added:        job.Added,
+	}
+}
+
+// deviceViews converts devices for display, ordered by mount point
+func deviceViews(devices []device.Device) []deviceView {
+	views := make([]deviceView, 0, len(devices))
+	for _, dev := range devices {
+		views = append(views, makeDeviceView(dev))
+	}
+
+	sort.Slice(views, func(i, j int) bool { return views[i].MountPoint < views[j].MountPoint })
+	return views
+}
+
+// makeDeviceView converts a device for display, including its derived space figures
+func makeDeviceView(dev device.Device) deviceView {
+	return deviceView{
+		DeviceID:       dev.DeviceID,
+		MountPoint:     dev.MountPoint,
+		DeviceSerial:   dev.DeviceSerial,
+		AvailableSpace: dev.AvailableSpace,
+		AllocatedSpace: dev.AllocatedSpace,
+		RemainingSpace: dev.RemainingSpace(),
+		TotalSpace:     dev.TotalSpace,
+		FillPercent:    dev.FillPercent(),
+		Offline:        dev.Offline,
+		OfflineReason:  dev.OfflineReason,
+		ReadOnly:       dev.ReadOnly,
+		ReadOnlyReason: dev.ReadOnlyReason,
+	}
+}
+
+// makeFileView converts a backed up file for display
+func makeFileView(file mydb.File) fileView {
+	view := fileView{
+		SourcePath:   file.SourcePath,
+		DeviceID:     file.DeviceID,
+		Size:         file.Size,
+		Checksum:     file.Checksum,
+		VerifyStatus: file.VerifyStatus,
+	}
+	if !file.LastVerified.IsZero() {
+		view.LastVerified = &file.LastVerified
+	}
+
+	return view
+}
+
+// makeReservationView converts a reservation for display, along with the device it was made on
+func makeReservationView(reservation mydb.Reservation, dev deviceView) reservationView {
+	view := reservationView{
+		ReservationID: reservation.ReservationID,
+		JobID:         reservation.JobID,
+		Size:          reservation.Size,
+		Created:       reservation.Created,
+		Device:        dev,
+	}
+	if !reservation.Expires.IsZero() {
+		view.Expires = &reservation.Expires
+	}
+
+	return view
+}
+
+// writeJSON sends the value as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logging.Default().Warnf("Failed to write response: %v", err)
+	}
+}
+
+// writeError sends an error message as a JSON response with the given status
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
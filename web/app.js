@@ -0,0 +1,191 @@
+"use strict";
+
+const refreshInterval = 2000;
+
+function formatBytes(bytes) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let value = bytes;
+  let unit = 0;
+  while (value >= 1024 && unit < units.length - 1) {
+    value /= 1024;
+    unit++;
+  }
+
+  return value.toFixed(unit === 0 ? 0 : 1) + " " + units[unit];
+}
+
+function formatDuration(seconds) {
+  if (!seconds) {
+    return "unknown";
+  }
+
+  const hours = Math.floor(seconds / 3600);
+  const minutes = Math.floor((seconds % 3600) / 60);
+  const secs = Math.floor(seconds % 60);
+  return (hours ? hours + "h " : "") + (hours || minutes ? minutes + "m " : "") + secs + "s";
+}
+
+function element(tag, text, className) {
+  const el = document.createElement(tag);
+  if (text !== undefined) {
+    el.textContent = text;
+  }
+  if (className) {
+    el.className = className;
+  }
+
+  return el;
+}
+
+function bar(percent, className) {
+  const outer = element("div", undefined, "bar");
+  const inner = element("div", undefined, className);
+  inner.style.width = Math.min(percent, 100).toFixed(1) + "%";
+  outer.appendChild(inner);
+  return outer;
+}
+
+async function getJSON(url, options) {
+  const response = await fetch(url, options);
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.error || response.statusText);
+  }
+
+  return body;
+}
+
+function renderJobs(list, jobs) {
+  list.replaceChildren();
+  for (const job of jobs) {
+    const item = element("li", undefined, job.error ? "failed" : "");
+    item.appendChild(element("div", "#" + job.id + " " + job.path));
+
+    let detail = job.message || "";
+    if (job.error) {
+      detail += ": " + job.error;
+    }
+    if (job.workerId) {
+      detail += " (worker " + job.workerId + ")";
+    }
+    item.appendChild(element("div", detail, "detail"));
+
+    if (job.progress) {
+      const progress = job.progress;
+      item.appendChild(bar(progress.percent));
+      item.appendChild(element(
+        "div",
+        formatBytes(progress.bytesDone) + " of " + formatBytes(progress.bytesTotal) +
+          " at " + formatBytes(progress.rate) + "/s, " + formatDuration(progress.etaSeconds) + " remaining",
+        "detail",
+      ));
+    }
+
+    list.appendChild(item);
+  }
+}
+
+async function loadQueue() {
+  const queue = await getJSON("api/queue");
+  renderJobs(document.getElementById("queue-in-progress"), queue.inProgress);
+  renderJobs(document.getElementById("queue-pending"), queue.pending);
+  renderJobs(document.getElementById("queue-completed"), queue.completed);
+}
+
+async function loadLocal(path) {
+  const local = await getJSON("api/local?path=" + encodeURIComponent(path));
+  document.getElementById("local-path").value = local.path;
+  document.getElementById("local-up").dataset.path = local.parent;
+
+  const body = document.getElementById("local-entries");
+  body.replaceChildren();
+  for (const entry of local.entries) {
+    const row = element("tr");
+    const name = element("td", entry.name + (entry.isDir ? "/" : ""), entry.isDir ? "dir" : "");
+    if (entry.isDir) {
+      name.addEventListener("click", () => loadLocal(entry.path));
+    }
+    row.appendChild(name);
+    row.appendChild(element("td", entry.isDir ? "" : formatBytes(entry.size)));
+    row.appendChild(element("td", entry.backedUp ? "Yes" : "No"));
+    body.appendChild(row);
+  }
+}
+
+async function loadBackup() {
+  const path = document.getElementById("backup-path").value;
+  const backup = await getJSON("api/backup?path=" + encodeURIComponent(path));
+
+  const devices = document.getElementById("backup-devices");
+  const mounts = {};
+  devices.replaceChildren();
+  for (const device of backup.devices) {
+    mounts[device.deviceId] = device.mountPoint;
+
+    const item = element("li");
+    item.appendChild(element("div", device.mountPoint + " (" + device.deviceSerial + ")"));
+    if (device.offline) {
+      item.appendChild(element("div", "Offline: " + device.offlineReason, "detail"));
+      devices.appendChild(item);
+      continue;
+    }
+    if (device.readOnly) {
+      item.appendChild(element("div", "Read-only: " + device.readOnlyReason, "detail"));
+    }
+
+    item.appendChild(bar(device.fillPercent, device.fillPercent > 90 ? "full" : ""));
+    item.appendChild(element(
+      "div",
+      device.fillPercent.toFixed(1) + "% full, " + formatBytes(device.remainingSpace) + " remaining of " +
+        formatBytes(device.totalSpace),
+      "detail",
+    ));
+    devices.appendChild(item);
+  }
+
+  const files = document.getElementById("backup-files");
+  files.replaceChildren();
+  for (const file of backup.files) {
+    const row = element("tr");
+    row.appendChild(element("td", file.sourcePath));
+    row.appendChild(element("td", mounts[file.deviceId] || "#" + file.deviceId));
+    row.appendChild(element("td", formatBytes(file.size)));
+    row.appendChild(element("td", file.lastVerified ? file.lastVerified + " (" + file.verifyStatus + ")" : "Never"));
+    files.appendChild(row);
+  }
+}
+
+const loaders = {
+  queue: loadQueue,
+  local: () => loadLocal(document.getElementById("local-path").value),
+  backup: loadBackup,
+};
+let activeTab = "queue";
+
+function refresh() {
+  loaders[activeTab]().catch((err) => console.error(err));
+}
+
+for (const tab of document.querySelectorAll(".tab")) {
+  tab.addEventListener("click", () => {
+    document.querySelectorAll(".tab, .view").forEach((el) => el.classList.remove("active"));
+    tab.classList.add("active");
+    document.getElementById(tab.dataset.tab).classList.add("active");
+    activeTab = tab.dataset.tab;
+    refresh();
+  });
+}
+
+document.getElementById("clear-completed").addEventListener("click", () => {
+  getJSON("api/queue/clear", { method: "POST", headers: { "Content-Type": "application/json" } }).then(loadQueue).catch((err) => alert(err.message));
+});
+document.getElementById("local-go").addEventListener("click", refresh);
+document.getElementById("local-up").addEventListener("click", (event) => loadLocal(event.target.dataset.path || "/"));
+document.getElementById("backup-go").addEventListener("click", refresh);
+
+refresh();
+setInterval(() => {
+  if (activeTab === "queue") {
+    refresh();
+  }
+}, refreshInterval);
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/device"
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestWebServer returns a server over the given devices, with an empty queue and tracker
+func makeTestWebServer(t *testing.T, devices []*device.Device) *WebServer {
+	return &WebServer{
+		db:       &sql.DB{},
+		devMan:   makeTestDevMan(t, devices),
+		jobQueue: queue.New(),
+		tracker:  progress.NewTracker(),
+	}
+}
+
+// serveTest performs a request against the server, decoding the JSON response into body
+func serveTest(t *testing.T, server *WebServer, method string, url string, body interface{}) int {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, nil)
+	req.Host = "localhost:8080"
+	req.Header.Set("Content-Type", "application/json")
+	server.Handler().ServeHTTP(recorder, req)
+
+	if body != nil {
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"), "JSON returned")
+		if err := json.NewDecoder(recorder.Body).Decode(body); err != nil {
+			panic(err)
+		}
+	}
+
+	return recorder.Code
+}
+
+// Check the embedded interface is served
+func TestWebAssets(t *testing.T) {
+	server := makeTestWebServer(t, nil)
+
+	for _, path := range []string{"/", "/app.js", "/style.css"} {
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code, "Asset %s served", path)
+		assert.NotEmpty(t, recorder.Body.String(), "Asset %s has content", path)
+	}
+}
+
+// Check each section of the queue is returned, and completed jobs can be cleared
+func TestWebQueue(t *testing.T) {
+	server := makeTestWebServer(t, nil)
+	server.jobQueue.Add(JobBackupFile, "/home/a.txt", queue.Redundancy{Copies: 1})
+	server.jobQueue.Add(JobBackupFolder, "/home/docs", queue.Redundancy{Copies: 1})
+
+	var view queueView
+	assert.Equal(t, http.StatusOK, serveTest(t, server, http.MethodGet, "/api/queue", &view), "Queue returned")
+	assert.Len(t, view.Pending, 2, "Pending jobs returned")
+	assert.Equal(t, "/home/docs", view.Pending[1].Path, "Job details returned")
+	assert.Empty(t, view.InProgress, "No jobs in progress")
+	assert.Empty(t, view.Completed, "No jobs completed")
+
+	var cleared map[string]int
+	assert.Equal(t, http.StatusOK, serveTest(t, server, http.MethodPost, "/api/queue/clear", &cleared), "Queue cleared")
+	assert.Equal(t, 0, cleared["cleared"], "Nothing to clear")
+
+	var failed map[string]string
+	assert.Equal(
+		t,
+		http.StatusMethodNotAllowed,
+		serveTest(t, server, http.MethodGet, "/api/queue/clear", &failed),
+		"Clearing requires POST",
+	)
+	assert.Equal(t, "POST required", failed["error"], "Error message returned")
+}
+
+// Check progress is attached to jobs being tracked
+func TestJobViewsProgress(t *testing.T) {
+	server := makeTestWebServer(t, nil)
+
+	reports := make(chan progress.Report, 1)
+	started := time.Now()
+	reports <- progress.Report{JobID: 2, BytesDone: 50, BytesTotal: 200, Started: started, Updated: started.Add(time.Second)}
+	close(reports)
+	server.tracker.Run(reports)
+
+	views := jobViews([]queue.Job{{ID: 1, Path: "/home/a.txt"}, {ID: 2, Path: "/home/b.txt"}}, server.tracker)
+	assert.Nil(t, views[0].Progress, "No progress for untracked job")
+	assert.Equal(
+		t,
+		&progressView{BytesDone: 50, BytesTotal: 200, Percent: 25, Rate: 50, ETASeconds: 3},
+		views[1].Progress,
+		"Progress for tracked job",
+	)
+}
+
+// Check local entries are listed with whether they are backed up
+func TestWebLocal(t *testing.T) {
+	realGetFile := getDBFile
+	realStatus := getFolderStatus
+
+	root := makeTestTree(t, "saved.txt", "new.txt", "done/a.txt", "partial/a.txt")
+	getDBFile = func(_ *sql.DB, path string) (mydb.File, error) {
+		if path == filepath.Join(root, "saved.txt") {
+			return mydb.File{SourcePath: path}, nil
+		}
+
+		return mydb.File{}, sql.ErrNoRows
+	}
+	getFolderStatus = func(_ *sql.DB, path string) (mydb.FolderStatus, error) {
+		status := mydb.FolderStatus{Folder: mydb.Folder{FolderPath: path, FileCount: 1}}
+		if path == filepath.Join(root, "done") {
+			status.BackedUpFiles = 1
+		}
+
+		return status, nil
+	}
+	defer func() {
+		getDBFile = realGetFile
+		getFolderStatus = realStatus
+	}()
+
+	server := makeTestWebServer(t, nil)
+
+	var view localView
+	assert.Equal(t, http.StatusOK, serveTest(t, server, http.MethodGet, "/api/local?path="+root, &view), "Directory listed")
+	assert.Equal(t, root, view.Path, "Path returned")
+	assert.Equal(t, filepath.Dir(root), view.Parent, "Parent returned")
+
+	backedUp := make(map[string]bool)
+	for _, entry := range view.Entries {
+		backedUp[entry.Name] = entry.BackedUp
+	}
+	assert.Equal(
+		t,
+		map[string]bool{"saved.txt": true, "new.txt": false, "done": true, "partial": false},
+		backedUp,
+		"Backup status of each entry",
+	)
+
+	var failed map[string]string
+	assert.Equal(
+		t,
+		http.StatusBadRequest,
+		serveTest(t, server, http.MethodGet, "/api/local?path=relative", &failed),
+		"Relative path rejected",
+	)
+	assert.Equal(
+		t,
+		http.StatusNotFound,
+		serveTest(t, server, http.MethodGet, "/api/local?path="+filepath.Join(root, "missing"), &failed),
+		"Missing path not found",
+	)
+}
+
+// Check devices and their files are returned
+func TestWebBackup(t *testing.T) {
+	realFilter := filterDBFiles
+
+	verified := time.Now().UTC().Truncate(time.Second)
+	filterDBFiles = func(_ *sql.DB, filter mydb.FileFilter) ([]mydb.File, error) {
+		assert.Equal(t, "/home", filter.Path, "Path filter passed through")
+		return []mydb.File{
+			{SourcePath: "/home/a.txt", DeviceID: 2, Size: 5},
+			{SourcePath: "/home/b.txt", DeviceID: 1, Size: 10, LastVerified: verified, VerifyStatus: VerifyOK},
+		}, nil
+	}
+	defer func() { filterDBFiles = realFilter }()
+
+	server := makeTestWebServer(t, []*device.Device{
+		{DeviceID: 2, MountPoint: "/mnt/2", AvailableSpace: 100, AllocatedSpace: 20, TotalSpace: 200},
+		{DeviceID: 1, MountPoint: "/mnt/1", AvailableSpace: 50, TotalSpace: 100},
+	})
+
+	var view backupView
+	assert.Equal(t, http.StatusOK, serveTest(t, server, http.MethodGet, "/api/backup?path=/home", &view), "Backup listed")
+	assert.Equal(t, []string{"/mnt/1", "/mnt/2"}, []string{view.Devices[0].MountPoint, view.Devices[1].MountPoint}, "Devices ordered")
+	assert.Equal(t, uint64(80), view.Devices[1].RemainingSpace, "Remaining space derived")
+	assert.Equal(t, float64(60), view.Devices[1].FillPercent, "Fill percent derived")
+
+	assert.Len(t, view.Files, 2, "Files returned")
+	assert.Nil(t, view.Files[0].LastVerified, "Unverified file has no verification time")
+	assert.True(t, verified.Equal(*view.Files[1].LastVerified), "Verification time returned")
+	assert.Equal(t, VerifyOK, view.Files[1].VerifyStatus, "Verification status returned")
+}
+
+// Check the JSON helpers set the status and content
+func TestWriteError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeError(recorder, http.StatusConflict, "Already exists")
+
+	assert.Equal(t, http.StatusConflict, recorder.Code, "Status set")
+	assert.Equal(t, "{\"error\":\"Already exists\"}", strings.TrimSpace(recorder.Body.String()), "Error encoded")
+}
+
+// Check API requests another website could make are rejected, while those from the interface are served
+func TestWebGuard(t *testing.T) {
+	server := makeTestWebServer(t, nil)
+	server.hostname = "backup.lan"
+
+	for _, check := range []struct {
+		method      string
+		host        string
+		origin      string
+		contentType string
+		status      int
+		message     string
+	}{
+		{http.MethodGet, "localhost:8080", "", "", http.StatusOK, "Local request served"},
+		{http.MethodGet, "[::1]:8080", "", "", http.StatusOK, "IPv6 loopback served"},
+		{http.MethodGet, "192.168.1.5:8080", "", "", http.StatusOK, "IP address served"},
+		{http.MethodGet, "backup.lan:8080", "", "", http.StatusOK, "Configured name served"},
+		{http.MethodGet, "evil.example:8080", "", "", http.StatusForbidden, "Other host names rejected"},
+		{http.MethodGet, "localhost:8080", "http://localhost:8080", "", http.StatusOK, "Same origin served"},
+		{http.MethodPost, "localhost:8080", "http://evil.example", "application/json", http.StatusForbidden, "Other origins rejected"},
+		{http.MethodPost, "localhost:8080", "", "text/plain", http.StatusUnsupportedMediaType, "Changes need JSON"},
+		{http.MethodPost, "localhost:8080", "", "application/json; charset=utf-8", http.StatusOK, "JSON changes served"},
+	} {
+		req := httptest.NewRequest(check.method, "/api/queue/clear", nil)
+		if check.method == http.MethodGet {
+			req = httptest.NewRequest(check.method, "/api/queue", nil)
+		}
+		req.Host = check.host
+		if len(check.origin) > 0 {
+			req.Header.Set("Origin", check.origin)
+		}
+		if len(check.contentType) > 0 {
+			req.Header.Set("Content-Type", check.contentType)
+		}
+
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, req)
+		assert.Equal(t, check.status, recorder.Code, check.message)
+	}
+
+	assert.Equal(t, "backup.lan", listenHostname("backup.lan:8080"), "Listen host name found")
+	assert.Equal(t, "", listenHostname(":8080"), "No host name when listening everywhere")
+}
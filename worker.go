@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ammesonb/dispersed-backup/erasure"
+	"github.com/ammesonb/dispersed-backup/logging"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+)
+
+var backupFolder = BackupFolder
+
+// JobBackupFile instructs a worker to back up a single file
+const JobBackupFile int = 1
+
+// JobBackupFolder instructs a worker to back up every file in a folder
+const JobBackupFolder int = 2
+
+// ErrInvalidCopies is returned when backing up with fewer than one copy of each file
+var ErrInvalidCopies = fmt.Errorf("Copies must be at least 1")
+
+// ErrInvalidShards is returned when erasure-coding with an impossible number of data or parity shards
+var ErrInvalidShards = fmt.Errorf(
+	"Erasure coding needs at least 1 data shard, no negative parity shards, and at most %d shards in total",
+	erasure.MaxShards,
+)
+
+// ErrCopiesAndShards is returned when asking for both several copies and erasure coding
+var ErrCopiesAndShards = fmt.Errorf("Files can be copied or erasure-coded, but not both")
+
+// checkRedundancy returns the redundancy a backup should have, with 0 copies meaning the default of one
+func checkRedundancy(redundancy queue.Redundancy) (queue.Redundancy, error) {
+	if redundancy.Copies < 0 {
+		return queue.Redundancy{}, ErrInvalidCopies
+	}
+	redundancy.Copies = copyCount(redundancy.Copies)
+
+	if redundancy.DataShards == 0 && redundancy.ParityShards == 0 {
+		return redundancy, nil
+	} else if _, err := erasure.New(redundancy.DataShards, redundancy.ParityShards); err != nil {
+		return queue.Redundancy{}, ErrInvalidShards
+	} else if redundancy.Copies > 1 {
+		return queue.Redundancy{}, ErrCopiesAndShards
+	}
+
+	return redundancy, nil
+}
+
+// backupAction returns the job action needed to back up the given path, and its absolute form
+func backupAction(path string) (int, string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return 0, "", err
+	}
+
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if info.IsDir() {
+		return JobBackupFolder, absPath, nil
+	} else if !info.Mode().IsRegular() {
+		return 0, "", fmt.Errorf("%s is not a regular file or directory", absPath)
+	}
+
+	return JobBackupFile, absPath, nil
+}
+
+// StartWorkers starts the given number of workers, which process jobs until the channel is closed
+// Workers report on each job they take ownership of through the updates channel,
+// and publish the progress of their copies to the reports channel
+// The returned WaitGroup completes once every worker has exited
+func StartWorkers(
+	count int,
+	db *sql.DB,
+	devMan *DevMan,
+	jobs <-chan queue.Job,
+	updates chan<- queue.StatusUpdate,
+	reports chan<- progress.Report,
+) *sync.WaitGroup {
+	var workers sync.WaitGroup
+
+	for id := 1; id <= count; id++ {
+		workers.Add(1)
+		go func(id int) {
+			defer workers.Done()
+			work(id, db, devMan, jobs, updates, reports)
+		}(id)
+	}
+
+	return &workers
+}
+
+// work runs each job received until the channel is closed, reporting when it starts and finishes
+func work(
+	id int,
+	db *sql.DB,
+	devMan *DevMan,
+	jobs <-chan queue.Job,
+	updates chan<- queue.StatusUpdate,
+	reports chan<- progress.Report,
+) {
+	for job := range jobs {
+		log := logging.Default().Job(id, job.ID)
+		log.Infof("Starting action %d for %s", job.Action, job.Path)
+		updates <- queue.StatusUpdate{JobID: job.ID, WorkerID: id, State: queue.StateInProgress, Message: "Started"}
+
+		meter := progress.NewMeter(job.ID, id, reports)
+		err := safeRunJob(db, devMan, job, meter)
+		meter.Finish()
+		message := "Finished"
+		if err != nil {
+			message = "Failed"
+			log.Errorf("Failed %s: %v", job.Path, err)
+		} else {
+			log.Infof("Finished %s", job.Path)
+		}
+
+		updates <- queue.StatusUpdate{JobID: job.ID, WorkerID: id, State: queue.StateCompleted, Message: message, Err: err}
+	}
+}
+
+// safeRunJob runs a job, converting any panic into an error so the worker can continue
+func safeRunJob(db *sql.DB, devMan *DevMan, job queue.Job, meter *progress.Meter) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic during job: %v", r)
+		}
+	}()
+
+	return runJob(db, devMan, job, meter)
+}
+
+// runJob performs the action requested by a job
+var runJob = func(db *sql.DB, devMan *DevMan, job queue.Job, meter *progress.Meter) error {
+	switch job.Action {
+	case JobBackupFile:
+		info, err := os.Stat(job.Path)
+		if err != nil {
+			return err
+		}
+
+		meter.AddTotal(storedSize(job.Redundancy, info.Size()))
+		_, err = backupFile(db, devMan, job.Path, job.Redundancy, meter)
+		return err
+	case JobBackupFolder:
+		result, err := backupFolder(db, devMan, job.Path, job.Redundancy, meter)
+		if err != nil {
+			return err
+		}
+		if len(result.Failed) > 0 {
+			return fmt.Errorf("%d of %d files failed to back up", len(result.Failed), result.Folder.FileCount)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%d is not a recognized job action", job.Action)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ammesonb/dispersed-backup/mydb"
+	"github.com/ammesonb/dispersed-backup/progress"
+	"github.com/ammesonb/dispersed-backup/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// Check every job is processed and reported, and the pool only finishes once the channel is closed
+func TestStartWorkers(t *testing.T) {
+	realRun := runJob
+
+	var lock sync.Mutex
+	processed := make(map[string]bool)
+	runJob = func(_ *sql.DB, _ *DevMan, job queue.Job, _ *progress.Meter) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		processed[job.Path] = true
+		if job.Path == "/panic" {
+			panic("worker should survive")
+		}
+
+		return nil
+	}
+	defer func() { runJob = realRun }()
+
+	jobs := make(chan queue.Job, 12)
+	updates := make(chan queue.StatusUpdate, 24)
+	reports := make(chan progress.Report, 100)
+	workers := StartWorkers(3, &sql.DB{}, &DevMan{}, jobs, updates, reports)
+
+	for n := 0; n < 10; n++ {
+		jobs <- queue.Job{ID: n, Action: JobBackupFile, Path: fmt.Sprintf("/file/%d", n)}
+	}
+	jobs <- queue.Job{ID: 10, Action: JobBackupFile, Path: "/panic"}
+	jobs <- queue.Job{ID: 11, Action: JobBackupFile, Path: "/after"}
+
+	done := make(chan bool)
+	go func() {
+		workers.Wait()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		assert.Fail(t, "Workers exited before jobs closed")
+	case <-time.After(100 * time.Millisecond):
+		break
+	}
+
+	close(jobs)
+
+	select {
+	case <-done:
+		break
+	case <-time.After(time.Second):
+		assert.Fail(t, "Workers did not exit after jobs closed")
+	}
+	close(updates)
+	close(reports)
+
+	assert.Len(t, processed, 12, "Every job processed, including after a panic")
+
+	finishedReports := 0
+	for report := range reports {
+		if report.Finished {
+			finishedReports++
+		}
+	}
+	assert.Equal(t, 12, finishedReports, "Progress finished for each job")
+
+	started, finished := 0, 0
+	for update := range updates {
+		assert.NotZero(t, update.WorkerID, "Worker identified")
+		if update.State == queue.StateInProgress {
+			started++
+			continue
+		}
+
+		finished++
+		if update.JobID == 10 {
+			assert.EqualErrorf(t, update.Err, "Panic during job: worker should survive", "Panic reported as failure")
+			assert.Equal(t, "Failed", update.Message, "Failure message sent")
+		} else {
+			assert.Nil(t, update.Err, "Successful jobs have no error")
+		}
+	}
+	assert.Equal(t, 12, started, "Start reported for each job")
+	assert.Equal(t, 12, finished, "Completion reported for each job")
+}
+
+// Check jobs are dispatched to the matching backup
+func TestRunJob(t *testing.T) {
+	realFile := backupFile
+	realFolder := backupFolder
+
+	backupFile = func(_ *sql.DB, _ *DevMan, path string, redundancy queue.Redundancy, _ *progress.Meter) ([]mydb.File, error) {
+		return nil, fmt.Errorf("file %s, %d copies", path, redundancy.Copies)
+	}
+	backupFolder = func(_ *sql.DB, _ *DevMan, path string, _ queue.Redundancy, _ *progress.Meter) (FolderResult, error) {
+		if path == "/bad" {
+			return FolderResult{}, fmt.Errorf("folder %s", path)
+		}
+
+		failed := make(map[string]error)
+		if path == "/partial" {
+			failed["/partial/a"] = fmt.Errorf("nope")
+		}
+
+		return FolderResult{Folder: mydb.Folder{FileCount: 2}, Failed: failed}, nil
+	}
+	defer func() {
+		backupFile = realFile
+		backupFolder = realFolder
+	}()
+
+	source := makeTestFile(t, "hello")
+	err := runJob(&sql.DB{}, &DevMan{}, queue.Job{Action: JobBackupFile, Path: source, Redundancy: queue.Redundancy{Copies: 2}}, nil)
+	assert.EqualErrorf(t, err, "file "+source+", 2 copies", "File backup called with copies")
+
+	err = runJob(&sql.DB{}, &DevMan{}, queue.Job{Action: JobBackupFile, Path: "/missing"}, nil)
+	assert.True(t, os.IsNotExist(err), "Missing file rejected")
+
+	err = runJob(&sql.DB{}, &DevMan{}, queue.Job{Action: JobBackupFolder, Path: "/bad"}, nil)
+	assert.EqualErrorf(t, err, "folder /bad", "Folder backup error returned")
+
+	err = runJob(&sql.DB{}, &DevMan{}, queue.Job{Action: JobBackupFolder, Path: "/partial"}, nil)
+	assert.EqualErrorf(t, err, "1 of 2 files failed to back up", "Partial failure reported")
+
+	err = runJob(&sql.DB{}, &DevMan{}, queue.Job{Action: JobBackupFolder, Path: "/good"}, nil)
+	assert.Nil(t, err, "Complete folder succeeds")
+
+	err = runJob(&sql.DB{}, &DevMan{}, queue.Job{Action: 99, Path: "/a"}, nil)
+	assert.EqualErrorf(t, err, "99 is not a recognized job action", "Unknown action rejected")
+}
+
+// Check copies default to one, and erasure coding needs a valid number of shards without extra copies
+func TestCheckRedundancy(t *testing.T) {
+	redundancy, err := checkRedundancy(queue.Redundancy{})
+	assert.Nil(t, err, "No error by default")
+	assert.Equal(t, queue.Redundancy{Copies: 1}, redundancy, "One copy by default")
+
+	redundancy, err = checkRedundancy(queue.Redundancy{DataShards: 4, ParityShards: 2})
+	assert.Nil(t, err, "No error for shards")
+	assert.Equal(t, queue.Redundancy{Copies: 1, DataShards: 4, ParityShards: 2}, redundancy, "Shards kept")
+
+	_, err = checkRedundancy(queue.Redundancy{DataShards: 1})
+	assert.Nil(t, err, "Parity shards optional")
+
+	_, err = checkRedundancy(queue.Redundancy{Copies: -1})
+	assert.ErrorIs(t, err, ErrInvalidCopies, "Negative copies rejected")
+	_, err = checkRedundancy(queue.Redundancy{ParityShards: 2})
+	assert.ErrorIs(t, err, ErrInvalidShards, "Parity needs data shards")
+	_, err = checkRedundancy(queue.Redundancy{DataShards: 200, ParityShards: 100})
+	assert.ErrorIs(t, err, ErrInvalidShards, "Too many shards rejected")
+	_, err = checkRedundancy(queue.Redundancy{Copies: 2, DataShards: 4, ParityShards: 2})
+	assert.ErrorIs(t, err, ErrCopiesAndShards, "Copies and shards rejected together")
+}
+
+// Check paths are backed up as file or folder jobs
+func TestBackupAction(t *testing.T) {
+	root := makeTestTree(t, "a.txt")
+
+	action, path, err := backupAction(root)
+	assert.Nil(t, err, "No error for folder")
+	assert.Equal(t, JobBackupFolder, action, "Folder job for directory")
+	assert.Equal(t, root, path, "Path returned")
+
+	action, _, err = backupAction(root + "/a.txt")
+	assert.Nil(t, err, "No error for file")
+	assert.Equal(t, JobBackupFile, action, "File job for file")
+
+	_, _, err = backupAction(root + "/b.txt")
+	assert.True(t, os.IsNotExist(err), "Missing path reported")
+}